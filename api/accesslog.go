@@ -0,0 +1,91 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// countingBody counts the bytes of the request body the handler reads.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accessLog writes one line per request through logger. The route is the
+// template the request matched, not the raw path, so wallet ids don't end
+// up in it; requests that matched no route are logged with an empty route.
+// Requests for skipPaths aren't logged.
+//
+// Requests of the routes in sampleRates, keyed like "GET /api/v1/wallet/:walletid",
+// are sampled: 1 in rate of them is logged, along with every request that
+// failed or took slow or longer. The decision is made once and kept in the
+// request's context, see SamplingHandler, so a request's lines are logged
+// or dropped together. Lines of a sampled route carry sampled and
+// sample_rate, the number of requests each line stands for.
+func accessLog(logger *slog.Logger, skipPaths []string, sampleRates map[string]int, slow time.Duration) gin.HandlerFunc {
+	skip := make(map[string]bool, len(skipPaths))
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+	return func(c *gin.Context) {
+		if skip[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		body := &countingBody{ReadCloser: c.Request.Body}
+		if c.Request.Body != nil {
+			c.Request.Body = body
+		}
+		ctx := c.Request.Context()
+		rate, sampled := sampleRates[c.Request.Method+" "+routeOf(c)]
+		var decision sampling
+		if sampled {
+			requestId := c.GetString("request_id")
+			if requestId == "" {
+				requestId = c.GetHeader(requestIdHeader)
+			}
+			decision = sample(requestId, rate)
+			c.Request = c.Request.WithContext(withSampling(ctx, decision))
+		}
+
+		c.Next()
+
+		latency := time.Since(start)
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", routeOf(c)),
+			slog.Int("status", c.Writer.Status()),
+			slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+			slog.Int64("bytes_in", body.n),
+			slog.Int("bytes_out", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("request_id", c.GetString("request_id")),
+		}
+		if t, ok := tracectx.FromContext(c.Request.Context()); ok {
+			attrs = append(attrs, slog.String("trace_id", t.TraceIdString()))
+		}
+		if sampled {
+			if c.Writer.Status() >= http.StatusBadRequest || latency >= slow {
+				// kept regardless of the sampling, so it stands for itself
+				decision.keep = false
+			} else if !decision.keep {
+				return
+			}
+			attrs = append(attrs, samplingAttrs(decision)...)
+		}
+		// the context from before the decision, the line was decided on above
+		logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+	}
+}
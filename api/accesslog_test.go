@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogLines decodes the JSON lines written to logs.
+func accessLogLines(t *testing.T, logs *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("not a JSON line: %q", line)
+		}
+		lines = append(lines, m)
+	}
+	logs.Reset()
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	r := gin.New()
+	r.Use(requestId, accessLog(logger, []string{"/healthz"}, nil, time.Second), recovery(discardLogger(), nil))
+	r.GET("/healthz", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/api/v1/wallet/:walletid/send", func(c *gin.Context) {
+		var body map[string]any
+		c.BindJSON(&body)
+		c.String(http.StatusOK, "sent")
+	})
+	r.GET("/api/v1/wallet/:walletid", func(c *gin.Context) { panic("boom") })
+	r.NoRoute(func(c *gin.Context) { abortWithError(c, http.StatusNotFound, "not_found", "no such endpoint") })
+
+	tests := []struct {
+		name, method, path, body string
+		route                    string
+		status                   int
+	}{
+		{"success", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB"}`, "/api/v1/wallet/:walletid/send", http.StatusOK},
+		{"not found", http.MethodGet, "/nothing/here", "", "", http.StatusNotFound},
+		{"panic", http.MethodGet, "/api/v1/wallet/AAAAAA", "", "/api/v1/wallet/:walletid", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(requestIdHeader, "req-"+tt.name)
+			req.RemoteAddr = "10.1.2.3:5000"
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			lines := accessLogLines(t, &logs)
+			if len(lines) != 1 {
+				t.Fatalf("%d lines, want 1", len(lines))
+			}
+			line := lines[0]
+			want := map[string]any{
+				"msg":        "request",
+				"method":     tt.method,
+				"route":      tt.route,
+				"status":     float64(tt.status),
+				"bytes_in":   float64(len(tt.body)),
+				"bytes_out":  float64(w.Body.Len()),
+				"client_ip":  "10.1.2.3",
+				"request_id": "req-" + tt.name,
+			}
+			for k, v := range want {
+				if line[k] != v {
+					t.Errorf("%s = %v, want %v", k, line[k], v)
+				}
+			}
+			if latency, ok := line["latency_ms"].(float64); !ok || latency < 0 {
+				t.Errorf("latency_ms = %v", line["latency_ms"])
+			}
+		})
+	}
+
+	serve(r, http.MethodGet, "/healthz", "")
+	if lines := accessLogLines(t, &logs); len(lines) != 0 {
+		t.Fatalf("a skipped path was logged: %v", lines)
+	}
+}
+
+// sampledRequestIds returns request ids of which sample keeps and drops
+// the requests of a route sampled at rate.
+func sampledRequestIds(rate int) (kept, dropped string) {
+	for i := 0; kept == "" || dropped == ""; i++ {
+		id := "req-" + strconv.Itoa(i)
+		if sample(id, rate).keep {
+			kept = id
+		} else {
+			dropped = id
+		}
+	}
+	return kept, dropped
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	logger := slog.New(SamplingHandler{slog.NewJSONHandler(&logs, nil)})
+	rates := map[string]int{"GET /balance": 100, "GET /fail": 100, "GET /slow": 100}
+	r := gin.New()
+	r.Use(requestId, accessLog(logger, nil, rates, 20*time.Millisecond))
+	r.GET("/balance", func(c *gin.Context) {
+		logger.InfoContext(c.Request.Context(), "balance read")
+		if c.Query("warn") != "" {
+			logger.WarnContext(c.Request.Context(), "balance low")
+		}
+		c.Status(http.StatusOK)
+	})
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusBadRequest) })
+	r.GET("/slow", func(c *gin.Context) {
+		time.Sleep(30 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	r.GET("/other", func(c *gin.Context) {
+		logger.InfoContext(c.Request.Context(), "other")
+		c.Status(http.StatusOK)
+	})
+	kept, dropped := sampledRequestIds(100)
+
+	get := func(path, id string) []map[string]any {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(requestIdHeader, id)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return accessLogLines(t, &logs)
+	}
+	marked := func(name string, line map[string]any, sampled bool, rate float64) {
+		t.Helper()
+		if line["sampled"] != sampled || line["sample_rate"] != rate {
+			t.Errorf("%s: %q with sampled=%v sample_rate=%v, want %v and %v",
+				name, line["msg"], line["sampled"], line["sample_rate"], sampled, rate)
+		}
+	}
+
+	// the request's lines are kept or dropped together, and stand for the rate
+	lines := get("/balance", kept)
+	if len(lines) != 2 {
+		t.Fatalf("kept request: %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		marked("kept request", line, true, 100)
+	}
+	if lines := get("/balance", dropped); len(lines) != 0 {
+		t.Fatalf("dropped request: %v", lines)
+	}
+	// the decision follows the request id
+	for i := 0; i < 3; i++ {
+		if lines := get("/balance", kept); len(lines) != 2 {
+			t.Fatalf("the same request id was decided differently: %v", lines)
+		}
+	}
+
+	// warn lines, failures and slow requests are always logged, for themselves
+	lines = get("/balance?warn=1", dropped)
+	if len(lines) != 1 || lines[0]["msg"] != "balance low" {
+		t.Fatalf("warn line of a dropped request: %v", lines)
+	}
+	lines = get("/fail", dropped)
+	if len(lines) != 1 {
+		t.Fatalf("failed request: %d lines, want 1", len(lines))
+	}
+	marked("failed request", lines[0], false, 1)
+	lines = get("/slow", dropped)
+	if len(lines) != 1 {
+		t.Fatalf("slow request: %d lines, want 1", len(lines))
+	}
+	marked("slow request", lines[0], false, 1)
+
+	// routes without a rate aren't sampled nor marked
+	lines = get("/other", dropped)
+	if len(lines) != 2 {
+		t.Fatalf("unsampled route: %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		if _, ok := line["sampled"]; ok {
+			t.Errorf("unsampled route marked: %v", line)
+		}
+	}
+}
+
+func TestSampleRatesOfUnknownRoutes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AccessLogSampleRates = map[string]int{"GET /api/v1/wallet/:nope": 10}
+	_, err := NewRouter(testHandlers(t, openTestStore(t), cfg), discardLogger(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "GET /api/v1/wallet/:nope") {
+		t.Fatalf("NewRouter = %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/jobs"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// AdminHandler serves the admin endpoints, which work on the database
+// itself rather than through store.WalletRepository.
+type AdminHandler struct {
+	db      *store.DB
+	backups *ops.Backups
+	maint   *ops.Maintenance
+	mode    *MaintenanceMode
+	jobs    *jobs.Runner
+	log     *slog.Logger
+	// level is the level of every logger of the service, log included.
+	level *slog.LevelVar
+	// features are the configured features, for listing.
+	features config.Features
+	// integrity has the report of the last integrity check, which runs
+	// as a job.
+	integrity *ops.Integrity
+	// maxPageSize is config.MaxPageSize.
+	maxPageSize int
+}
+
+func NewAdminHandler(db *store.DB, mode *MaintenanceMode, runner *jobs.Runner, integrity *ops.Integrity, logger *slog.Logger, level *slog.LevelVar, cfg config.Config) *AdminHandler {
+	return &AdminHandler{
+		db:          db,
+		backups:     ops.NewBackups(db, cfg.BackupDir, cfg.BackupRetention),
+		maint:       ops.NewMaintenance(db, cfg.MaintenanceVacuum),
+		integrity:   integrity,
+		mode:        mode,
+		jobs:        runner,
+		log:         logger,
+		level:       level,
+		features:    cfg.Features,
+		maxPageSize: cfg.MaxPageSize,
+	}
+}
+
+// Backup handles POST /api/v1/admin/backup.
+//
+//	curl -X POST http://localhost:8080/api/v1/admin/backup
+func (h *AdminHandler) Backup(c *gin.Context) {
+	info, err := h.backups.Create(c.Request.Context())
+	switch {
+	case errors.Is(err, store.ErrBackupUnsupported):
+		abortWithError(c, http.StatusNotImplemented, "backup_unsupported", err.Error())
+	case errors.Is(err, ops.ErrBusy):
+		abortWithError(c, http.StatusConflict, "busy", err.Error())
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not write backup", "backup")
+	default:
+		h.log.Info("backup written", "path", info.Path, "bytes", info.Size)
+		c.JSON(http.StatusCreated, info)
+	}
+}
+
+// Maintenance handles POST /api/v1/admin/maintenance.
+//
+//	curl -X POST http://localhost:8080/api/v1/admin/maintenance?vacuum=true
+func (h *AdminHandler) Maintenance(c *gin.Context) {
+	vacuum := h.maint.Vacuum
+	if v := c.Query("vacuum"); v != "" {
+		vacuum = v == "true"
+	}
+	report, err := h.maint.Run(c.Request.Context(), vacuum)
+	switch {
+	case errors.Is(err, store.ErrMaintenanceUnsupported):
+		abortWithError(c, http.StatusNotImplemented, "maintenance_unsupported", err.Error())
+	case errors.Is(err, ops.ErrBusy):
+		abortWithError(c, http.StatusConflict, "busy", err.Error())
+	case err != nil:
+		abortInternalError(c, h.log, err, "maintenance failed", "maintenance")
+	default:
+		h.log.Info("maintenance done", "steps", report.Steps, "duration", report.Duration, "reclaimed_bytes", report.Reclaimed)
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// IntegrityCheckStatus is the state of the integrity check, as returned
+// by the integrity-check endpoints.
+type IntegrityCheckStatus struct {
+	// Running includes a check that was started but waits for its job.
+	Running bool                 `json:"running"`
+	Last    *ops.IntegrityReport `json:"last"`
+}
+
+// IntegrityCheck handles POST /api/v1/admin/integrity-check, which starts
+// the full PRAGMA integrity_check in the background. It reads the whole
+// database while the service keeps serving; GET has the report once it
+// is done.
+//
+//	curl -X POST http://localhost:8080/api/v1/admin/integrity-check
+func (h *AdminHandler) IntegrityCheck(c *gin.Context) {
+	if h.db.Driver != store.SQLite {
+		abortWithError(c, http.StatusNotImplemented, "integrity_check_unsupported", "the integrity check is only supported for SQLite")
+		return
+	}
+	err := h.jobs.Trigger(ops.IntegrityJob)
+	switch {
+	case errors.Is(err, jobs.ErrJobRunning):
+		abortWithError(c, http.StatusConflict, "busy", "an integrity check is already running")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not start the integrity check", "integrity check")
+		return
+	}
+	h.log.Info("integrity check started", "client_ip", c.ClientIP())
+	c.JSON(http.StatusAccepted, IntegrityCheckStatus{Running: true, Last: h.integrity.Last()})
+}
+
+// IntegrityCheckResult handles GET /api/v1/admin/integrity-check, the
+// report of the last integrity check since the server started.
+//
+//	curl http://localhost:8080/api/v1/admin/integrity-check
+func (h *AdminHandler) IntegrityCheckResult(c *gin.Context) {
+	status := IntegrityCheckStatus{Last: h.integrity.Last()}
+	for _, job := range h.jobs.Status() {
+		if job.Name == ops.IntegrityJob {
+			status.Running = job.Running || job.Pending
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// MaintenanceMode handles GET /api/v1/admin/maintenance.
+//
+//	curl http://localhost:8080/api/v1/admin/maintenance
+func (h *AdminHandler) MaintenanceMode(c *gin.Context) {
+	c.JSON(http.StatusOK, h.mode.State())
+}
+
+// SetMaintenanceMode handles PUT /api/v1/admin/maintenance, which switches
+// the service to read-only and back. Requests that started before the
+// switch finish, new ones see the new mode.
+//
+//	curl -X PUT --json '{"enabled":true,"message":"back at 04:00 UTC"}' http://localhost:8080/api/v1/admin/maintenance
+func (h *AdminHandler) SetMaintenanceMode(c *gin.Context) {
+	var body struct {
+		Enabled *bool  `json:"enabled" binding:"required"`
+		Message string `json:"message"`
+	}
+	if !bindJSON(c, &body) {
+		return
+	}
+	if err := validateText("message", body.Message, maxMaintenanceMessageBytes, false); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	state, err := h.mode.Set(*body.Enabled, body.Message)
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not store the maintenance mode", "maintenance mode")
+		return
+	}
+	h.log.Warn("maintenance mode changed", "enabled", state.Enabled, "message", state.Message, "client_ip", c.ClientIP())
+	c.JSON(http.StatusOK, state)
+}
+
+// Export handles GET /api/v1/admin/export.
+//
+//	curl http://localhost:8080/api/v1/admin/export > export.jsonl
+func (h *AdminHandler) Export(c *gin.Context) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="export.jsonl"`)
+	c.Status(http.StatusOK)
+	if err := ops.WriteExport(c.Request.Context(), h.db, c.Writer); err != nil {
+		// the status is already sent, the missing end record tells the importer
+		h.log.Error("export", "err", err)
+	}
+}
+
+// Import handles POST /api/v1/admin/import.
+//
+//	curl --data-binary @export.jsonl http://localhost:8080/api/v1/admin/import?force=true
+func (h *AdminHandler) Import(c *gin.Context) {
+	force := c.Query("force") == "true"
+	wallets, transactions, err := ops.ReadImport(c.Request.Context(), h.db, c.Request.Body, force)
+	var importErr *ops.ImportError
+	switch {
+	case errors.Is(err, store.ErrNotEmpty):
+		abortWithError(c, http.StatusConflict, "database_not_empty", "the database already contains wallets, use ?force=true to replace them")
+	case errors.As(err, &importErr):
+		abortWithError(c, http.StatusBadRequest, "invalid_import", err.Error())
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not import", "import")
+	default:
+		h.log.Info("import done", "wallets", wallets, "transactions", transactions)
+		c.JSON(http.StatusOK, gin.H{
+			"wallets":      wallets,
+			"transactions": transactions,
+		})
+	}
+}
+
+// LogLevel handles GET /api/v1/admin/loglevel.
+//
+//	curl http://localhost:8080/api/v1/admin/loglevel
+func (h *AdminHandler) LogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": levelName(h.level.Level())})
+}
+
+// SetLogLevel handles PUT /api/v1/admin/loglevel. The new level applies
+// to the next log line.
+//
+//	curl -X PUT --json '{"level":"debug"}' http://localhost:8080/api/v1/admin/loglevel
+func (h *AdminHandler) SetLogLevel(c *gin.Context) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if !bindJSON(c, &body) {
+		return
+	}
+	level, err := config.ParseLevel(body.Level)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("level: %v", err))
+		return
+	}
+	old := h.level.Level()
+	h.level.Set(level)
+	h.log.Warn("log level changed", "previous", levelName(old), "level", levelName(level), "client_ip", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"level": levelName(level)})
+}
+
+// Jobs handles GET /api/v1/admin/jobs, listing the background jobs with
+// their last and next runs.
+//
+//	curl http://localhost:8080/api/v1/admin/jobs
+func (h *AdminHandler) Jobs(c *gin.Context) {
+	c.JSON(http.StatusOK, h.jobs.Status())
+}
+
+// Outbox handles GET /api/v1/admin/outbox, listing the events of the
+// outbox with a status, dead by default, newest first.
+//
+//	curl http://localhost:8080/api/v1/admin/outbox?status=dead&limit=20
+func (h *AdminHandler) Outbox(c *gin.Context) {
+	status := c.DefaultQuery("status", store.EventDead)
+	switch status {
+	case store.EventPending, store.EventSent, store.EventDead:
+	default:
+		abortWithError(c, http.StatusBadRequest, "invalid_request",
+			fmt.Sprintf("status: must be one of %s, %s or %s", store.EventPending, store.EventSent, store.EventDead))
+		return
+	}
+	limit, ok := pageLimit(c, 100, h.maxPageSize)
+	if !ok {
+		return
+	}
+	total, ok := includeTotal(c)
+	if !ok {
+		return
+	}
+	events, err := h.db.Events(c.Request.Context(), status, limit)
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not list events", "outbox")
+		return
+	}
+	if total {
+		count, err := h.db.CountEvents(c.Request.Context(), status)
+		if err != nil {
+			abortInternalError(c, h.log, err, "could not count events", "outbox count")
+			return
+		}
+		c.Header(totalCountHeader, strconv.FormatInt(count, 10))
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// RedriveEvent handles POST /api/v1/admin/outbox/:id/redrive, which gives
+// a dead event a new set of delivery attempts.
+//
+//	curl -X POST http://localhost:8080/api/v1/admin/outbox/42/redrive
+func (h *AdminHandler) RedriveEvent(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", "id: must be an integer")
+		return
+	}
+	err = h.db.RedriveEvent(c.Request.Context(), id, time.Now().UTC())
+	switch {
+	case errors.Is(err, store.ErrEventNotFound):
+		abortWithError(c, http.StatusNotFound, "event_not_found", err.Error())
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not redrive the event", "redrive event", "id", id)
+	default:
+		h.log.Info("event redriven", "id", id, "client_ip", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"id": id, "status": store.EventPending})
+	}
+}
+
+// Features handles GET /api/v1/admin/features, listing whether each
+// feature is enabled.
+//
+//	curl http://localhost:8080/api/v1/admin/features
+func (h *AdminHandler) Features(c *gin.Context) {
+	c.JSON(http.StatusOK, h.features)
+}
+
+// levelName is the name ParseLevel accepts for level.
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
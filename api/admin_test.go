@@ -0,0 +1,197 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/jobs"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// TestLogLevelSharedByEveryLogger changes the level through the admin
+// endpoint and checks that the access log, which has its own logger on
+// the same LevelVar, follows at once.
+func TestLogLevelSharedByEveryLogger(t *testing.T) {
+	db := openTestStore(t)
+	cfg := testConfig(t)
+	mode, err := NewMaintenanceMode(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	level := new(slog.LevelVar)
+	handler := slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: level})
+	adminLog, accessLogger := slog.New(handler), slog.New(handler).With("component", "access")
+	h := NewAdminHandler(db, mode, jobs.NewRunner(adminLog), ops.NewIntegrity(db), adminLog, level, cfg)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(accessLog(accessLogger, nil, nil, time.Second))
+	r.GET("/api/v1/admin/loglevel", h.LogLevel)
+	r.PUT("/api/v1/admin/loglevel", h.SetLogLevel)
+
+	if w := serve(r, http.MethodGet, "/api/v1/admin/loglevel", ""); w.Body.String() != `{"level":"info"}` {
+		t.Fatalf("level %s", w.Body)
+	}
+	if !strings.Contains(logs.String(), `"msg":"request"`) {
+		t.Fatalf("no access log line at info: %s", logs.String())
+	}
+
+	w := serve(r, http.MethodPut, "/api/v1/admin/loglevel", `{"level":"warn"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"level":"warn"}` {
+		t.Fatalf("set warn: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(logs.String(), `"msg":"log level changed"`) {
+		t.Fatalf("the change was not logged: %s", logs.String())
+	}
+	logs.Reset()
+	if w := serve(r, http.MethodGet, "/api/v1/admin/loglevel", ""); w.Body.String() != `{"level":"warn"}` {
+		t.Fatalf("level %s", w.Body)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("access log line at warn: %s", logs.String())
+	}
+
+	decodeError(t, serve(r, http.MethodPut, "/api/v1/admin/loglevel", `{"level":"verbose"}`), http.StatusBadRequest, "invalid_request")
+	if level.Level() != slog.LevelWarn {
+		t.Fatalf("an invalid level changed it to %s", level.Level())
+	}
+
+	serve(r, http.MethodPut, "/api/v1/admin/loglevel", `{"level":"debug"}`)
+	logs.Reset()
+	serve(r, http.MethodGet, "/api/v1/admin/loglevel", "")
+	if !strings.Contains(logs.String(), `"msg":"request"`) {
+		t.Fatalf("no access log line at debug: %s", logs.String())
+	}
+}
+
+// TestIntegrityCheck runs the integrity check through the admin endpoints
+// on an intact database and on one whose wallets index was edited behind
+// SQLite's back, which only the full check notices.
+func TestIntegrityCheck(t *testing.T) {
+	for _, damaged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("damaged=%t", damaged), func(t *testing.T) {
+			db := openTestStore(t)
+			seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+			if damaged {
+				db = damageWalletsIndex(t, db, "BBBBBB")
+			}
+			cfg := testConfig(t)
+			_, testNet, _ := net.ParseCIDR("192.0.2.0/24")
+			cfg.AdminAllowedNets = []*net.IPNet{testNet}
+			runner := jobs.NewRunner(discardLogger())
+			integrity := ops.NewIntegrity(db)
+			// holds the run back, to find it running
+			release := make(chan struct{})
+			runner.Add(jobs.Job{Name: ops.IntegrityJob, Run: func(ctx context.Context) error {
+				<-release
+				return integrity.Job(ctx)
+			}})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runner.Run(ctx)
+			h := testHandlers(t, db, cfg)
+			h.Admin = NewAdminHandler(db, h.Maintenance, runner, integrity, discardLogger(), new(slog.LevelVar), cfg)
+			r, err := NewRouter(h, discardLogger(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const path = "/api/v1/admin/integrity-check"
+			status := func(w *httptest.ResponseRecorder, code int) IntegrityCheckStatus {
+				t.Helper()
+				var status IntegrityCheckStatus
+				if w.Code != code || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+					t.Fatalf("%d %s, want %d", w.Code, w.Body, code)
+				}
+				return status
+			}
+			if s := status(serve(r, http.MethodGet, path, ""), http.StatusOK); s.Running || s.Last != nil {
+				t.Fatalf("before any check: %+v", s)
+			}
+			if s := status(serve(r, http.MethodPost, path, ""), http.StatusAccepted); !s.Running || s.Last != nil {
+				t.Fatalf("started: %+v", s)
+			}
+			decodeError(t, serve(r, http.MethodPost, path, ""), http.StatusConflict, "busy")
+			if s := status(serve(r, http.MethodGet, path, ""), http.StatusOK); !s.Running {
+				t.Fatalf("while running: %+v", s)
+			}
+			close(release)
+
+			var s IntegrityCheckStatus
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if s = status(serve(r, http.MethodGet, path, ""), http.StatusOK); !s.Running && s.Last != nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("the check did not end: %+v", s)
+				}
+			}
+			want := []string{"ok"}
+			if damaged {
+				want = []string{"row 2 missing from index sqlite_autoindex_wallets_1"}
+			}
+			last := s.Last
+			if last.Check != "integrity_check" || last.Ok == damaged || last.Error != "" || last.DurationMs < 0 ||
+				strings.Join(last.Messages, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("report: %+v", last)
+			}
+			// the job fails with a damaged database
+			for _, job := range runner.Status() {
+				if job.Name == ops.IntegrityJob && (job.Runs != 1 || (job.Failures == 1) != damaged) {
+					t.Fatalf("job: %+v", job)
+				}
+			}
+		})
+	}
+}
+
+// damageWalletsIndex closes db and changes the last letter of wallet id
+// in the primary key index of wallets, in the file itself: the index
+// stays in order but no longer matches the table. It returns the
+// database opened again.
+func damageWalletsIndex(t *testing.T, db *store.DB, id string) *store.DB {
+	t.Helper()
+	var pageSize, root int64
+	if err := db.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select rootpage from sqlite_master where type = 'index' and name like 'sqlite_autoindex_wallets_%'").Scan(&root); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	file, err := os.ReadFile(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := file[(root-1)*pageSize : root*pageSize]
+	i := bytes.Index(page, []byte(id))
+	if i < 0 {
+		t.Fatalf("%s is not on page %d", id, root)
+	}
+	page[i+len(id)-1]++
+	if err := os.WriteFile(db.Path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = store.Open(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/metrics"
+	"kordimion/secure-web-service/tracectx"
+	"kordimion/secure-web-service/walletid"
+)
+
+// requestIdHeader carries the request id in both directions.
+const requestIdHeader = "X-Request-ID"
+
+// maxRequestIdBytes bounds a request id sent by the client.
+const maxRequestIdBytes = 128
+
+// middleware builds the named member of the middleware chain. registry
+// gets its metrics, it is nil without cfg.Metrics.
+func middleware(name string, logger *slog.Logger, cfg config.Config, registry *metrics.Registry) (gin.HandlerFunc, error) {
+	switch name {
+	case "recovery":
+		return recovery(logger, registry), nil
+	case "request_id":
+		return requestId, nil
+	case "trace_context":
+		return traceContext, nil
+	case "access_log":
+		return accessLog(logger, cfg.AccessLogSkipPaths, cfg.AccessLogSampleRates, cfg.AccessLogSlow), nil
+	default:
+		return nil, fmt.Errorf("unknown middleware %q, expected recovery, request_id, trace_context or access_log", name)
+	}
+}
+
+// recovery turns a panicking handler into a 500 in the usual ErrorResponse
+// shape, with an error id the client can quote to find the panic and its
+// stack in the log: the request id, or a new id without the request_id
+// middleware. When the response has already started nothing can be
+// added to it, so the connection is closed instead, and the client sees
+// a failure rather than a response that looks complete.
+func recovery(logger *slog.Logger, registry *metrics.Registry) gin.HandlerFunc {
+	var panics *metrics.Counter
+	if registry != nil {
+		panics = registry.Counter("panics_total", "Requests whose handler panicked.")
+	}
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// a handler giving up on the response on purpose
+				panic(err)
+			}
+			if panics != nil {
+				panics.Inc()
+			}
+			errorId := c.GetString("request_id")
+			if errorId == "" {
+				errorId, _ = walletid.GenerateRandomStringURLSafe(12)
+			}
+			written := c.Writer.Written()
+			logger.ErrorContext(c.Request.Context(), "panic while serving request", "err", err, "path", c.Request.URL.Path,
+				"error_id", errorId, "request_id", c.GetString("request_id"), "response_started", written,
+				"stack", string(debug.Stack()))
+			if written {
+				panic(http.ErrAbortHandler)
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{
+				Code:    "internal_error",
+				Message: "internal error, quote error id " + errorId + " when reporting it",
+				ErrorId: errorId,
+			})
+		}()
+		c.Next()
+	}
+}
+
+// requestId keeps the X-Request-ID a client or proxy sent, or makes one up,
+// stores it as "request_id" in the context and echoes it in the response.
+func requestId(c *gin.Context) {
+	id := c.GetHeader(requestIdHeader)
+	if id == "" || validateText(requestIdHeader, id, maxRequestIdBytes, false) != nil {
+		var err error
+		id, err = walletid.GenerateRandomStringURLSafe(12)
+		if err != nil {
+			abortWithError(c, http.StatusServiceUnavailable, "rng_unavailable", "could not generate a request id")
+			return
+		}
+	}
+	c.Set("request_id", id)
+	c.Header(requestIdHeader, id)
+	c.Next()
+}
+
+// traceContext puts the W3C trace context of the request, or a new trace
+// when it came without one, in the request's context. The outbox events
+// the request causes keep it, see store.Event.
+func traceContext(c *gin.Context) {
+	t := tracectx.FromRequest(c.Request.Header)
+	c.Request = c.Request.WithContext(tracectx.NewContext(c.Request.Context(), t))
+	c.Next()
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/metrics"
+)
+
+// chainRouter serves GET /panic, which panics, and GET /id, which
+// answers the request id, behind the middleware chain.
+func chainRouter(t *testing.T, chain []string, logger *slog.Logger) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	cfg := testConfig(t)
+	for _, name := range chain {
+		m, err := middleware(name, logger, cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Use(m)
+	}
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	r.GET("/id", func(c *gin.Context) { c.String(http.StatusOK, c.GetString("request_id")) })
+	return r
+}
+
+func TestRecoveryAnswersErrorResponse(t *testing.T) {
+	var logs bytes.Buffer
+	r := chainRouter(t, []string{"recovery", "request_id"}, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(requestIdHeader, "req-42")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	body := decodeError(t, w, http.StatusInternalServerError, "internal_error")
+	if body.ErrorId != "req-42" || !strings.Contains(body.Message, "req-42") {
+		t.Fatalf("error id %q in %q, want the request id", body.ErrorId, body.Message)
+	}
+	if !strings.Contains(logs.String(), "error_id=req-42") || !strings.Contains(logs.String(), "boom") {
+		t.Fatalf("the panic was not logged with its error id:\n%s", logs.String())
+	}
+}
+
+func TestRecoveryWithoutRequestId(t *testing.T) {
+	r := chainRouter(t, []string{"recovery"}, discardLogger())
+	body := decodeError(t, serve(r, http.MethodGet, "/panic", ""), http.StatusInternalServerError, "internal_error")
+	if body.ErrorId == "" {
+		t.Fatal("no error id without the request_id middleware")
+	}
+}
+
+func TestMiddlewareChainConfigured(t *testing.T) {
+	// request_id left out of the chain sets no id
+	w := serve(chainRouter(t, []string{"recovery"}, discardLogger()), http.MethodGet, "/id", "")
+	if w.Body.String() != "" || w.Header().Get(requestIdHeader) != "" {
+		t.Fatalf("request id %q, header %q without the request_id middleware", w.Body, w.Header().Get(requestIdHeader))
+	}
+	w = serve(chainRouter(t, []string{"request_id", "recovery"}, discardLogger()), http.MethodGet, "/id", "")
+	if id := w.Header().Get(requestIdHeader); id == "" || w.Body.String() != id {
+		t.Fatalf("request id %q, header %q", w.Body, id)
+	}
+
+	if _, err := middleware("cors", discardLogger(), testConfig(t), nil); err == nil {
+		t.Fatal("unknown middleware accepted")
+	}
+	cfg := testConfig(t)
+	cfg.Middleware = []string{"recovery", "gzip"}
+	db := openTestStore(t)
+	mode, err := NewMaintenanceMode(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRouter(Handlers{Maintenance: mode}, discardLogger(), cfg)
+	if err == nil || !strings.Contains(err.Error(), `"gzip"`) {
+		t.Fatalf("NewRouter with an unknown middleware: %v", err)
+	}
+}
+
+// TestRecoveryKeepsServing panics before and after the response started
+// on a real server: the first gets the 500, the second a closed
+// connection with nothing written after the partial body, and the server
+// goes on answering. Both panics are counted, a handler aborting on
+// purpose isn't.
+func TestRecoveryKeepsServing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	registry := metrics.NewRegistry()
+	r := gin.New()
+	r.Use(requestId, recovery(slog.New(slog.NewJSONHandler(&logs, nil)), registry))
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	r.GET("/partial", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		c.Writer.Flush()
+		panic("boom after the headers")
+	})
+	r.GET("/abort", func(c *gin.Context) { panic(http.ErrAbortHandler) })
+	r.GET("/ok", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	ts := httptest.NewUnstartedServer(r)
+	// the server logs the aborted handlers
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.Start()
+	defer ts.Close()
+
+	get := func(path string) (*http.Response, []byte, error) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res, body, err
+	}
+	for i := 0; i < 2; i++ {
+		res, body, err := get("/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e ErrorResponse
+		if res.StatusCode != http.StatusInternalServerError || json.Unmarshal(body, &e) != nil ||
+			e.Code != "internal_error" || e.ErrorId != res.Header.Get(requestIdHeader) {
+			t.Fatalf("panic: %d %s", res.StatusCode, body)
+		}
+
+		res, body, err = get("/partial")
+		if err == nil {
+			t.Fatalf("partial: %d %q, want a broken response", res.StatusCode, body)
+		}
+		if res != nil && res.StatusCode != http.StatusOK {
+			t.Fatalf("partial: %d", res.StatusCode)
+		}
+		if _, _, err := get("/abort"); err == nil {
+			t.Fatal("abort: the response looks complete")
+		}
+
+		if _, body, err := get("/ok"); err != nil || string(body) != "ok" {
+			t.Fatalf("after the panics: %q, %v", body, err)
+		}
+	}
+
+	var out strings.Builder
+	registry.Write(&out)
+	if !strings.Contains(out.String(), "panics_total 4\n") {
+		t.Fatalf("metrics:\n%s", &out)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d lines logged:\n%s", len(lines), &logs)
+	}
+	for i, line := range lines {
+		var entry struct {
+			Err     string `json:"err"`
+			ErrorId string `json:"error_id"`
+			Started bool   `json:"response_started"`
+			Stack   string `json:"stack"`
+			Request string `json:"request_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if started := i%2 == 1; entry.Started != started || entry.ErrorId == "" || entry.ErrorId != entry.Request ||
+			!strings.Contains(entry.Stack, "chain_test.go") || !strings.HasPrefix(entry.Err, "boom") {
+			t.Errorf("logged %s", line)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package api
+
+import "time"
+
+// Clock tells handlers the time, so that it can be fixed in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+// SystemClock is the Clock backed by time.Now, in UTC like every time the
+// service stores.
+var SystemClock Clock = systemClock{}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// DebugHandler serves the net/http/pprof profiles under /debug/pprof/ and
+// runtime statistics as JSON at /debug/runtime. It exposes the internals
+// of the process and must only be reachable by operators.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", runtimeStats)
+	return mux
+}
+
+// runtimeStats reports goroutine and memory statistics.
+func runtimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]any{
+		"goroutines":     runtime.NumGoroutine(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"num_cpu":        runtime.NumCPU(),
+		"heap_alloc":     m.HeapAlloc,
+		"heap_objects":   m.HeapObjects,
+		"total_alloc":    m.TotalAlloc,
+		"sys":            m.Sys,
+		"num_gc":         m.NumGC,
+		"gc_pause_total": m.PauseTotalNs,
+	})
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	db := openTestStore(t)
+	cfg := testConfig(t)
+	cfg.DebugEndpoints = false
+	off := newTestRouter(t, db, cfg)
+	for _, path := range []string{"/debug/pprof/goroutine?debug=2", "/debug/runtime"} {
+		decodeError(t, serve(off, http.MethodGet, path, ""), http.StatusNotFound, "not_found")
+	}
+
+	cfg.DebugEndpoints = true
+	on := newTestRouter(t, db, cfg)
+	w := serve(on, http.MethodGet, "/debug/pprof/goroutine?debug=2", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine ") {
+		t.Fatalf("goroutine dump: %d %.200s", w.Code, w.Body)
+	}
+	w = serve(on, http.MethodGet, "/debug/runtime", "")
+	var stats map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats["goroutines"] == nil {
+		t.Fatalf("runtime statistics: %d %s", w.Code, w.Body)
+	}
+
+	// behind the admin allowlist
+	req := httptest.NewRequest(http.MethodGet, "/debug/runtime", nil)
+	req.RemoteAddr = "203.0.113.5:5000"
+	w = httptest.NewRecorder()
+	on.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("from outside the allowlist: %d", w.Code)
+	}
+
+	// not on the main listener when they have their own
+	cfg.DebugAddr = "127.0.0.1:6060"
+	decodeError(t, serve(newTestRouter(t, db, cfg), http.MethodGet, "/debug/runtime", ""), http.StatusNotFound, "not_found")
+}
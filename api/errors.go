@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// ErrorResponse is the body of every error returned by the API.
+// Code is a stable machine readable identifier, Message is meant for humans.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	// RetryAfterMs is set on throttling responses, see abortThrottled.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// Details lists the fields of a validation_failed body, see bindJSON.
+	Details []FieldDetail `json:"details,omitempty"`
+	// ErrorId is set on the 500s of a panic, see recovery.
+	ErrorId string `json:"error_id,omitempty"`
+}
+
+// FieldDetail is a field of a request body that could not be used, with
+// why, such as {"field":"amount","reason":"must be a decimal number"}.
+type FieldDetail struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Messages of error responses are written by this service: validation
+// messages may name the fields of the request, but errors of the database,
+// the JSON decoder or the runtime are only logged, see abortInternalError
+// and bindJSON, as they name tables, Go types and file paths.
+
+// abortWithError stops the handler chain and writes an ErrorResponse.
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// abortInternalError answers 500 internal_error with message for an error
+// the client can't do anything about, and logs err with msg and args. The
+// log line has the request id, which the client got in X-Request-ID, so a
+// reported failure can be found.
+func abortInternalError(c *gin.Context, log *slog.Logger, err error, message string, msg string, args ...any) {
+	args = append(args, "request_id", c.GetString("request_id"), "err", err)
+	log.ErrorContext(c.Request.Context(), msg, args...)
+	// for timeout, which answers 504 when err is the deadline's doing
+	c.Error(err)
+	abortWithError(c, http.StatusInternalServerError, "internal_error", message)
+}
+
+// abortValidation rejects a body whose fields are of the wrong type or
+// fail their binding tags with 400 validation_failed, listing them.
+func abortValidation(c *gin.Context, details []FieldDetail) {
+	messages := make([]string, len(details))
+	for i, d := range details {
+		messages[i] = d.Field + ": " + d.Reason
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+		Code:    "validation_failed",
+		Message: strings.Join(messages, "; "),
+		Details: details,
+	})
+}
+
+// bindJSON decodes the JSON body of the request into v, a pointer to a
+// struct, and checks its binding tags. A body that isn't a JSON object
+// aborts with 400 invalid_json, fields that can't be decoded or are
+// invalid with 400 validation_failed, and bindJSON returns false.
+func bindJSON(c *gin.Context, v any) bool {
+	err := c.ShouldBindBodyWith(v, binding.JSON)
+	if err == nil {
+		return true
+	}
+	if message, ok := malformedJSON(err); ok {
+		abortWithError(c, http.StatusBadRequest, "invalid_json", message)
+		return false
+	}
+	var body []byte
+	if b, ok := c.Get(gin.BodyBytesKey); ok {
+		body, _ = b.([]byte)
+	}
+	abortValidation(c, fieldDetails(err, reflect.TypeOf(v).Elem(), body))
+	return false
+}
+
+// malformedJSON describes an error of the JSON decoder for a body that
+// isn't a JSON object at all, without the decoder's own message, which
+// names the Go types the body is decoded into.
+func malformedJSON(err error) (string, bool) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "body: a JSON object is required", true
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "body: the JSON ends early", true
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("body: malformed JSON at byte %d", syntaxErr.Offset), true
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		return "body: must be a JSON object", true
+	}
+	return "", false
+}
+
+// fieldDetails lists the fields of body, decoded into a struct of type t,
+// that err is about.
+func fieldDetails(err error, t reflect.Type, body []byte) []FieldDetail {
+	var typeErr *json.UnmarshalTypeError
+	var invalid validator.ValidationErrors
+	switch {
+	case errors.As(err, &typeErr):
+		return []FieldDetail{{Field: typeErr.Field, Reason: "must be " + jsonKind(typeErr.Type)}}
+	case errors.As(err, &invalid):
+		details := make([]FieldDetail, len(invalid))
+		for i, e := range invalid {
+			details[i] = FieldDetail{Field: jsonName(t, e.StructField()), Reason: e.Tag()}
+			if e.Tag() != "required" {
+				details[i].Reason = "must be " + e.Tag() + " " + e.Param()
+			}
+		}
+		return details
+	}
+	// from the decoder of a field's type, such as an amount that isn't a
+	// number, whose errors don't say which field it was: the one that
+	// fails again on its own
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil && t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			raw, ok := fields[jsonName(t, f.Name)]
+			if !ok || json.Unmarshal(raw, reflect.New(f.Type).Interface()) == nil {
+				continue
+			}
+			return []FieldDetail{{Field: jsonName(t, f.Name), Reason: "must be " + jsonKind(f.Type)}}
+		}
+	}
+	return []FieldDetail{{Field: "body", Reason: "a field has a value of the wrong format"}}
+}
+
+// jsonName is the name in JSON of the field of struct type t named field.
+func jsonName(t reflect.Type, field string) string {
+	f, ok := t.FieldByName(field)
+	if !ok {
+		return field
+	}
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return field
+}
+
+// jsonKind names the JSON value a field of type t takes, with an article.
+func jsonKind(t reflect.Type) string {
+	if t == reflect.TypeOf(decimal.Decimal{}) {
+		return "a decimal number"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// abortThrottled rejects a request the client should repeat after
+// retryAfter, because it is rate limited, the database is busy or the
+// service is in maintenance. Every such response has the same shape: the
+// hint is in the Retry-After header in whole seconds, rounded up, and in
+// the body as retry_after_ms. The request must not have changed anything,
+// so that clients can retry it blindly.
+func abortThrottled(c *gin.Context, status int, code string, message string, retryAfter time.Duration) {
+	// Retry-After can't say less than a second
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	c.Header("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Code:         code,
+		Message:      message,
+		RetryAfterMs: retryAfter.Milliseconds(),
+	})
+}
+
+// abortInvalidWalletId rejects a request whose wallet id failed validateWalletId.
+func abortInvalidWalletId(c *gin.Context, err error) {
+	code := "invalid_wallet_id"
+	if errors.Is(err, walletid.ErrChecksum) {
+		code = "invalid_wallet_id_checksum"
+	}
+	abortWithError(c, http.StatusBadRequest, code, err.Error())
+}
+
+// abortTransferError maps an error from WalletRepository.Transfer to a response.
+func (h *WalletHandler) abortTransferError(c *gin.Context, fromId, toId, amount string, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+	case errors.Is(err, store.ErrRecipientNotFound):
+		abortWithError(c, http.StatusBadRequest, "recipient_not_found", "recipient wallet not found")
+	case errors.Is(err, store.ErrInsufficientFunds):
+		abortWithError(c, http.StatusUnprocessableEntity, "insufficient_funds", "insufficient funds")
+	case errors.Is(err, store.ErrInvalidAmount):
+		abortWithError(c, http.StatusBadRequest, "invalid_amount", err.Error())
+	case errors.Is(err, store.ErrTooPrecise), errors.Is(err, store.ErrOutOfRange):
+		abortWithError(c, http.StatusBadRequest, "invalid_amount", fmt.Sprintf("amount %s: %v", amount, err))
+	case errors.Is(err, store.ErrConflict):
+		abortWithError(c, http.StatusConflict, "wallet_conflict", "a wallet changed during the transfer, try again")
+	default:
+		abortInternalError(c, h.log, err, "could not complete transfer", "send", "from", fromId, "to", toId)
+	}
+}
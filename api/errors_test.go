@@ -0,0 +1,182 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+)
+
+// TestDatabaseErrorsNotSent breaks the database under every handler that
+// reads it and checks the answers hold nothing of the driver's errors,
+// only a stable code and the request id.
+func TestDatabaseErrorsNotSent(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true, config.FeatureImport: true}
+	r := newTestRouter(t, db, cfg)
+	for _, table := range []string{"wallets", "wallet_transactions", "webhooks", "outbox", "schema_migrations"} {
+		if _, err := db.Exec("ALTER TABLE " + table + " RENAME TO " + table + "_gone"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/v1/wallet", ""},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA", ""},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/history", ""},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1"}`},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks", ""},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`},
+		{http.MethodGet, "/api/v1/admin/outbox", ""},
+		{http.MethodPost, "/api/v1/admin/outbox/1/redrive", ""},
+	}
+	for _, req := range requests {
+		w := serve(r, req.method, req.path, req.body)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s: %d %s", req.method, req.path, w.Code, w.Body)
+			continue
+		}
+		decodeError(t, w, http.StatusInternalServerError, "internal_error")
+		if w.Header().Get(requestIdHeader) == "" {
+			t.Errorf("%s %s: no request id", req.method, req.path)
+		}
+		for _, leak := range []string{"no such table", "_gone", "sqlite", "sql:", "SQL"} {
+			if strings.Contains(w.Body.String(), leak) {
+				t.Errorf("%s %s: %q in %s", req.method, req.path, leak, w.Body)
+			}
+		}
+	}
+}
+
+// TestBindJSONMessages checks that bodies the decoder refuses are
+// described in the request's terms, not with the Go types they are
+// decoded into.
+func TestBindJSONMessages(t *testing.T) {
+	r := walletRouter(NewWalletHandler(newMemRepo(newTestWallet("AAAAAA", 100)), fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+	tests := []struct{ body, code, message string }{
+		{"", "invalid_json", "body: a JSON object is required"},
+		{`{"to":"BBBBBB"`, "invalid_json", "body: the JSON ends early"},
+		{`{"to":"BBBBBB",}`, "invalid_json", "body: malformed JSON at byte 16"},
+		{`[1]`, "invalid_json", "body: must be a JSON object"},
+		{`{"to":12,"amount":1}`, "validation_failed", "to: must be a string"},
+	}
+	for _, tt := range tests {
+		body := decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", tt.body), http.StatusBadRequest, tt.code)
+		if body.Message != tt.message {
+			t.Errorf("%q: %q, want %q", tt.body, body.Message, tt.message)
+		}
+	}
+}
+
+// TestValidationDetails checks the details of the bodies refused by every
+// handler binding one: each field that can't be used is listed with why,
+// and a body that isn't JSON gets invalid_json without details.
+func TestValidationDetails(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	cfg.StrictAmounts = true
+	r := newTestRouter(t, db, cfg)
+
+	const (
+		send        = "/api/v1/wallet/AAAAAA/send"
+		maintenance = "/api/v1/admin/maintenance"
+		loglevel    = "/api/v1/admin/loglevel"
+		webhooks    = "/api/v1/wallet/AAAAAA/webhooks"
+	)
+	tests := []struct {
+		name, method, path, body string
+		code                     string
+		details                  []FieldDetail
+	}{
+		{"send missing to", http.MethodPost, send, `{"amount":"1"}`, "validation_failed",
+			[]FieldDetail{{"to", "required"}}},
+		{"send missing amount", http.MethodPost, send, `{"to":"BBBBBB"}`, "validation_failed",
+			[]FieldDetail{{"amount", "required"}}},
+		{"send null amount", http.MethodPost, send, `{"to":"BBBBBB","amount":null}`, "validation_failed",
+			[]FieldDetail{{"amount", "required"}}},
+		{"send amount not a number", http.MethodPost, send, `{"to":"BBBBBB","amount":"abc"}`, "validation_failed",
+			[]FieldDetail{{"amount", "must be a plain decimal number like 10.50"}}},
+		{"send amount a boolean", http.MethodPost, send, `{"to":"BBBBBB","amount":true}`, "validation_failed",
+			[]FieldDetail{{"amount", "must be a plain decimal number like 10.50"}}},
+		{"send to a number", http.MethodPost, send, `{"to":12,"amount":"1"}`, "validation_failed",
+			[]FieldDetail{{"to", "must be a string"}}},
+		{"send not json", http.MethodPost, send, `to=BBBBBB&amount=1`, "invalid_json", nil},
+		{"send array", http.MethodPost, send, `[{"to":"BBBBBB"}]`, "invalid_json", nil},
+		{"maintenance missing enabled", http.MethodPut, maintenance, `{"message":"soon"}`, "validation_failed",
+			[]FieldDetail{{"enabled", "required"}}},
+		{"maintenance enabled a string", http.MethodPut, maintenance, `{"enabled":"yes"}`, "validation_failed",
+			[]FieldDetail{{"enabled", "must be a boolean"}}},
+		{"maintenance truncated", http.MethodPut, maintenance, `{"enabled":true`, "invalid_json", nil},
+		{"loglevel a number", http.MethodPut, loglevel, `{"level":3}`, "validation_failed",
+			[]FieldDetail{{"level", "must be a string"}}},
+		{"loglevel empty", http.MethodPut, loglevel, ``, "invalid_json", nil},
+		{"webhook events a string", http.MethodPost, webhooks, `{"url":"https://example.com/hook","events":"transfer.completed"}`, "validation_failed",
+			[]FieldDetail{{"events", "must be an array"}}},
+		{"webhook url an object", http.MethodPost, webhooks, `{"url":{}}`, "validation_failed",
+			[]FieldDetail{{"url", "must be a string"}}},
+		{"webhook trailing comma", http.MethodPost, webhooks, `{"url":"https://example.com/hook",}`, "invalid_json", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := decodeError(t, serve(r, tt.method, tt.path, tt.body), http.StatusBadRequest, tt.code)
+			if len(body.Details) != len(tt.details) {
+				t.Fatalf("details %v, want %v", body.Details, tt.details)
+			}
+			for i := range tt.details {
+				if body.Details[i] != tt.details[i] {
+					t.Errorf("details %v, want %v", body.Details, tt.details)
+				}
+				if !strings.Contains(body.Message, tt.details[i].Field+": "+tt.details[i].Reason) {
+					t.Errorf("message %q doesn't list %v", body.Message, tt.details[i])
+				}
+			}
+		})
+	}
+}
+
+// TestBindJSONDetails covers what no handler's body has yet: several
+// failed tags at once, tags with a parameter and a field whose own
+// decoder refuses the value.
+func TestBindJSONDetails(t *testing.T) {
+	r := gin.New()
+	r.POST("/", func(c *gin.Context) {
+		var body struct {
+			Name   string          `json:"name" binding:"required,min=3"`
+			Note   string          `json:"note" binding:"max=4"`
+			Amount decimal.Decimal `json:"amount"`
+		}
+		if bindJSON(c, &body) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+	tests := []struct {
+		body    string
+		details []FieldDetail
+	}{
+		{`{"name":"abc","note":"abcd","amount":"1.5"}`, nil},
+		{`{"note":"abcde"}`, []FieldDetail{{"name", "required"}, {"note", "must be max 4"}}},
+		{`{"name":"ab"}`, []FieldDetail{{"name", "must be min 3"}}},
+		{`{"name":"abc","amount":"lots"}`, []FieldDetail{{"amount", "must be a decimal number"}}},
+	}
+	for _, tt := range tests {
+		w := serve(r, http.MethodPost, "/", tt.body)
+		if tt.details == nil {
+			if w.Code != http.StatusNoContent {
+				t.Errorf("%s: %d %s", tt.body, w.Code, w.Body)
+			}
+			continue
+		}
+		body := decodeError(t, w, http.StatusBadRequest, "validation_failed")
+		if fmt.Sprint(body.Details) != fmt.Sprint(tt.details) {
+			t.Errorf("%s: details %v, want %v", tt.body, body.Details, tt.details)
+		}
+	}
+}
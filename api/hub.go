@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// errTooManySubscribers is returned when a wallet already has the most
+	// live connections allowed.
+	errTooManySubscribers = errors.New("too many live connections for this wallet")
+	// errHubClosed is returned once the server is shutting down.
+	errHubClosed = errors.New("the server is shutting down")
+)
+
+// subscriptionBuffer is how many updates a slow subscriber may fall behind
+// before the oldest ones are dropped; only the latest balance matters.
+const subscriptionBuffer = 8
+
+// BalanceUpdate is a wallet's balance after a change.
+type BalanceUpdate struct {
+	WalletId string          `json:"wallet_id"`
+	Balance  decimal.Decimal `json:"balance"`
+	Time     time.Time       `json:"time"`
+}
+
+// BalanceHub fans the balance changes made by this process out to the
+// live connections watching the wallets. Changes made by other instances
+// on a shared database aren't seen.
+type BalanceHub struct {
+	maxPerWallet int
+
+	mu     sync.Mutex
+	subs   map[string]map[chan BalanceUpdate]struct{}
+	closed bool
+}
+
+func NewBalanceHub(maxPerWallet int) *BalanceHub {
+	return &BalanceHub{maxPerWallet: maxPerWallet, subs: map[string]map[chan BalanceUpdate]struct{}{}}
+}
+
+// Subscribe returns the updates of a wallet and the function ending the
+// subscription. The channel is closed when the hub is.
+func (h *BalanceHub) Subscribe(walletId string) (<-chan BalanceUpdate, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, errHubClosed
+	}
+	if len(h.subs[walletId]) >= h.maxPerWallet {
+		return nil, nil, errTooManySubscribers
+	}
+	ch := make(chan BalanceUpdate, subscriptionBuffer)
+	if h.subs[walletId] == nil {
+		h.subs[walletId] = map[chan BalanceUpdate]struct{}{}
+	}
+	h.subs[walletId][ch] = struct{}{}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if _, ok := h.subs[walletId][ch]; !ok {
+				// already closed by Close
+				return
+			}
+			delete(h.subs[walletId], ch)
+			if len(h.subs[walletId]) == 0 {
+				delete(h.subs, walletId)
+			}
+			close(ch)
+		})
+	}
+	return ch, unsubscribe, nil
+}
+
+// Publish hands u to the subscribers of its wallet without blocking.
+func (h *BalanceHub) Publish(u BalanceUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[u.WalletId] {
+		select {
+		case ch <- u:
+			continue
+		default:
+		}
+		// full, make room by dropping the oldest update
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- u:
+		default:
+		}
+	}
+}
+
+// Close ends every subscription and refuses new ones. It is called when
+// the server shuts down, since hijacked connections aren't closed by
+// http.Server.Shutdown.
+func (h *BalanceHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for walletId, subs := range h.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(h.subs, walletId)
+	}
+}
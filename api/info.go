@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
+)
+
+// InfoHandler serves what is known about the running service.
+type InfoHandler struct {
+	db *store.DB
+	// health is nil when the database isn't monitored.
+	health *ops.DBHealth
+	build  version.Info
+	log    *slog.Logger
+	level  *slog.LevelVar
+}
+
+func NewInfoHandler(db *store.DB, health *ops.DBHealth, build version.Info, logger *slog.Logger, level *slog.LevelVar) *InfoHandler {
+	return &InfoHandler{db: db, health: health, build: build, log: logger, level: level}
+}
+
+// Version handles GET /api/v1/version.
+//
+//	curl http://localhost:8080/api/v1/version
+func (h *InfoHandler) Version(c *gin.Context) {
+	schema, err := h.db.SchemaVersion(c.Request.Context())
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not read the schema version", "version: schema version")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"version":        h.build.Version,
+		"commit":         h.build.Commit,
+		"date":           h.build.Date,
+		"go_version":     h.build.GoVersion,
+		"schema_version": schema,
+		"log_level":      levelName(h.level.Level()),
+	})
+}
+
+// Health handles GET /healthz. The service is alive as long as it
+// answers, so it is always 200; the body says whether the database passes
+// its health checks, which /readyz turns into a 503.
+//
+//	curl http://localhost:8080/healthz
+func (h *InfoHandler) Health(c *gin.Context) {
+	if h.health == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	state := h.health.State()
+	status := "ok"
+	if !state.Healthy {
+		status = "degraded"
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "database": state})
+}
+
+// Ready handles GET /readyz. It answers 503 while the database can't be
+// written, with the code of the store.NotWritableError when the reason is
+// known, so a file made read-only or removed after startup shows up here
+// and not only as failing transfers. A database the health checks found
+// unhealthy isn't tried again.
+//
+//	curl http://localhost:8080/readyz
+func (h *InfoHandler) Ready(c *gin.Context) {
+	if !h.health.Healthy() {
+		abortWithError(c, http.StatusServiceUnavailable, "database_unavailable", unhealthyMessage(h.health.State()))
+		return
+	}
+	err := h.db.CheckWritable(c.Request.Context())
+	var notWritable *store.NotWritableError
+	switch {
+	case errors.As(err, &notWritable):
+		h.log.Warn("not ready", "code", notWritable.Code, "err", err)
+		abortWithError(c, http.StatusServiceUnavailable, notWritable.Code, notWritable.Reason)
+		return
+	case err != nil:
+		h.log.Warn("not ready", "err", err)
+		abortWithError(c, http.StatusServiceUnavailable, "database_unavailable", "the database can't be reached")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// unhealthyMessage says since when the database fails its health checks.
+func unhealthyMessage(state ops.DBHealthState) string {
+	return fmt.Sprintf("the database failed %d health checks in a row since %s", state.Failures, state.Since.Format(time.RFC3339))
+}
+
+// refuseUnhealthy rejects requests with a throttling 503 while the
+// database is unhealthy, rather than letting each wait for its timeout.
+// It goes on the routes that need the database.
+func refuseUnhealthy(health *ops.DBHealth, retryAfter time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if health.Healthy() {
+			return
+		}
+		abortThrottled(c, http.StatusServiceUnavailable, "database_unavailable", unhealthyMessage(health.State()), retryAfter)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
+)
+
+func TestVersion(t *testing.T) {
+	db := openTestStore(t)
+	schema, err := db.SchemaVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelWarn)
+	build := version.Info{Version: "v1.4.2", Commit: "3f9c2e1", Date: "2024-03-01T12:00:00Z", GoVersion: "go1.21.5"}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/version", NewInfoHandler(db, nil, build, discardLogger(), level).Version)
+
+	w := serve(r, http.MethodGet, "/api/v1/version", "")
+	want := fmt.Sprintf(`{"commit":"3f9c2e1","date":"2024-03-01T12:00:00Z","go_version":"go1.21.5","log_level":"warn","schema_version":%d,"version":"v1.4.2"}`, schema)
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("got %d %s\nwant %s", w.Code, w.Body, want)
+	}
+	if schema == 0 {
+		t.Fatal("schema version 0 on a migrated database")
+	}
+
+	db.Close()
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/version", ""), http.StatusInternalServerError, "internal_error")
+}
+
+// TestReady removes the database file under a running service: /readyz
+// must turn to a 503 saying why, as the writes would silently be lost.
+func TestReady(t *testing.T) {
+	db := openTestStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/readyz", NewInfoHandler(db, nil, version.Info{}, discardLogger(), new(slog.LevelVar)).Ready)
+
+	if w := serve(r, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Fatalf("ready: %d %s", w.Code, w.Body)
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(db.Path + suffix)
+	}
+	body := decodeError(t, serve(r, http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable, store.NotWritableMissing)
+	if !strings.Contains(body.Message, "removed or renamed") {
+		t.Fatalf("message: %s", body.Message)
+	}
+}
+
+// TestUnhealthy moves the database file away until the health checks
+// give up on it: /healthz turns degraded, /readyz and the wallet
+// endpoints answer 503 at once, the admin endpoints stay open, and all of
+// it recovers with the file.
+func TestUnhealthy(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100))
+	cfg := testConfig(t)
+	_, testNet, _ := net.ParseCIDR("192.0.2.0/24")
+	cfg.AdminAllowedNets = []*net.IPNet{testNet}
+	health := ops.NewDBHealth(db, 1, time.Second, discardLogger(), nil)
+	h := testHandlers(t, db, cfg)
+	h.Info = NewInfoHandler(db, health, version.Info{}, discardLogger(), new(slog.LevelVar))
+	h.Health = health
+	r, err := NewRouter(h, discardLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		if err := health.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	move := func(from, to string) {
+		t.Helper()
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(from+suffix, to+suffix); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	healthz := func(want string) {
+		t.Helper()
+		w := serve(r, http.MethodGet, "/healthz", "")
+		var body struct {
+			Status   string
+			Database ops.DBHealthState
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK || body.Status != want ||
+			body.Database.Healthy != (want == "ok") {
+			t.Fatalf("/healthz: %d %+v %v, want %s", w.Code, body, err, want)
+		}
+	}
+
+	check()
+	healthz("ok")
+	if w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA", ""); w.Code != http.StatusOK {
+		t.Fatalf("healthy: %d %s", w.Code, w.Body)
+	}
+
+	move(db.Path, db.Path+".away")
+	check()
+	healthz("degraded")
+	for _, path := range []string{"/readyz", "/api/v1/wallet/AAAAAA", "/api/v1/wallet/AAAAAA/history"} {
+		w := serve(r, http.MethodGet, path, "")
+		retryAfter := w.Header().Get("Retry-After")
+		body := decodeError(t, w, http.StatusServiceUnavailable, "database_unavailable")
+		if !strings.Contains(body.Message, "1 health checks in a row") || path != "/readyz" && retryAfter != "5" {
+			t.Errorf("%s: %s, Retry-After %q", path, body.Message, retryAfter)
+		}
+	}
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"AAAAAA","amount":"1"}`),
+		http.StatusServiceUnavailable, "database_unavailable")
+	if w := serve(r, http.MethodGet, "/api/v1/admin/features", ""); w.Code != http.StatusOK {
+		t.Errorf("admin while unhealthy: %d %s", w.Code, w.Body)
+	}
+
+	move(db.Path+".away", db.Path)
+	check()
+	healthz("ok")
+	for _, path := range []string{"/readyz", "/api/v1/wallet/AAAAAA"} {
+		if w := serve(r, http.MethodGet, path, ""); w.Code != http.StatusOK {
+			t.Errorf("%s after recovering: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	// without a monitor the service is always healthy
+	w := serve(newTestRouter(t, db, cfg), http.MethodGet, "/healthz", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}` {
+		t.Fatalf("/healthz without a monitor: %d %s", w.Code, w.Body)
+	}
+}
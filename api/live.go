@@ -0,0 +1,170 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// Message types of the live connections. Every message is a JSON object
+// with a type; balance messages are a liveBalanceUpdate besides.
+const (
+	liveBalance = "balance"
+	livePing    = "ping"
+	livePong    = "pong"
+)
+
+type liveMessage struct {
+	Type string `json:"type"`
+	*liveBalanceUpdate
+}
+
+// liveBalanceUpdate is a BalanceUpdate as sent to clients.
+type liveBalanceUpdate struct {
+	WalletId string    `json:"wallet_id"`
+	Balance  Money     `json:"balance"`
+	Time     Timestamp `json:"time"`
+}
+
+// LiveHandler pushes balance changes to clients over a WebSocket.
+//
+// The keepalive is done with ping and pong messages rather than control
+// frames, which browsers neither send nor expose: the server sends a ping
+// every PingInterval and drops a client it hasn't heard from in two.
+// Clients may ping too and are answered with a pong.
+type LiveHandler struct {
+	db    store.WalletRepository
+	hub   *BalanceHub
+	log   *slog.Logger
+	ids   walletid.Format
+	money moneyFormat
+
+	pingInterval time.Duration
+	writeTimeout time.Duration
+}
+
+func NewLiveHandler(repo store.WalletRepository, hub *BalanceHub, logger *slog.Logger, cfg config.Config) *LiveHandler {
+	return &LiveHandler{
+		db:           repo,
+		hub:          hub,
+		log:          logger,
+		ids:          cfg.WalletIds,
+		money:        newMoneyFormat(cfg),
+		pingInterval: cfg.WebSocketPingInterval,
+		writeTimeout: cfg.WebSocketWriteTimeout,
+	}
+}
+
+// WebSocket handles GET /api/v1/wallet/:walletid/ws. The first message is
+// the current balance, then one follows every transfer of the wallet.
+//
+//	websocat ws://localhost:8080/api/v1/wallet/TTTFGF/ws
+func (h *LiveHandler) WebSocket(c *gin.Context) {
+	id := c.Param("walletid")
+	if err := validateWalletId(h.ids, "walletid", id); err != nil {
+		abortInvalidWalletId(c, err)
+		return
+	}
+	id = h.ids.Normalize(id)
+	wallet, err := h.db.GetWallet(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not read the wallet", "live", "wallet", id)
+		return
+	}
+	// subscribed before upgrading, so that refusals are plain HTTP errors
+	// and no transfer is missed between the first message and the next
+	updates, unsubscribe, err := h.hub.Subscribe(id)
+	switch {
+	case errors.Is(err, errTooManySubscribers):
+		abortWithError(c, http.StatusTooManyRequests, "too_many_connections", err.Error())
+		return
+	case err != nil:
+		abortWithError(c, http.StatusServiceUnavailable, "shutting_down", err.Error())
+		return
+	}
+	defer unsubscribe()
+
+	first := BalanceUpdate{WalletId: wallet.Id, Balance: wallet.Balance, Time: time.Now().UTC()}
+	server := websocket.Server{
+		// the API takes requests from any origin, so does this endpoint
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			h.serve(c, ws, first, updates)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// serve writes the messages of one connection until the client leaves,
+// a write fails or the hub closes updates.
+func (h *LiveHandler) serve(c *gin.Context, ws *websocket.Conn, first BalanceUpdate, updates <-chan BalanceUpdate) {
+	defer ws.Close()
+	h.log.Debug("live connection opened", "wallet", first.WalletId, "remote", c.ClientIP())
+
+	// the reader only answers pings and notices the client going away,
+	// every write happens below
+	pings := make(chan struct{}, 1)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			ws.SetReadDeadline(time.Now().Add(2 * h.pingInterval))
+			var msg liveMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == livePing {
+				select {
+				case pings <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	write := func(msg liveMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		return websocket.JSON.Send(ws, msg)
+	}
+	balance := func(u BalanceUpdate) liveMessage {
+		return liveMessage{Type: liveBalance, liveBalanceUpdate: &liveBalanceUpdate{u.WalletId, h.money.of(u.Balance), newTimestamp(u.Time, time.UTC)}}
+	}
+	if err := write(balance(first)); err != nil {
+		return
+	}
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				h.log.Debug("live connection closed by shutdown", "wallet", first.WalletId)
+				return
+			}
+			err = write(balance(u))
+		case <-ticker.C:
+			err = write(liveMessage{Type: livePing})
+		case <-pings:
+			err = write(liveMessage{Type: livePong})
+		case <-gone:
+			h.log.Debug("live connection closed by client or timed out", "wallet", first.WalletId)
+			return
+		}
+		if err != nil {
+			h.log.Debug("live connection write", "wallet", first.WalletId, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+	"kordimion/secure-web-service/config"
+)
+
+// liveServer serves the live endpoint of a handler on repo and hub.
+func liveServer(t *testing.T, repo *memRepo, hub *BalanceHub, cfg config.Config) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewLiveHandler(repo, hub, discardLogger(), cfg)
+	handleBoth(r.Group("/api/v1/wallet"), http.MethodGet, ":walletid/ws", h.WebSocket)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// dial opens a live connection to the wallet id of ts.
+func dial(t *testing.T, ts *httptest.Server, id string) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/api/v1/wallet/"+id+"/ws", "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// liveReceived is a message as the client decodes it.
+type liveReceived struct {
+	Type     string `json:"type"`
+	WalletId string `json:"wallet_id"`
+	Balance  string `json:"balance"`
+}
+
+// receive reads the next message of ws, failing after a few seconds.
+func receive(t *testing.T, ws *websocket.Conn) liveReceived {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg liveReceived
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// closed reports whether the server ended ws within a few seconds.
+func closed(ws *websocket.Conn) bool {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg liveReceived
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return !strings.Contains(err.Error(), "timeout")
+		}
+	}
+}
+
+func TestWebSocketBalanceUpdates(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebSocket: true}
+	ts := httptest.NewServer(newTestRouter(t, db, cfg))
+	defer ts.Close()
+
+	ws := dial(t, ts, "BBBBBB")
+	if msg := receive(t, ws); msg != (liveReceived{liveBalance, "BBBBBB", "100"}) {
+		t.Fatalf("first message %+v", msg)
+	}
+	res, err := http.Post(ts.URL+"/api/v1/wallet/AAAAAA/send", "application/json", strings.NewReader(`{"to":"BBBBBB","amount":"12.5"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("send: %d", res.StatusCode)
+	}
+	if msg := receive(t, ws); msg != (liveReceived{liveBalance, "BBBBBB", "112.5"}) {
+		t.Fatalf("after the transfer %+v", msg)
+	}
+
+	if err := websocket.JSON.Send(ws, liveMessage{Type: livePing}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, ws); msg.Type != livePong {
+		t.Fatalf("answer to a ping %+v", msg)
+	}
+
+	res, err = http.Get(ts.URL + "/api/v1/wallet/ZZZZZZ/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown wallet: %d", res.StatusCode)
+	}
+}
+
+func TestWebSocketConnectionLimit(t *testing.T) {
+	cfg := testConfig(t)
+	hub := NewBalanceHub(1)
+	ts := liveServer(t, newMemRepo(newTestWallet("AAAAAA", 100)), hub, cfg)
+
+	first := dial(t, ts, "AAAAAA")
+	receive(t, first)
+	res, err := http.Get(ts.URL + "/api/v1/wallet/AAAAAA/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: %d", res.StatusCode)
+	}
+
+	// a closed connection makes room for another
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/api/v1/wallet/AAAAAA/ws", "", ts.URL)
+		if err == nil {
+			ws.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no room after closing the first connection: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WebSocketPingInterval = 20 * time.Millisecond
+	ts := liveServer(t, newMemRepo(newTestWallet("AAAAAA", 100)), NewBalanceHub(5), cfg)
+
+	ws := dial(t, ts, "AAAAAA")
+	receive(t, ws)
+	if msg := receive(t, ws); msg.Type != livePing {
+		t.Fatalf("want a ping, got %+v", msg)
+	}
+	// a client that never answers is dropped after two intervals
+	if !closed(ws) {
+		t.Fatal("a silent client was not dropped")
+	}
+}
+
+func TestWebSocketClosedOnShutdown(t *testing.T) {
+	cfg := testConfig(t)
+	hub := NewBalanceHub(5)
+	ts := liveServer(t, newMemRepo(newTestWallet("AAAAAA", 100)), hub, cfg)
+
+	ws := dial(t, ts, "AAAAAA")
+	receive(t, ws)
+	hub.Publish(BalanceUpdate{WalletId: "AAAAAA", Balance: decimal.NewFromInt(90), Time: testTime})
+	if msg := receive(t, ws); msg.Balance != "90" {
+		t.Fatalf("published update %+v", msg)
+	}
+	hub.Close()
+	if !closed(ws) {
+		t.Fatal("the connection outlived the hub")
+	}
+	res, err := http.Get(ts.URL + "/api/v1/wallet/AAAAAA/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("after the shutdown: %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+// maintenanceSetting is the settings key the mode is stored under, so it
+// survives restarts.
+const maintenanceSetting = "maintenance_mode"
+
+// defaultMaintenanceMessage is sent when the mode was switched on without one.
+const defaultMaintenanceMessage = "the service is in maintenance, try again later"
+
+// MaintenanceState is the state of the maintenance mode, as stored and as
+// returned by GET /api/v1/admin/maintenance.
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// MaintenanceMode makes the service read-only. While it is enabled the
+// requests that change wallets are refused before their handler runs; a
+// request already past that point finishes normally.
+type MaintenanceMode struct {
+	db         *store.DB
+	retryAfter time.Duration
+
+	state atomic.Pointer[MaintenanceState]
+	// mu keeps concurrent Sets from storing one state and serving another.
+	mu sync.Mutex
+}
+
+// NewMaintenanceMode loads the stored mode. cfg.MaintenanceMode enables it
+// regardless, with cfg.MaintenanceMessage.
+func NewMaintenanceMode(db *store.DB, cfg config.Config) (*MaintenanceMode, error) {
+	m := &MaintenanceMode{db: db, retryAfter: cfg.MaintenanceRetryAfter}
+	var state MaintenanceState
+	value, ok, err := db.GetSetting(maintenanceSetting)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			return nil, err
+		}
+	}
+	m.state.Store(&state)
+	if cfg.MaintenanceMode && !state.Enabled {
+		if _, err := m.Set(true, cfg.MaintenanceMessage); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// State returns the current mode.
+func (m *MaintenanceMode) State() MaintenanceState {
+	return *m.state.Load()
+}
+
+// Refusal reports whether requests that change wallets are refused, and
+// with which message.
+func (m *MaintenanceMode) Refusal() (message string, refused bool) {
+	state := m.state.Load()
+	if !state.Enabled {
+		return "", false
+	}
+	if state.Message == "" {
+		return defaultMaintenanceMessage, true
+	}
+	return state.Message, true
+}
+
+// Set stores the mode first and then switches to it, so the service never
+// runs in a mode that would be lost on restart.
+func (m *MaintenanceMode) Set(enabled bool, message string) (MaintenanceState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := MaintenanceState{Enabled: enabled}
+	if enabled {
+		// whole seconds, like every Timestamp; the state is stored as
+		// JSON too, so it stays a time.Time
+		now := time.Now().UTC().Truncate(time.Second)
+		state.Message, state.Since = message, &now
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return MaintenanceState{}, err
+	}
+	if err := m.db.PutSetting(maintenanceSetting, string(value)); err != nil {
+		return MaintenanceState{}, err
+	}
+	m.state.Store(&state)
+	return state, nil
+}
+
+// refuse rejects requests with a throttling 503 while the mode is
+// enabled. It goes on the routes that change wallets.
+func (m *MaintenanceMode) refuse(c *gin.Context) {
+	message, refused := m.Refusal()
+	if !refused {
+		return
+	}
+	abortThrottled(c, http.StatusServiceUnavailable, "maintenance", message, m.retryAfter)
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+// memRepo is a store.WalletRepository kept in memory. When err is set
+// every method fails with it, like a database that went away.
+type memRepo struct {
+	mu      sync.Mutex
+	err     error
+	wallets map[string]store.Wallet
+	txs     []store.Transaction
+	queued  []store.QueuedTransfer
+}
+
+var _ store.WalletRepository = (*memRepo)(nil)
+
+func newMemRepo(wallets ...store.Wallet) *memRepo {
+	m := &memRepo{wallets: map[string]store.Wallet{}}
+	for _, w := range wallets {
+		m.wallets[w.Id] = w
+	}
+	return m
+}
+
+func (m *memRepo) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+func (m *memRepo) GetWallet(ctx context.Context, id string) (store.Wallet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return store.Wallet{}, m.err
+	}
+	w, ok := m.wallets[id]
+	if !ok {
+		return store.Wallet{}, store.ErrNotFound
+	}
+	return w, nil
+}
+
+func (m *memRepo) CreateWallet(ctx context.Context, w store.Wallet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if _, ok := m.wallets[w.Id]; ok {
+		return store.ErrDuplicateID
+	}
+	w.Opening = decimal.NewNullDecimal(w.Balance)
+	m.wallets[w.Id] = w
+	return nil
+}
+
+func (m *memRepo) Transfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (store.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return store.Transaction{}, m.err
+	}
+	sender, ok := m.wallets[from]
+	if !ok {
+		return store.Transaction{}, store.ErrNotFound
+	}
+	recipient, ok := m.wallets[to]
+	if !ok {
+		return store.Transaction{}, store.ErrRecipientNotFound
+	}
+	// the rules of store.DB.Transfer: both balances stay positive, unless
+	// a positive amount only raises a negative recipient
+	if !sender.Balance.Sub(amount).IsPositive() {
+		return store.Transaction{}, store.ErrInsufficientFunds
+	}
+	if from != to && !recipient.Balance.Add(amount).IsPositive() && !amount.IsPositive() {
+		return store.Transaction{}, store.ErrInvalidAmount
+	}
+	if from != to {
+		sender.Balance = sender.Balance.Sub(amount)
+		recipient.Balance = recipient.Balance.Add(amount)
+		m.wallets[from], m.wallets[to] = sender, recipient
+	}
+	t := store.Transaction{
+		FromId:      from,
+		ToId:        to,
+		Amount:      amount,
+		Date:        sql.NullTime{Time: at.UTC(), Valid: true},
+		Status:      store.StatusCompleted,
+		FromBalance: decimal.NewNullDecimal(m.wallets[from].Balance),
+		ToBalance:   decimal.NewNullDecimal(m.wallets[to].Balance),
+	}
+	m.txs = append(m.txs, t)
+	return t, nil
+}
+
+// history is the history of id under filter, newest first like the store.
+func (m *memRepo) history(id string, filter store.HistoryFilter) ([]store.Transaction, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.wallets[id]; !ok {
+		return nil, store.ErrNotFound
+	}
+	var rows []store.Transaction
+	for i := len(m.txs) - 1; i >= 0; i-- {
+		t := m.txs[i]
+		if t.FromId != id && t.ToId != id {
+			continue
+		}
+		if filter.Status != "" && t.Status != filter.Status {
+			continue
+		}
+		if filter.Counterparty != "" && t.FromId != filter.Counterparty && t.ToId != filter.Counterparty {
+			continue
+		}
+		rows = append(rows, t)
+	}
+	return rows, nil
+}
+
+func (m *memRepo) History(ctx context.Context, id string, filter store.HistoryFilter) ([]store.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows, err := m.history(id, filter)
+	if filter.Limit > 0 {
+		rows = rows[min(filter.Offset, len(rows)):]
+		rows = rows[:min(filter.Limit, len(rows))]
+	}
+	return rows, err
+}
+
+func (m *memRepo) EachHistory(ctx context.Context, id string, filter store.HistoryFilter, fn func(store.Transaction) error) error {
+	rows, err := m.History(ctx, id, filter)
+	if err != nil {
+		return err
+	}
+	for _, t := range rows {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memRepo) CountHistory(ctx context.Context, id string, filter store.HistoryFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows, err := m.history(id, filter)
+	return int64(len(rows)), err
+}
+
+func (m *memRepo) EnqueueTransfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (store.QueuedTransfer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return store.QueuedTransfer{}, m.err
+	}
+	if _, ok := m.wallets[from]; !ok {
+		return store.QueuedTransfer{}, store.ErrNotFound
+	}
+	q := store.QueuedTransfer{
+		Id:        int64(len(m.queued) + 1),
+		FromId:    from,
+		ToId:      to,
+		Amount:    amount,
+		Status:    store.StatusPending,
+		CreatedAt: at.UTC(),
+	}
+	m.queued = append(m.queued, q)
+	return q, nil
+}
+
+func (m *memRepo) QueuedTransfer(ctx context.Context, from string, id int64) (store.QueuedTransfer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return store.QueuedTransfer{}, m.err
+	}
+	for _, q := range m.queued {
+		if q.Id == id && q.FromId == from {
+			return q, nil
+		}
+	}
+	return store.QueuedTransfer{}, store.ErrTransferNotFound
+}
+
+func (m *memRepo) TransactionCount(ctx context.Context, id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	var n int64
+	for _, t := range m.txs {
+		if t.FromId == id || t.ToId == id {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// fixedClock is a Clock stopped at a time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testConfig is the configuration of the environment, the defaults in a
+// clean one.
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// walletRouter serves the wallet endpoints of h without any middleware,
+// not even recovery, so that a panic fails the test.
+func walletRouter(h *WalletHandler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1/wallet")
+	handleBoth(v1, http.MethodPost, "", h.Create)
+	handleBoth(v1, http.MethodPost, ":walletid/send", h.Send)
+	handleBoth(v1, http.MethodGet, ":walletid/history", h.History)
+	handleBoth(v1, http.MethodGet, ":walletid", h.Get)
+	handleBoth(v1, http.MethodGet, ":walletid/transfers/:id", h.Transfer)
+	return r
+}
+
+// serve runs a request with an optional JSON body through r.
+func serve(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
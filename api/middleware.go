@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type unixPeerKey struct{}
+
+// WithUnixPeer marks ctx as that of a connection accepted on a Unix domain
+// socket. The server sets it with http.Server.ConnContext.
+func WithUnixPeer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unixPeerKey{}, true)
+}
+
+func unixPeer(ctx context.Context) bool {
+	ok, _ := ctx.Value(unixPeerKey{}).(bool)
+	return ok
+}
+
+// ipAllowlist only lets through requests whose client address is inside one
+// of the given networks. The client address comes from gin's ClientIP, so
+// forwarded headers are honored only when they come from a trusted proxy.
+// A peer on a Unix domain socket has no address and is local: who may
+// connect is up to the socket file's mode, so it is let through.
+func ipAllowlist(nets []*net.IPNet, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if unixPeer(c.Request.Context()) {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(c.ClientIP())
+		if ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					c.Next()
+					return
+				}
+			}
+		}
+		logger.Warn("admin request rejected by allowlist", "client_ip", c.ClientIP())
+		abortWithError(c, http.StatusForbidden, "forbidden", "this endpoint is only served to the networks of ADMIN_ALLOWED_CIDRS")
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIPAllowlist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"192.168.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/admin", ipAllowlist(nets, slog.New(slog.NewTextHandler(io.Discard, nil))), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      int
+	}{
+		{"direct inside", "10.1.2.3:5000", "", http.StatusOK},
+		{"direct outside", "172.16.0.1:5000", "", http.StatusForbidden},
+		{"trusted proxy forwarding inside", "192.168.1.1:5000", "10.9.9.9", http.StatusOK},
+		{"trusted proxy forwarding outside", "192.168.1.1:5000", "172.16.0.1", http.StatusForbidden},
+		{"untrusted proxy forwarding inside", "172.16.0.1:5000", "10.9.9.9", http.StatusForbidden},
+		{"untrusted proxy inside forwarding outside", "10.1.2.3:5000", "172.16.0.1", http.StatusOK},
+		{"ipv6 inside", "[2001:db8::1]:5000", "", http.StatusOK},
+		{"ipv6 outside", "[2001:db9::1]:5000", "", http.StatusForbidden},
+		{"trusted proxy forwarding ipv6", "192.168.1.1:5000", "2001:db8::42", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if tt.want == http.StatusForbidden {
+				decodeError(t, w, http.StatusForbidden, "forbidden")
+			} else if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// a Unix domain socket peer, with the RemoteAddr net/http gives it
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.RemoteAddr = "@"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	decodeError(t, w, http.StatusForbidden, "forbidden")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req.WithContext(WithUnixPeer(req.Context())))
+	if w.Code != http.StatusOK {
+		t.Errorf("unix socket peer: status = %d, want 200", w.Code)
+	}
+}
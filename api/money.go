@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+)
+
+// Money is an amount or balance in a response. Every one the API writes
+// is a Money, so they all look the same: a JSON string like "10.50" by
+// default, or a number with MONEY_JSON=number.
+type Money struct {
+	Amount decimal.Decimal
+	number bool
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.number {
+		return []byte(m.Amount.String()), nil
+	}
+	return json.Marshal(m.Amount.String())
+}
+
+// moneyFormat makes the Money of a handler, as configured by MONEY_JSON.
+type moneyFormat struct {
+	number bool
+}
+
+func newMoneyFormat(cfg config.Config) moneyFormat {
+	return moneyFormat{number: cfg.MoneyJSON == "number"}
+}
+
+func (f moneyFormat) of(d decimal.Decimal) Money {
+	return Money{Amount: d, number: f.number}
+}
+
+// plainAmount is the form of the amounts STRICT_AMOUNTS accepts: digits
+// without leading zeros, with an optional minus sign and decimal places.
+var plainAmount = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// ParseAmount parses an amount sent by a client. When strict, only plain
+// fixed-point amounts like 10.50 are accepted, see config.StrictAmounts.
+// The error is the reason, to follow the name of the field.
+func ParseAmount(s string, strict bool) (decimal.Decimal, error) {
+	if strict && !plainAmount.MatchString(s) {
+		return decimal.Decimal{}, errors.New("must be a plain decimal number like 10.50")
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal.Decimal{}, errors.New("must be a decimal number")
+	}
+	return d, nil
+}
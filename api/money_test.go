@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+	"kordimion/secure-web-service/config"
+)
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	tests := []struct {
+		amount      string
+		str, number string
+	}{
+		{"100", `"100"`, `100`},
+		{"10.50", `"10.5"`, `10.5`},
+		{"-0.01", `"-0.01"`, `-0.01`},
+		{"12345678901234567890.12", `"12345678901234567890.12"`, `12345678901234567890.12`},
+	}
+	for _, tt := range tests {
+		d := decimal.RequireFromString(tt.amount)
+		for _, f := range []struct {
+			format moneyFormat
+			want   string
+		}{{moneyFormat{}, tt.str}, {moneyFormat{number: true}, tt.number}} {
+			b, err := json.Marshal(f.format.of(d))
+			if err != nil || string(b) != f.want {
+				t.Errorf("%s with number=%v: %s, %v, want %s", tt.amount, f.format.number, b, err, f.want)
+			}
+		}
+	}
+}
+
+// TestMoneyAcrossEndpoints checks that every endpoint writes amounts the
+// same way, in both formats of MONEY_JSON.
+func TestMoneyAcrossEndpoints(t *testing.T) {
+	for _, format := range []string{"string", "number"} {
+		t.Run(format, func(t *testing.T) {
+			db := openTestStore(t)
+			seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+			cfg := testConfig(t)
+			cfg.MoneyJSON = format
+			cfg.Features = config.Features{config.FeatureWebSocket: true}
+			r := newTestRouter(t, db, cfg)
+			// money writes the amount s as the format does
+			money := func(s string) string {
+				if format == "string" {
+					return `"` + s + `"`
+				}
+				return s
+			}
+			fields := func(w *httptest.ResponseRecorder, status int) map[string]json.RawMessage {
+				t.Helper()
+				var m map[string]json.RawMessage
+				if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || w.Code != status {
+					t.Fatalf("%d %s", w.Code, w.Body)
+				}
+				return m
+			}
+			check := func(endpoint string, got json.RawMessage, want string) {
+				t.Helper()
+				if string(got) != money(want) {
+					t.Errorf("%s: %s, want %s", endpoint, got, money(want))
+				}
+			}
+
+			created := fields(serve(r, http.MethodPost, "/api/v1/wallet", ""), http.StatusCreated)
+			check("create", created["balance"], "100")
+			sent := fields(serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"12.5"}`), http.StatusOK)
+			check("send", sent["balance"], "87.5")
+			got := fields(serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA", ""), http.StatusOK)
+			check("get", got["balance"], "87.5")
+
+			w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history", "")
+			var history []map[string]json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history) != 1 {
+				t.Fatalf("history: %d %s", w.Code, w.Body)
+			}
+			check("history amount", history[0]["amount"], "12.5")
+			check("history balance_after", history[0]["balance_after"], "87.5")
+
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+			ws := dial(t, ts, "AAAAAA")
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var msg map[string]json.RawMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				t.Fatal(err)
+			}
+			check("websocket", msg["balance"], "87.5")
+		})
+	}
+}
+
+// TestParseAmount lists the forms of amount accepted with and without
+// STRICT_AMOUNTS: strict mode only takes what the regexp calls plain.
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s               string
+		lenient, strict bool
+	}{
+		{"10", true, true},
+		{"10.50", true, true},
+		{"0.01", true, true},
+		{"0", true, true},
+		{"-3.5", true, true},
+		{"12345678901234567890.12", true, true},
+		{"1e3", true, false},
+		{"1E3", true, false},
+		{"1.5e-2", true, false},
+		{"+10", true, false},
+		{"01", true, false},
+		{"00.5", true, false},
+		{"-01", true, false},
+		{"10.", true, false},
+		{".5", true, false},
+		{"-.5", true, false},
+		{"", false, false},
+		{"abc", false, false},
+		{"1,5", false, false},
+		{" 1", false, false},
+		{"1 ", false, false},
+		{"--1", false, false},
+		{"0x10", false, false},
+	}
+	for _, tt := range tests {
+		for _, mode := range []struct {
+			strict, ok bool
+		}{{false, tt.lenient}, {true, tt.strict}} {
+			d, err := ParseAmount(tt.s, mode.strict)
+			if (err == nil) != mode.ok {
+				t.Errorf("ParseAmount(%q, strict %v) = %s, %v, want ok %v", tt.s, mode.strict, d, err, mode.ok)
+				continue
+			}
+			if err == nil && !d.Equal(decimal.RequireFromString(tt.s)) {
+				t.Errorf("ParseAmount(%q, strict %v) = %s", tt.s, mode.strict, d)
+			}
+		}
+		if !tt.strict && tt.lenient {
+			if _, err := ParseAmount(tt.s, true); err == nil || err.Error() != "must be a plain decimal number like 10.50" {
+				t.Errorf("ParseAmount(%q, strict) = %v, want the accepted format", tt.s, err)
+			}
+		}
+	}
+}
+
+// TestSendStrictAmounts sends amounts as JSON numbers and as strings: in
+// strict mode the token is checked as the client wrote it, so 1e0 is
+// refused as a number too, although it decodes to 1.
+func TestSendStrictAmounts(t *testing.T) {
+	tests := []struct {
+		amount          string
+		lenient, strict bool
+	}{
+		{`1`, true, true},
+		{`"1"`, true, true},
+		{`0.5`, true, true},
+		{`"0.50"`, true, true},
+		{`1e0`, true, false},
+		{`"1e0"`, true, false},
+		{`1.0E0`, true, false},
+		{`"+1"`, true, false},
+		{`"01"`, true, false},
+		{`"1."`, true, false},
+		{`"abc"`, false, false},
+		{`true`, false, false},
+	}
+	for _, strict := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.StrictAmounts = strict
+		repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+		r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), cfg))
+		for _, tt := range tests {
+			ok := tt.lenient
+			if strict {
+				ok = tt.strict
+			}
+			w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":`+tt.amount+`}`)
+			if ok {
+				if w.Code != http.StatusOK {
+					t.Errorf("strict %v, amount %s: %d %s", strict, tt.amount, w.Code, w.Body)
+				}
+				continue
+			}
+			body := decodeError(t, w, http.StatusBadRequest, "validation_failed")
+			if len(body.Details) != 1 || body.Details[0].Field != "amount" {
+				t.Errorf("strict %v, amount %s: %v", strict, tt.amount, body.Details)
+			}
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/version"
+)
+
+// object is a JSON object of the OpenAPI document.
+type object = map[string]any
+
+// openAPI returns the OpenAPI 3 document of the API. Endpoints of
+// features that are off by default say so; they answer 404 when disabled.
+func openAPI() object {
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "Wallet service",
+			"version": version.Get().Version,
+			"description": "Wallets with a balance and transfers between them. " +
+				"Amounts and balances are decimal strings like \"10.50\" so no precision is lost, " +
+				"or numbers when the service runs with MONEY_JSON=number; " +
+				"requests accept them as strings or numbers. Errors have the Error shape. " +
+				"The wallet endpoints other than the WebSocket take an X-Request-Deadline (RFC 3339) or " +
+				"X-Request-Timeout-Ms header and give up with a 504 deadline_exceeded when it passes. " +
+				"They answer 503 database_unavailable right away while the database fails its health checks, see /healthz. " +
+				"The admin endpoints answer 403 forbidden to clients outside ADMIN_ALLOWED_CIDRS.",
+		},
+		"paths": object{
+			"/api/v1/version": object{
+				"get": operation("Build and schema version", nil, nil, responses(http.StatusOK, "The running build", ref("Version"))),
+			},
+			"/readyz": object{
+				"get": operation("Whether the service can take requests: the database passes its health checks, answers and takes writes", nil, nil,
+					responses(http.StatusOK, "Ready", ref("Ready")),
+					errorResponse(http.StatusServiceUnavailable, "database_missing, database_read_only, database_cant_open or database_unavailable")),
+			},
+			"/healthz": object{
+				"get": operation("Whether the service is alive, and what the database health checks found", nil, nil,
+					responses(http.StatusOK, "Alive, degraded while the database is unhealthy", ref("Health"))),
+			},
+			"/api/v1/wallet": object{
+				"post": operation("Create a wallet with the initial balance and a random id", nil, nil,
+					responses(http.StatusCreated, "The new wallet", ref("CreatedWallet")),
+					errorResponse(http.StatusServiceUnavailable, "rng_unavailable, wallet_id_exhausted or maintenance")),
+			},
+			"/api/v1/wallet/{walletid}": object{
+				"get": operation("Get a wallet", walletParams(), nil,
+					responses(http.StatusOK, "The wallet", ref("Wallet")),
+					errorResponse(http.StatusBadRequest, "invalid_wallet_id or invalid_wallet_id_checksum"),
+					errorResponse(http.StatusNotFound, "wallet_not_found")),
+			},
+			"/api/v1/wallet/{walletid}/send": object{
+				"post": operation("Transfer money to another wallet",
+					append(walletParams(),
+						queryParam("async", "Queue the transfer and answer 202 (async_transfers feature, off by default)", object{"type": "boolean"}),
+						headerParam("Prefer", "respond-async does what async=true does, and is confirmed by Preference-Applied", object{"type": "string"})),
+					ref("SendRequest"),
+					responses(http.StatusOK, "The sender's balance after the transfer", ref("Wallet")),
+					responses(http.StatusAccepted, "The queued transfer, to poll at its status_url, also sent as Location", ref("QueuedTransfer")),
+					errorResponse(http.StatusBadRequest, "invalid_json, validation_failed, invalid_wallet_id, invalid_wallet_id_checksum, recipient_not_found or invalid_amount"),
+					errorResponse(http.StatusNotFound, "wallet_not_found"),
+					errorResponse(http.StatusConflict, "wallet_conflict, try again"),
+					errorResponse(http.StatusUnprocessableEntity, "insufficient_funds"),
+					errorResponse(http.StatusServiceUnavailable, "maintenance")),
+			},
+			"/api/v1/wallet/{walletid}/transfers/{id}": object{
+				"get": operation("The status of a queued transfer (async_transfers feature, off by default)",
+					append(walletParams(), pathParam("id", "integer")), nil,
+					responses(http.StatusOK, "The transfer", ref("QueuedTransfer")),
+					errorResponse(http.StatusBadRequest, "invalid_request, invalid_wallet_id or invalid_wallet_id_checksum"),
+					errorResponse(http.StatusNotFound, "transfer_not_found")),
+			},
+			"/api/v1/wallet/{walletid}/history": object{
+				"get": operation("List the transactions of a wallet",
+					append(walletParams(),
+						queryParam("include_archived", "Add the archived transactions", object{"type": "boolean"}),
+						queryParam("status", "Only transactions with this status", object{"type": "string", "enum": []string{"pending", "completed", "failed"}}),
+						queryParam("counterparty", "Only transactions with this wallet, in either direction", object{"type": "string"}),
+						queryParam("limit", "At most this many per page, 1 to MAX_PAGE_SIZE (1000 unless configured)", object{"type": "integer", "default": 50}),
+						queryParam("cursor", "The "+nextCursorHeader+" of the previous page, the newest transactions without", object{"type": "string"}),
+						includeTotalParam(),
+						queryParam("tz", "IANA time zone to write the times in, such as Europe/Berlin. UTC by default", object{"type": "string"})),
+					nil,
+					withNextCursor(withTotalCount(responses(http.StatusOK, "The transactions, newest first. They are streamed: a failure after the first one closes the connection before the closing bracket", array(ref("Transaction"))))),
+					errorResponse(http.StatusBadRequest, "invalid_request, validation_failed, invalid_wallet_id or invalid_wallet_id_checksum"),
+					errorResponse(http.StatusNotFound, "wallet_not_found")),
+			},
+			"/api/v1/wallet/{walletid}/ws": object{
+				"get": operation("Live balance updates over a WebSocket (websocket feature, off by default). "+
+					"Every message is a JSON object with a type: balance messages add wallet_id, balance and time, "+
+					"ping messages expect any message back within two ping intervals.",
+					walletParams(), nil,
+					responses(http.StatusSwitchingProtocols, "Upgraded to a WebSocket", nil),
+					errorResponse(http.StatusNotFound, "wallet_not_found"),
+					errorResponse(http.StatusTooManyRequests, "too_many_connections")),
+			},
+			"/api/v1/wallet/{walletid}/webhooks": object{
+				"get": operation("List the webhooks of a wallet (webhooks feature, off by default)", walletParams(), nil,
+					responses(http.StatusOK, "The webhooks, oldest first", array(ref("Webhook"))),
+					errorResponse(http.StatusNotFound, "wallet_not_found")),
+				"post": operation("Subscribe a URL to the transfers of a wallet (webhooks feature, off by default)", walletParams(), ref("WebhookRequest"),
+					responses(http.StatusCreated, "The webhook, with its secret", ref("Webhook")),
+					errorResponse(http.StatusBadRequest, "invalid_json, validation_failed or invalid_request"),
+					errorResponse(http.StatusNotFound, "wallet_not_found"),
+					errorResponse(http.StatusConflict, "too_many_webhooks")),
+			},
+			"/api/v1/wallet/{walletid}/webhooks/{id}": object{
+				"delete": operation("Delete a webhook (webhooks feature, off by default)", append(walletParams(), pathParam("id", "integer")), nil,
+					responses(http.StatusNoContent, "Deleted", nil),
+					errorResponse(http.StatusNotFound, "webhook_not_found")),
+			},
+			"/api/v1/wallet/{walletid}/webhooks/{id}/deliveries": object{
+				"get": operation("The latest delivery attempts of a webhook (webhooks feature, off by default)",
+					append(walletParams(), pathParam("id", "integer"), queryParam("limit", "At most this many, 1 to MAX_PAGE_SIZE (1000 unless configured)", object{"type": "integer", "default": 50}),
+						includeTotalParam()),
+					nil,
+					withTotalCount(responses(http.StatusOK, "The attempts, newest first", array(ref("WebhookDelivery")))),
+					errorResponse(http.StatusBadRequest, "validation_failed"),
+					errorResponse(http.StatusNotFound, "wallet_not_found or webhook_not_found")),
+			},
+			"/api/v1/admin/backup": object{
+				"post": operation("Write a database backup (admin)", nil, nil,
+					responses(http.StatusCreated, "The backup file", ref("Backup")),
+					errorResponse(http.StatusNotImplemented, "backup_unsupported"),
+					errorResponse(http.StatusConflict, "busy")),
+			},
+			"/api/v1/admin/maintenance": object{
+				"post": operation("Run database maintenance now (admin)",
+					[]any{queryParam("vacuum", "Also vacuum the database", object{"type": "boolean"})}, nil,
+					responses(http.StatusOK, "What was done", ref("MaintenanceReport")),
+					errorResponse(http.StatusNotImplemented, "maintenance_unsupported"),
+					errorResponse(http.StatusConflict, "busy")),
+				"get": operation("The maintenance mode (admin)", nil, nil,
+					responses(http.StatusOK, "The mode", ref("MaintenanceState"))),
+				"put": operation("Switch the maintenance mode, which refuses the requests that change wallets (admin)", nil, ref("MaintenanceRequest"),
+					responses(http.StatusOK, "The new mode", ref("MaintenanceState")),
+					errorResponse(http.StatusBadRequest, "invalid_json, validation_failed or invalid_request")),
+			},
+			"/api/v1/admin/integrity-check": object{
+				"post": operation("Start a full SQLite integrity check in the background (admin)", nil, nil,
+					responses(http.StatusAccepted, "Started", ref("IntegrityCheckStatus")),
+					errorResponse(http.StatusNotImplemented, "integrity_check_unsupported"),
+					errorResponse(http.StatusConflict, "busy")),
+				"get": operation("The last integrity check since the server started (admin)", nil, nil,
+					responses(http.StatusOK, "Whether one runs and the last report, null before the first", ref("IntegrityCheckStatus"))),
+			},
+			"/api/v1/admin/export": object{
+				"get": operation("Export every wallet and transaction as JSON lines (admin)", nil, nil,
+					object{"200": object{"description": "The export", "content": object{"application/x-ndjson": object{"schema": object{"type": "string"}}}}}),
+			},
+			"/api/v1/admin/import": object{
+				"post": operation("Import an export (admin, import feature)",
+					[]any{queryParam("force", "Replace the wallets already in the database", object{"type": "boolean"})},
+					object{"type": "string"},
+					responses(http.StatusOK, "What was imported", ref("ImportResult")),
+					errorResponse(http.StatusBadRequest, "invalid_import"),
+					errorResponse(http.StatusConflict, "database_not_empty")),
+			},
+			"/api/v1/admin/loglevel": object{
+				"get": operation("The log level (admin)", nil, nil, responses(http.StatusOK, "The level", ref("LogLevel"))),
+				"put": operation("Change the log level (admin)", nil, ref("LogLevel"),
+					responses(http.StatusOK, "The new level", ref("LogLevel")),
+					errorResponse(http.StatusBadRequest, "invalid_json, validation_failed or invalid_request")),
+			},
+			"/api/v1/admin/features": object{
+				"get": operation("Whether each feature is enabled (admin)", nil, nil,
+					responses(http.StatusOK, "Features by name", object{"type": "object", "additionalProperties": object{"type": "boolean"}})),
+			},
+			"/api/v1/admin/jobs": object{
+				"get": operation("The background jobs (admin)", nil, nil, responses(http.StatusOK, "The jobs", array(ref("Job")))),
+			},
+			"/api/v1/admin/outbox": object{
+				"get": operation("Events of the outbox, newest first (admin)",
+					[]any{
+						queryParam("status", "Events with this status", object{"type": "string", "enum": []string{"pending", "sent", "dead"}, "default": "dead"}),
+						queryParam("limit", "At most this many, 1 to MAX_PAGE_SIZE (1000 unless configured)", object{"type": "integer", "default": 100}),
+						includeTotalParam(),
+					}, nil,
+					withTotalCount(responses(http.StatusOK, "The events", array(ref("Event")))),
+					errorResponse(http.StatusBadRequest, "invalid_request or validation_failed")),
+			},
+			"/api/v1/admin/outbox/{id}/redrive": object{
+				"post": operation("Give a dead event new delivery attempts (admin)", []any{pathParam("id", "integer")}, nil,
+					responses(http.StatusOK, "The event is pending again", object{"type": "object", "properties": object{"id": object{"type": "integer"}, "status": object{"type": "string"}}}),
+					errorResponse(http.StatusNotFound, "event_not_found")),
+			},
+		},
+		"components": object{"schemas": schemas()},
+	}
+}
+
+func schemas() object {
+	decimal := object{"type": "string", "format": "decimal", "example": "10.50"}
+	timestamp := object{"type": "string", "format": "date-time", "example": "2024-01-02T15:04:05Z"}
+	str := object{"type": "string"}
+	integer := object{"type": "integer"}
+	boolean := object{"type": "boolean"}
+	return object{
+		"Error": properties(object{
+			"code":           str,
+			"error":          str,
+			"retry_after_ms": object{"type": "integer", "description": "On 429s and 503s to retry after, like the Retry-After header"},
+			"details":        array(ref("FieldDetail")),
+			"error_id":       object{"type": "string", "description": "On 500s of a failure the server didn't expect, to quote when reporting it"},
+		}, "code", "error"),
+		"FieldDetail": properties(object{"field": str, "reason": str}, "field", "reason"),
+		"Wallet": properties(object{
+			"id":                str,
+			"balance":           decimal,
+			"created_at":        object{"type": "string", "format": "date-time", "example": "2024-01-02T15:04:05Z", "nullable": true},
+			"transaction_count": integer,
+		}, "id", "balance"),
+		"CreatedWallet": properties(object{"id": str, "balance": decimal}, "id", "balance"),
+		"SendRequest":   properties(object{"to": str, "amount": decimal}, "to", "amount"),
+		"Transaction": properties(object{
+			"from":           str,
+			"to":             str,
+			"amount":         decimal,
+			"time":           timestamp,
+			"status":         object{"type": "string", "enum": []string{"pending", "completed", "failed"}},
+			"failure_reason": str,
+			"balance_after":  decimal,
+		}, "from", "to", "amount", "time", "status"),
+		"QueuedTransfer": properties(object{
+			"id":             integer,
+			"from":           str,
+			"to":             str,
+			"amount":         decimal,
+			"status":         object{"type": "string", "enum": []string{"queued", "completed", "failed"}},
+			"failure_reason": object{"type": "string", "description": "The error code a synchronous send would have answered, such as insufficient_funds"},
+			"created_at":     timestamp,
+			"processed_at":   timestamp,
+			"balance":        object{"type": "string", "format": "decimal", "description": "The sender's balance right after the completed transfer"},
+			"status_url":     str,
+		}, "id", "from", "to", "amount", "status", "created_at", "status_url"),
+		"Health": properties(object{
+			"status": object{"type": "string", "enum": []string{"ok", "degraded"}},
+			"database": properties(object{
+				"healthy": boolean, "since": timestamp, "last_check": timestamp,
+				"consecutive_failures": integer, "last_error": str, "pool_resets": integer,
+			}),
+		}, "status"),
+		"Ready": properties(object{"status": object{"type": "string", "enum": []string{"ready"}}}),
+		"Version": properties(object{
+			"version": str, "commit": str, "date": str, "go_version": str,
+			"schema_version": integer, "log_level": str,
+		}),
+		"WebhookRequest": properties(object{
+			"url":    str,
+			"secret": object{"type": "string", "description": "Keys the signatures, generated when empty", "minLength": minWebhookSecretBytes},
+			"events": array(object{"type": "string", "enum": []string{"transfer.received", "transfer.sent"}}),
+		}, "url"),
+		"Webhook": properties(object{
+			"id": integer, "url": str, "events": array(str), "created_at": timestamp,
+			"failures": integer, "failing_since": timestamp, "disabled_at": timestamp,
+			"secret": object{"type": "string", "description": "Only returned when the webhook is created"},
+		}),
+		"WebhookDelivery": properties(object{
+			"id": integer, "event_id": integer, "event_type": str, "attempted_at": timestamp,
+			"duration_ms": integer, "status_code": integer, "error": str,
+		}),
+		"Backup": properties(object{"path": str, "size": integer}),
+		"IntegrityCheckStatus": properties(object{
+			"running": boolean,
+			"last": object{"type": "object", "nullable": true, "properties": object{
+				"check":      object{"type": "string", "enum": []string{"integrity_check", "quick_check"}},
+				"started_at": timestamp, "duration_ms": integer, "ok": boolean,
+				"messages": object{"type": "array", "items": str, "description": "What SQLite reported, \"ok\" alone when intact"},
+				"error":    str,
+			}},
+		}),
+		"MaintenanceReport": properties(object{"steps": array(str), "duration_ms": integer, "reclaimed_bytes": integer}),
+		"MaintenanceState":  properties(object{"enabled": boolean, "message": str, "since": timestamp}),
+		"MaintenanceRequest": properties(object{
+			"enabled": boolean,
+			"message": object{"type": "string", "maxLength": maxMaintenanceMessageBytes},
+		}, "enabled"),
+		"ImportResult": properties(object{"wallets": integer, "transactions": integer}),
+		"LogLevel":     properties(object{"level": object{"type": "string", "enum": []string{"debug", "info", "warn", "error"}}}, "level"),
+		"Job": properties(object{
+			"name": str, "running": boolean, "pending": boolean, "runs": integer, "failures": integer,
+			"last_run": timestamp, "last_duration_ms": integer, "last_error": str, "next_run": timestamp,
+		}),
+		"Event": properties(object{
+			"id": integer, "type": str, "payload": object{"type": "object"}, "created_at": timestamp,
+			"status": str, "attempts": integer, "next_attempt_at": timestamp, "last_error": str,
+		}),
+	}
+}
+
+// operation describes an endpoint. A body of type string is JSON lines,
+// the import format; any other is JSON.
+func operation(summary string, params []any, body object, resps ...object) object {
+	op := object{"summary": summary}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if body != nil {
+		contentType := "application/json"
+		if body["type"] == "string" {
+			contentType = "application/x-ndjson"
+		}
+		op["requestBody"] = object{"required": true, "content": object{contentType: object{"schema": body}}}
+	}
+	all := object{}
+	for _, r := range resps {
+		for status, resp := range r {
+			all[status] = resp
+		}
+	}
+	op["responses"] = all
+	return op
+}
+
+func responses(status int, description string, schema object) object {
+	resp := object{"description": description}
+	if schema != nil {
+		resp["content"] = object{"application/json": object{"schema": schema}}
+	}
+	return object{fmt.Sprint(status): resp}
+}
+
+func errorResponse(status int, codes string) object {
+	return responses(status, codes, ref("Error"))
+}
+
+func walletParams() []any {
+	return []any{pathParam("walletid", "string")}
+}
+
+func pathParam(name, typ string) object {
+	return object{"name": name, "in": "path", "required": true, "schema": object{"type": typ}}
+}
+
+func queryParam(name, description string, schema object) object {
+	return object{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+func headerParam(name, description string, schema object) object {
+	return object{"name": name, "in": "header", "description": description, "schema": schema}
+}
+
+// includeTotalParam and withTotalCount document the total of a listing,
+// see includeTotal.
+func includeTotalParam() object {
+	return queryParam("include_total", "Send the number of items without limit as "+totalCountHeader+". It costs a count query", object{"type": "boolean"})
+}
+
+func withTotalCount(resps object) object {
+	for _, resp := range resps {
+		resp.(object)["headers"] = object{totalCountHeader: object{
+			"description": "The number of items without limit, with include_total",
+			"schema":      object{"type": "integer"},
+		}}
+	}
+	return resps
+}
+
+func withNextCursor(resps object) object {
+	for _, resp := range resps {
+		resp.(object)["headers"].(object)[nextCursorHeader] = object{
+			"description": "The cursor of the next page, left out on the last one",
+			"schema":      object{"type": "string"},
+		}
+	}
+	return resps
+}
+
+func ref(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func array(items object) object {
+	return object{"type": "array", "items": items}
+}
+
+func properties(props object, required ...string) object {
+	schema := object{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// docsCSP lets the docs page load Redoc from its CDN, nothing else.
+const docsCSP = "default-src 'none'; script-src https://cdn.redoc.ly; style-src 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; img-src data: https://cdn.redoc.ly; connect-src 'self'; worker-src blob:; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Wallet service API</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="/openapi.json"></redoc>
+<script src="https://cdn.redoc.ly/redoc/v2.1.3/bundles/redoc.standalone.js"></script>
+</body>
+</html>
+`
+
+// openAPIHandler serves the document, built once.
+func openAPIHandler(doc object) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// docsHandler serves a Redoc page rendering /openapi.json. Redoc is
+// loaded from its CDN, so the browser needs to reach it.
+func docsHandler(c *gin.Context) {
+	c.Header("Content-Security-Policy", docsCSP)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
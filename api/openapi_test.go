@@ -0,0 +1,60 @@
+package api
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"kordimion/secure-web-service/config"
+)
+
+// undocumented are the routes that aren't part of the API: pages for
+// people, the metrics and the document itself.
+var undocumented = map[string]bool{
+	"GET /openapi.json":   true,
+	"GET /docs":           true,
+	"ANY /debug/*path":    true,
+	"GET /admin/ui/*path": true,
+	"GET /metrics":        true,
+}
+
+// ginParam matches the parameters of gin paths, :name or *name.
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z_]+)`)
+
+// TestEveryRouteDocumented checks that the OpenAPI document describes
+// every route of a router with all the features on, so that a new
+// endpoint can't be added without it.
+func TestEveryRouteDocumented(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Features = config.Features{}
+	for _, name := range []string{config.FeatureImport, config.FeatureScheduledMaintenance, config.FeatureWebhooks,
+		config.FeatureWebSocket, config.FeatureAsyncTransfers} {
+		cfg.Features[name] = true
+	}
+	cfg.APIDocs, cfg.DebugEndpoints, cfg.DebugAddr, cfg.Metrics, cfg.AdminUI = true, true, "", true, true
+	r := newTestRouter(t, openTestStore(t), cfg)
+
+	paths := openAPI()["paths"].(object)
+	described := map[string]bool{}
+	for _, route := range r.Routes() {
+		key := route.Method + " " + route.Path
+		if undocumented[key] || undocumented["ANY "+route.Path] {
+			continue
+		}
+		// the trailing slash form of handleBoth
+		path := ginParam.ReplaceAllString(strings.TrimSuffix(route.Path, "/"), "{$1}")
+		item, ok := paths[path].(object)
+		if !ok || item[strings.ToLower(route.Method)] == nil {
+			t.Errorf("%s is missing from the OpenAPI document", key)
+		}
+		described[strings.ToLower(route.Method)+" "+path] = true
+	}
+	// and nothing is described that isn't served
+	for path, item := range paths {
+		for method := range item.(object) {
+			if !described[method+" "+path] {
+				t.Errorf("the OpenAPI document describes %s %s, which isn't served", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
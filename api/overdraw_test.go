@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// sendResult is the answer to one of the concurrent sends of the stress
+// test.
+type sendResult struct {
+	amount decimal.Decimal
+	status int
+	code   string
+}
+
+// sendConcurrently fires a send of each amount from AAAAAA to BBBBBB at
+// once through ts.
+func sendConcurrently(t *testing.T, ts *httptest.Server, amounts []string) []sendResult {
+	t.Helper()
+	results := make([]sendResult, len(amounts))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, amount := range amounts {
+		wg.Add(1)
+		go func(i int, amount string) {
+			defer wg.Done()
+			<-start
+			results[i].amount = decimal.RequireFromString(amount)
+			res, err := http.Post(ts.URL+"/api/v1/wallet/AAAAAA/send", "application/json",
+				strings.NewReader(`{"to":"BBBBBB","amount":"`+amount+`"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			results[i].status = res.StatusCode
+			if res.StatusCode != http.StatusOK {
+				var e ErrorResponse
+				json.Unmarshal(body, &e)
+				results[i].code = e.Code
+			}
+		}(i, amount)
+	}
+	close(start)
+	wg.Wait()
+	return results
+}
+
+// TestConcurrentSendsCannotOverdraw fires concurrent sends from one wallet
+// adding up to more than its balance, on both ways a transfer is applied,
+// and checks that exactly those the balance covers go through: the others
+// are refused with insufficient_funds, and only when the balance left
+// couldn't cover them.
+func TestConcurrentSendsCannotOverdraw(t *testing.T) {
+	equal := make([]string, 40)
+	for i := range equal {
+		equal[i] = "7"
+	}
+	var mixed []string
+	for i := 0; i < 40; i++ {
+		mixed = append(mixed, fmt.Sprintf("%d.%02d", 1+i%9, i*7%100))
+	}
+	for _, returning := range []bool{true, false} {
+		for _, amounts := range []struct {
+			name    string
+			amounts []string
+		}{{"equal", equal}, {"mixed", mixed}} {
+			t.Run(fmt.Sprintf("returning=%v/%s", returning, amounts.name), func(t *testing.T) {
+				db := openTestStore(t)
+				if err := db.DetectReturning(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if returning && !db.Returning {
+					t.Skip("no UPDATE ... RETURNING")
+				}
+				db.Returning = returning
+				seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+				ts := httptest.NewServer(newTestRouter(t, db, testConfig(t)))
+				defer ts.Close()
+
+				results := sendConcurrently(t, ts, amounts.amounts)
+				sent := decimal.Zero
+				var refused []decimal.Decimal
+				for _, r := range results {
+					switch {
+					case r.status == http.StatusOK:
+						sent = sent.Add(r.amount)
+					case r.status == http.StatusUnprocessableEntity && r.code == "insufficient_funds":
+						refused = append(refused, r.amount)
+					default:
+						t.Errorf("send of %s: %d %s", r.amount, r.status, r.code)
+					}
+				}
+				if len(refused) == 0 {
+					t.Fatal("every send went through, the amounts don't exceed the balance")
+				}
+
+				balance := walletBalance(t, db, "AAAAAA")
+				if balance.IsNegative() || !balance.Equal(decimal.NewFromInt(100).Sub(sent)) {
+					t.Fatalf("balance %s after sending %s of 100", balance, sent)
+				}
+				if got := walletBalance(t, db, "BBBBBB"); !got.Equal(decimal.NewFromInt(100).Add(sent)) {
+					t.Fatalf("recipient balance %s after receiving %s", got, sent)
+				}
+				// the balance only went down, so a refused send found at most
+				// as much as is left: covering it would have left nothing
+				for _, amount := range refused {
+					if amount.LessThan(balance) {
+						t.Errorf("a send of %s was refused, the %s left covers it", amount, balance)
+					}
+				}
+				if amounts.name == "equal" && len(refused) != 26 {
+					t.Errorf("%d sends of 7 from 100 refused, want 26", len(refused))
+				}
+
+				completed, err := db.History(context.Background(), "AAAAAA", store.HistoryFilter{Status: store.StatusCompleted})
+				if err != nil || len(completed) != len(results)-len(refused) {
+					t.Fatalf("%d completed transactions recorded, %v", len(completed), err)
+				}
+			})
+		}
+	}
+}
+
+// walletBalance returns the balance of the wallet id of db.
+func walletBalance(t *testing.T, db *store.DB, id string) decimal.Decimal {
+	t.Helper()
+	w, err := db.GetWallet(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Balance
+}
@@ -0,0 +1,158 @@
+// Package api is the HTTP interface of the service.
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/metrics"
+	"kordimion/secure-web-service/ops"
+)
+
+// Handlers are the handlers NewRouter registers.
+type Handlers struct {
+	Wallets *WalletHandler
+	Admin   *AdminHandler
+	Info    *InfoHandler
+	// Webhooks is only used with the webhooks feature.
+	Webhooks *WebhookHandler
+	// Live is only used with the websocket feature.
+	Live *LiveHandler
+	// Maintenance refuses the requests that change wallets while enabled.
+	Maintenance *MaintenanceMode
+	// Health refuses the wallet requests while the database is unhealthy,
+	// nil when it isn't monitored.
+	Health *ops.DBHealth
+	// Metrics serves the Prometheus metrics and gets those of the API,
+	// only used with cfg.Metrics.
+	Metrics *metrics.Registry
+}
+
+// NewRouter registers the handlers' methods on a new engine. Every request
+// first goes through cfg.Middleware in order; the known members are
+// recovery, request_id, trace_context and access_log. Endpoints of disabled features
+// aren't registered.
+func NewRouter(h Handlers, logger *slog.Logger, cfg config.Config) (*gin.Engine, error) {
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for _, name := range cfg.Middleware {
+		m, err := middleware(name, logger, cfg, h.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		r.Use(m)
+	}
+	logger.Info("middleware chain", "mode", gin.Mode(), "chain", strings.Join(cfg.Middleware, " -> "))
+
+	r.GET("/openapi.json", openAPIHandler(openAPI()))
+	if cfg.APIDocs {
+		r.GET("/docs", docsHandler)
+	}
+	r.GET("/api/v1/version", h.Info.Version)
+	r.GET("/readyz", h.Info.Ready)
+	r.GET("/healthz", h.Info.Health)
+
+	v1Admin := r.Group("/api/v1/admin")
+	// admin endpoints have no time limits, see config.HTTPWriteTimeout
+	v1Admin.Use(ipAllowlist(cfg.AdminAllowedNets, logger), noDeadlines)
+	{
+		v1Admin.POST("backup", h.Admin.Backup)
+		v1Admin.POST("maintenance", h.Admin.Maintenance)
+		v1Admin.GET("maintenance", h.Admin.MaintenanceMode)
+		v1Admin.PUT("maintenance", h.Admin.SetMaintenanceMode)
+		v1Admin.POST("integrity-check", h.Admin.IntegrityCheck)
+		v1Admin.GET("integrity-check", h.Admin.IntegrityCheckResult)
+		v1Admin.GET("export", h.Admin.Export)
+		if cfg.Features.Enabled(config.FeatureImport) {
+			v1Admin.POST("import", h.Admin.Import)
+		}
+		v1Admin.GET("loglevel", h.Admin.LogLevel)
+		v1Admin.PUT("loglevel", h.Admin.SetLogLevel)
+		v1Admin.GET("features", h.Admin.Features)
+		v1Admin.GET("jobs", h.Admin.Jobs)
+		v1Admin.GET("outbox", h.Admin.Outbox)
+		v1Admin.POST("outbox/:id/redrive", h.Admin.RedriveEvent)
+	}
+
+	bounded, send := timeout(cfg.RequestTimeout, cfg.ClientDeadlineMax), timeout(cfg.SendTimeout, cfg.ClientDeadlineMax)
+	// on the main listener the debug endpoints are for admins only, see
+	// config.DebugAddr for serving them on their own
+	if cfg.DebugEndpoints && cfg.DebugAddr == "" {
+		debug := r.Group("/debug", ipAllowlist(cfg.AdminAllowedNets, logger))
+		debug.Any("/*path", gin.WrapH(DebugHandler()))
+	}
+
+	if cfg.Metrics {
+		r.GET("/metrics", ipAllowlist(cfg.AdminAllowedNets, logger), gin.WrapH(h.Metrics))
+	}
+
+	if cfg.AdminUI {
+		ui := r.Group("/admin/ui", ipAllowlist(cfg.AdminAllowedNets, logger))
+		ui.GET("/*path", uiHandler())
+	}
+
+	v1 := r.Group("/api/v1/wallet", refuseUnhealthy(h.Health, cfg.DBHealthInterval))
+	{
+		handleBoth(v1, http.MethodPost, "", h.Maintenance.refuse, bounded, h.Wallets.Create)
+		handleBoth(v1, http.MethodPost, ":walletid/send", h.Maintenance.refuse, send, h.Wallets.Send)
+		handleBoth(v1, http.MethodGet, ":walletid/history", bounded, h.Wallets.History)
+		handleBoth(v1, http.MethodGet, ":walletid", bounded, h.Wallets.Get)
+		if cfg.Features.Enabled(config.FeatureWebhooks) {
+			handleBoth(v1, http.MethodPost, ":walletid/webhooks", h.Maintenance.refuse, bounded, h.Webhooks.Create)
+			handleBoth(v1, http.MethodGet, ":walletid/webhooks", bounded, h.Webhooks.List)
+			handleBoth(v1, http.MethodDelete, ":walletid/webhooks/:id", h.Maintenance.refuse, bounded, h.Webhooks.Delete)
+			handleBoth(v1, http.MethodGet, ":walletid/webhooks/:id/deliveries", bounded, h.Webhooks.Deliveries)
+		}
+		if cfg.Features.Enabled(config.FeatureAsyncTransfers) {
+			handleBoth(v1, http.MethodGet, ":walletid/transfers/:id", bounded, h.Wallets.Transfer)
+		}
+		if cfg.Features.Enabled(config.FeatureWebSocket) {
+			// long lived, so not bounded; shutdown ends it through the hub
+			handleBoth(v1, http.MethodGet, ":walletid/ws", h.Live.WebSocket)
+		}
+	}
+	// in the usual error shape, and written inside the chain so the access log sees it
+	r.NoRoute(func(c *gin.Context) {
+		abortWithError(c, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	for route := range cfg.AccessLogSampleRates {
+		if !hasRoute(r, route) {
+			return nil, fmt.Errorf("ACCESS_LOG_SAMPLE_RATES: no route %s", route)
+		}
+	}
+	return r, nil
+}
+
+// handleBoth registers handlers for path with and without a trailing
+// slash. Otherwise gin answers the other form with a redirect, which
+// clients don't follow for every method, and not at all for a POST body.
+func handleBoth(g *gin.RouterGroup, method, path string, handlers ...gin.HandlerFunc) {
+	g.Handle(method, path, handlers...)
+	g.Handle(method, path+"/", handlers...)
+}
+
+// routeOf is the route of a request, the same for both forms registered
+// by handleBoth.
+func routeOf(c *gin.Context) string {
+	route := c.FullPath()
+	if len(route) > 1 {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+// hasRoute reports whether r has the route "METHOD /path".
+func hasRoute(r *gin.Engine, route string) bool {
+	for _, info := range r.Routes() {
+		if info.Method+" "+info.Path == route {
+			return true
+		}
+	}
+	return false
+}
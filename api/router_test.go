@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/jobs"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
+)
+
+// openTestStore opens a migrated SQLite database in a temporary directory.
+func openTestStore(t *testing.T) *store.DB {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestRouter wires every handler on db the way the server does, with
+// the clock stopped at testTime and the admin endpoints open to the
+// network of httptest.NewRequest's client, 192.0.2.1.
+func newTestRouter(t *testing.T, db *store.DB, cfg config.Config) *gin.Engine {
+	t.Helper()
+	_, testNet, _ := net.ParseCIDR("192.0.2.0/24")
+	cfg.AdminAllowedNets = []*net.IPNet{testNet}
+	r, err := NewRouter(testHandlers(t, db, cfg), discardLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testHandlers returns the handlers of a router serving db.
+func testHandlers(t *testing.T, db *store.DB, cfg config.Config) Handlers {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	mode, err := NewMaintenanceMode(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := discardLogger()
+	hub := NewBalanceHub(cfg.WebSocketMaxPerWallet)
+	return Handlers{
+		Wallets:     NewWalletHandler(db, fixedClock(testTime), hub, logger, cfg),
+		Admin:       NewAdminHandler(db, mode, jobs.NewRunner(logger), ops.NewIntegrity(db), logger, new(slog.LevelVar), cfg),
+		Info:        NewInfoHandler(db, nil, version.Info{Version: "test"}, logger, new(slog.LevelVar)),
+		Webhooks:    NewWebhookHandler(db, logger, cfg),
+		Live:        NewLiveHandler(db, hub, logger, cfg),
+		Maintenance: mode,
+	}
+}
+
+// seedWallets creates wallets with the given ids and balances.
+func seedWallets(t *testing.T, db *store.DB, wallets ...store.Wallet) {
+	t.Helper()
+	for _, w := range wallets {
+		w.CreatedAt = sql.NullTime{Time: testTime, Valid: true}
+		if err := db.CreateWallet(context.Background(), w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRouterGolden pins the answers of the whole HTTP surface, in order,
+// against a real database: the status and the exact body of each step.
+func TestRouterGolden(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	r := newTestRouter(t, db, testConfig(t))
+
+	steps := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{http.MethodGet, "/healthz", "", http.StatusOK, `{"status":"ok"}`},
+		{http.MethodGet, "/readyz", "", http.StatusOK, `{"status":"ready"}`},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA", "", http.StatusOK,
+			`{"balance":"100","created_at":"2024-03-01T12:00:00Z","id":"AAAAAA","transaction_count":0}`},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/", "", http.StatusOK,
+			`{"balance":"100","created_at":"2024-03-01T12:00:00Z","id":"AAAAAA","transaction_count":0}`},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"30.25"}`, http.StatusOK,
+			`{"balance":"69.75","id":"AAAAAA"}`},
+		{http.MethodPost, "/api/v1/wallet/BBBBBB/send/", `{"to":"AAAAAA","amount":5}`, http.StatusOK,
+			`{"balance":"125.25","id":"BBBBBB"}`},
+		// at the same time, the store orders by sender
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/history", "", http.StatusOK,
+			`[{"from":"AAAAAA","to":"BBBBBB","amount":"30.25","time":"2024-03-01T12:00:00Z","status":"completed","balance_after":"69.75"},` +
+				`{"from":"BBBBBB","to":"AAAAAA","amount":"5","time":"2024-03-01T12:00:00Z","status":"completed","balance_after":"74.75"}]`},
+		{http.MethodGet, "/api/v1/wallet/BBBBBB", "", http.StatusOK,
+			`{"balance":"125.25","created_at":"2024-03-01T12:00:00Z","id":"BBBBBB","transaction_count":2}`},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":1000}`, http.StatusUnprocessableEntity,
+			`{"code":"insufficient_funds","error":"insufficient funds"}`},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"ZZZZZZ","amount":1}`, http.StatusBadRequest,
+			`{"code":"recipient_not_found","error":"recipient wallet not found"}`},
+		{http.MethodGet, "/api/v1/wallet/ZZZZZZ", "", http.StatusNotFound,
+			`{"code":"wallet_not_found","error":"wallet not found"}`},
+		{http.MethodGet, "/api/v1/wallet/ZZZZZZ/history", "", http.StatusNotFound,
+			`{"code":"wallet_not_found","error":"wallet not found"}`},
+		{http.MethodGet, "/api/v1/nothing", "", http.StatusNotFound,
+			`{"code":"not_found","error":"no such endpoint"}`},
+		{http.MethodGet, "/api/v1/admin/maintenance", "", http.StatusOK,
+			`{"enabled":false}`},
+	}
+	for _, s := range steps {
+		w := serve(r, s.method, s.path, s.body)
+		if w.Code != s.status || w.Body.String() != s.want {
+			t.Fatalf("%s %s:\ngot  %d %s\nwant %d %s", s.method, s.path, w.Code, w.Body, s.status, s.want)
+		}
+	}
+}
+
+// TestTrailingSlash replays the wallet routes with and without a trailing
+// slash on databases in the same state and checks both forms answer the
+// same, and neither with a redirect.
+func TestTrailingSlash(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true, config.FeatureAsyncTransfers: true}
+	requests := []struct {
+		method, path, body string
+		// random fields of the answer
+		volatile []string
+	}{
+		{http.MethodPost, "/api/v1/wallet", "", []string{"id"}},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA", "", nil},
+		{http.MethodGet, "/api/v1/wallet/ZZZZZZ", "", nil},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1.5"}`, nil},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1000"}`, nil},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/history", "", nil},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`, []string{"secret", "created_at"}},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks", "", []string{"created_at"}},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks/1/deliveries", "", nil},
+		{http.MethodDelete, "/api/v1/wallet/AAAAAA/webhooks/1", "", nil},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/1", "", nil},
+	}
+	// replay answers the requests in order, the paths ending with slash
+	replay := func(slash string) []string {
+		db := openTestStore(t)
+		seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+		r := newTestRouter(t, db, cfg)
+		var answers []string
+		for _, req := range requests {
+			w := serve(r, req.method, req.path+slash, req.body)
+			if w.Code >= 300 && w.Code < 400 {
+				t.Errorf("%s %s%s: redirected with %d", req.method, req.path, slash, w.Code)
+			}
+			body := w.Body.String()
+			if req.volatile != nil {
+				var objects []map[string]any
+				if err := json.Unmarshal(w.Body.Bytes(), &objects); err != nil {
+					objects = make([]map[string]any, 1)
+					json.Unmarshal(w.Body.Bytes(), &objects[0])
+				}
+				for _, fields := range objects {
+					for _, name := range req.volatile {
+						delete(fields, name)
+					}
+				}
+				b, _ := json.Marshal(objects)
+				body = string(b)
+			}
+			answers = append(answers, fmt.Sprintf("%s %s: %d %s", req.method, req.path, w.Code, body))
+		}
+		return answers
+	}
+	without, with := replay(""), replay("/")
+	for i := range without {
+		if without[i] != with[i] {
+			t.Errorf("without the slash: %s\nwith it: %s", without[i], with[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+)
+
+// sampling is the sampling decision of a request, made once by the access
+// log and kept in the request's context so every line of the request
+// follows it.
+type sampling struct {
+	// rate keeps 1 in rate requests of the route
+	rate int
+	keep bool
+}
+
+type samplingKey struct{}
+
+func withSampling(ctx context.Context, s sampling) context.Context {
+	return context.WithValue(ctx, samplingKey{}, s)
+}
+
+// sample decides whether a request of a route sampled at rate is logged.
+// The decision is a hash of the request id when there is one, so that
+// services sharing request ids keep the same requests.
+func sample(requestId string, rate int) sampling {
+	if rate <= 1 {
+		return sampling{rate: 1, keep: true}
+	}
+	if requestId == "" {
+		return sampling{rate: rate, keep: rand.Intn(rate) == 0}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(requestId))
+	return sampling{rate: rate, keep: h.Sum32()%uint32(rate) == 0}
+}
+
+// samplingAttrs mark a line of a sampled route: sampled lines stand for
+// sample_rate lines, the others for themselves.
+func samplingAttrs(s sampling) []slog.Attr {
+	rate := 1
+	if s.keep {
+		rate = s.rate
+	}
+	return []slog.Attr{slog.Bool("sampled", s.keep), slog.Int("sample_rate", rate)}
+}
+
+// SamplingHandler drops the lines below warn logged with the context of a
+// request the access log sampled out, see ACCESS_LOG_SAMPLE_RATES, and
+// marks those of a sampled request. Lines logged without a request's
+// context aren't sampled.
+type SamplingHandler struct {
+	slog.Handler
+}
+
+func (h SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	s, ok := ctx.Value(samplingKey{}).(sampling)
+	if !ok || s.rate <= 1 || r.Level >= slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	if !s.keep {
+		return nil
+	}
+	r = r.Clone()
+	r.AddAttrs(samplingAttrs(s)...)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return SamplingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h SamplingHandler) WithGroup(name string) slog.Handler {
+	return SamplingHandler{h.Handler.WithGroup(name)}
+}
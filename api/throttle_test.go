@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/ops"
+)
+
+// throttled checks that w is a throttling response with the code and the
+// hint retryAfter, in the shape every producer shares.
+func throttled(t *testing.T, name string, w *httptest.ResponseRecorder, status int, code, retryAfter string, retryAfterMs float64) {
+	t.Helper()
+	var fields map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("%s: %s", name, w.Body)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if w.Code != status || strings.Join(keys, ",") != "code,error,retry_after_ms" {
+		t.Errorf("%s: %d with fields %s", name, w.Code, keys)
+	}
+	if fields["code"] != code || fields["retry_after_ms"] != retryAfterMs || w.Header().Get("Retry-After") != retryAfter {
+		t.Errorf("%s: %s with Retry-After %q", name, w.Body, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestThrottledResponses(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaintenanceRetryAfter = 1500 * time.Millisecond
+	mode, err := NewMaintenanceMode(openTestStore(t), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mode.Set(true, "upgrading"); err != nil {
+		t.Fatal(err)
+	}
+
+	down := openTestStore(t)
+	health := ops.NewDBHealth(down, 1, time.Second, discardLogger(), nil)
+	down.Close()
+	health.Check(context.Background())
+	if health.Healthy() {
+		t.Fatal("a closed database is healthy")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/maintenance", mode.refuse, ok)
+	r.GET("/unhealthy", refuseUnhealthy(health, 1500*time.Millisecond), ok)
+	r.GET("/short", func(c *gin.Context) {
+		abortThrottled(c, http.StatusTooManyRequests, "rate_limited", "slow down", 10*time.Millisecond)
+	})
+
+	// every producer answers in the same shape, the hint rounded up to
+	// whole seconds in the header
+	w := serve(r, http.MethodGet, "/maintenance", "")
+	throttled(t, "maintenance", w, http.StatusServiceUnavailable, "maintenance", "2", 1500)
+	w = serve(r, http.MethodGet, "/unhealthy", "")
+	throttled(t, "unhealthy database", w, http.StatusServiceUnavailable, "database_unavailable", "2", 1500)
+	// and never less than a second
+	w = serve(r, http.MethodGet, "/short", "")
+	throttled(t, "short hint", w, http.StatusTooManyRequests, "rate_limited", "1", 1000)
+}
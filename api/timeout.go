@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timeoutWriter replaces the response of a request that failed because
+// its deadline passed with a 504: the first write after the deadline is
+// replaced when the handler recorded a context error with c.Error, as
+// abortInternalError does, and dropped along with the rest. Any other
+// response goes through even after the deadline, as it may report a
+// transfer that committed just before the store noticed the deadline. The
+// handler runs on the request's goroutine, so there is only ever one
+// writer.
+type timeoutWriter struct {
+	gin.ResponseWriter
+	c   *gin.Context
+	ctx context.Context
+	// response is the body of the 504
+	response ErrorResponse
+	timedOut bool
+}
+
+// check writes the 504 if the deadline passed, the response hasn't
+// started and the handler failed because of the deadline, or wrote
+// nothing at all.
+func (w *timeoutWriter) check(done bool) {
+	if w.timedOut || w.ResponseWriter.Written() || w.ctx.Err() == nil {
+		return
+	}
+	if !done && !deadlineError(w.c) {
+		return
+	}
+	w.timedOut = true
+	body, _ := json.Marshal(w.response)
+	w.ResponseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	w.ResponseWriter.Write(body)
+}
+
+// deadlineError reports whether one of the errors the handler recorded
+// is a context's deadline or cancelation.
+func deadlineError(c *gin.Context) bool {
+	for _, err := range c.Errors {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if !w.timedOut {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	w.check(false)
+	if !w.timedOut {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.check(false)
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	w.check(false)
+	if w.timedOut {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Unwrap lets http.ResponseController reach the connection under the
+// gin writer.
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// noDeadlines clears the read and write deadlines the server sets from
+// config.HTTPReadTimeout and HTTPWriteTimeout, for endpoints that take
+// their time on purpose, like export and import streaming whole databases.
+func noDeadlines(c *gin.Context) {
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	c.Next()
+}
+
+// The headers a caller bounds its request with, see clientDeadline.
+const (
+	deadlineHeader  = "X-Request-Deadline"
+	timeoutMsHeader = "X-Request-Timeout-Ms"
+)
+
+// timeout bounds a request to d, or to the deadline the caller sent if
+// that is sooner, see clientDeadline. The store gives up on the context's
+// deadline, rolling back a transfer in progress, and the handler's answer
+// to the context error becomes a 504: timeout when d ran out and
+// deadline_exceeded when the caller's deadline did. A transfer that
+// committed just before the deadline is answered as usual, so a transfer
+// answered with a 504 was rolled back. Zero disables the server's
+// timeout; a caller's deadline is still honoured.
+func timeout(d, deadlineLimit time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := d
+		response := ErrorResponse{Code: "timeout", Message: "the request took too long"}
+		callerLimit, ok, err := clientDeadline(c, time.Now(), deadlineLimit)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if ok && (limit <= 0 || callerLimit < limit) {
+			limit = callerLimit
+			response = ErrorResponse{Code: "deadline_exceeded", Message: "the deadline of the request passed"}
+		}
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), limit)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		w := &timeoutWriter{ResponseWriter: c.Writer, c: c, ctx: ctx, response: response}
+		c.Writer = w
+
+		c.Next()
+
+		w.check(true)
+		c.Writer = w.ResponseWriter
+	}
+}
+
+// clientDeadline returns how long the caller gives the request, from an
+// RFC 3339 X-Request-Deadline or an X-Request-Timeout-Ms, the sooner of
+// the two if it sent both. It is clamped between a millisecond and limit;
+// a deadline that has passed already is an error. ok is false when the
+// caller sent neither.
+func clientDeadline(c *gin.Context, now time.Time, limit time.Duration) (d time.Duration, ok bool, err error) {
+	if v := c.GetHeader(deadlineHeader); v != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %q is not an RFC 3339 time", deadlineHeader, v)
+		}
+		if !deadline.After(now) {
+			return 0, false, fmt.Errorf("%s: %s has passed", deadlineHeader, v)
+		}
+		d, ok = deadline.Sub(now), true
+	}
+	if v := c.GetHeader(timeoutMsHeader); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			return 0, false, fmt.Errorf("%s: %q is not a positive number of milliseconds", timeoutMsHeader, v)
+		}
+		// clamped before converting, so a huge number can't overflow
+		timeout := time.Duration(min(ms, limit.Milliseconds()+1)) * time.Millisecond
+		if !ok || timeout < d {
+			d, ok = timeout, true
+		}
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	return min(max(d, time.Millisecond), limit), true, nil
+}
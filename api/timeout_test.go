@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// slowRepo is a memRepo whose reads take delay, or until their context
+// is done.
+type slowRepo struct {
+	*memRepo
+	delay time.Duration
+}
+
+func (r slowRepo) GetWallet(ctx context.Context, id string) (store.Wallet, error) {
+	select {
+	case <-time.After(r.delay):
+		return r.memRepo.GetWallet(ctx, id)
+	case <-ctx.Done():
+		return store.Wallet{}, ctx.Err()
+	}
+}
+
+func timeoutRouter(t *testing.T, repo store.WalletRepository, d time.Duration) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t))
+	r.GET("/api/v1/wallet/:walletid", timeout(d, time.Minute), h.Get)
+	return r
+}
+
+func TestTimeout(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100))
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		header string
+		status int
+		code   string
+	}{
+		{"in time", 0, "", http.StatusOK, ""},
+		{"too slow", time.Second, "", http.StatusGatewayTimeout, "timeout"},
+		{"caller deadline", 200 * time.Millisecond, "20", http.StatusGatewayTimeout, "deadline_exceeded"},
+		{"invalid caller deadline", 0, "soon", http.StatusBadRequest, "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := timeoutRouter(t, slowRepo{repo, tt.delay}, 100*time.Millisecond)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/wallet/AAAAAA", nil)
+			if tt.header != "" {
+				req.Header.Set(timeoutMsHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			r.ServeHTTP(w, req)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("answered after %s", elapsed)
+			}
+			if tt.code == "" {
+				if w.Code != tt.status {
+					t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				return
+			}
+			decodeError(t, w, tt.status, tt.code)
+			// nothing the handler wrote after the 504 made it out
+			dec := json.NewDecoder(w.Body)
+			if err := dec.Decode(new(ErrorResponse)); err != nil || dec.More() {
+				t.Fatalf("not a single error body: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestTimeoutDisabled(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100))
+	r := timeoutRouter(t, slowRepo{repo, 50 * time.Millisecond}, 0)
+	if w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA", ""); w.Code != http.StatusOK {
+		t.Fatalf("status %d without a timeout: %s", w.Code, w.Body)
+	}
+}
+
+func TestTimeoutAndCallerDeadline(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100))
+	tests := []struct {
+		name             string
+		server, limit    time.Duration
+		header           string
+		code             string
+		earliest, latest time.Duration
+	}{
+		{"caller sooner", 200 * time.Millisecond, time.Minute, "20", "deadline_exceeded", 20 * time.Millisecond, 150 * time.Millisecond},
+		{"server sooner", 20 * time.Millisecond, time.Minute, "200", "timeout", 20 * time.Millisecond, 150 * time.Millisecond},
+		{"no server timeout", 0, time.Minute, "20", "deadline_exceeded", 20 * time.Millisecond, 150 * time.Millisecond},
+		{"caller clamped", 0, 30 * time.Millisecond, "60000", "deadline_exceeded", 30 * time.Millisecond, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			h := NewWalletHandler(slowRepo{repo, time.Second}, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t))
+			r.GET("/api/v1/wallet/:walletid", timeout(tt.server, tt.limit), h.Get)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/wallet/AAAAAA", nil)
+			req.Header.Set(timeoutMsHeader, tt.header)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			r.ServeHTTP(w, req)
+			if elapsed := time.Since(start); elapsed < tt.earliest || elapsed > tt.latest {
+				t.Errorf("answered after %s", elapsed)
+			}
+			decodeError(t, w, http.StatusGatewayTimeout, tt.code)
+		})
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		deadline, timeoutMs string
+		want                time.Duration
+		ok, err             bool
+	}{
+		{"", "", 0, false, false},
+		{"", "250", 250 * time.Millisecond, true, false},
+		{"2024-03-01T12:00:02Z", "", 2 * time.Second, true, false},
+		{"2024-03-01T12:00:00.0000001Z", "", time.Millisecond, true, false},
+		// the sooner of the two
+		{"2024-03-01T12:00:02Z", "500", 500 * time.Millisecond, true, false},
+		{"2024-03-01T12:00:00.1Z", "500", 100 * time.Millisecond, true, false},
+		// clamped to the limit of a minute
+		{"2024-03-01T13:00:00Z", "", time.Minute, true, false},
+		{"", "9223372036854775807", time.Minute, true, false},
+		{"2024-03-01T12:00:00Z", "", 0, false, true},
+		{"2024-03-01T11:00:00Z", "", 0, false, true},
+		{"tomorrow", "", 0, false, true},
+		{"", "0", 0, false, true},
+		{"", "-5", 0, false, true},
+		{"", "1.5", 0, false, true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.deadline != "" {
+			c.Request.Header.Set(deadlineHeader, tt.deadline)
+		}
+		if tt.timeoutMs != "" {
+			c.Request.Header.Set(timeoutMsHeader, tt.timeoutMs)
+		}
+		d, ok, err := clientDeadline(c, now, time.Minute)
+		if d != tt.want || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("deadline %q, timeout %q: %s, %t, %v", tt.deadline, tt.timeoutMs, d, ok, err)
+		}
+	}
+}
+
+// TestDeadlineRollsBackTransfer lets the caller's deadline pass in the
+// middle of a transfer, slowed down by a trigger after its debit and
+// credit. The transaction rolls back and the caller gets a 504.
+func TestDeadlineRollsBackTransfer(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	r := newTestRouter(t, db, testConfig(t))
+	ctx := context.Background()
+	_, err := db.Exec(`create trigger slow_insert after insert on wallet_transactions begin
+		select count(*) from (with recursive n(i) as (select 1 union all select i + 1 from n where i < 100000000) select i from n);
+		end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/wallet/AAAAAA/send", strings.NewReader(`{"to":"BBBBBB","amount":10}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timeoutMsHeader, "50")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("answered after %s", elapsed)
+	}
+	decodeError(t, w, http.StatusGatewayTimeout, "deadline_exceeded")
+
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if wallet, err := db.GetWallet(ctx, id); err != nil || wallet.Balance.String() != "100" {
+			t.Fatalf("%s after the rollback: %+v, %v", id, wallet, err)
+		}
+	}
+	if n, err := db.TransactionCount(ctx, "AAAAAA"); err != nil || n != 0 {
+		t.Fatalf("%d transactions after the rollback, %v", n, err)
+	}
+}
+
+// lateRepo is a memRepo whose transfers commit after delay, whatever
+// their context says by then.
+type lateRepo struct {
+	*memRepo
+	delay time.Duration
+}
+
+func (r lateRepo) Transfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (store.Transaction, error) {
+	time.Sleep(r.delay)
+	return r.memRepo.Transfer(context.Background(), from, to, amount, at)
+}
+
+// TestTimeoutAfterCommit lets the deadline pass while a transfer commits:
+// the money moved, so the client must get the handler's answer and not a
+// 504 it would retry. Only a handler failing with the context's error,
+// or writing nothing, is answered with a 504.
+func TestTimeoutAfterCommit(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewWalletHandler(lateRepo{repo, 50 * time.Millisecond}, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t))
+	r.POST("/api/v1/wallet/:walletid/send", timeout(10*time.Millisecond, time.Minute), h.Send)
+	r.GET("/conflict", timeout(10*time.Millisecond, time.Minute), func(c *gin.Context) {
+		time.Sleep(50 * time.Millisecond)
+		abortWithError(c, http.StatusConflict, "conflict", "refused after the deadline")
+	})
+	r.GET("/silent", timeout(10*time.Millisecond, time.Minute), func(c *gin.Context) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"10"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"balance":"90"`) {
+		t.Fatalf("committed transfer answered %d %s", w.Code, w.Body)
+	}
+	if wallet, err := repo.GetWallet(context.Background(), "AAAAAA"); err != nil || wallet.Balance.String() != "90" {
+		t.Fatalf("AAAAAA: %+v, %v", wallet, err)
+	}
+	decodeError(t, serve(r, http.MethodGet, "/conflict", ""), http.StatusConflict, "conflict")
+	decodeError(t, serve(r, http.MethodGet, "/silent", ""), http.StatusGatewayTimeout, "timeout")
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Timestamp is a time in a response. Every one the API writes is a
+// Timestamp, so they all look the same: RFC 3339 in whole seconds, in UTC
+// unless the client asked for another zone with tz, such as
+// "2024-01-02T16:04:05+01:00". An unknown time is null.
+type Timestamp struct {
+	t time.Time
+}
+
+// newTimestamp is t in loc. The zero time, which drivers return for a
+// NULL or a date they can't read, is unknown.
+func newTimestamp(t time.Time, loc *time.Location) Timestamp {
+	if t.IsZero() {
+		return Timestamp{}
+	}
+	return Timestamp{t: t.In(loc)}
+}
+
+func (ts Timestamp) MarshalJSON() ([]byte, error) {
+	if ts.t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(ts.t.Format(time.RFC3339))
+}
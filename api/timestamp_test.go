@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+func TestTimestampMarshalJSON(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		loc  *time.Location
+		want string
+	}{
+		{time.Date(2024, 1, 2, 15, 4, 5, 999, time.UTC), time.UTC, `"2024-01-02T15:04:05Z"`},
+		{time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), berlin, `"2024-01-02T16:04:05+01:00"`},
+		{time.Date(2024, 7, 2, 15, 4, 5, 0, time.UTC), berlin, `"2024-07-02T17:04:05+02:00"`},
+		{time.Date(2024, 1, 2, 16, 4, 5, 0, berlin), time.UTC, `"2024-01-02T15:04:05Z"`},
+		{time.Time{}, berlin, `null`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(newTimestamp(tt.t, tt.loc))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s in %s = %s, %v, want %s", tt.t, tt.loc, got, err, tt.want)
+		}
+	}
+}
+
+// TestHistoryTimeZone reads a history spanning both DST changes of 2026
+// in Europe/Berlin: each time must get the offset of its own moment, not
+// the one of the first row or of the request.
+func TestHistoryTimeZone(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	for _, at := range []time.Time{
+		time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+	} {
+		if _, err := db.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.NewFromInt(1), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newTestRouter(t, db, testConfig(t))
+
+	times := func(query string) []string {
+		t.Helper()
+		w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("history%s: %d %s", query, w.Code, w.Body)
+		}
+		var rows []struct {
+			Time string `json:"time"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var times []string
+		for _, row := range rows {
+			times = append(times, row.Time)
+		}
+		return times
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"2026-10-25T01:30:00Z", "2026-10-25T00:30:00Z", "2026-03-29T01:30:00Z", "2026-03-29T00:30:00Z"}},
+		{"?tz=UTC", []string{"2026-10-25T01:30:00Z", "2026-10-25T00:30:00Z", "2026-03-29T01:30:00Z", "2026-03-29T00:30:00Z"}},
+		// 02:30 comes twice in October, only the offset tells them apart
+		{"?tz=Europe/Berlin", []string{"2026-10-25T02:30:00+01:00", "2026-10-25T02:30:00+02:00", "2026-03-29T03:30:00+02:00", "2026-03-29T01:30:00+01:00"}},
+		{"?tz=America/New_York", []string{"2026-10-24T21:30:00-04:00", "2026-10-24T20:30:00-04:00", "2026-03-28T21:30:00-04:00", "2026-03-28T20:30:00-04:00"}},
+	}
+	for _, tt := range tests {
+		got := times(tt.query)
+		if len(got) != len(tt.want) {
+			t.Fatalf("history%s: %v", tt.query, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("history%s: time %d = %s, want %s", tt.query, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	for _, tz := range []string{"Europe/Nowhere", "Local", "+02:00", "../../etc/passwd"} {
+		body := decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history?tz="+url.QueryEscape(tz), ""), http.StatusBadRequest, "invalid_request")
+		if body.Message != `tz: "`+tz+`" is not an IANA time zone` {
+			t.Errorf("tz=%s: %s", tz, body.Message)
+		}
+	}
+}
+
+// timestampFormat is how every time of a response looks, in UTC or with
+// the offset of the zone asked for, in whole seconds.
+var timestampFormat = regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(Z|[+-]\d\d:\d\d)$`)
+
+// TestTimestampsAcrossEndpoints makes times with nanoseconds in a zone
+// other than UTC and reads them back from every endpoint writing times:
+// all of them must write the same string for the same moment.
+func TestTimestampsAcrossEndpoints(t *testing.T) {
+	db := openTestStore(t)
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebSocket: true, config.FeatureWebhooks: true, config.FeatureAsyncTransfers: true}
+	_, testNet, _ := net.ParseCIDR("192.0.2.0/24")
+	cfg.AdminAllowedNets = []*net.IPNet{testNet}
+	at := time.Date(2024, 3, 1, 13, 0, 0, 123456789, time.FixedZone("CET", 60*60))
+	h := testHandlers(t, db, cfg)
+	hub := NewBalanceHub(cfg.WebSocketMaxPerWallet)
+	h.Wallets = NewWalletHandler(db, fixedClock(at), hub, discardLogger(), cfg)
+	h.Live = NewLiveHandler(db, hub, discardLogger(), cfg)
+	r, err := NewRouter(h, discardLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	do := func(method, path, body string, header ...string) map[string]any {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var v any
+		if err := json.NewDecoder(res.Body).Decode(&v); err != nil || res.StatusCode >= 300 {
+			t.Fatalf("%s %s: %d %v", method, path, res.StatusCode, err)
+		}
+		if rows, ok := v.([]any); ok {
+			return rows[0].(map[string]any)
+		}
+		return v.(map[string]any)
+	}
+
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(context.Background(), store.Wallet{Id: id, Balance: decimal.NewFromInt(100),
+			CreatedAt: sql.NullTime{Time: at, Valid: true}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := dial(t, ts, "AAAAAA")
+	receive(t, ws)
+	do(http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1"}`)
+	var live struct {
+		Time string `json:"time"`
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &live); err != nil {
+		t.Fatal(err)
+	}
+	queued := do(http.MethodPost, "/api/v1/wallet/AAAAAA/send?async=true", `{"to":"BBBBBB","amount":"2"}`)
+	pending, err := db.QueuedTransfers(context.Background(), 10)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("queued transfers: %v, %v", pending, err)
+	}
+	if _, err := db.ApplyQueuedTransfer(context.Background(), pending[0], at); err != nil {
+		t.Fatal(err)
+	}
+	processed := do(http.MethodGet, queued["status_url"].(string), "")
+	hook := do(http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`)
+
+	const want = "2024-03-01T12:00:00Z"
+	times := []struct {
+		name string
+		got  any
+		want string
+	}{
+		{"wallet created_at", do(http.MethodGet, "/api/v1/wallet/AAAAAA", "")["created_at"], want},
+		{"history time", do(http.MethodGet, "/api/v1/wallet/AAAAAA/history", "")["time"], want},
+		{"history time in Berlin", do(http.MethodGet, "/api/v1/wallet/AAAAAA/history?tz=Europe/Berlin", "")["time"], "2024-03-01T13:00:00+01:00"},
+		{"live time", live.Time, want},
+		{"queued created_at", queued["created_at"], want},
+		{"processed created_at", processed["created_at"], want},
+		{"processed processed_at", processed["processed_at"], want},
+		// made with the time of the store, only its format is known
+		{"webhook created_at", hook["created_at"], ""},
+		{"webhooks created_at", do(http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks", "")["created_at"], ""},
+	}
+	for _, tt := range times {
+		s, _ := tt.got.(string)
+		if !timestampFormat.MatchString(s) || tt.want != "" && s != tt.want {
+			t.Errorf("%s = %v, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
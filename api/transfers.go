@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// QueuedTransferDTO is a transfer asked for asynchronously. Reason is the
+// error code of a failed transfer and Balance the sender's balance right
+// after a completed one.
+type QueuedTransferDTO struct {
+	Id          int64      `json:"id"`
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Amount      Money      `json:"amount"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"failure_reason,omitempty"`
+	CreatedAt   Timestamp  `json:"created_at"`
+	ProcessedAt *Timestamp `json:"processed_at,omitempty"`
+	Balance     *Money     `json:"balance,omitempty"`
+	StatusURL   string     `json:"status_url"`
+}
+
+func (h *WalletHandler) newQueuedTransferDTO(q store.QueuedTransfer) QueuedTransferDTO {
+	dto := QueuedTransferDTO{
+		Id:        q.Id,
+		From:      q.FromId,
+		To:        q.ToId,
+		Amount:    h.money.of(q.Amount),
+		Status:    q.Status,
+		Reason:    q.FailureReason,
+		CreatedAt: newTimestamp(q.CreatedAt, time.UTC),
+		StatusURL: transferStatusURL(q.FromId, q.Id),
+	}
+	if q.ProcessedAt.Valid {
+		ts := newTimestamp(q.ProcessedAt.Time, time.UTC)
+		dto.ProcessedAt = &ts
+	}
+	if q.FromBalance.Valid {
+		balance := h.money.of(q.FromBalance.Decimal)
+		dto.Balance = &balance
+	}
+	return dto
+}
+
+// transferStatusURL is the path of GET /api/v1/wallet/:walletid/transfers/:id.
+func transferStatusURL(walletId string, id int64) string {
+	return fmt.Sprintf("/api/v1/wallet/%s/transfers/%d", walletId, id)
+}
+
+// asyncRequested reports whether a send asked to be asynchronous, with
+// async=true or the respond-async preference, and whether it was the
+// preference. Anything but a boolean for async aborts the request with
+// a validation_failed.
+func asyncRequested(c *gin.Context) (async, preferred, ok bool) {
+	for _, header := range c.Request.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				preferred = true
+			}
+		}
+	}
+	if v := c.Query("async"); v != "" {
+		var err error
+		async, err = strconv.ParseBool(v)
+		if err != nil {
+			abortValidation(c, []FieldDetail{{Field: "async", Reason: "must be a boolean"}})
+			return false, false, false
+		}
+	}
+	return async || preferred, preferred, true
+}
+
+// enqueue queues the transfer of a send for the transfer queue and
+// answers 202 with where to poll for its outcome. Only an unknown sender
+// and an amount the store can't hold are refused right away, the rest
+// is found out when the transfer is applied.
+func (h *WalletHandler) enqueue(c *gin.Context, fromId, toId string, amount decimal.Decimal, preferred bool) {
+	q, err := h.store.EnqueueTransfer(c.Request.Context(), fromId, toId, amount, h.clock.Now())
+	if err != nil {
+		h.abortTransferError(c, fromId, toId, amount.String(), err)
+		return
+	}
+	dto := h.newQueuedTransferDTO(q)
+	c.Header("Location", dto.StatusURL)
+	if preferred {
+		c.Header("Preference-Applied", "respond-async")
+	}
+	c.JSON(http.StatusAccepted, dto)
+}
+
+// Transfer handles GET /api/v1/wallet/:walletid/transfers/:id, the status
+// of a transfer queued by an asynchronous send. Processed transfers are
+// kept for config.TransferQueueRetention.
+//
+//	curl http://localhost:8080/api/v1/wallet/TTTFGF/transfers/1
+func (h *WalletHandler) Transfer(c *gin.Context) {
+	walletId, ok := h.walletId(c, "walletid", c.Param("walletid"))
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", "id: must be an integer")
+		return
+	}
+	q, err := h.store.QueuedTransfer(c.Request.Context(), walletId, id)
+	switch {
+	case errors.Is(err, store.ErrTransferNotFound):
+		abortWithError(c, http.StatusNotFound, "transfer_not_found", "transfer not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not get transfer", "transfer", "wallet", walletId, "transfer", id)
+		return
+	}
+	c.JSON(http.StatusOK, h.newQueuedTransferDTO(q))
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// TestAsyncSend queues sends with async=true and the respond-async
+// preference, and polls their status before and after the transfer
+// queue ran.
+func TestAsyncSend(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureAsyncTransfers: true}
+	r := newTestRouter(t, db, cfg)
+
+	// the fields of a QueuedTransferDTO that change with its status
+	type transfer struct {
+		Status      string  `json:"status"`
+		Reason      string  `json:"failure_reason"`
+		ProcessedAt *string `json:"processed_at"`
+		Balance     *string `json:"balance"`
+		StatusURL   string  `json:"status_url"`
+	}
+	queue := func(w *httptest.ResponseRecorder) transfer {
+		t.Helper()
+		var dto transfer
+		if err := json.NewDecoder(w.Body).Decode(&dto); err != nil || w.Code != http.StatusAccepted {
+			t.Fatalf("%d %v", w.Code, err)
+		}
+		if dto.Status != "queued" || dto.ProcessedAt != nil || dto.Balance != nil || w.Header().Get("Location") != dto.StatusURL {
+			t.Fatalf("queued %+v, Location %q", dto, w.Header().Get("Location"))
+		}
+		return dto
+	}
+	status := func(url string) transfer {
+		t.Helper()
+		w := serve(r, http.MethodGet, url, "")
+		var dto transfer
+		if err := json.NewDecoder(w.Body).Decode(&dto); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %v", url, w.Code, err)
+		}
+		return dto
+	}
+
+	w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send?async=true", `{"to":"BBBBBB","amount":"60"}`)
+	if w.Header().Get("Preference-Applied") != "" {
+		t.Fatal("Preference-Applied without a preference")
+	}
+	completed := queue(w)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/wallet/AAAAAA/send", strings.NewReader(`{"to":"BBBBBB","amount":"50"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "wait=10, Respond-Async")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got := w.Header().Get("Preference-Applied"); got != "respond-async" {
+		t.Fatalf("Preference-Applied: %q", got)
+	}
+	failed := queue(w)
+
+	// nothing moved yet
+	if got := balanceOf(t, db, "AAAAAA"); got != "100" {
+		t.Fatalf("AAAAAA has %s before the queue ran", got)
+	}
+	if dto := status(completed.StatusURL); dto.Status != "queued" {
+		t.Fatalf("before the queue ran: %+v", dto)
+	}
+
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send?async=maybe", `{"to":"BBBBBB","amount":"1"}`),
+		http.StatusBadRequest, "validation_failed")
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/ZZZZZZ/send?async=true", `{"to":"BBBBBB","amount":"1"}`),
+		http.StatusNotFound, "wallet_not_found")
+
+	if err := ops.NewTransferQueue(db, 2, time.Hour, discardLogger()).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dto := status(completed.StatusURL); dto.Status != "completed" || dto.ProcessedAt == nil || dto.Balance == nil || *dto.Balance != "40" {
+		t.Errorf("completed: %+v", dto)
+	}
+	if dto := status(failed.StatusURL); dto.Status != "failed" || dto.Reason != "insufficient_funds" || dto.ProcessedAt == nil || dto.Balance != nil {
+		t.Errorf("failed: %+v", dto)
+	}
+	if got := balanceOf(t, db, "AAAAAA"); got != "40" {
+		t.Errorf("AAAAAA has %s after the queue ran, want 40", got)
+	}
+
+	// a transfer is only found under its sender
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/BBBBBB/transfers/1", ""), http.StatusNotFound, "transfer_not_found")
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/99", ""), http.StatusNotFound, "transfer_not_found")
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/one", ""), http.StatusBadRequest, "invalid_request")
+
+	// without the feature a send is made at once, whatever it asks for
+	cfg.Features = config.Features{}
+	w = serve(newTestRouter(t, db, cfg), http.MethodPost, "/api/v1/wallet/AAAAAA/send?async=true", `{"to":"BBBBBB","amount":"1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("without the feature: %d %s", w.Code, w.Body)
+	}
+	if got := balanceOf(t, db, "AAAAAA"); got != "39" {
+		t.Errorf("AAAAAA has %s after a send without the feature, want 39", got)
+	}
+}
+
+// balanceOf returns the balance of the wallet id in db.
+func balanceOf(t *testing.T, db *store.DB, id string) string {
+	t.Helper()
+	w, err := db.GetWallet(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Balance.String()
+}
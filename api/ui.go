@@ -0,0 +1,35 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiCSP only lets the page load its own script and style and talk to this
+// server.
+const uiCSP = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// uiHandler serves the wallet lookup page for support staff. It is static
+// and reads through the wallet endpoints.
+func uiHandler() gin.HandlerFunc {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/admin/ui", http.FileServer(http.FS(files)))
+	return func(c *gin.Context) {
+		c.Header("Content-Security-Policy", uiCSP)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("X-Frame-Options", "DENY")
+		c.Header("Referrer-Policy", "no-referrer")
+		c.Header("Cache-Control", "no-store")
+		fileServer.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,93 @@
+// The wallet lookup page only reads through the public wallet endpoints.
+"use strict";
+
+const pageSize = 20;
+let transactions = [];
+let page = 0;
+let walletId = "";
+
+const $ = (id) => document.getElementById(id);
+
+function showError(message) {
+  $("error").textContent = message;
+  $("error").hidden = !message;
+}
+
+async function fetchJSON(url) {
+  const res = await fetch(url, { headers: { Accept: "application/json" } });
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.error || res.statusText);
+  }
+  return { body, next: res.headers.get("X-Next-Cursor") };
+}
+
+async function getJSON(url) {
+  return (await fetchJSON(url)).body;
+}
+
+// getAllPages reads a listing to its end, following X-Next-Cursor.
+async function getAllPages(url) {
+  const sep = url.includes("?") ? "&" : "?";
+  let items = [];
+  let cursor = null;
+  do {
+    const page = await fetchJSON(cursor === null ? url : `${url}${sep}cursor=${encodeURIComponent(cursor)}`);
+    items = items.concat(page.body);
+    cursor = page.next;
+  } while (cursor);
+  return items;
+}
+
+function renderPage() {
+  const rows = $("history");
+  rows.replaceChildren();
+  const start = page * pageSize;
+  for (const t of transactions.slice(start, start + pageSize)) {
+    const tr = document.createElement("tr");
+    if (t.status !== "completed") {
+      tr.className = t.status;
+    }
+    for (const [value, cls] of [[t.time], [t.from], [t.to], [t.amount, "amount"], [t.failure_reason ? `${t.status} (${t.failure_reason})` : t.status]]) {
+      const td = document.createElement("td");
+      td.textContent = value;
+      if (cls) {
+        td.className = cls;
+      }
+      tr.append(td);
+    }
+    rows.append(tr);
+  }
+  const pages = Math.max(1, Math.ceil(transactions.length / pageSize));
+  $("page").textContent = `page ${page + 1} of ${pages}, ${transactions.length} transactions`;
+  $("prev").disabled = page === 0;
+  $("next").disabled = page >= pages - 1;
+}
+
+async function load() {
+  showError("");
+  const id = encodeURIComponent(walletId);
+  try {
+    const wallet = await getJSON(`/api/v1/wallet/${id}`);
+    const archived = $("archived").checked ? "?include_archived=true" : "";
+    const history = await getAllPages(`/api/v1/wallet/${id}/history${archived}`);
+    $("id").textContent = wallet.id;
+    $("balance").textContent = wallet.balance;
+    transactions = history.sort((a, b) => Date.parse(b.time) - Date.parse(a.time));
+    page = 0;
+    renderPage();
+    $("wallet").hidden = false;
+  } catch (err) {
+    $("wallet").hidden = true;
+    showError(err.message);
+  }
+}
+
+$("search").addEventListener("submit", (e) => {
+  e.preventDefault();
+  walletId = $("wallet-id").value.trim();
+  load();
+});
+$("archived").addEventListener("change", load);
+$("prev").addEventListener("click", () => { page--; renderPage(); });
+$("next").addEventListener("click", () => { page++; renderPage(); });
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminUI(t *testing.T) {
+	db := openTestStore(t)
+	cfg := testConfig(t)
+	cfg.AdminUI = true
+	r := newTestRouter(t, db, cfg)
+
+	for _, path := range []string{"/admin/ui/", "/admin/ui/app.js", "/admin/ui/style.css"} {
+		w := serve(r, http.MethodGet, path, "")
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Fatalf("%s: %d", path, w.Code)
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); csp != uiCSP {
+			t.Fatalf("%s: Content-Security-Policy %q", path, csp)
+		}
+		for header, want := range map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"Referrer-Policy":        "no-referrer",
+			"Cache-Control":          "no-store",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("%s: %s %q, want %q", path, header, got, want)
+			}
+		}
+	}
+	if w := serve(r, http.MethodGet, "/admin/ui/", ""); !strings.Contains(w.Body.String(), "<html") {
+		t.Fatalf("the page is not HTML: %.200s", w.Body)
+	}
+
+	// behind the admin allowlist
+	req := httptest.NewRequest(http.MethodGet, "/admin/ui/", nil)
+	req.RemoteAddr = "203.0.113.5:5000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("from outside the allowlist: %d", w.Code)
+	}
+
+	cfg.AdminUI = false
+	off := newTestRouter(t, db, cfg)
+	for _, path := range []string{"/admin/ui/", "/admin/ui/app.js"} {
+		decodeError(t, serve(off, http.MethodGet, path, ""), http.StatusNotFound, "not_found")
+	}
+}
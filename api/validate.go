@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/walletid"
+)
+
+// Limits for every free-form string we accept from clients, in bytes.
+// Keep them here so handlers can't drift apart.
+const (
+	maxWalletIdBytes           = walletid.MaxBytes
+	maxMaintenanceMessageBytes = 256
+	maxWebhookURLBytes         = 2048
+	minWebhookSecretBytes      = 16
+	maxWebhookSecretBytes      = 256
+)
+
+// fieldError describes a client supplied value that failed validation.
+type fieldError struct {
+	Field  string
+	Reason string
+	// Err is the underlying cause, if there is one worth matching on.
+	Err error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// validateText checks that value is valid UTF-8, at most maxBytes long and
+// free of control characters. Newlines are let through when allowNewline is set.
+func validateText(field, value string, maxBytes int, allowNewline bool) error {
+	if len(value) > maxBytes {
+		return &fieldError{Field: field, Reason: fmt.Sprintf("must be at most %d bytes", maxBytes)}
+	}
+	if !utf8.ValidString(value) {
+		return &fieldError{Field: field, Reason: "must be valid UTF-8"}
+	}
+	for _, r := range value {
+		if allowNewline && r == '\n' {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return &fieldError{Field: field, Reason: "must not contain control characters"}
+		}
+	}
+	return nil
+}
+
+// validateWalletId applies the wallet id limits to a path parameter or body field
+// and checks that the id could have been generated with the given format.
+func validateWalletId(format walletid.Format, field, id string) error {
+	if err := validateText(field, id, maxWalletIdBytes, false); err != nil {
+		return err
+	}
+	if !format.Matches(id) {
+		return &fieldError{Field: field, Reason: format.Describe()}
+	}
+	if err := format.Check(id); err != nil {
+		return &fieldError{Field: field, Reason: "has a mistyped character, its checksum does not match", Err: err}
+	}
+	return nil
+}
+
+// pageLimit reads the limit query parameter of a listing: def when it is
+// missing, otherwise an integer from 1 to max, see config.MaxPageSize.
+// Anything else aborts the request with a validation_failed. Limits above
+// max are refused rather than clamped, so a client never takes a shorter
+// list for the whole of what it asked for.
+func pageLimit(c *gin.Context, def, max int) (int, bool) {
+	v, ok := c.GetQuery("limit")
+	if !ok {
+		return min(def, max), true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > max {
+		abortValidation(c, []FieldDetail{{Field: "limit", Reason: fmt.Sprintf("must be an integer from 1 to %d", max)}})
+		return 0, false
+	}
+	return limit, true
+}
+
+// nextCursorHeader carries the cursor of the next page of a listing, see
+// pageCursor. It is left out on the last page.
+const nextCursorHeader = "X-Next-Cursor"
+
+// pageCursor reads the cursor query parameter of a listing, the
+// nextCursorHeader of the page before. Clients pass it back as it is; it
+// is the number of items the pages before held, 0 when it is missing.
+// Anything else aborts the request with a validation_failed.
+func pageCursor(c *gin.Context) (int, bool) {
+	v, ok := c.GetQuery("cursor")
+	if !ok {
+		return 0, true
+	}
+	offset, err := strconv.Atoi(v)
+	if err != nil || offset < 0 {
+		abortValidation(c, []FieldDetail{{Field: "cursor", Reason: "must be the " + nextCursorHeader + " of the previous page"}})
+		return 0, false
+	}
+	return offset, true
+}
+
+// totalCountHeader carries the total of a listing, see includeTotal.
+const totalCountHeader = "X-Total-Count"
+
+// includeTotal reads the include_total query parameter of a listing. The
+// total takes a count query on top of the page, so it is only sent as
+// X-Total-Count when asked for. Anything but a boolean aborts the request
+// with a validation_failed.
+func includeTotal(c *gin.Context) (bool, bool) {
+	v := c.Query("include_total")
+	if v == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		abortValidation(c, []FieldDetail{{Field: "include_total", Reason: "must be a boolean"}})
+		return false, false
+	}
+	return include, true
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+func TestValidateTextLimits(t *testing.T) {
+	limits := []struct {
+		field string
+		max   int
+	}{
+		{"message", maxMaintenanceMessageBytes},
+		{"url", maxWebhookURLBytes},
+		{"secret", maxWebhookSecretBytes},
+		{requestIdHeader, maxRequestIdBytes},
+	}
+	for _, l := range limits {
+		tests := []struct {
+			name  string
+			value string
+			ok    bool
+		}{
+			{"below", strings.Repeat("a", l.max-1), true},
+			{"at", strings.Repeat("a", l.max), true},
+			{"above", strings.Repeat("a", l.max+1), false},
+			// é is two bytes: the first value ends on the limit, the second
+			// crosses it although it has as many characters
+			{"multi-byte at", strings.Repeat("a", l.max-2) + "é", true},
+			{"multi-byte across", strings.Repeat("a", l.max-1) + "é", false},
+			{"multi-byte only at", strings.Repeat("é", l.max/2), true},
+			{"multi-byte only above", strings.Repeat("é", l.max/2+1), false},
+		}
+		for _, tt := range tests {
+			t.Run(l.field+"/"+tt.name, func(t *testing.T) {
+				err := validateText(l.field, tt.value, l.max, false)
+				if (err == nil) != tt.ok {
+					t.Fatalf("validateText(%d bytes) = %v, want ok %v", len(tt.value), err, tt.ok)
+				}
+				if err != nil {
+					var fe *fieldError
+					if !errors.As(err, &fe) || fe.Field != l.field {
+						t.Fatalf("error = %v, want a fieldError for %s", err, l.field)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestValidateTextCharacters(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		allowNewline bool
+		reason       string
+	}{
+		{"plain", "back at 04:00 UTC", false, ""},
+		{"unicode", "Wartung bis 04:00 – bitte später", false, ""},
+		{"invalid utf-8", "abc\xff", false, "must be valid UTF-8"},
+		{"truncated multi-byte", strings.Repeat("a", 10) + "é"[:1], false, "must be valid UTF-8"},
+		{"nul", "a\x00b", false, "must not contain control characters"},
+		{"escape", "a\x1b[31mb", false, "must not contain control characters"},
+		{"delete", "a\x7fb", false, "must not contain control characters"},
+		{"c1 control", "a\u0085b", false, "must not contain control characters"},
+		{"newline refused", "a\nb", false, "must not contain control characters"},
+		{"newline allowed", "a\nb", true, ""},
+		{"carriage return with newlines allowed", "a\r\nb", true, "must not contain control characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateText("memo", tt.value, 64, tt.allowNewline)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("validateText(%q) = %v, want nil", tt.value, err)
+				}
+				return
+			}
+			var fe *fieldError
+			if !errors.As(err, &fe) || fe.Reason != tt.reason {
+				t.Fatalf("validateText(%q) = %v, want %q", tt.value, err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookLimits(t *testing.T) {
+	prefix := "https://example.com/"
+	tests := []struct {
+		name  string
+		body  WebhookRequestBody
+		field string
+	}{
+		{"url at limit", WebhookRequestBody{URL: prefix + strings.Repeat("a", maxWebhookURLBytes-len(prefix))}, ""},
+		{"url above limit", WebhookRequestBody{URL: prefix + strings.Repeat("a", maxWebhookURLBytes-len(prefix)+1)}, "url"},
+		{"url with control character", WebhookRequestBody{URL: prefix + "a\tb"}, "url"},
+		{"secret below minimum", WebhookRequestBody{URL: prefix, Secret: strings.Repeat("s", minWebhookSecretBytes-1)}, "secret"},
+		{"secret at minimum", WebhookRequestBody{URL: prefix, Secret: strings.Repeat("s", minWebhookSecretBytes)}, ""},
+		{"secret at limit", WebhookRequestBody{URL: prefix, Secret: strings.Repeat("s", maxWebhookSecretBytes)}, ""},
+		{"secret above limit", WebhookRequestBody{URL: prefix, Secret: strings.Repeat("s", maxWebhookSecretBytes+1)}, "secret"},
+		{"secret multi-byte across limit", WebhookRequestBody{URL: prefix, Secret: strings.Repeat("s", maxWebhookSecretBytes-1) + "é"}, "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWebhook(&tt.body)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("validateWebhook = %v, want nil", err)
+				}
+				return
+			}
+			var fe *fieldError
+			if !errors.As(err, &fe) || fe.Field != tt.field {
+				t.Fatalf("validateWebhook = %v, want an error for %s", err, tt.field)
+			}
+		})
+	}
+}
+
+// TestPageLimit reads every listing with limits around a cap of 3: those
+// from 1 to the cap are used, the others refused with the field, not
+// clamped, and without a limit each listing has its own default, which
+// the cap lowers.
+func TestPageLimit(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	for i := 1; i <= 4; i++ {
+		if _, err := db.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.NewFromInt(int64(i)), testTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	cfg.MaxPageSize = 3
+	r := newTestRouter(t, db, cfg)
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`); w.Code != http.StatusCreated {
+		t.Fatalf("webhook: %d %s", w.Code, w.Body)
+	}
+
+	listings := []struct {
+		path string
+		// rows is how many rows the listing has without a limit, -1 for
+		// the listings not counted here
+		rows int
+	}{
+		{"/api/v1/wallet/AAAAAA/history", 3},
+		{"/api/v1/wallet/AAAAAA/webhooks/1/deliveries", -1},
+		{"/api/v1/admin/outbox?status=pending", -1},
+	}
+	for _, l := range listings {
+		sep := "?"
+		if strings.Contains(l.path, "?") {
+			sep = "&"
+		}
+		for _, tt := range []struct {
+			limit string
+			rows  int
+		}{
+			{"", l.rows},
+			{"1", 1},
+			{"3", 3},
+		} {
+			path := l.path
+			if tt.limit != "" {
+				path += sep + "limit=" + tt.limit
+			}
+			w := serve(r, http.MethodGet, path, "")
+			var rows []json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &rows); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+			}
+			if l.rows >= 0 && len(rows) != tt.rows {
+				t.Errorf("%s: %d rows, want %d", path, len(rows), tt.rows)
+			}
+		}
+		for _, limit := range []string{"0", "4", "1000", "-1", "ten", "2.5", "1e2", ""} {
+			path := l.path + sep + "limit=" + limit
+			body := decodeError(t, serve(r, http.MethodGet, path, ""), http.StatusBadRequest, "validation_failed")
+			if want := []FieldDetail{{"limit", "must be an integer from 1 to 3"}}; fmt.Sprint(body.Details) != fmt.Sprint(want) {
+				t.Errorf("%s: details %v, want %v", path, body.Details, want)
+			}
+		}
+	}
+}
+
+// TestIncludeTotal reads the outbox and webhook deliveries a row at a
+// time: X-Total-Count has the number of all their items, and is only
+// sent when asked for.
+func TestIncludeTotal(t *testing.T) {
+	db := openTestStore(t)
+	db.RecordEvents = true
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(int64(i)), testTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hook := store.Webhook{WalletId: "AAAAAA", URL: "https://example.com/hook", Secret: "0123456789abcdef", Events: []string{store.WebhookTransferSent}}
+	if err := db.CreateWebhook(ctx, &hook); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := db.RecordDelivery(ctx, store.WebhookDelivery{WebhookId: hook.Id, EventId: int64(i), EventType: store.WebhookTransferSent, AttemptedAt: testTime}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	r := newTestRouter(t, db, cfg)
+
+	deliveries := fmt.Sprintf("/api/v1/wallet/AAAAAA/webhooks/%d/deliveries?limit=1", hook.Id)
+	tests := []struct {
+		path, total string
+	}{
+		{"/api/v1/admin/outbox?status=pending&limit=1&include_total=true", "3"},
+		{"/api/v1/admin/outbox?status=dead&limit=1&include_total=true", "0"},
+		{"/api/v1/admin/outbox?status=pending&limit=1&include_total=false", ""},
+		{"/api/v1/admin/outbox?status=pending&limit=1", ""},
+		{deliveries + "&include_total=true", "2"},
+		{deliveries + "&include_total=1", "2"},
+		{deliveries, ""},
+	}
+	for _, tt := range tests {
+		w := serve(r, http.MethodGet, tt.path, "")
+		if w.Code != http.StatusOK || w.Header().Get(totalCountHeader) != tt.total {
+			t.Errorf("%s: %d, total %q, want %q", tt.path, w.Code, w.Header().Get(totalCountHeader), tt.total)
+		}
+	}
+	for _, path := range []string{"/api/v1/admin/outbox?include_total=maybe", deliveries + "&include_total=maybe"} {
+		body := decodeError(t, serve(r, http.MethodGet, path, ""), http.StatusBadRequest, "validation_failed")
+		if want := []FieldDetail{{"include_total", "must be a boolean"}}; fmt.Sprint(body.Details) != fmt.Sprint(want) {
+			t.Errorf("%s: details %v", path, body.Details)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// WalletTransactionDTO is a transaction in a wallet's history. From is
+// the wallet that sent the amount and To the one that received it, on the
+// history of either. BalanceAfter is the balance of the wallet of the
+// history right after the transaction, when it is known; the other
+// wallet's is none of its business.
+type WalletTransactionDTO struct {
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Amount       Money     `json:"amount"`
+	Date         Timestamp `json:"time"`
+	Status       string    `json:"status"`
+	Reason       string    `json:"failure_reason,omitempty"`
+	BalanceAfter *Money    `json:"balance_after,omitempty"`
+}
+
+// SendWalletRequestBody is the body of a send. Amount is kept as sent,
+// a JSON string or number, for parseAmount to check its form.
+type SendWalletRequestBody struct {
+	ID     string          `json:"to" binding:"required"`
+	Amount json.RawMessage `json:"amount"`
+}
+
+// WalletHandler serves the wallet endpoints. Everything it needs is
+// passed in, so any store, clock or logger can be used.
+type WalletHandler struct {
+	store store.WalletRepository
+	clock Clock
+	log   *slog.Logger
+	money moneyFormat
+	// strictAmounts is config.StrictAmounts.
+	strictAmounts bool
+	// maxPageSize is config.MaxPageSize.
+	maxPageSize int
+	// writeTimeout is config.HTTPWriteTimeout.
+	writeTimeout time.Duration
+	// asyncTransfers is whether the async_transfers feature is enabled.
+	asyncTransfers bool
+
+	ids        walletid.Format
+	idAttempts int
+	wallets    *ops.Wallets
+	// hub gets the balances changed by transfers.
+	hub *BalanceHub
+}
+
+func NewWalletHandler(repo store.WalletRepository, clock Clock, hub *BalanceHub, logger *slog.Logger, cfg config.Config) *WalletHandler {
+	return &WalletHandler{
+		store:          repo,
+		clock:          clock,
+		hub:            hub,
+		log:            logger,
+		money:          newMoneyFormat(cfg),
+		strictAmounts:  cfg.StrictAmounts,
+		maxPageSize:    cfg.MaxPageSize,
+		writeTimeout:   cfg.HTTPWriteTimeout,
+		asyncTransfers: cfg.Features.Enabled(config.FeatureAsyncTransfers),
+		ids:            cfg.WalletIds,
+		idAttempts:     cfg.WalletIdAttempts,
+		wallets:        ops.NewWallets(repo, cfg.WalletIds, cfg.WalletIdAttempts),
+	}
+}
+
+// walletId validates and normalizes a wallet id taken from field. It
+// aborts the request and returns false when the id is invalid.
+func (h *WalletHandler) walletId(c *gin.Context, field, id string) (string, bool) {
+	if err := validateWalletId(h.ids, field, id); err != nil {
+		abortInvalidWalletId(c, err)
+		return "", false
+	}
+	return h.ids.Normalize(id), true
+}
+
+// Create handles POST /api/v1/wallet/.
+//
+//	curl -d "" http://localhost:8080/api/v1/wallet/
+func (h *WalletHandler) Create(c *gin.Context) {
+	// ids are short random strings, see walletid.Format for how long and from which letters.
+	// collisions are retried a few times before giving up, see ops.Wallets.Create
+	// the body of a failure never has an id, none was stored
+	id, err := h.wallets.Create(c.Request.Context(), store.InitialBalance, h.clock.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, ops.ErrRandomUnavailable):
+			// the system RNG is broken, which is not something a retry from the client will fix soon
+			h.log.ErrorContext(c.Request.Context(), "create wallet", "request_id", c.GetString("request_id"), "err", err)
+			abortWithError(c, http.StatusServiceUnavailable, "rng_unavailable", "could not generate a wallet id")
+		case errors.Is(err, ops.ErrWalletIdsExhausted):
+			h.log.ErrorContext(c.Request.Context(), "create wallet", "request_id", c.GetString("request_id"), "err", err)
+			abortWithError(c, http.StatusServiceUnavailable, "wallet_id_exhausted",
+				fmt.Sprintf("no free wallet id found after %d attempts", h.idAttempts))
+		default:
+			abortInternalError(c, h.log, err, "could not create wallet", "create wallet")
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":      id,
+		"balance": h.money.of(store.InitialBalance),
+	})
+}
+
+// Send handles POST /api/v1/wallet/:walletid/send. With the
+// async_transfers feature, a client asking for it with Prefer:
+// respond-async or async=true gets the transfer queued instead, see
+// enqueue.
+//
+//	curl --json '{"to":"TTTFGF","amount":10}' http://localhost:8080/api/v1/wallet/TTTFGF/send
+func (h *WalletHandler) Send(c *gin.Context) {
+	// this is a weird endpoint, because there is a lot of undefined behaviour.
+
+	// what happens when fromId == toId?
+	// Idk, so i'll allow those empty transactions to happen.
+	// So, you can transfer money to yourself, but it'll fail if you don't have enough money to do it.
+	// What a fancy way to check if your balance is above a certain threshold...
+
+	// what happens when amount is negative or zero?
+	// Idk, so i'll allow that as well.
+	// So, you can basically steal money from other people's wallets by specifying negative amount;
+	// It can also make other people's wallets negative, but that's a very weird thing to do.
+	// so BOTH receiver and sender balances are validated by the store, even though it is not stated in the problem.
+
+	var requestBody SendWalletRequestBody
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+
+	fromId, ok := h.walletId(c, "walletid", c.Param("walletid"))
+	if !ok {
+		return
+	}
+	toId, ok := h.walletId(c, "to", requestBody.ID)
+	if !ok {
+		return
+	}
+	amount, ok := h.parseAmount(c, "amount", requestBody.Amount)
+	if !ok {
+		return
+	}
+	if h.asyncTransfers {
+		async, preferred, ok := asyncRequested(c)
+		if !ok {
+			return
+		}
+		if async {
+			h.enqueue(c, fromId, toId, amount, preferred)
+			return
+		}
+	}
+
+	t, err := h.store.Transfer(c.Request.Context(), fromId, toId, amount, h.clock.Now())
+	if err != nil {
+		h.abortTransferError(c, fromId, toId, amount.String(), err)
+		return
+	}
+	h.hub.Publish(BalanceUpdate{WalletId: fromId, Balance: t.FromBalance.Decimal, Time: t.Date.Time.UTC()})
+	if toId != fromId {
+		h.hub.Publish(BalanceUpdate{WalletId: toId, Balance: t.ToBalance.Decimal, Time: t.Date.Time.UTC()})
+	}
+	// only the sender's own balance is returned, the recipient's is none of their business
+	c.JSON(http.StatusOK, gin.H{
+		"id":      t.FromId,
+		"balance": h.money.of(t.FromBalance.Decimal),
+	})
+}
+
+// parseAmount parses the amount in field of a request body, a JSON string
+// or number, with ParseAmount. It aborts the request with 400
+// validation_failed and returns false when the amount is invalid. A
+// missing amount is zero, unless amounts are strict.
+func (h *WalletHandler) parseAmount(c *gin.Context, field string, raw json.RawMessage) (decimal.Decimal, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		if h.strictAmounts {
+			abortValidation(c, []FieldDetail{{Field: field, Reason: "required"}})
+			return decimal.Decimal{}, false
+		}
+		return decimal.Decimal{}, true
+	}
+	s := string(raw)
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			abortValidation(c, []FieldDetail{{Field: field, Reason: "must be a decimal number"}})
+			return decimal.Decimal{}, false
+		}
+	}
+	amount, err := ParseAmount(s, h.strictAmounts)
+	if err != nil {
+		abortValidation(c, []FieldDetail{{Field: field, Reason: err.Error()}})
+		return decimal.Decimal{}, false
+	}
+	return amount, true
+}
+
+// historyFlushRows is how many transactions of a history are written
+// between flushes, so the client gets them while the rest are read.
+const historyFlushRows = 500
+
+// History handles GET /api/v1/wallet/:walletid/history. The transactions
+// are written as they are read, so a long history is never held in memory
+// whole. A failure once the response has started can't become an error
+// response any more: the connection is closed before the closing bracket,
+// so clients see a broken response instead of a short history. A page
+// holds the newest 50 transactions unless limit says otherwise; the
+// cursor of the next one is sent as X-Next-Cursor.
+//
+//	curl http://localhost:8080/api/v1/wallet/TTTFGF/history?include_archived=true&status=completed&counterparty=GGHJKL&limit=50&cursor=50&tz=Europe/Berlin
+func (h *WalletHandler) History(c *gin.Context) {
+	id, ok := h.walletId(c, "walletid", c.Param("walletid"))
+	if !ok {
+		return
+	}
+	loc := time.UTC
+	if v := c.Query("tz"); v != "" {
+		var err error
+		loc, err = time.LoadLocation(v)
+		// Local is the zone of the server, which the client can't know
+		if err != nil || v == "Local" {
+			abortWithError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("tz: %q is not an IANA time zone", v))
+			return
+		}
+	}
+	var filter store.HistoryFilter
+	if v := c.Query("include_archived"); v != "" {
+		includeArchived, err := strconv.ParseBool(v)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "invalid_request", fmt.Sprintf("include_archived: %q is not a boolean", v))
+			return
+		}
+		filter.IncludeArchived = includeArchived
+	}
+	switch status := c.Query("status"); status {
+	case "", store.StatusPending, store.StatusCompleted, store.StatusFailed:
+		filter.Status = status
+	default:
+		abortWithError(c, http.StatusBadRequest, "invalid_request",
+			fmt.Sprintf("status: must be one of %s, %s or %s", store.StatusPending, store.StatusCompleted, store.StatusFailed))
+		return
+	}
+	// rows have no id to continue from, so the cursor counts the rows of
+	// the pages before. New transactions push older ones to later pages,
+	// which may repeat a row but never skip one
+	if filter.Limit, ok = pageLimit(c, 50, h.maxPageSize); !ok {
+		return
+	}
+	if filter.Offset, ok = pageCursor(c); !ok {
+		return
+	}
+	// an unknown counterparty just has no transactions with the wallet
+	if v := c.Query("counterparty"); v != "" {
+		if filter.Counterparty, ok = h.walletId(c, "counterparty", v); !ok {
+			return
+		}
+	}
+	total, ok := includeTotal(c)
+	if !ok {
+		return
+	}
+	if total {
+		count, err := h.store.CountHistory(c.Request.Context(), id, filter)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+			return
+		case err != nil:
+			abortInternalError(c, h.log, err, "could not count the history", "history count", "wallet", id)
+			return
+		}
+		c.Header(totalCountHeader, strconv.FormatInt(count, 10))
+	}
+	// the header goes out before the first row, so whether there is a next
+	// page is looked up first
+	next := filter
+	next.Limit, next.Offset = 1, filter.Offset+filter.Limit
+	more, err := h.store.History(c.Request.Context(), id, next)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not read the history", "history next page", "wallet", id)
+		return
+	}
+	if len(more) > 0 {
+		c.Header(nextCursorHeader, strconv.Itoa(next.Offset))
+	}
+	w := jsonArrayWriter{c: c, flushEvery: historyFlushRows, writeTimeout: h.writeTimeout}
+	err = h.store.EachHistory(c.Request.Context(), id, filter, func(row store.Transaction) error {
+		return w.write(h.historyDTO(id, row, loc))
+	})
+	switch {
+	case err != nil && w.started() && c.Writer.Status() != http.StatusOK:
+		// the deadline passed before the first row, the 504 written instead stands
+		return
+	case err != nil && w.started():
+		h.log.ErrorContext(c.Request.Context(), "history: response cut short", "err", err, "wallet", id, "written", w.n)
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not read the history", "history", "wallet", id)
+		return
+	}
+	w.close()
+}
+
+// historyDTO is row in the history of the wallet id, with its times in loc.
+func (h *WalletHandler) historyDTO(id string, row store.Transaction, loc *time.Location) WalletTransactionDTO {
+	dto := WalletTransactionDTO{
+		From:   row.FromId,
+		To:     row.ToId,
+		Amount: h.money.of(row.Amount),
+		Date:   newTimestamp(row.Date.Time, loc),
+		Status: row.Status,
+		Reason: row.FailureReason,
+	}
+	balance := row.ToBalance
+	if row.FromId == id {
+		balance = row.FromBalance
+	}
+	if balance.Valid {
+		m := h.money.of(balance.Decimal)
+		dto.BalanceAfter = &m
+	}
+	return dto
+}
+
+// jsonArrayWriter writes a 200 with a JSON array, one element at a time.
+// Nothing is written before the first element, so the handler can still
+// answer with an error until then.
+type jsonArrayWriter struct {
+	c *gin.Context
+	// flushEvery is how many elements are written between flushes.
+	flushEvery int
+	// writeTimeout, when not 0, is moved forward on every flush, so that
+	// the server's write timeout ends a stalled response but not a long one.
+	writeTimeout time.Duration
+	n            int
+}
+
+func (w *jsonArrayWriter) started() bool { return w.n > 0 }
+
+// write adds v to the array. The error is the client's connection failing.
+func (w *jsonArrayWriter) write(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if w.n == 0 {
+		w.c.Header("Content-Type", "application/json; charset=utf-8")
+		w.c.Status(http.StatusOK)
+		sep = "["
+	}
+	w.n++
+	if _, err := w.c.Writer.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := w.c.Writer.Write(b); err != nil {
+		return err
+	}
+	if w.n%w.flushEvery == 0 {
+		w.c.Writer.Flush()
+		if w.writeTimeout > 0 {
+			http.NewResponseController(w.c.Writer).SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		}
+	}
+	return nil
+}
+
+// close ends the array, which is [] when nothing was written.
+func (w *jsonArrayWriter) close() {
+	if w.n == 0 {
+		w.c.JSON(http.StatusOK, []any{})
+		return
+	}
+	w.c.Writer.WriteString("]")
+}
+
+// Get handles GET /api/v1/wallet/:walletid.
+//
+//	curl http://localhost:8080/api/v1/wallet/TTTFGF
+func (h *WalletHandler) Get(c *gin.Context) {
+	id, ok := h.walletId(c, "walletid", c.Param("walletid"))
+	if !ok {
+		return
+	}
+	wallet, err := h.store.GetWallet(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not read the wallet", "get wallet", "wallet", id)
+		return
+	}
+	count, err := h.store.TransactionCount(c.Request.Context(), id)
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not read the wallet", "count transactions", "wallet", id)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      wallet.Id,
+		"balance": h.money.of(wallet.Balance),
+		// null for old wallets without transactions
+		"created_at":        newTimestamp(wallet.CreatedAt.Time, time.UTC),
+		"transaction_count": count,
+	})
+}
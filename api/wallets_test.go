@@ -0,0 +1,809 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+func newTestWallet(id string, balance int64) store.Wallet {
+	return store.Wallet{Id: id, Balance: decimal.NewFromInt(balance)}
+}
+
+// decodeError decodes the ErrorResponse of w, failing the test when it
+// isn't one with status and code.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) ErrorResponse {
+	t.Helper()
+	res := w.Result()
+	defer res.Body.Close()
+	var body ErrorResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if res.StatusCode != status || body.Code != code {
+		t.Fatalf("got %d %q, want %d %q (%s)", res.StatusCode, body.Code, status, code, body.Message)
+	}
+	return body
+}
+
+func TestWalletHandlersDatabaseDown(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+
+	dbErr := errors.New("database is locked: /var/lib/wallets/data.db")
+	repo.fail(dbErr)
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/api/v1/wallet/", ""},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":10}`},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA", ""},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/history", ""},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/history?include_total=true", ""},
+	}
+	for _, req := range requests {
+		t.Run(req.method+" "+req.path, func(t *testing.T) {
+			body := decodeError(t, serve(r, req.method, req.path, req.body), http.StatusInternalServerError, "internal_error")
+			if body.Message == dbErr.Error() {
+				t.Errorf("the database error was sent to the client: %q", body.Message)
+			}
+		})
+	}
+
+	// still serving once the database is back
+	repo.fail(nil)
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":10}`); w.Code != http.StatusOK {
+		t.Fatalf("send after recovery: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/", ""); w.Code != http.StatusCreated {
+		t.Fatalf("create after recovery: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCreateWalletFailureHasNoId(t *testing.T) {
+	repo := newMemRepo()
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+	repo.fail(errors.New("disk I/O error"))
+
+	w := serve(r, http.MethodPost, "/api/v1/wallet/", "")
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["id"]; ok {
+		t.Fatalf("failed create answered with an id: %s", w.Body)
+	}
+	if len(repo.wallets) != 0 {
+		t.Fatalf("failed create stored %d wallets", len(repo.wallets))
+	}
+}
+
+func TestWalletHandlersDatabaseClosed(t *testing.T) {
+	db, err := store.Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r := walletRouter(NewWalletHandler(db, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+	db.Close()
+
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/", ""), http.StatusInternalServerError, "internal_error")
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":10}`), http.StatusInternalServerError, "internal_error")
+}
+
+func TestCreateWalletIdsExhausted(t *testing.T) {
+	repo := newMemRepo()
+	cfg := testConfig(t)
+	cfg.WalletIdAttempts = 3
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), cfg))
+	// every id generated is taken
+	repo.fail(store.ErrDuplicateID)
+
+	body := decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/", ""), http.StatusServiceUnavailable, "wallet_id_exhausted")
+	if want := "no free wallet id found after 3 attempts"; body.Message != want {
+		t.Fatalf("message = %q, want %q", body.Message, want)
+	}
+}
+
+// collidingRepo is a store.WalletRepository on which the first
+// collisions wallets created collide with an existing id.
+type collidingRepo struct {
+	store.WalletRepository
+	collisions *int
+}
+
+func (r collidingRepo) CreateWallet(ctx context.Context, w store.Wallet) error {
+	if *r.collisions > 0 {
+		*r.collisions--
+		return store.ErrDuplicateID
+	}
+	return r.WalletRepository.CreateWallet(ctx, w)
+}
+
+func TestCreateWalletRetriesCollisions(t *testing.T) {
+	repo := newMemRepo()
+	collisions := 2
+	cfg := testConfig(t)
+	cfg.WalletIdAttempts = 3
+	r := walletRouter(NewWalletHandler(collidingRepo{repo, &collisions}, fixedClock(testTime), NewBalanceHub(0), discardLogger(), cfg))
+
+	w := serve(r, http.MethodPost, "/api/v1/wallet", "")
+	var created struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated || collisions != 0 {
+		t.Fatalf("create after %d collisions: %d %s", 2-collisions, w.Code, w.Body)
+	}
+	if _, ok := repo.wallets[created.Id]; !ok || len(repo.wallets) != 1 {
+		t.Fatalf("created %s, stored %v", created.Id, repo.wallets)
+	}
+}
+
+// TestCreateWalletFailuresLogged checks that a failed create is logged
+// with the request id the client got, answers without an id and leaves
+// the service serving.
+func TestCreateWalletFailuresLogged(t *testing.T) {
+	repo := newMemRepo()
+	cfg := testConfig(t)
+	cfg.WalletIdAttempts = 2
+	var logs bytes.Buffer
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requestId)
+	r.POST("/api/v1/wallet", NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), slog.New(slog.NewTextHandler(&logs, nil)), cfg).Create)
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+		logged string
+	}{
+		{errors.New("disk I/O error"), http.StatusInternalServerError, "internal_error", "disk I/O error"},
+		{store.ErrDuplicateID, http.StatusServiceUnavailable, "wallet_id_exhausted", "wallet ids exhausted"},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		repo.fail(tt.err)
+		w := serve(r, http.MethodPost, "/api/v1/wallet", "")
+		if strings.Contains(w.Body.String(), `"id"`) {
+			t.Errorf("%v: answered with an id: %s", tt.err, w.Body)
+		}
+		decodeError(t, w, tt.status, tt.code)
+		id := w.Header().Get(requestIdHeader)
+		if id == "" || !strings.Contains(logs.String(), "request_id="+id) || !strings.Contains(logs.String(), tt.logged) {
+			t.Errorf("%v: request id %q not logged with the error:\n%s", tt.err, id, &logs)
+		}
+	}
+	if len(repo.wallets) != 0 {
+		t.Fatalf("failed creates stored %d wallets", len(repo.wallets))
+	}
+
+	repo.fail(nil)
+	if w := serve(r, http.MethodPost, "/api/v1/wallet", ""); w.Code != http.StatusCreated {
+		t.Fatalf("create after the failures: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMistypedWalletIdChecksum(t *testing.T) {
+	repo := newMemRepo()
+	cfg := testConfig(t)
+	cfg.WalletIds.Checksum = true
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), cfg))
+	w := serve(r, http.MethodPost, "/api/v1/wallet/", "")
+	var created struct{ Id string }
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	typo := []byte(created.Id)
+	typo[2] = cfg.WalletIds.Alphabet[(strings.IndexByte(cfg.WalletIds.Alphabet, typo[2])+1)%len(cfg.WalletIds.Alphabet)]
+	// refused before the store is asked, which would answer 500 now
+	repo.fail(errors.New("store must not be called"))
+
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/"+string(typo), ""), http.StatusBadRequest, "invalid_wallet_id_checksum")
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/"+created.Id+"/send", `{"to":"`+string(typo)+`","amount":1}`),
+		http.StatusBadRequest, "invalid_wallet_id_checksum")
+}
+
+func TestWalletHandlersWithFakeRepository(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100), newTestWallet("NNNNNN", -20))
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+
+	tests := []struct {
+		name               string
+		method, path, body string
+		status             int
+		// code of an error, or the body of a success
+		code, want string
+	}{
+		{"get", http.MethodGet, "/api/v1/wallet/AAAAAA", "", http.StatusOK, "",
+			`{"balance":"100","created_at":null,"id":"AAAAAA","transaction_count":0}`},
+		{"get unknown", http.MethodGet, "/api/v1/wallet/ZZZZZZ", "", http.StatusNotFound, "wallet_not_found", ""},
+		{"get invalid id", http.MethodGet, "/api/v1/wallet/AAA", "", http.StatusBadRequest, "invalid_wallet_id", ""},
+		{"send", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"12.5"}`, http.StatusOK, "",
+			`{"balance":"87.5","id":"AAAAAA"}`},
+		{"send from unknown", http.MethodPost, "/api/v1/wallet/ZZZZZZ/send", `{"to":"BBBBBB","amount":1}`, http.StatusNotFound, "wallet_not_found", ""},
+		{"send to unknown", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"ZZZZZZ","amount":1}`, http.StatusBadRequest, "recipient_not_found", ""},
+		{"send too much", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":1000}`, http.StatusUnprocessableEntity, "insufficient_funds", ""},
+		{"send draining", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"NNNNNN","amount":-1}`, http.StatusBadRequest, "invalid_amount", ""},
+		{"send without recipient", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"amount":1}`, http.StatusBadRequest, "validation_failed", ""},
+		{"history", http.MethodGet, "/api/v1/wallet/BBBBBB/history", "", http.StatusOK, "",
+			`[{"from":"AAAAAA","to":"BBBBBB","amount":"12.5","time":"2024-03-01T12:00:00Z","status":"completed","balance_after":"112.5"}]`},
+		{"history unknown", http.MethodGet, "/api/v1/wallet/ZZZZZZ/history", "", http.StatusNotFound, "wallet_not_found", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, tt.method, tt.path, tt.body)
+			if tt.code != "" {
+				decodeError(t, w, tt.status, tt.code)
+				return
+			}
+			if w.Code != tt.status || w.Body.String() != tt.want {
+				t.Fatalf("got %d %s\nwant %d %s", w.Code, w.Body, tt.status, tt.want)
+			}
+		})
+	}
+
+	// creating retries the ids the repository already has
+	w := serve(r, http.MethodPost, "/api/v1/wallet/", "")
+	var created struct {
+		Id      string `json:"id"`
+		Balance string `json:"balance"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if _, ok := repo.wallets[created.Id]; !ok || created.Balance != store.InitialBalance.String() {
+		t.Fatalf("created %+v, not in the repository", created)
+	}
+}
+
+func TestWalletHandlerUsesInjectedClockAndLogger(t *testing.T) {
+	repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	at := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	r := walletRouter(NewWalletHandler(repo, fixedClock(at), NewBalanceHub(0), logger, testConfig(t)))
+
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":1}`); w.Code != http.StatusOK {
+		t.Fatalf("send: %d %s", w.Code, w.Body)
+	}
+	w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history", "")
+	if !strings.Contains(w.Body.String(), `"time":"2001-02-03T04:05:06Z"`) {
+		t.Fatalf("history does not have the time of the clock: %s", w.Body)
+	}
+
+	repo.fail(errors.New("disk I/O error"))
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA", ""), http.StatusInternalServerError, "internal_error")
+	if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "disk I/O error") {
+		t.Fatalf("the failure was not logged to the handler's logger:\n%s", logs.String())
+	}
+}
+
+// TestHistoryDirection checks that both sides of a transfer read it the
+// same way: from is the sender and to the recipient, whichever wallet's
+// history it is in.
+func TestHistoryDirection(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	r := newTestRouter(t, db, testConfig(t))
+
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"30"}`); w.Code != http.StatusOK {
+		t.Fatalf("send: %d %s", w.Code, w.Body)
+	}
+	// refused, and recorded as failed in the sender's history
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"500"}`),
+		http.StatusUnprocessableEntity, "insufficient_funds")
+
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		w := serve(r, http.MethodGet, "/api/v1/wallet/"+id+"/history", "")
+		var history []map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || w.Code != http.StatusOK || len(history) == 0 {
+			t.Fatalf("history of %s: %d %s", id, w.Code, w.Body)
+		}
+		var completed map[string]any
+		for _, tx := range history {
+			if tx["from"] != "AAAAAA" || tx["to"] != "BBBBBB" {
+				t.Errorf("history of %s: %v", id, tx)
+			}
+			if tx["status"] == store.StatusCompleted {
+				completed = tx
+			}
+		}
+		want := map[string]string{"AAAAAA": "70", "BBBBBB": "130"}[id]
+		if completed["amount"] != "30" || completed["balance_after"] != want {
+			t.Errorf("history of %s: %v, want the transfer with balance_after %s", id, history, want)
+		}
+	}
+	// and the columns say the same
+	var from, to string
+	if err := db.QueryRow(`SELECT from_wallet_id, to_wallet_id FROM wallet_transactions WHERE status = 'completed'`).Scan(&from, &to); err != nil {
+		t.Fatal(err)
+	}
+	if from != "AAAAAA" || to != "BBBBBB" {
+		t.Fatalf("stored from %s to %s", from, to)
+	}
+}
+
+// failingHistory is a store.WalletRepository whose EachHistory hands over
+// rows transactions, then fails like rows.Err does after the loop.
+type failingHistory struct {
+	store.WalletRepository
+	rows int
+}
+
+func (f failingHistory) EachHistory(ctx context.Context, id string, filter store.HistoryFilter, fn func(store.Transaction) error) error {
+	n := 0
+	err := f.WalletRepository.EachHistory(ctx, id, filter, func(t store.Transaction) error {
+		if n == f.rows {
+			return errStopRows
+		}
+		n++
+		return fn(t)
+	})
+	if err != nil && !errors.Is(err, errStopRows) {
+		return err
+	}
+	return errors.New("connection reset while reading rows")
+}
+
+var errStopRows = errors.New("stop")
+
+// TestHistoryFailures injects a failure at each stage of reading a
+// history: only a missing wallet is a 404, the rest are logged 500s the
+// client can match to the log by their request id.
+func TestHistoryFailures(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1), testTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	history := func(repo store.WalletRepository) *httptest.ResponseRecorder {
+		logs.Reset()
+		r := gin.New()
+		r.Use(requestId)
+		r.GET("/api/v1/wallet/:walletid/history", NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0),
+			slog.New(slog.NewTextHandler(&logs, nil)), testConfig(t)).History)
+		return serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history", "")
+	}
+	internal := func(name string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		decodeError(t, w, http.StatusInternalServerError, "internal_error")
+		id := w.Header().Get(requestIdHeader)
+		if id == "" || !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "request_id="+id) {
+			t.Errorf("%s: request id %q not in the log:\n%s", name, id, &logs)
+		}
+	}
+
+	if w := history(db); w.Code != http.StatusOK {
+		t.Fatalf("history: %d %s", w.Code, w.Body)
+	}
+	decodeError(t, serve(walletRouter(NewWalletHandler(db, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t))),
+		http.MethodGet, "/api/v1/wallet/ZZZZZZ/history", ""), http.StatusNotFound, "wallet_not_found")
+
+	// iterating fails before a row is written, or after some were
+	internal("iteration", history(failingHistory{db, 0}))
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("a history cut short wasn't aborted: %v", err)
+			}
+		}()
+		history(failingHistory{db, 2})
+	}()
+
+	// a row that can't be scanned, and one with a malformed date
+	corrupt := func(stmt string) {
+		t.Helper()
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(`UPDATE wallet_transactions SET amount_cents = 'lots'`)
+	internal("scan", history(db))
+	corrupt(`UPDATE wallet_transactions SET amount_cents = 100, date = 'last tuesday'`)
+	internal("malformed date", history(db))
+
+	// the query itself failing
+	corrupt(`ALTER TABLE wallet_transactions RENAME TO gone`)
+	internal("query", history(db))
+}
+
+// historyRepo is a memRepo holding n transfers between AAAAAA and BBBBBB.
+func historyRepo(tb testing.TB, n int) *memRepo {
+	tb.Helper()
+	repo := newMemRepo(newTestWallet("AAAAAA", 1000000), newTestWallet("BBBBBB", 1000000))
+	for i := 0; i < n; i++ {
+		if _, err := repo.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.New(int64(i+1), -2), testTime.Add(time.Duration(i)*time.Second)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return repo
+}
+
+// TestHistoryStreamed reads a history longer than historyFlushRows over a
+// real connection: whole, it must be what marshalling every transaction
+// at once gives, and cut short the client must be able to tell.
+func TestHistoryStreamed(t *testing.T) {
+	const rows = 2*historyFlushRows + 200
+	repo := historyRepo(t, rows)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	cfg := testConfig(t)
+	cfg.MaxPageSize = rows
+	get := func(repo store.WalletRepository) (*http.Response, []byte, error) {
+		t.Helper()
+		ts := httptest.NewServer(walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), logger, cfg)))
+		defer ts.Close()
+		// the server logs the aborted handler, which is the point
+		ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+		res, err := http.Get(fmt.Sprintf("%s/api/v1/wallet/AAAAAA/history?limit=%d", ts.URL, rows))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res, body, err
+	}
+
+	h := NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), logger, cfg)
+	transactions, err := repo.History(context.Background(), "AAAAAA", store.HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtos := []WalletTransactionDTO{}
+	for _, tx := range transactions {
+		dtos = append(dtos, h.historyDTO("AAAAAA", tx, time.UTC))
+	}
+	want, err := json.Marshal(dtos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body, err := get(repo)
+	if err != nil || res.StatusCode != http.StatusOK || !bytes.Equal(body, want) {
+		t.Fatalf("%d, %v: %d bytes, want the %d of %d transactions marshalled at once", res.StatusCode, err, len(body), len(want), rows)
+	}
+	if res.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("Content-Type %s", res.Header.Get("Content-Type"))
+	}
+
+	// what was written before the failure may be lost in the buffers of
+	// the server, the rows flushed before it never are
+	res, body, err = get(failingHistory{repo, historyFlushRows + 100})
+	flushed, _ := json.Marshal(dtos[:historyFlushRows])
+	if err == nil || res.StatusCode != http.StatusOK || json.Valid(body) {
+		t.Fatalf("cut short: %d, %v, %d bytes that decode", res.StatusCode, err, len(body))
+	}
+	if !bytes.HasPrefix(want, body) || len(body) < len(flushed)-1 || len(body) >= len(want)-1 {
+		t.Fatalf("cut short: %d bytes, want a part of the %d of the whole history, at least the %d flushed", len(body), len(want), len(flushed)-1)
+	}
+	if !strings.Contains(logs.String(), "history: response cut short") || !strings.Contains(logs.String(), fmt.Sprintf("written=%d", historyFlushRows+100)) {
+		t.Fatalf("the cut isn't logged:\n%s", &logs)
+	}
+}
+
+// TestHistoryPages reads a history of 120 transactions without a limit:
+// the first page holds the newest 50 and the cursor of the next, and
+// following the cursors gives every transaction once, in order.
+func TestHistoryPages(t *testing.T) {
+	repo := historyRepo(t, 120)
+	r := walletRouter(NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), testConfig(t)))
+	type transaction struct {
+		Amount string `json:"amount"`
+	}
+	page := func(query string) ([]transaction, string) {
+		t.Helper()
+		w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history"+query, "")
+		var rows []transaction
+		if err := json.Unmarshal(w.Body.Bytes(), &rows); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+		}
+		return rows, w.Header().Get(nextCursorHeader)
+	}
+
+	var amounts []string
+	cursor, pages := "", 0
+	for query := ""; ; query = "?cursor=" + url.QueryEscape(cursor) {
+		var rows []transaction
+		rows, cursor = page(query)
+		pages++
+		if want := min(50, 120-50*(pages-1)); len(rows) != want {
+			t.Fatalf("page %d: %d rows, want %d", pages, len(rows), want)
+		}
+		for _, row := range rows {
+			amounts = append(amounts, row.Amount)
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	if pages != 3 {
+		t.Fatalf("%d pages, want 3", pages)
+	}
+	// historyRepo sends 0.01 more each time, the newest is 1.2
+	for i, amount := range amounts {
+		if want := decimal.New(int64(120-i), -2).String(); amount != want {
+			t.Fatalf("transaction %d is %s, want %s", i, amount, want)
+		}
+	}
+
+	// a page ending with the last transaction has no next one
+	if rows, cursor := page("?limit=60&cursor=60"); len(rows) != 60 || cursor != "" {
+		t.Fatalf("last page: %d rows, cursor %q", len(rows), cursor)
+	}
+	if rows, cursor := page("?cursor=500"); len(rows) != 0 || cursor != "" {
+		t.Fatalf("past the end: %d rows, cursor %q", len(rows), cursor)
+	}
+	for _, cursor := range []string{"-1", "next", ""} {
+		body := decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history?cursor="+cursor, ""), http.StatusBadRequest, "validation_failed")
+		if len(body.Details) != 1 || body.Details[0].Field != "cursor" {
+			t.Errorf("cursor %q: details %v", cursor, body.Details)
+		}
+	}
+}
+
+// discardResponse is an http.ResponseWriter that keeps nothing of the
+// body, so that only the handler's allocations are measured.
+type discardResponse struct{ header http.Header }
+
+func (w discardResponse) Header() http.Header         { return w.header }
+func (w discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponse) WriteHeader(int)             {}
+func (w discardResponse) Flush()                      {}
+
+// BenchmarkHistory writes a long history the way the handler does, one
+// transaction at a time, and marshalled whole, as it used to.
+func BenchmarkHistory(b *testing.B) {
+	repo := historyRepo(b, 10000)
+	cfg, err := config.Load(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := NewWalletHandler(repo, fixedClock(testTime), NewBalanceHub(0), discardLogger(), cfg)
+	transactions, err := repo.History(context.Background(), "AAAAAA", store.HistoryFilter{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c, _ := gin.CreateTestContext(discardResponse{http.Header{}})
+			w := jsonArrayWriter{c: c, flushEvery: historyFlushRows}
+			for _, tx := range transactions {
+				if err := w.write(h.historyDTO("AAAAAA", tx, time.UTC)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			w.close()
+		}
+	})
+	b.Run("collected", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c, _ := gin.CreateTestContext(discardResponse{http.Header{}})
+			dtos := []WalletTransactionDTO{}
+			for _, tx := range transactions {
+				dtos = append(dtos, h.historyDTO("AAAAAA", tx, time.UTC))
+			}
+			c.JSON(http.StatusOK, dtos)
+		}
+	})
+}
+
+func TestHistoryTimesInUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("CEST", 2*60*60)
+	defer func() { time.Local = local }()
+	if SystemClock.Now().Location() != time.UTC {
+		t.Fatal("SystemClock isn't in UTC")
+	}
+
+	repo := newMemRepo(newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	at := time.Date(2024, 3, 1, 14, 0, 0, 0, time.Local)
+	r := walletRouter(NewWalletHandler(repo, fixedClock(at), NewBalanceHub(0), discardLogger(), testConfig(t)))
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":1}`); w.Code != http.StatusOK {
+		t.Fatalf("send: %d %s", w.Code, w.Body)
+	}
+	w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history", "")
+	if !strings.Contains(w.Body.String(), `"time":"2024-03-01T12:00:00Z"`) {
+		t.Fatalf("history not in UTC: %s", w.Body)
+	}
+}
+
+// TestWalletLookupFailures checks that only a missing wallet is a 404:
+// a database that can't be read is a 500, on every endpoint looking a
+// wallet up.
+func TestWalletLookupFailures(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebSocket: true}
+	r := newTestRouter(t, db, cfg)
+
+	missing := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodGet, "/api/v1/wallet/ZZZZZZ", "", http.StatusNotFound, "wallet_not_found"},
+		{http.MethodGet, "/api/v1/wallet/ZZZZZZ/ws", "", http.StatusNotFound, "wallet_not_found"},
+		{http.MethodPost, "/api/v1/wallet/ZZZZZZ/send", `{"to":"BBBBBB","amount":1}`, http.StatusNotFound, "wallet_not_found"},
+		{http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"ZZZZZZ","amount":1}`, http.StatusBadRequest, "recipient_not_found"},
+	}
+	for _, tt := range missing {
+		decodeError(t, serve(r, tt.method, tt.path, tt.body), tt.status, tt.code)
+	}
+
+	if _, err := db.Exec("ALTER TABLE wallets RENAME TO wallets_gone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range missing {
+		w := serve(r, tt.method, tt.path, tt.body)
+		body := decodeError(t, w, http.StatusInternalServerError, "internal_error")
+		if w.Header().Get(requestIdHeader) == "" || strings.Contains(body.Message, "wallets") {
+			t.Errorf("%s %s: %s with request id %q", tt.method, tt.path, w.Body, w.Header().Get(requestIdHeader))
+		}
+	}
+}
+
+// seedNegativeWallet creates a wallet with a negative balance, like the
+// ones left by versions that allowed negative transfers: the rule
+// refusing them is lifted for the insert.
+func seedNegativeWallet(t *testing.T, db *store.DB, id string, balance int64) {
+	t.Helper()
+	const trigger = "wallets_balance_non_negative_insert"
+	var create string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?", trigger).Scan(&create); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{"DROP TRIGGER " + trigger, "", create} {
+		if stmt == "" {
+			seedWallets(t, db, newTestWallet(id, balance))
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestNegativeWallets checks that a wallet already below zero may receive
+// any positive amount but not send until it is positive again, and that
+// its balance is written as negative.
+func TestNegativeWallets(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100))
+	seedNegativeWallet(t, db, "NNNNNN", -50)
+	r := newTestRouter(t, db, testConfig(t))
+	balance := func(id, want string) {
+		t.Helper()
+		w := serve(r, http.MethodGet, "/api/v1/wallet/"+id, "")
+		if !strings.Contains(w.Body.String(), `"balance":"`+want+`"`) {
+			t.Fatalf("%s: %d %s, want a balance of %s", id, w.Code, w.Body, want)
+		}
+	}
+	balance("NNNNNN", "-50")
+
+	// sending needs a positive balance afterwards, even for a small amount
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/NNNNNN/send", `{"to":"AAAAAA","amount":"0.01"}`),
+		http.StatusUnprocessableEntity, "insufficient_funds")
+	// a credit that leaves it negative only improves it
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"NNNNNN","amount":"1"}`); w.Code != http.StatusOK {
+		t.Fatalf("credit to a negative wallet: %d %s", w.Code, w.Body)
+	}
+	balance("NNNNNN", "-49")
+	w := serve(r, http.MethodGet, "/api/v1/wallet/NNNNNN/history", "")
+	if !strings.Contains(w.Body.String(), `"balance_after":"-49"`) {
+		t.Fatalf("history: %s", w.Body)
+	}
+	// and once raised above zero, it can send again
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"NNNNNN","amount":"59"}`); w.Code != http.StatusOK {
+		t.Fatalf("credit to a negative wallet: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, http.MethodPost, "/api/v1/wallet/NNNNNN/send", `{"to":"AAAAAA","amount":"5"}`); w.Code != http.StatusOK {
+		t.Fatalf("send once positive: %d %s", w.Code, w.Body)
+	}
+	balance("NNNNNN", "5")
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/NNNNNN/send", `{"to":"AAAAAA","amount":"6"}`),
+		http.StatusUnprocessableEntity, "insufficient_funds")
+
+	// and the database refuses to lower a balance below zero on its own
+	if _, err := db.Exec("UPDATE wallets SET balance_cents = -6000 WHERE id = 'NNNNNN'"); !store.IsCheckViolation(err) {
+		t.Fatalf("lowering a balance below zero: %v", err)
+	}
+}
+
+// TestHistoryCounterparty filters a history by the other wallet, both
+// ways, together with the other filters, the limit and the total.
+func TestHistoryCounterparty(t *testing.T) {
+	db := openTestStore(t)
+	db.RecordFailures = true
+	seedWallets(t, db, newTestWallet("AAAAAA", 100), newTestWallet("BBBBBB", 100), newTestWallet("CCCCCC", 100))
+	ctx := context.Background()
+	transfers := []struct {
+		from, to string
+		amount   int64
+		at       time.Duration
+	}{
+		{"AAAAAA", "BBBBBB", 1, -48 * time.Hour},
+		{"BBBBBB", "AAAAAA", 2, 0},
+		{"AAAAAA", "CCCCCC", 3, time.Minute},
+		{"AAAAAA", "BBBBBB", 4, 2 * time.Minute},
+		{"CCCCCC", "BBBBBB", 5, 3 * time.Minute},
+		{"AAAAAA", "BBBBBB", 1000, 4 * time.Minute},
+		{"AAAAAA", "AAAAAA", 6, 5 * time.Minute},
+	}
+	for _, tr := range transfers {
+		if _, err := db.Transfer(ctx, tr.from, tr.to, decimal.NewFromInt(tr.amount), testTime.Add(tr.at)); err != nil && tr.amount != 1000 {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ArchiveTransactions(ctx, testTime.Add(-time.Hour), 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(t, db, testConfig(t))
+
+	tests := []struct {
+		query   string
+		amounts string
+		total   string
+	}{
+		{"counterparty=BBBBBB", "1000,4,2", ""},
+		{"counterparty=BBBBBB&include_archived=true", "1000,4,2,1", ""},
+		{"counterparty=BBBBBB&status=completed&include_total=true", "4,2", "2"},
+		{"counterparty=BBBBBB&include_archived=true&limit=2&include_total=true", "1000,4", "4"},
+		{"counterparty=CCCCCC&include_total=true", "3", "1"},
+		{"counterparty=AAAAAA", "6", ""},
+		// unknown, but a valid id
+		{"counterparty=ZZZZZZ&include_total=true", "", "0"},
+	}
+	for _, tt := range tests {
+		w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history?"+tt.query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.query, w.Code, w.Body)
+		}
+		var rows []struct {
+			Amount string `json:"amount"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var amounts []string
+		for _, row := range rows {
+			amounts = append(amounts, row.Amount)
+		}
+		if got := strings.Join(amounts, ","); got != tt.amounts || w.Header().Get(totalCountHeader) != tt.total {
+			t.Errorf("%s: %s, total %q, want %s, total %q", tt.query, got, w.Header().Get(totalCountHeader), tt.amounts, tt.total)
+		}
+	}
+	for _, v := range []string{"BBB", "BBBBBBB", "BBBBB!"} {
+		w := serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/history?counterparty="+url.QueryEscape(v), "")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "counterparty") {
+			t.Errorf("counterparty=%s: %d %s", v, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// maxWebhooksPerWallet keeps one wallet from fanning every transfer out
+// to an unbounded number of URLs.
+const maxWebhooksPerWallet = 10
+
+type WebhookRequestBody struct {
+	URL string `json:"url"`
+	// Secret keys the signatures, one is generated when it is empty.
+	Secret string `json:"secret"`
+	// Events default to every event type.
+	Events []string `json:"events"`
+}
+
+type WebhookDTO struct {
+	Id           int64      `json:"id"`
+	URL          string     `json:"url"`
+	Events       []string   `json:"events"`
+	CreatedAt    Timestamp  `json:"created_at"`
+	Failures     int        `json:"failures"`
+	FailingSince *Timestamp `json:"failing_since,omitempty"`
+	DisabledAt   *Timestamp `json:"disabled_at,omitempty"`
+	// Secret is only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDeliveryDTO struct {
+	Id          int64     `json:"id"`
+	EventId     int64     `json:"event_id"`
+	EventType   string    `json:"event_type"`
+	AttemptedAt Timestamp `json:"attempted_at"`
+	DurationMs  int64     `json:"duration_ms"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func newWebhookDTO(w store.Webhook) WebhookDTO {
+	dto := WebhookDTO{Id: w.Id, URL: w.URL, Events: w.Events, CreatedAt: newTimestamp(w.CreatedAt, time.UTC), Failures: w.Failures}
+	if w.FailingSince.Valid {
+		ts := newTimestamp(w.FailingSince.Time, time.UTC)
+		dto.FailingSince = &ts
+	}
+	if w.DisabledAt.Valid {
+		ts := newTimestamp(w.DisabledAt.Time, time.UTC)
+		dto.DisabledAt = &ts
+	}
+	return dto
+}
+
+// WebhookHandler serves the webhook subscriptions of wallets. The
+// deliveries themselves are made by outbox.WebhookSink.
+type WebhookHandler struct {
+	db  *store.DB
+	log *slog.Logger
+	ids walletid.Format
+	// maxPageSize is config.MaxPageSize.
+	maxPageSize int
+}
+
+func NewWebhookHandler(db *store.DB, logger *slog.Logger, cfg config.Config) *WebhookHandler {
+	return &WebhookHandler{db: db, log: logger, ids: cfg.WalletIds, maxPageSize: cfg.MaxPageSize}
+}
+
+// walletId validates and normalizes the wallet id of the path, see
+// WalletHandler.walletId.
+func (h *WebhookHandler) walletId(c *gin.Context) (string, bool) {
+	id := c.Param("walletid")
+	if err := validateWalletId(h.ids, "walletid", id); err != nil {
+		abortInvalidWalletId(c, err)
+		return "", false
+	}
+	return h.ids.Normalize(id), true
+}
+
+// webhookId parses the webhook id of the path.
+func webhookId(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", "id: must be an integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// validateWebhook checks the body of a new webhook and fills in the defaults.
+func validateWebhook(body *WebhookRequestBody) error {
+	if err := validateText("url", body.URL, maxWebhookURLBytes, false); err != nil {
+		return err
+	}
+	u, err := url.Parse(body.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return &fieldError{Field: "url", Reason: "must be an absolute http or https URL"}
+	}
+	if body.Secret != "" {
+		if err := validateText("secret", body.Secret, maxWebhookSecretBytes, false); err != nil {
+			return err
+		}
+		if len(body.Secret) < minWebhookSecretBytes {
+			return &fieldError{Field: "secret", Reason: fmt.Sprintf("must be at least %d bytes", minWebhookSecretBytes)}
+		}
+	}
+	if len(body.Events) == 0 {
+		body.Events = []string{store.WebhookTransferReceived, store.WebhookTransferSent}
+	}
+	seen := map[string]bool{}
+	for _, e := range body.Events {
+		if e != store.WebhookTransferReceived && e != store.WebhookTransferSent {
+			return &fieldError{Field: "events", Reason: fmt.Sprintf("must be %s or %s", store.WebhookTransferReceived, store.WebhookTransferSent)}
+		}
+		if seen[e] {
+			return &fieldError{Field: "events", Reason: fmt.Sprintf("lists %s twice", e)}
+		}
+		seen[e] = true
+	}
+	return nil
+}
+
+// Create handles POST /api/v1/wallet/:walletid/webhooks. The secret is
+// only ever returned here.
+//
+//	curl --json '{"url":"https://example.com/hook","events":["transfer.received"]}' http://localhost:8080/api/v1/wallet/TTTFGF/webhooks
+func (h *WebhookHandler) Create(c *gin.Context) {
+	walletId, ok := h.walletId(c)
+	if !ok {
+		return
+	}
+	var body WebhookRequestBody
+	if !bindJSON(c, &body) {
+		return
+	}
+	if err := validateWebhook(&body); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if body.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			h.log.Error("webhook secret", "err", err)
+			abortWithError(c, http.StatusServiceUnavailable, "rng_unavailable", "could not generate a webhook secret")
+			return
+		}
+		body.Secret = hex.EncodeToString(b)
+	}
+
+	ctx := c.Request.Context()
+	existing, err := h.db.Webhooks(ctx, walletId)
+	if errors.Is(err, store.ErrNotFound) {
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	}
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not create webhook", "list webhooks", "wallet", walletId)
+		return
+	}
+	if len(existing) >= maxWebhooksPerWallet {
+		abortWithError(c, http.StatusConflict, "too_many_webhooks",
+			fmt.Sprintf("a wallet can have at most %d webhooks", maxWebhooksPerWallet))
+		return
+	}
+
+	w := store.Webhook{
+		WalletId:  walletId,
+		URL:       body.URL,
+		Secret:    body.Secret,
+		Events:    body.Events,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.db.CreateWebhook(ctx, &w); err != nil {
+		abortInternalError(c, h.log, err, "could not create webhook", "create webhook", "wallet", walletId)
+		return
+	}
+	h.log.Info("webhook created", "wallet", walletId, "webhook", w.Id, "events", w.Events)
+	dto := newWebhookDTO(w)
+	dto.Secret = w.Secret
+	c.JSON(http.StatusCreated, dto)
+}
+
+// List handles GET /api/v1/wallet/:walletid/webhooks.
+//
+//	curl http://localhost:8080/api/v1/wallet/TTTFGF/webhooks
+func (h *WebhookHandler) List(c *gin.Context) {
+	walletId, ok := h.walletId(c)
+	if !ok {
+		return
+	}
+	webhooks, err := h.db.Webhooks(c.Request.Context(), walletId)
+	if errors.Is(err, store.ErrNotFound) {
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	}
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not list webhooks", "list webhooks", "wallet", walletId)
+		return
+	}
+	dtos := []WebhookDTO{}
+	for _, w := range webhooks {
+		dtos = append(dtos, newWebhookDTO(w))
+	}
+	c.JSON(http.StatusOK, dtos)
+}
+
+// Delete handles DELETE /api/v1/wallet/:walletid/webhooks/:id.
+//
+//	curl -X DELETE http://localhost:8080/api/v1/wallet/TTTFGF/webhooks/1
+func (h *WebhookHandler) Delete(c *gin.Context) {
+	walletId, ok := h.walletId(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookId(c)
+	if !ok {
+		return
+	}
+	err := h.db.DeleteWebhook(c.Request.Context(), walletId, id)
+	switch {
+	case errors.Is(err, store.ErrWebhookNotFound):
+		abortWithError(c, http.StatusNotFound, "webhook_not_found", "webhook not found")
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not delete webhook", "delete webhook", "wallet", walletId, "webhook", id)
+	default:
+		h.log.Info("webhook deleted", "wallet", walletId, "webhook", id)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// Deliveries handles GET /api/v1/wallet/:walletid/webhooks/:id/deliveries,
+// the latest delivery attempts of a webhook.
+//
+//	curl http://localhost:8080/api/v1/wallet/TTTFGF/webhooks/1/deliveries?limit=20
+func (h *WebhookHandler) Deliveries(c *gin.Context) {
+	walletId, ok := h.walletId(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookId(c)
+	if !ok {
+		return
+	}
+	limit, ok := pageLimit(c, 50, h.maxPageSize)
+	if !ok {
+		return
+	}
+	total, ok := includeTotal(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err := h.db.Webhook(ctx, walletId, id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		abortWithError(c, http.StatusNotFound, "wallet_not_found", "wallet not found")
+		return
+	case errors.Is(err, store.ErrWebhookNotFound):
+		abortWithError(c, http.StatusNotFound, "webhook_not_found", "webhook not found")
+		return
+	case err != nil:
+		abortInternalError(c, h.log, err, "could not list deliveries", "webhook", "wallet", walletId, "webhook", id)
+		return
+	}
+	deliveries, err := h.db.Deliveries(ctx, id, limit)
+	if err != nil {
+		abortInternalError(c, h.log, err, "could not list deliveries", "webhook deliveries", "webhook", id)
+		return
+	}
+	if total {
+		count, err := h.db.CountDeliveries(ctx, id)
+		if err != nil {
+			abortInternalError(c, h.log, err, "could not count deliveries", "webhook deliveries count", "webhook", id)
+			return
+		}
+		c.Header(totalCountHeader, strconv.FormatInt(count, 10))
+	}
+	dtos := []WebhookDeliveryDTO{}
+	for _, d := range deliveries {
+		dtos = append(dtos, WebhookDeliveryDTO{
+			Id:          d.Id,
+			EventId:     d.EventId,
+			EventType:   d.EventType,
+			AttemptedAt: newTimestamp(d.AttemptedAt, time.UTC),
+			DurationMs:  d.Duration.Milliseconds(),
+			StatusCode:  d.StatusCode,
+			Error:       d.Error,
+		})
+	}
+	c.JSON(http.StatusOK, dtos)
+}
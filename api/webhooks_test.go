@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+// webhookBody is the part of a WebhookDTO the tests read back.
+type webhookBody struct {
+	Id     int64
+	URL    string
+	Events []string
+	Secret string
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	r := newTestRouter(t, db, cfg)
+	ctx := context.Background()
+
+	w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook","events":["transfer.received"]}`)
+	var created webhookBody
+	if err := json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if created.Id == 0 || len(created.Secret) != 64 || created.URL != "https://example.com/hook" ||
+		len(created.Events) != 1 || created.Events[0] != store.WebhookTransferReceived {
+		t.Fatalf("created %+v", created)
+	}
+	w = serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/all","secret":"0123456789abcdef"}`)
+	var all webhookBody
+	if err := json.Unmarshal(w.Body.Bytes(), &all); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("create with a secret: %d %s", w.Code, w.Body)
+	}
+	if all.Secret != "0123456789abcdef" || len(all.Events) != 2 {
+		t.Fatalf("created %+v, want the given secret and every event", all)
+	}
+
+	for _, tt := range []struct{ body, reason string }{
+		{`{"url":"ftp://example.com/hook"}`, "url"},
+		{`{"url":"/hook"}`, "url"},
+		{`{"url":"https://example.com/hook","secret":"short"}`, "secret"},
+		{`{"url":"https://example.com/hook","events":["wallet.created"]}`, "events"},
+		{`{"url":"https://example.com/hook","events":["transfer.sent","transfer.sent"]}`, "events"},
+	} {
+		w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", tt.body)
+		if e := decodeError(t, w, http.StatusBadRequest, "invalid_request"); !strings.HasPrefix(e.Message, tt.reason) {
+			t.Errorf("%s: %q", tt.body, e.Message)
+		}
+	}
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/ZZZZZZ/webhooks", `{"url":"https://example.com/hook"}`),
+		http.StatusNotFound, "wallet_not_found")
+
+	w = serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks", "")
+	var listed []webhookBody
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); w.Code != http.StatusOK || err != nil || len(listed) != 2 {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	for _, l := range listed {
+		if l.Secret != "" {
+			t.Fatalf("the secret of webhook %d is listed", l.Id)
+		}
+	}
+
+	if _, err := db.RecordDelivery(ctx, store.WebhookDelivery{WebhookId: created.Id, EventId: 7, EventType: store.WebhookTransferReceived,
+		AttemptedAt: testTime, Duration: 12 * time.Millisecond, StatusCode: http.StatusInternalServerError, Error: "status 500"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/v1/wallet/AAAAAA/webhooks/%d", created.Id)
+	w = serve(r, http.MethodGet, path+"/deliveries", "")
+	want := `[{"id":1,"event_id":7,"event_type":"transfer.received","attempted_at":"2024-03-01T12:00:00Z","duration_ms":12,"status_code":500,"error":"status 500"}]`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("deliveries: %d %s", w.Code, w.Body)
+	}
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks/999/deliveries", ""), http.StatusNotFound, "webhook_not_found")
+	decodeError(t, serve(r, http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks/x/deliveries", ""), http.StatusBadRequest, "invalid_request")
+
+	if w := serve(r, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	decodeError(t, serve(r, http.MethodDelete, path, ""), http.StatusNotFound, "webhook_not_found")
+	if hooks, err := db.Webhooks(ctx, "AAAAAA"); err != nil || len(hooks) != 1 || hooks[0].Id != all.Id {
+		t.Fatalf("after the delete %+v, %v", hooks, err)
+	}
+}
+
+func TestWebhooksPerWalletLimit(t *testing.T) {
+	db := openTestStore(t)
+	seedWallets(t, db, newTestWallet("AAAAAA", 100))
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	r := newTestRouter(t, db, cfg)
+
+	for i := 0; i < maxWebhooksPerWallet; i++ {
+		if w := serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`); w.Code != http.StatusCreated {
+			t.Fatalf("webhook %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	decodeError(t, serve(r, http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"https://example.com/hook"}`),
+		http.StatusConflict, "too_many_webhooks")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// runArchive implements the archive command, which moves old transactions
+// out of the table that history lookups read by default:
+//
+//	archive                      archive transactions older than a year
+//	archive -older-than 720h     archive transactions older than 30 days
+//	archive -batch 500           move at most about 500 rows per transaction
+//
+// It returns the process exit code.
+func runArchive(db *store.DB, args []string) int {
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", 365*24*time.Hour, "archive transactions older than this")
+	batch := fs.Int("batch", 1000, "rows to move per transaction")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *olderThan <= 0 || *batch < 1 {
+		fmt.Fprintln(os.Stderr, "-older-than and -batch must be positive")
+		return 2
+	}
+
+	cutoff := time.Now().Add(-*olderThan)
+	moved, err := db.ArchiveTransactions(context.Background(), cutoff, *batch, func(moved int64) {
+		log.Printf("archived %d transactions", moved)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("archived %d transactions older than %s\n", moved, cutoff.Format(time.RFC3339))
+	return 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// runBackup implements the backup command, which writes one snapshot
+// like the admin endpoint does, for use from cron:
+//
+//	backup            write a snapshot into BACKUP_DIR
+//	backup -dir DIR   write it into DIR instead
+//
+// It returns the process exit code.
+func runBackup(db *store.DB, cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := fs.String("dir", cfg.BackupDir, "directory to write the snapshot into")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	info, err := ops.NewBackups(db, *dir, cfg.BackupRetention).Create(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s %d\n", info.Path, info.Size)
+	return 0
+}
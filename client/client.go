@@ -0,0 +1,264 @@
+// Package client is the Go client of the wallet REST API.
+//
+//	c, err := client.New("http://localhost:8080")
+//	w, err := c.CreateWallet(ctx)
+//	w, err = c.Send(ctx, w.Id, to, decimal.RequireFromString("10.50"))
+//	if errors.Is(err, client.ErrInsufficientFunds) { ... }
+//
+// Amounts are decimal.Decimal throughout, so nothing goes through a float.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// firstBackoff is the first wait of WithRetry without a hint of the server.
+const firstBackoff = 100 * time.Millisecond
+
+// Wallet is a wallet and its balance.
+type Wallet struct {
+	Id      string          `json:"id"`
+	Balance decimal.Decimal `json:"balance"`
+	// CreatedAt and TransactionCount are only set by GetWallet. CreatedAt
+	// is nil for old wallets without transactions.
+	CreatedAt        *time.Time `json:"created_at"`
+	TransactionCount int64      `json:"transaction_count"`
+}
+
+// Transaction is a transfer as listed by History.
+type Transaction struct {
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Amount decimal.Decimal `json:"amount"`
+	Time   time.Time       `json:"time"`
+	// Status is pending, completed or failed.
+	Status string `json:"status"`
+	// FailureReason says why a failed transfer was refused.
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// HistoryOptions filter History.
+type HistoryOptions struct {
+	// IncludeArchived adds the transactions moved to the archive.
+	IncludeArchived bool
+	// Status, when set, only lists transactions with that status.
+	Status string
+	// Counterparty, when set, only lists the transactions with that
+	// wallet, in either direction.
+	Counterparty string
+	// Limit, when positive, only lists that many of the newest
+	// transactions, in one request. The server refuses more than its
+	// MAX_PAGE_SIZE.
+	Limit int
+}
+
+// Client calls the API of one server. It is safe for concurrent use.
+type Client struct {
+	base *url.URL
+	http *http.Client
+
+	// attempts and maxDelay are set by WithRetry
+	attempts int
+	maxDelay time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests through hc, for its
+// timeouts, transport or instrumentation. http.DefaultClient is used
+// otherwise.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithRetry makes the client retry the requests the server throttled:
+// the 429s and 503s carrying a Retry-After hint, which the server only
+// sends when it refused a request without acting on it, so retrying a
+// Send is safe too. A request is tried at most attempts times, waiting for
+// the longer of the server's hint and an exponential backoff from 100ms
+// capped at maxDelay. When the server asks for a longer wait than
+// maxDelay, its error is returned instead.
+func WithRetry(attempts int, maxDelay time.Duration) Option {
+	return func(c *Client) {
+		c.attempts = attempts
+		c.maxDelay = maxDelay
+	}
+}
+
+// New returns a client of the server at baseURL, such as
+// http://localhost:8080.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("client: %q is not an http or https URL", baseURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	c := &Client{base: base, http: http.DefaultClient, attempts: 1}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CreateWallet creates a wallet with the initial balance.
+func (c *Client) CreateWallet(ctx context.Context) (Wallet, error) {
+	var w Wallet
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/wallet", nil, nil, http.StatusCreated, &w)
+	return w, err
+}
+
+// GetWallet returns a wallet, or an error matching ErrNotFound.
+func (c *Client) GetWallet(ctx context.Context, id string) (Wallet, error) {
+	var w Wallet
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/wallet/"+url.PathEscape(id), nil, nil, http.StatusOK, &w)
+	return w, err
+}
+
+// Send transfers amount from one wallet to another and returns the
+// sender's wallet with its new balance.
+func (c *Client) Send(ctx context.Context, from, to string, amount decimal.Decimal) (Wallet, error) {
+	body := struct {
+		To     string          `json:"to"`
+		Amount decimal.Decimal `json:"amount"`
+	}{to, amount}
+	var w Wallet
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/wallet/"+url.PathEscape(from)+"/send", nil, body, http.StatusOK, &w)
+	return w, err
+}
+
+// History lists the transactions of a wallet, newest first: the newest
+// opts.Limit, or all of them, following the pages the server returns.
+func (c *Client) History(ctx context.Context, id string, opts HistoryOptions) ([]Transaction, error) {
+	query := url.Values{}
+	if opts.IncludeArchived {
+		query.Set("include_archived", "true")
+	}
+	if opts.Status != "" {
+		query.Set("status", opts.Status)
+	}
+	if opts.Counterparty != "" {
+		query.Set("counterparty", opts.Counterparty)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var transactions []Transaction
+	for {
+		var page []Transaction
+		header, err := c.do(ctx, http.MethodGet, "/api/v1/wallet/"+url.PathEscape(id)+"/history", query, nil, http.StatusOK, &page)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, page...)
+		next := header.Get("X-Next-Cursor")
+		if opts.Limit > 0 || next == "" {
+			return transactions, nil
+		}
+		query.Set("cursor", next)
+	}
+}
+
+// do sends a request with body as JSON and decodes a response with the
+// status want into out, returning its header. Any other status is
+// returned as an *Error. Throttled requests are retried as WithRetry says.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, want int, out any) (http.Header, error) {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		header, err := c.send(ctx, method, u.String(), b, want, out)
+		var e *Error
+		if attempt >= c.attempts || !errors.As(err, &e) || !e.throttled() || e.RetryAfter > c.maxDelay {
+			return header, err
+		}
+		delay := max(min(firstBackoff<<(attempt-1), c.maxDelay), e.RetryAfter)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt of a request.
+func (c *Client) send(ctx context.Context, method, rawURL string, body []byte, want int, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		return nil, newError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("client: decoding the response of %s %s: %w", method, req.URL.Path, err)
+	}
+	return resp.Header, nil
+}
+
+// newError reads the error response of the server. Responses not in its
+// error shape, say from a proxy, keep their status as the message.
+func newError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode, RequestId: resp.Header.Get("X-Request-ID")}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Code         string        `json:"code"`
+		Message      string        `json:"error"`
+		RetryAfterMs int64         `json:"retry_after_ms"`
+		Details      []FieldDetail `json:"details"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Code != "" {
+		e.Code, e.Message, e.Details = body.Code, body.Message, body.Details
+		// more precise than the header's whole seconds
+		if body.RetryAfterMs > 0 {
+			e.RetryAfter = time.Duration(body.RetryAfterMs) * time.Millisecond
+		}
+	} else {
+		e.Message = resp.Status
+	}
+	return e
+}
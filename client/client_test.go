@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// throttlingServer answers the first refusals requests with a throttling
+// 503 carrying retryAfterMs, then creates a wallet. It counts the requests.
+func throttlingServer(t *testing.T, refusals int64, retryAfterMs int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if requests.Add(1) <= refusals {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"code":"maintenance","error":"upgrading","retry_after_ms":` + strconv.Itoa(retryAfterMs) + `}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"AAAAAA","balance":"100"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &requests
+}
+
+func TestRetryThrottled(t *testing.T) {
+	ts, requests := throttlingServer(t, 2, 30)
+	c, err := New(ts.URL, WithRetry(3, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	w, err := c.CreateWallet(context.Background())
+	if err != nil || w.Id != "AAAAAA" {
+		t.Fatalf("CreateWallet: %+v, %v", w, err)
+	}
+	if requests.Load() != 3 {
+		t.Fatalf("%d requests, want 3", requests.Load())
+	}
+	// the server's 30ms hint is shorter than the backoff of 100ms, then 200ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("retried after %s, before the backoff", elapsed)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		hintMs   int
+		requests int64
+	}{
+		{"without WithRetry", nil, 10, 1},
+		{"after the attempts", []Option{WithRetry(2, time.Second)}, 10, 2},
+		{"hint longer than maxDelay", []Option{WithRetry(5, 50*time.Millisecond)}, 60000, 1},
+	}
+	for _, tt := range tests {
+		ts, requests := throttlingServer(t, 10, tt.hintMs)
+		c, err := New(ts.URL, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.CreateWallet(context.Background())
+		var e *Error
+		if !errors.Is(err, ErrMaintenance) || !errors.As(err, &e) || e.RetryAfter != time.Duration(tt.hintMs)*time.Millisecond {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if requests.Load() != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, requests.Load(), tt.requests)
+		}
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	ts, requests := throttlingServer(t, 10, 500)
+	c, err := New(ts.URL, WithRetry(5, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.CreateWallet(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CreateWallet = %v", err)
+	}
+	if time.Since(start) > 400*time.Millisecond || requests.Load() != 1 {
+		t.Fatalf("waited %s for %d requests after the context ended", time.Since(start), requests.Load())
+	}
+}
+
+func TestErrorWithoutBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetWallet(context.Background(), "AAAAAA")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "" || e.Message != "502 Bad Gateway" || e.RetryAfter != 3*time.Second {
+		t.Fatalf("GetWallet = %#v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatal("an error without a code matched a sentinel")
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	var query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts HistoryOptions
+		want string
+	}{
+		{HistoryOptions{}, ""},
+		{HistoryOptions{Limit: 50}, "limit=50"},
+		{HistoryOptions{Limit: -1}, ""},
+		{HistoryOptions{Counterparty: "BBBBBB", Limit: 1}, "counterparty=BBBBBB&limit=1"},
+	}
+	for _, tt := range tests {
+		if _, err := c.History(context.Background(), "AAAAAA", tt.opts); err != nil || query != tt.want {
+			t.Errorf("History(%+v) asked for %q, %v, want %q", tt.opts, query, err, tt.want)
+		}
+	}
+}
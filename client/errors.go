@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The errors an *Error matches with errors.Is, by its code.
+var (
+	ErrNotFound          = errors.New("wallet not found")
+	ErrRecipientNotFound = errors.New("recipient wallet not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidWalletId   = errors.New("invalid wallet id")
+	ErrInvalidAmount     = errors.New("invalid amount")
+	// ErrConflict is a transfer that lost a race with another one, it
+	// can be retried.
+	ErrConflict = errors.New("wallet changed during the transfer")
+	// ErrMaintenance is a change refused while the server is in
+	// maintenance mode, see Error.RetryAfter.
+	ErrMaintenance = errors.New("server in maintenance mode")
+)
+
+// codes maps the codes of the API to the errors above.
+var codes = map[string]error{
+	"wallet_not_found":           ErrNotFound,
+	"recipient_not_found":        ErrRecipientNotFound,
+	"insufficient_funds":         ErrInsufficientFunds,
+	"invalid_wallet_id":          ErrInvalidWalletId,
+	"invalid_wallet_id_checksum": ErrInvalidWalletId,
+	"invalid_amount":             ErrInvalidAmount,
+	"wallet_conflict":            ErrConflict,
+	"maintenance":                ErrMaintenance,
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int
+	// Code is the stable code of the error, such as insufficient_funds.
+	// It's empty for responses that didn't come from the server itself.
+	Code    string
+	Message string
+	// RequestId is the X-Request-ID of the response, to find it in the
+	// server's log.
+	RequestId string
+	// RetryAfter is how long the server asked to wait before retrying,
+	// zero when it didn't say.
+	RetryAfter time.Duration
+	// Details are the fields of a validation_failed request the server
+	// refused, and why.
+	Details []FieldDetail
+}
+
+// FieldDetail is a field of a request body the server could not use.
+type FieldDetail struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("client: %s", e.Message)
+	}
+	return fmt.Sprintf("client: %s: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is the error of e's code.
+func (e *Error) Is(target error) bool {
+	err, ok := codes[e.Code]
+	return ok && err == target
+}
+
+// throttled reports whether the server refused the request for now and
+// said when to try again, see WithRetry.
+func (e *Error) throttled() bool {
+	return (e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable) && e.RetryAfter > 0
+}
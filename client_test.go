@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/client"
+	"kordimion/secure-web-service/store"
+)
+
+// countingTransport counts the requests it passes on.
+type countingTransport struct {
+	requests atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestClient drives the server with package client, so that the two
+// can't drift apart.
+func TestClient(t *testing.T) {
+	ts := httptest.NewServer(newTestHandler(t))
+	defer ts.Close()
+	transport := &countingTransport{}
+	c, err := client.New(ts.URL+"/", client.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	a, err := c.CreateWallet(ctx)
+	if err != nil || !a.Balance.Equal(store.InitialBalance) {
+		t.Fatalf("CreateWallet: %+v, %v", a, err)
+	}
+	b, err := c.CreateWallet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests.Load() != 2 {
+		t.Fatalf("%d requests through the injected client", transport.requests.Load())
+	}
+
+	sent, err := c.Send(ctx, a.Id, b.Id, decimal.RequireFromString("30.25"))
+	if err != nil || sent.Id != a.Id || sent.Balance.String() != "69.75" {
+		t.Fatalf("Send: %+v, %v", sent, err)
+	}
+	if _, err := c.Send(ctx, b.Id, a.Id, decimal.RequireFromString("0.1")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetWallet(ctx, b.Id)
+	if err != nil || got.Balance.String() != "130.15" || got.TransactionCount != 2 || got.CreatedAt == nil {
+		t.Fatalf("GetWallet: %+v, %v", got, err)
+	}
+
+	history, err := c.History(ctx, a.Id, client.HistoryOptions{})
+	if err != nil || len(history) != 2 {
+		t.Fatalf("History: %+v, %v", history, err)
+	}
+	for _, tx := range history {
+		if tx.Status != store.StatusCompleted || tx.Time.IsZero() {
+			t.Fatalf("transaction %+v", tx)
+		}
+	}
+	if h, err := c.History(ctx, a.Id, client.HistoryOptions{Limit: 1}); err != nil || len(h) != 1 {
+		t.Fatalf("History with a limit: %+v, %v", h, err)
+	}
+	if h, err := c.History(ctx, a.Id, client.HistoryOptions{Counterparty: a.Id}); err != nil || len(h) != 0 {
+		t.Fatalf("History with a counterparty: %+v, %v", h, err)
+	}
+	// more than a page of the server, which History follows to the end
+	for i := 0; i < 60; i++ {
+		if _, err := c.Send(ctx, b.Id, a.Id, decimal.RequireFromString("0.01")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := transport.requests.Load()
+	if h, err := c.History(ctx, a.Id, client.HistoryOptions{}); err != nil || len(h) != 62 || h[61].Amount.String() != "30.25" {
+		t.Fatalf("History of two pages: %d transactions, %v", len(h), err)
+	}
+	if pages := transport.requests.Load() - before; pages != 2 {
+		t.Fatalf("History of two pages took %d requests", pages)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"insufficient funds", sendErr(c, a.Id, b.Id, "1000"), client.ErrInsufficientFunds},
+		{"unknown sender", sendErr(c, "ZZZZZZ", b.Id, "1"), client.ErrNotFound},
+		{"unknown recipient", sendErr(c, a.Id, "ZZZZZZ", "1"), client.ErrRecipientNotFound},
+		{"invalid id", sendErr(c, "A", b.Id, "1"), client.ErrInvalidWalletId},
+		{"too precise", sendErr(c, a.Id, b.Id, "0.001"), client.ErrInvalidAmount},
+	}
+	for _, tt := range tests {
+		var e *client.Error
+		if !errors.Is(tt.err, tt.want) || !errors.As(tt.err, &e) || e.RequestId == "" || e.Message == "" {
+			t.Errorf("%s: %v, want %v with a request id", tt.name, tt.err, tt.want)
+		}
+	}
+	if _, err := c.GetWallet(ctx, "ZZZZZZ"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetWallet of an unknown wallet: %v", err)
+	}
+}
+
+func sendErr(c *client.Client, from, to, amount string) error {
+	_, err := c.Send(context.Background(), from, to, decimal.RequireFromString(amount))
+	return err
+}
+
+func TestClientNew(t *testing.T) {
+	for _, url := range []string{"localhost:8080", "ftp://localhost", "http://", "%zz"} {
+		if _, err := client.New(url); err == nil {
+			t.Errorf("New(%q) accepted", url)
+		}
+	}
+}
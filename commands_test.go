@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// captureStdout returns what fn printed to standard output along with its
+// result.
+func captureStdout(t *testing.T, fn func() int) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	code := fn()
+	os.Stdout = old
+	w.Close()
+	return code, <-out
+}
+
+func TestMigrateCommand(t *testing.T) {
+	db := openTestDB(t, false)
+	ctx := context.Background()
+
+	code, out := captureStdout(t, func() int { return runMigrate(db, []string{"-plan"}) })
+	if code != 0 || !strings.Contains(out, "schema version 0") {
+		t.Fatalf("plan: %d %q", code, out)
+	}
+	if v, err := db.SchemaVersion(ctx); err != nil || v != 0 {
+		t.Fatalf("planning migrated to %d, %v", v, err)
+	}
+
+	code, out = captureStdout(t, func() int { return runMigrate(db, nil) })
+	if v, err := db.SchemaVersion(ctx); code != 0 || err != nil || v != store.LatestVersion() {
+		t.Fatalf("migrate: %d, version %d, %v: %q", code, v, err, out)
+	}
+	if code, out = captureStdout(t, func() int { return runMigrate(db, nil) }); code != 0 || !strings.Contains(out, "nothing to do") {
+		t.Fatalf("again: %d %q", code, out)
+	}
+	if code := runMigrate(db, []string{"-to", "1000"}); code != 1 {
+		t.Fatalf("unknown version: exit code %d", code)
+	}
+	if code := runMigrate(db, []string{"-bogus"}); code != 2 {
+		t.Fatalf("bad flag: exit code %d", code)
+	}
+}
+
+func TestCreateWalletCommand(t *testing.T) {
+	db := openTestDB(t, true)
+	cfg := testConfig(t)
+	ctx := context.Background()
+
+	var created struct {
+		Id      string `json:"id"`
+		Balance string `json:"balance"`
+	}
+	code, out := captureStdout(t, func() int { return runCreateWallet(db, cfg, nil) })
+	if err := json.Unmarshal([]byte(out), &created); code != 0 || err != nil || !cfg.WalletIds.Matches(created.Id) {
+		t.Fatalf("generated: %d %q", code, out)
+	}
+	if w, err := db.GetWallet(ctx, created.Id); err != nil || !w.Balance.Equal(store.InitialBalance) {
+		t.Fatalf("stored %+v, %v", w, err)
+	}
+
+	code, out = captureStdout(t, func() int { return runCreateWallet(db, cfg, []string{"-id", "AAAAAA", "-balance", "250.5"}) })
+	if code != 0 || strings.TrimSpace(out) != `{"id":"AAAAAA","balance":"250.5"}` {
+		t.Fatalf("with id and balance: %d %q", code, out)
+	}
+	if w, err := db.GetWallet(ctx, "AAAAAA"); err != nil || w.Balance.String() != "250.5" || !w.CreatedAt.Valid {
+		t.Fatalf("stored %+v, %v", w, err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-id", "AAAAAA"}, 3},
+		{[]string{"-id", "A"}, 2},
+		{[]string{"-balance", "-5"}, 2},
+		{[]string{"-balance", "1.001"}, 2},
+		{[]string{"-balance", "lots"}, 2},
+		{[]string{"extra"}, 2},
+	} {
+		if code, _ := captureStdout(t, func() int { return runCreateWallet(db, cfg, tt.args) }); code != tt.want {
+			t.Errorf("%q: exit code %d, want %d", tt.args, code, tt.want)
+		}
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	db := openTestDB(t, true)
+	cfg := testConfig(t)
+	captureStdout(t, func() int { return runCreateWallet(db, cfg, []string{"-id", "AAAAAA"}) })
+
+	if code, out := captureStdout(t, func() int { return runVerify(db, nil, strings.NewReader("")) }); code != 0 {
+		t.Fatalf("consistent database: %d %q", code, out)
+	}
+	if _, err := db.Exec("update wallets set balance_cents = balance_cents + 500 where id = 'AAAAAA'"); err != nil {
+		t.Fatal(err)
+	}
+	code, out := captureStdout(t, func() int { return runVerify(db, nil, strings.NewReader("")) })
+	if code != 1 || !strings.Contains(out, "wallet AAAAAA: balance 105, ledger says 100") {
+		t.Fatalf("mismatch: %d %q", code, out)
+	}
+	if code, _ := captureStdout(t, func() int { return runVerify(db, []string{"-fix"}, strings.NewReader("no\n")) }); code != 1 {
+		t.Fatalf("fix declined: exit code %d", code)
+	}
+	if code, out := captureStdout(t, func() int { return runVerify(db, []string{"-fix", "-yes"}, nil) }); code != 0 || !strings.Contains(out, "rewrote 1 balances") {
+		t.Fatalf("fix: %d %q", code, out)
+	}
+	if code, out := captureStdout(t, func() int { return runVerify(db, nil, nil) }); code != 0 {
+		t.Fatalf("after the fix: %d %q", code, out)
+	}
+}
+
+func TestVerifyReportsUndatedTransactions(t *testing.T) {
+	db := openTestDB(t, true)
+	cfg := testConfig(t)
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		captureStdout(t, func() int { return runCreateWallet(db, cfg, []string{"-id", id}) })
+	}
+	ctx := context.Background()
+	for _, amount := range []int64{1, 2} {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(amount), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert := "insert into %s(from_wallet_id, to_wallet_id, amount_cents, date, status) values('AAAAAA', 'BBBBBB', 0, ?, 'completed')"
+	// a date is required
+	if _, err := db.Exec(fmt.Sprintf(insert, "wallet_transactions"), nil); err == nil {
+		t.Fatal("a transaction without a date was stored")
+	}
+	// but the drivers read one they can't parse, or a zero date, as year 1
+	if _, err := db.Exec("update wallet_transactions set date = 'garbage' where amount_cents = 100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf(insert, "wallet_transactions_archive"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, out := captureStdout(t, func() int { return runVerify(db, nil, nil) })
+	if code != 1 || strings.Count(out, "has no valid date") != 2 || !strings.Contains(out, "2 have no valid date") {
+		t.Fatalf("exit code %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "transaction AAAAAA -> BBBBBB of 1 (completed): has no valid date") {
+		t.Fatalf("the live transaction isn't reported:\n%s", out)
+	}
+}
+
+func TestVerifyReportsBalanceGaps(t *testing.T) {
+	db := openTestDB(t, true)
+	cfg := testConfig(t)
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		captureStdout(t, func() int { return runCreateWallet(db, cfg, []string{"-id", id}) })
+	}
+	ctx := context.Background()
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, amount := range []int64{1, 2} {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(amount), at.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, out := captureStdout(t, func() int { return runVerify(db, nil, nil) }); code != 0 {
+		t.Fatalf("consistent database: %d %q", code, out)
+	}
+	if _, err := db.Exec("update wallet_transactions set from_balance_after_cents = 9000 where amount_cents = 200"); err != nil {
+		t.Fatal(err)
+	}
+	code, out := captureStdout(t, func() int { return runVerify(db, nil, nil) })
+	if code != 1 || !strings.Contains(out, "0 balances don't match the ledger") || !strings.Contains(out, "1 record a balance that doesn't follow") {
+		t.Fatalf("exit code %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "transaction AAAAAA -> BBBBBB of 2 at 2024-03-01T12:01:00Z: wallet AAAAAA has a balance of 90 after it, the transaction before gives 97") {
+		t.Fatalf("the gap isn't reported:\n%s", out)
+	}
+}
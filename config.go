@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"kordimion/secure-web-service/config"
+)
+
+// runConfig implements the config command:
+//
+//	config validate [-config FILE] [server flags]
+//
+// validate loads the configuration the server would run with, reporting
+// the first problem or printing the effective settings. It returns the
+// process exit code.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: config validate [-config FILE] [server flags]")
+		return 2
+	}
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	slog.New(slog.NewJSONHandler(os.Stdout, nil)).Info("configuration is valid", "config", cfg)
+	return 0
+}
@@ -0,0 +1,920 @@
+// Package config loads the service settings from the environment and
+// the server's command line flags.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/walletid"
+)
+
+// Config holds the service settings that can be changed without recompiling.
+type Config struct {
+	// File is the config file the settings were read from, if any.
+	File string
+	// Addr is the host:port the server listens on. An empty host listens
+	// on all interfaces.
+	Addr string
+	// SocketMode are the permissions of the socket file when Addr is a
+	// Unix domain socket.
+	SocketMode os.FileMode
+	// ListenFD, when not 0, is an inherited listening socket to serve on
+	// instead of listening on Addr.
+	ListenFD int
+	// ShutdownGrace is how long in-flight requests get to finish on
+	// SIGINT or SIGTERM before they are cancelled.
+	ShutdownGrace time.Duration
+	// HTTPReadHeaderTimeout is how long a client gets to send the headers
+	// of a request, so that slow clients can't hold connections forever.
+	HTTPReadHeaderTimeout time.Duration
+	// HTTPReadTimeout bounds reading a whole request, body included, 0 for
+	// no limit.
+	HTTPReadTimeout time.Duration
+	// HTTPWriteTimeout bounds a request from the end of its headers to the
+	// end of the response, 0 for no limit. A request still running then
+	// loses its connection rather than getting an answer, so it is longer
+	// than RequestTimeout and SendTimeout. The admin endpoints clear both
+	// deadlines and streamed history extends it as rows are sent.
+	HTTPWriteTimeout time.Duration
+	// HTTPIdleTimeout is how long a keep-alive connection waits for the
+	// next request.
+	HTTPIdleTimeout time.Duration
+	// HTTPMaxHeaderBytes bounds the size of the request headers, 1 MiB
+	// like net/http unless set.
+	HTTPMaxHeaderBytes int
+	// HTTPMaxConnections, when not 0, is the most connections the main
+	// listener keeps open at once. Further ones wait in the listen backlog.
+	HTTPMaxConnections int
+	// GinMode is the gin mode: release, debug or test.
+	GinMode string
+	// Middleware are the names of the middleware every request goes
+	// through, outermost first. See api.NewRouter for the known names.
+	Middleware []string
+	// LogFormat is how log lines are written: json, one object per line,
+	// or text.
+	LogFormat string
+	// LogLevel is the level logging starts at. It can be changed while
+	// the server runs, see the admin loglevel endpoint.
+	LogLevel slog.Level
+	// LogRedact shortens wallet ids in log lines to a prefix and a hash
+	// and leaves amounts and balances out of all but debug lines.
+	LogRedact bool
+	// AccessLogSkipPaths are request paths left out of the access log,
+	// such as health checks.
+	AccessLogSkipPaths []string
+	// AccessLogSampleRates keeps 1 in rate requests of a route in the
+	// access log, keyed by method and route like
+	// "GET /api/v1/wallet/:walletid". Failed and slow requests are always
+	// logged.
+	AccessLogSampleRates map[string]int
+	// AccessLogSlow is the latency from which a request of a sampled
+	// route is always logged.
+	AccessLogSlow time.Duration
+	// RequestTimeout bounds the wallet endpoints other than send, 0 for no limit.
+	RequestTimeout time.Duration
+	// SendTimeout bounds the send endpoint, 0 for no limit. The admin
+	// endpoints have no limit, export and import stream whole databases.
+	SendTimeout time.Duration
+	// ClientDeadlineMax bounds the deadline a caller can set with the
+	// X-Request-Deadline or X-Request-Timeout-Ms header on the endpoints
+	// above. The sooner of it and their timeout wins.
+	ClientDeadlineMax time.Duration
+	// DebugEndpoints serves pprof profiles and runtime statistics under /debug/.
+	DebugEndpoints bool
+	// DebugAddr, when set, serves the debug endpoints on their own
+	// listener, such as 127.0.0.1:6060, instead of behind the admin
+	// allowlist of the main one.
+	DebugAddr string
+	// GRPCAddr, when set, serves the experimental gRPC API of package rpc
+	// on its own listener, such as :9090.
+	GRPCAddr string
+	// Metrics serves Prometheus metrics at /metrics, behind the admin
+	// allowlist.
+	Metrics bool
+	// MetricsAmountBuckets are the upper bounds of the buckets of the
+	// transfer amount histogram, in currency units.
+	MetricsAmountBuckets []float64
+	// MetricsLatencyBuckets are the upper bounds of the buckets of the
+	// duration histograms, in seconds.
+	MetricsLatencyBuckets []float64
+	// DatabaseURL selects the database; see store.Open for the accepted forms.
+	DatabaseURL string
+	// DBHealthInterval is how often the database health check runs.
+	DBHealthInterval time.Duration
+	// DBHealthTimeout bounds a health check.
+	DBHealthTimeout time.Duration
+	// DBHealthFailures is how many failed health checks in a row make the
+	// database unhealthy, see ops.DBHealth.
+	DBHealthFailures int
+	// MoneyScale is the number of decimal places amounts are stored with.
+	// It is fixed once the database has been migrated.
+	MoneyScale int32
+	// MoneyRounding is how amounts the service computes are rounded to
+	// MoneyScale: half_up or half_even, see store.DB.ToMinorRounded.
+	MoneyRounding string
+	// MoneyJSON is how the API writes amounts and balances: string, a JSON
+	// string like "10.50" that no client rounds, or number.
+	MoneyJSON string
+	// StrictAmounts accepts only plain fixed-point amounts like 10.50 in
+	// requests, refusing forms such as 1e3, +10, 010 or 10. that are read
+	// as decimals otherwise.
+	StrictAmounts bool
+	// MaxPageSize is the largest limit a listing endpoint accepts, such as
+	// the outbox or a wallet's history.
+	MaxPageSize int
+	// MigrateOnStart applies pending schema migrations when the server starts.
+	// When off, the server refuses to start with pending migrations.
+	MigrateOnStart bool
+	// AdminAllowedNets are the client networks allowed to reach /api/v1/admin.
+	// Clients on a Unix domain socket are always allowed.
+	AdminAllowedNets []*net.IPNet
+	// AdminUI serves the wallet lookup page at /admin/ui/, to the same
+	// clients as the admin endpoints.
+	AdminUI bool
+	// APIDocs serves a page rendering the OpenAPI document at /docs. The
+	// page loads Redoc from its CDN. /openapi.json is always served.
+	APIDocs bool
+	// TrustedProxies are the proxies whose X-Forwarded-For / X-Real-IP
+	// headers are believed. When empty the socket peer address is used.
+	TrustedProxies []string
+	// WalletIdAttempts is how many ids are tried when creating a wallet
+	// before giving up because all of them were taken.
+	WalletIdAttempts int
+	// WalletIds is the format of generated and accepted wallet ids.
+	WalletIds walletid.Format
+	// MinFreeDiskBytes is the free space a SQLite database's directory
+	// needs for the server to start, 0 to skip the check.
+	MinFreeDiskBytes int64
+	// StartupIntegrityCheck runs SQLite's quick_check before the server
+	// starts: off, warn, which logs the problems and starts anyway, or
+	// fail, which refuses to start. It reads the whole file, so it takes
+	// a while on a big database.
+	StartupIntegrityCheck string
+	// BackupDir is where backups of the database are written.
+	BackupDir string
+	// BackupRetention is how many backups are kept, 0 keeps all of them.
+	BackupRetention int
+	// MaintenanceAt is the UTC time of day maintenance runs at every day,
+	// as an offset from midnight. Negative disables scheduled maintenance.
+	MaintenanceAt time.Duration
+	// MaintenanceVacuum adds VACUUM to the maintenance steps.
+	MaintenanceVacuum bool
+	// MaintenanceMode starts the server read-only, refusing every request
+	// that changes wallets with a 503. Without it the mode stored in the
+	// database by the admin endpoint is used.
+	MaintenanceMode bool
+	// MaintenanceMessage is the error message of those 503s.
+	MaintenanceMessage string
+	// MaintenanceRetryAfter is sent as Retry-After with those 503s.
+	MaintenanceRetryAfter time.Duration
+	// RecordFailedTransfers keeps a failed transaction for every transfer
+	// refused for insufficient funds.
+	RecordFailedTransfers bool
+	// BalanceCacheTTL, when not 0, caches wallets read by the API for that
+	// long. Transfers on this server invalidate the wallets they touch,
+	// those of other servers on the same database show after the TTL.
+	BalanceCacheTTL time.Duration
+	// Features switches features on and off, see the Feature constants.
+	Features Features
+	// EventSinks are where the events of the outbox are delivered to,
+	// see EventSinkNames. The webhooks feature adds its own sink; without
+	// any sink no events are recorded.
+	EventSinks []string
+	// NATSURL is the server of the nats sink, nats://[user:pass@]host:port
+	// or nats://token@host:port.
+	NATSURL string
+	// NATSSubject is the subject events are published to by the nats
+	// sink, where {type} stands for the event type and {wallet_id} for
+	// each wallet of a transfer.
+	NATSSubject string
+	// NATSJetStream waits for a JetStream stream to acknowledge every
+	// event; a stream must capture NATSSubject.
+	NATSJetStream bool
+	// NATSTimeout bounds connecting and every publish.
+	NATSTimeout time.Duration
+	// OutboxInterval is how often due events are delivered.
+	OutboxInterval time.Duration
+	// OutboxMaxAttempts is how many failed deliveries make an event dead.
+	OutboxMaxAttempts int
+	// OutboxRetention is how long delivered events are kept.
+	OutboxRetention time.Duration
+	// WebhookTimeout bounds a single webhook delivery.
+	WebhookTimeout time.Duration
+	// WebhookDisableAfter is how long a webhook may keep failing before
+	// it is disabled.
+	WebhookDisableAfter time.Duration
+	// WebSocketMaxPerWallet bounds the live connections watching one wallet.
+	WebSocketMaxPerWallet int
+	// WebSocketPingInterval is how often live connections are pinged; a
+	// client silent for two intervals is dropped.
+	WebSocketPingInterval time.Duration
+	// WebSocketWriteTimeout bounds every write to a live connection.
+	WebSocketWriteTimeout time.Duration
+	// TransferQueueInterval is how often the transfer queue looks for
+	// queued transfers when it is empty.
+	TransferQueueInterval time.Duration
+	// TransferQueueWorkers is how many senders' transfers are applied at
+	// once. The transfers of one sender are applied in order.
+	TransferQueueWorkers int
+	// TransferQueueRetention is how long completed and failed queued
+	// transfers can still be looked up.
+	TransferQueueRetention time.Duration
+}
+
+// EventSinkNames are the known EventSinks.
+var EventSinkNames = []string{"log", "nats"}
+
+var defaultAdminAllowedCIDRs = "127.0.0.0/8,::1/128"
+
+var defaultMiddleware = "recovery,request_id,trace_context,access_log"
+
+// Load reads the configuration from the config file, the environment and
+// the server's command line flags in args, each one winning over the ones
+// before. The file is named by -config or CONFIG_FILE and is optional.
+// It returns an error if any of the values can't be parsed,
+// in which case the service should refuse to start.
+func Load(args []string) (Config, error) {
+	var cfg Config
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFlag := fs.String("config", "", "YAML file to read the settings from (env CONFIG_FILE)")
+	fs.String("addr", "", "host:port to listen on (env LISTEN_ADDR)")
+	fs.String("host", "", "host or IP to listen on, empty for all interfaces (env HOST)")
+	fs.String("port", "", "port to listen on (env PORT, default 8080)")
+	listenFD := fs.Int("listen-fd", 0, "serve on the already listening socket with this file descriptor")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	cfg.File = os.Getenv("CONFIG_FILE")
+	if *configFlag != "" {
+		cfg.File = *configFlag
+	}
+	s, err := loadSettings(cfg.File)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Addr, err = listenAddr(s, fs)
+	if err != nil {
+		return cfg, err
+	}
+	if *listenFD < 0 || *listenFD > 0 && *listenFD < 3 {
+		return cfg, fmt.Errorf("-listen-fd: %d is not a socket, descriptors 0 to 2 are stdio", *listenFD)
+	}
+	cfg.ListenFD = *listenFD
+	cfg.SocketMode = 0o660
+	if v := s.get("SOCKET_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0o777 {
+			return cfg, fmt.Errorf("SOCKET_MODE: %q is not an octal file mode like 0660", v)
+		}
+		cfg.SocketMode = os.FileMode(mode)
+	}
+	cfg.ShutdownGrace, err = s.duration("SHUTDOWN_GRACE", 15*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownGrace < 0 {
+		return cfg, fmt.Errorf("SHUTDOWN_GRACE: must not be negative")
+	}
+
+	cfg.GinMode = s.get("GIN_MODE")
+	switch cfg.GinMode {
+	case "":
+		cfg.GinMode = "release"
+	case "release", "debug", "test":
+	default:
+		return cfg, fmt.Errorf("GIN_MODE: must be release, debug or test")
+	}
+	middleware, ok := s.lookup("MIDDLEWARE")
+	if !ok {
+		middleware = defaultMiddleware
+	}
+	for _, name := range strings.Split(middleware, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cfg.Middleware = append(cfg.Middleware, name)
+		}
+	}
+
+	cfg.LogFormat = s.get("LOG_FORMAT")
+	switch cfg.LogFormat {
+	case "":
+		cfg.LogFormat = "json"
+	case "json", "text":
+	default:
+		return cfg, fmt.Errorf("LOG_FORMAT: must be json or text")
+	}
+	if v := s.get("LOG_LEVEL"); v != "" {
+		cfg.LogLevel, err = ParseLevel(v)
+		if err != nil {
+			return cfg, fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+	cfg.LogRedact, err = s.boolean("LOG_REDACT", false)
+	if err != nil {
+		return cfg, err
+	}
+	for _, path := range strings.Split(s.get("ACCESS_LOG_SKIP_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			cfg.AccessLogSkipPaths = append(cfg.AccessLogSkipPaths, path)
+		}
+	}
+	cfg.AccessLogSampleRates, err = parseSampleRates(s.get("ACCESS_LOG_SAMPLE_RATES"))
+	if err != nil {
+		return cfg, fmt.Errorf("ACCESS_LOG_SAMPLE_RATES: %w", err)
+	}
+	cfg.AccessLogSlow, err = s.duration("ACCESS_LOG_SLOW", time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.AccessLogSlow <= 0 {
+		return cfg, fmt.Errorf("ACCESS_LOG_SLOW: must be positive")
+	}
+
+	cfg.RequestTimeout, err = s.duration("REQUEST_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SendTimeout, err = s.duration("SEND_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.RequestTimeout < 0 || cfg.SendTimeout < 0 {
+		return cfg, fmt.Errorf("REQUEST_TIMEOUT and SEND_TIMEOUT: must not be negative")
+	}
+	cfg.ClientDeadlineMax, err = s.duration("CLIENT_DEADLINE_MAX", time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.ClientDeadlineMax < time.Millisecond {
+		return cfg, fmt.Errorf("CLIENT_DEADLINE_MAX: must be at least 1ms")
+	}
+	cfg.HTTPReadHeaderTimeout, err = s.duration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPReadHeaderTimeout <= 0 {
+		return cfg, fmt.Errorf("HTTP_READ_HEADER_TIMEOUT: must be positive")
+	}
+	cfg.HTTPReadTimeout, err = s.duration("HTTP_READ_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.HTTPWriteTimeout, err = s.duration("HTTP_WRITE_TIMEOUT", time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.HTTPIdleTimeout, err = s.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPReadTimeout < 0 || cfg.HTTPWriteTimeout < 0 || cfg.HTTPIdleTimeout < 0 {
+		return cfg, fmt.Errorf("HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT: must not be negative")
+	}
+	if cfg.HTTPWriteTimeout > 0 && (cfg.HTTPWriteTimeout <= cfg.RequestTimeout || cfg.HTTPWriteTimeout <= cfg.SendTimeout) {
+		return cfg, fmt.Errorf("HTTP_WRITE_TIMEOUT: must be longer than REQUEST_TIMEOUT and SEND_TIMEOUT, or their 504 is never written")
+	}
+	cfg.HTTPMaxHeaderBytes, err = s.integer("HTTP_MAX_HEADER_BYTES", 1<<20)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxHeaderBytes < 1024 {
+		return cfg, fmt.Errorf("HTTP_MAX_HEADER_BYTES: must be at least 1024")
+	}
+	cfg.HTTPMaxConnections, err = s.integer("HTTP_MAX_CONNECTIONS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxConnections < 0 {
+		return cfg, fmt.Errorf("HTTP_MAX_CONNECTIONS: must not be negative")
+	}
+
+	cfg.DebugEndpoints, err = s.boolean("DEBUG_ENDPOINTS", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DebugAddr = s.get("DEBUG_ADDR")
+	if cfg.DebugAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.DebugAddr); err != nil {
+			return cfg, fmt.Errorf("DEBUG_ADDR: %q is not a host:port address", cfg.DebugAddr)
+		}
+	}
+	cfg.GRPCAddr = s.get("GRPC_ADDR")
+	if cfg.GRPCAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.GRPCAddr); err != nil {
+			return cfg, fmt.Errorf("GRPC_ADDR: %q is not a host:port address", cfg.GRPCAddr)
+		}
+	}
+	cfg.Metrics, err = s.boolean("METRICS", false)
+	if err != nil {
+		return cfg, err
+	}
+	// decades, since amount scales differ between deployments
+	cfg.MetricsAmountBuckets, err = parseBuckets("METRICS_AMOUNT_BUCKETS", s.get("METRICS_AMOUNT_BUCKETS"),
+		[]float64{0.01, 0.1, 1, 10, 100, 1000, 10000, 100000, 1000000})
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MetricsLatencyBuckets, err = parseBuckets("METRICS_LATENCY_BUCKETS", s.get("METRICS_LATENCY_BUCKETS"),
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.DatabaseURL = s.get("DATABASE_URL")
+	if cfg.DatabaseURL == "" {
+		cfg.DatabaseURL = "./data.db"
+	}
+	cfg.DBHealthInterval, err = s.duration("DB_HEALTH_INTERVAL", 5*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DBHealthInterval <= 0 {
+		return cfg, fmt.Errorf("DB_HEALTH_INTERVAL: must be positive")
+	}
+	cfg.DBHealthTimeout, err = s.duration("DB_HEALTH_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DBHealthTimeout <= 0 {
+		return cfg, fmt.Errorf("DB_HEALTH_TIMEOUT: must be positive")
+	}
+	cfg.DBHealthFailures, err = s.integer("DB_HEALTH_FAILURES", 3)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DBHealthFailures < 1 {
+		return cfg, fmt.Errorf("DB_HEALTH_FAILURES: must be at least 1")
+	}
+	scale, err := s.integer("MONEY_SCALE", 2)
+	if err != nil {
+		return cfg, err
+	}
+	if scale < 0 || scale > 12 {
+		return cfg, fmt.Errorf("MONEY_SCALE: must be between 0 and 12")
+	}
+	cfg.MoneyScale = int32(scale)
+	cfg.MoneyRounding = s.get("MONEY_ROUNDING")
+	switch cfg.MoneyRounding {
+	case "":
+		cfg.MoneyRounding = "half_up"
+	case "half_up", "half_even":
+	default:
+		return cfg, fmt.Errorf("MONEY_ROUNDING: must be half_up or half_even")
+	}
+	cfg.MoneyJSON = s.get("MONEY_JSON")
+	switch cfg.MoneyJSON {
+	case "":
+		cfg.MoneyJSON = "string"
+	case "string", "number":
+	default:
+		return cfg, fmt.Errorf("MONEY_JSON: must be string or number")
+	}
+	cfg.StrictAmounts, err = s.boolean("STRICT_AMOUNTS", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxPageSize, err = s.integer("MAX_PAGE_SIZE", 1000)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPageSize < 1 {
+		return cfg, fmt.Errorf("MAX_PAGE_SIZE: must be at least 1")
+	}
+	cfg.MigrateOnStart, err = s.boolean("MIGRATE_ON_START", true)
+	if err != nil {
+		return cfg, err
+	}
+
+	adminCIDRs := s.get("ADMIN_ALLOWED_CIDRS")
+	if adminCIDRs == "" {
+		adminCIDRs = defaultAdminAllowedCIDRs
+	}
+	nets, err := parseCIDRList(adminCIDRs)
+	if err != nil {
+		return cfg, fmt.Errorf("ADMIN_ALLOWED_CIDRS: %w", err)
+	}
+	cfg.AdminAllowedNets = nets
+
+	cfg.AdminUI, err = s.boolean("ADMIN_UI", true)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.APIDocs, err = s.boolean("API_DOCS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	proxies, err := parseCIDRList(s.get("TRUSTED_PROXIES"))
+	if err != nil {
+		return cfg, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	for _, n := range proxies {
+		cfg.TrustedProxies = append(cfg.TrustedProxies, n.String())
+	}
+
+	cfg.WalletIdAttempts, err = s.integer("WALLET_ID_ATTEMPTS", 5)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.WalletIdAttempts < 1 {
+		return cfg, fmt.Errorf("WALLET_ID_ATTEMPTS: must be at least 1")
+	}
+
+	cfg.WalletIds.Strategy = s.get("WALLET_ID_STRATEGY")
+	if cfg.WalletIds.Strategy == "" {
+		cfg.WalletIds.Strategy = walletid.StrategyShort
+	}
+	cfg.WalletIds.Alphabet = s.get("WALLET_ID_ALPHABET")
+	if cfg.WalletIds.Alphabet == "" {
+		cfg.WalletIds.Alphabet = walletid.DefaultAlphabet
+	}
+	cfg.WalletIds.Length, err = s.integer("WALLET_ID_LENGTH", 6)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.WalletIds.Checksum, err = s.boolean("WALLET_ID_CHECKSUM", false)
+	if err != nil {
+		return cfg, err
+	}
+	minEntropy, err := s.integer("WALLET_ID_MIN_ENTROPY_BITS", 32)
+	if err != nil {
+		return cfg, err
+	}
+	if err := cfg.WalletIds.Validate(float64(minEntropy)); err != nil {
+		return cfg, fmt.Errorf("wallet id format: %w", err)
+	}
+
+	minFreeMB, err := s.integer("MIN_FREE_DISK_MB", 64)
+	if err != nil {
+		return cfg, err
+	}
+	if minFreeMB < 0 {
+		return cfg, fmt.Errorf("MIN_FREE_DISK_MB: must not be negative")
+	}
+	cfg.MinFreeDiskBytes = int64(minFreeMB) << 20
+	cfg.StartupIntegrityCheck = s.get("STARTUP_INTEGRITY_CHECK")
+	switch cfg.StartupIntegrityCheck {
+	case "":
+		cfg.StartupIntegrityCheck = "off"
+	case "off", "warn", "fail":
+	default:
+		return cfg, fmt.Errorf("STARTUP_INTEGRITY_CHECK: must be off, warn or fail")
+	}
+
+	cfg.BackupDir = s.get("BACKUP_DIR")
+	if cfg.BackupDir == "" {
+		cfg.BackupDir = "./backups"
+	}
+	cfg.BackupRetention, err = s.integer("BACKUP_RETENTION", 7)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.BackupRetention < 0 {
+		return cfg, fmt.Errorf("BACKUP_RETENTION: must not be negative")
+	}
+
+	cfg.MaintenanceAt = -1
+	if at := s.get("MAINTENANCE_AT"); at != "" {
+		cfg.MaintenanceAt, err = parseTimeOfDay(at)
+		if err != nil {
+			return cfg, fmt.Errorf("MAINTENANCE_AT: %w", err)
+		}
+	}
+	cfg.MaintenanceVacuum, err = s.boolean("MAINTENANCE_VACUUM", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaintenanceMode, err = s.boolean("MAINTENANCE_MODE", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaintenanceMessage = s.get("MAINTENANCE_MESSAGE")
+	cfg.MaintenanceRetryAfter, err = s.duration("MAINTENANCE_RETRY_AFTER", time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.MaintenanceRetryAfter < time.Second {
+		return cfg, fmt.Errorf("MAINTENANCE_RETRY_AFTER: must be at least 1s")
+	}
+
+	cfg.RecordFailedTransfers, err = s.boolean("RECORD_FAILED_TRANSFERS", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.BalanceCacheTTL, err = s.duration("BALANCE_CACHE_TTL", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.BalanceCacheTTL < 0 {
+		return cfg, fmt.Errorf("BALANCE_CACHE_TTL: must not be negative")
+	}
+
+	cfg.Features, err = parseFeatures(s.get("FEATURES"))
+	if err != nil {
+		return cfg, fmt.Errorf("FEATURES: %w", err)
+	}
+
+	for _, name := range strings.Split(s.get("EVENT_SINKS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !slices.Contains(EventSinkNames, name) {
+			return cfg, fmt.Errorf("EVENT_SINKS: unknown sink %q, known sinks are %s", name, strings.Join(EventSinkNames, ", "))
+		}
+		cfg.EventSinks = append(cfg.EventSinks, name)
+	}
+	cfg.NATSURL = s.get("NATS_URL")
+	if slices.Contains(cfg.EventSinks, "nats") && cfg.NATSURL == "" {
+		return cfg, fmt.Errorf("NATS_URL: must be set for the nats event sink")
+	}
+	cfg.NATSSubject = s.get("NATS_SUBJECT")
+	if cfg.NATSSubject == "" {
+		cfg.NATSSubject = "wallets.{wallet_id}.transfers"
+	}
+	if err := checkSubject(cfg.NATSSubject); err != nil {
+		return cfg, fmt.Errorf("NATS_SUBJECT: %w", err)
+	}
+	cfg.NATSJetStream, err = s.boolean("NATS_JETSTREAM", true)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.NATSTimeout, err = s.duration("NATS_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.NATSTimeout <= 0 {
+		return cfg, fmt.Errorf("NATS_TIMEOUT: must be positive")
+	}
+	cfg.OutboxInterval, err = s.duration("OUTBOX_INTERVAL", time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.OutboxInterval <= 0 {
+		return cfg, fmt.Errorf("OUTBOX_INTERVAL: must be positive")
+	}
+	cfg.OutboxMaxAttempts, err = s.integer("OUTBOX_MAX_ATTEMPTS", 10)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.OutboxMaxAttempts < 1 {
+		return cfg, fmt.Errorf("OUTBOX_MAX_ATTEMPTS: must be at least 1")
+	}
+	cfg.OutboxRetention, err = s.duration("OUTBOX_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.WebhookTimeout, err = s.duration("WEBHOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookTimeout <= 0 {
+		return cfg, fmt.Errorf("WEBHOOK_TIMEOUT: must be positive")
+	}
+	cfg.WebhookDisableAfter, err = s.duration("WEBHOOK_DISABLE_AFTER", 24*time.Hour)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.WebSocketMaxPerWallet, err = s.integer("WEBSOCKET_MAX_PER_WALLET", 5)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.WebSocketMaxPerWallet < 1 {
+		return cfg, fmt.Errorf("WEBSOCKET_MAX_PER_WALLET: must be at least 1")
+	}
+	cfg.WebSocketPingInterval, err = s.duration("WEBSOCKET_PING_INTERVAL", 30*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.WebSocketPingInterval <= 0 {
+		return cfg, fmt.Errorf("WEBSOCKET_PING_INTERVAL: must be positive")
+	}
+	cfg.WebSocketWriteTimeout, err = s.duration("WEBSOCKET_WRITE_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.WebSocketWriteTimeout <= 0 {
+		return cfg, fmt.Errorf("WEBSOCKET_WRITE_TIMEOUT: must be positive")
+	}
+	cfg.TransferQueueInterval, err = s.duration("TRANSFER_QUEUE_INTERVAL", time.Second)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.TransferQueueInterval <= 0 {
+		return cfg, fmt.Errorf("TRANSFER_QUEUE_INTERVAL: must be positive")
+	}
+	cfg.TransferQueueWorkers, err = s.integer("TRANSFER_QUEUE_WORKERS", 4)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.TransferQueueWorkers < 1 {
+		return cfg, fmt.Errorf("TRANSFER_QUEUE_WORKERS: must be at least 1")
+	}
+	cfg.TransferQueueRetention, err = s.duration("TRANSFER_QUEUE_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.TransferQueueRetention <= 0 {
+		return cfg, fmt.Errorf("TRANSFER_QUEUE_RETENTION: must be positive")
+	}
+
+	return cfg, nil
+}
+
+// checkSubject checks a NATS subject template: dot separated tokens
+// without wildcards or whitespace, where {type} and {wallet_id} may stand
+// for a token or a part of one.
+func checkSubject(subject string) error {
+	plain := strings.NewReplacer("{type}", "x", "{wallet_id}", "x").Replace(subject)
+	for _, token := range strings.Split(plain, ".") {
+		if token == "" {
+			return fmt.Errorf("%q has an empty token", subject)
+		}
+		if strings.ContainsAny(token, "*>{} \t\r\n") {
+			return fmt.Errorf("%q may only use the placeholders {type} and {wallet_id} and no wildcards or whitespace", subject)
+		}
+	}
+	return nil
+}
+
+// UnixPrefix starts an Addr that is the path of a Unix domain socket.
+const UnixPrefix = "unix:"
+
+// listenAddr works out the address to listen on. LISTEN_ADDR (host:port)
+// is the base, HOST and PORT replace its parts, PORT being what PaaS
+// platforms inject. The -addr, -host and -port flags in fs override those in the same way.
+// A unix:/path address in LISTEN_ADDR or -addr listens on a Unix domain
+// socket instead, unless -host or -port ask for TCP.
+func listenAddr(s settings, fs *flag.FlagSet) (string, error) {
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	_, hostFlag := flags["host"]
+	_, portFlag := flags["port"]
+	if addr := flags["addr"]; strings.HasPrefix(addr, UnixPrefix) {
+		return unixAddr("-addr", addr)
+	}
+	if addr := s.get("LISTEN_ADDR"); strings.HasPrefix(addr, UnixPrefix) && !hostFlag && !portFlag {
+		return unixAddr("LISTEN_ADDR", addr)
+	}
+
+	host, port := "", "8080"
+	if addr := s.get("LISTEN_ADDR"); addr != "" && !strings.HasPrefix(addr, UnixPrefix) {
+		var err error
+		host, port, err = net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("LISTEN_ADDR: %q is not a host:port address", addr)
+		}
+	}
+	if v, ok := s.lookup("HOST"); ok {
+		host = v
+	}
+	if v := s.get("PORT"); v != "" {
+		port = v
+	}
+
+	if addr, ok := flags["addr"]; ok && addr != "" {
+		var err error
+		host, port, err = net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("-addr: %q is not a host:port address", addr)
+		}
+	}
+	if v, ok := flags["host"]; ok {
+		host = v
+	}
+	if v, ok := flags["port"]; ok {
+		port = v
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("listen port %q must be a number between 1 and 65535", port)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " /:[]") {
+		return "", fmt.Errorf("listen host %q is neither an IP address nor a host name", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// unixAddr checks a unix:/path address read from name.
+func unixAddr(name, addr string) (string, error) {
+	if strings.TrimPrefix(addr, UnixPrefix) == "" {
+		return "", fmt.Errorf("%s: %q has no socket path", name, addr)
+	}
+	return addr, nil
+}
+
+// parseCIDRList parses a comma separated list of CIDR blocks.
+// Bare addresses are accepted and treated as single-host networks.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseSampleRates parses a comma separated list of METHOD /route=rate.
+func parseSampleRates(list string) (map[string]int, error) {
+	rates := map[string]int{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not METHOD /route=rate", entry)
+		}
+		route := strings.Join(strings.Fields(entry[:i]), " ")
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q is not a method and a route like GET /api/v1/wallet/:walletid", entry[:i])
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || rate < 1 {
+			return nil, fmt.Errorf("%s: rate must be a positive integer", route)
+		}
+		rates[route] = rate
+	}
+	return rates, nil
+}
+
+// parseBuckets parses a comma separated list of increasing histogram
+// bucket bounds, returning def when list is empty.
+func parseBuckets(name, list string, def []float64) ([]float64, error) {
+	if strings.TrimSpace(list) == "" {
+		return def, nil
+	}
+	var buckets []float64
+	for _, entry := range strings.Split(list, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil || math.IsInf(b, 0) || math.IsNaN(b) {
+			return nil, fmt.Errorf("%s: %q is not a number", name, entry)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("%s: must be increasing", name)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// ParseLevel parses one of the log levels debug, info, warn and error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("%q is not one of debug, info, warn or error", s)
+}
+
+// parseTimeOfDay parses "HH:MM" into the offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 03:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
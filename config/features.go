@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature names. A disabled feature's endpoints aren't registered, so they
+// answer 404 like any unknown path, and its background work doesn't start.
+const (
+	// FeatureImport is POST /api/v1/admin/import.
+	FeatureImport = "import"
+	// FeatureScheduledMaintenance is the daily maintenance run of MaintenanceAt.
+	FeatureScheduledMaintenance = "scheduled_maintenance"
+	// FeatureWebhooks is /api/v1/wallet/:walletid/webhooks and the
+	// delivery of the webhooks through the outbox.
+	FeatureWebhooks = "webhooks"
+	// FeatureWebSocket is /api/v1/wallet/:walletid/ws, the live balance
+	// updates of a wallet.
+	FeatureWebSocket = "websocket"
+	// FeatureAsyncTransfers is the asynchronous send, with Prefer:
+	// respond-async or async=true, GET /api/v1/wallet/:walletid/transfers/:id
+	// and the transfer queue applying them.
+	FeatureAsyncTransfers = "async_transfers"
+)
+
+// knownFeatures are the features and whether they are enabled by default.
+var knownFeatures = map[string]bool{
+	FeatureImport:               true,
+	FeatureScheduledMaintenance: true,
+	FeatureWebhooks:             false,
+	FeatureWebSocket:            false,
+	FeatureAsyncTransfers:       false,
+}
+
+// Features tells which features are enabled, by name.
+type Features map[string]bool
+
+// Enabled reports whether the feature called name is enabled. Features
+// the configuration didn't mention have their default.
+func (f Features) Enabled(name string) bool {
+	if on, ok := f[name]; ok {
+		return on
+	}
+	return knownFeatures[name]
+}
+
+// parseFeatures parses a comma separated list of name=bool pairs into the
+// state of every known feature. Unknown names are an error, so that a
+// misspelled flag doesn't silently leave a feature at its default.
+func parseFeatures(list string) (Features, error) {
+	features := make(Features, len(knownFeatures))
+	for name, on := range knownFeatures {
+		features[name] = on
+	}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not name=true or name=false", item)
+		}
+		name = strings.TrimSpace(name)
+		if _, known := knownFeatures[name]; !known {
+			return nil, fmt.Errorf("unknown feature %q, known features are %s", name, featureNames())
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a boolean", name, value)
+		}
+		features[name] = on
+	}
+	return features, nil
+}
+
+// featureNames lists the known features for error messages.
+func featureNames() string {
+	names := make([]string, 0, len(knownFeatures))
+	for name := range knownFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
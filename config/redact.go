@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LogValue lists the effective settings for the startup log, with the
+// database password redacted.
+func (c Config) LogValue() slog.Value {
+	var adminNets []string
+	for _, n := range c.AdminAllowedNets {
+		adminNets = append(adminNets, n.String())
+	}
+	return slog.GroupValue(
+		slog.String("file", c.File),
+		slog.String("addr", c.Addr),
+		slog.String("socket_mode", fmt.Sprintf("%04o", c.SocketMode)),
+		slog.Int("listen_fd", c.ListenFD),
+		slog.String("shutdown_grace", c.ShutdownGrace.String()),
+		slog.String("http_read_header_timeout", c.HTTPReadHeaderTimeout.String()),
+		slog.String("http_read_timeout", c.HTTPReadTimeout.String()),
+		slog.String("http_write_timeout", c.HTTPWriteTimeout.String()),
+		slog.String("http_idle_timeout", c.HTTPIdleTimeout.String()),
+		slog.Int("http_max_header_bytes", c.HTTPMaxHeaderBytes),
+		slog.Int("http_max_connections", c.HTTPMaxConnections),
+		slog.String("gin_mode", c.GinMode),
+		slog.Any("middleware", c.Middleware),
+		slog.String("log_format", c.LogFormat),
+		slog.String("log_level", strings.ToLower(c.LogLevel.String())),
+		slog.Bool("log_redact", c.LogRedact),
+		slog.Any("access_log_skip_paths", c.AccessLogSkipPaths),
+		slog.Any("access_log_sample_rates", c.AccessLogSampleRates),
+		slog.String("access_log_slow", c.AccessLogSlow.String()),
+		slog.String("request_timeout", c.RequestTimeout.String()),
+		slog.String("send_timeout", c.SendTimeout.String()),
+		slog.String("client_deadline_max", c.ClientDeadlineMax.String()),
+		slog.Bool("debug_endpoints", c.DebugEndpoints),
+		slog.String("debug_addr", c.DebugAddr),
+		slog.String("grpc_addr", c.GRPCAddr),
+		slog.Bool("metrics", c.Metrics),
+		slog.Any("metrics_amount_buckets", c.MetricsAmountBuckets),
+		slog.Any("metrics_latency_buckets", c.MetricsLatencyBuckets),
+		slog.String("database_url", redactDSN(c.DatabaseURL)),
+		slog.String("db_health_interval", c.DBHealthInterval.String()),
+		slog.String("db_health_timeout", c.DBHealthTimeout.String()),
+		slog.Int("db_health_failures", c.DBHealthFailures),
+		slog.Int("money_scale", int(c.MoneyScale)),
+		slog.String("money_rounding", c.MoneyRounding),
+		slog.String("money_json", c.MoneyJSON),
+		slog.Bool("strict_amounts", c.StrictAmounts),
+		slog.Int("max_page_size", c.MaxPageSize),
+		slog.Bool("migrate_on_start", c.MigrateOnStart),
+		slog.Any("admin_allowed_cidrs", adminNets),
+		slog.Bool("admin_ui", c.AdminUI),
+		slog.Bool("api_docs", c.APIDocs),
+		slog.Any("trusted_proxies", c.TrustedProxies),
+		slog.Int("wallet_id_attempts", c.WalletIdAttempts),
+		slog.String("wallet_id_strategy", c.WalletIds.Strategy),
+		slog.Int("wallet_id_length", c.WalletIds.Length),
+		slog.Bool("wallet_id_checksum", c.WalletIds.Checksum),
+		slog.Int64("min_free_disk_mb", c.MinFreeDiskBytes>>20),
+		slog.String("startup_integrity_check", c.StartupIntegrityCheck),
+		slog.String("backup_dir", c.BackupDir),
+		slog.Int("backup_retention", c.BackupRetention),
+		slog.String("maintenance_at", timeOfDay(c.MaintenanceAt)),
+		slog.Bool("maintenance_vacuum", c.MaintenanceVacuum),
+		slog.Bool("maintenance_mode", c.MaintenanceMode),
+		slog.String("maintenance_message", c.MaintenanceMessage),
+		slog.String("maintenance_retry_after", c.MaintenanceRetryAfter.String()),
+		slog.Bool("record_failed_transfers", c.RecordFailedTransfers),
+		slog.String("balance_cache_ttl", c.BalanceCacheTTL.String()),
+		slog.Any("features", c.Features),
+		slog.Any("event_sinks", c.EventSinks),
+		slog.String("nats_url", redactNATSURL(c.NATSURL)),
+		slog.String("nats_subject", c.NATSSubject),
+		slog.Bool("nats_jetstream", c.NATSJetStream),
+		slog.String("nats_timeout", c.NATSTimeout.String()),
+		slog.String("outbox_interval", c.OutboxInterval.String()),
+		slog.Int("outbox_max_attempts", c.OutboxMaxAttempts),
+		slog.String("outbox_retention", c.OutboxRetention.String()),
+		slog.String("webhook_timeout", c.WebhookTimeout.String()),
+		slog.String("webhook_disable_after", c.WebhookDisableAfter.String()),
+		slog.Int("websocket_max_per_wallet", c.WebSocketMaxPerWallet),
+		slog.String("websocket_ping_interval", c.WebSocketPingInterval.String()),
+		slog.String("websocket_write_timeout", c.WebSocketWriteTimeout.String()),
+		slog.String("transfer_queue_interval", c.TransferQueueInterval.String()),
+		slog.Int("transfer_queue_workers", c.TransferQueueWorkers),
+		slog.String("transfer_queue_retention", c.TransferQueueRetention.String()),
+	)
+}
+
+// redactDSN hides the password of a database URL or of a MySQL DSN like
+// user:password@tcp(host)/db. SQLite paths are returned as they are.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	if colon := strings.Index(dsn[:at], ":"); colon >= 0 {
+		return dsn[:colon+1] + "xxxxx" + dsn[at:]
+	}
+	return dsn
+}
+
+// redactNATSURL hides the password or the token of a NATS URL, a token
+// being given as the user name.
+func redactNATSURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		u.User = url.User("xxxxx")
+	}
+	return u.Redacted()
+}
+
+// timeOfDay formats a MaintenanceAt offset as HH:MM, "" when disabled.
+func timeOfDay(d time.Duration) string {
+	if d < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// knownSettings are the names of every setting. In a config file they are
+// written in lower case, database_url for DATABASE_URL.
+var knownSettings = []string{
+	"LISTEN_ADDR", "HOST", "PORT", "SOCKET_MODE", "SHUTDOWN_GRACE",
+	"HTTP_READ_HEADER_TIMEOUT", "HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT",
+	"HTTP_MAX_HEADER_BYTES", "HTTP_MAX_CONNECTIONS",
+	"GIN_MODE", "MIDDLEWARE", "LOG_FORMAT", "LOG_LEVEL", "LOG_REDACT", "ACCESS_LOG_SKIP_PATHS",
+	"ACCESS_LOG_SAMPLE_RATES", "ACCESS_LOG_SLOW",
+	"REQUEST_TIMEOUT", "SEND_TIMEOUT", "CLIENT_DEADLINE_MAX", "DEBUG_ENDPOINTS", "DEBUG_ADDR", "GRPC_ADDR",
+	"METRICS", "METRICS_AMOUNT_BUCKETS", "METRICS_LATENCY_BUCKETS",
+	"DATABASE_URL", "DB_HEALTH_INTERVAL", "DB_HEALTH_TIMEOUT", "DB_HEALTH_FAILURES", "MONEY_SCALE", "MONEY_ROUNDING", "MONEY_JSON", "STRICT_AMOUNTS", "MAX_PAGE_SIZE", "MIGRATE_ON_START",
+	"ADMIN_ALLOWED_CIDRS", "ADMIN_UI", "API_DOCS", "TRUSTED_PROXIES",
+	"WALLET_ID_ATTEMPTS", "WALLET_ID_STRATEGY", "WALLET_ID_ALPHABET",
+	"WALLET_ID_LENGTH", "WALLET_ID_CHECKSUM", "WALLET_ID_MIN_ENTROPY_BITS",
+	"MIN_FREE_DISK_MB", "STARTUP_INTEGRITY_CHECK", "BACKUP_DIR", "BACKUP_RETENTION", "MAINTENANCE_AT", "MAINTENANCE_VACUUM",
+	"MAINTENANCE_MODE", "MAINTENANCE_MESSAGE", "MAINTENANCE_RETRY_AFTER",
+	"RECORD_FAILED_TRANSFERS", "BALANCE_CACHE_TTL", "FEATURES",
+	"EVENT_SINKS", "NATS_URL", "NATS_SUBJECT", "NATS_JETSTREAM", "NATS_TIMEOUT",
+	"OUTBOX_INTERVAL", "OUTBOX_MAX_ATTEMPTS", "OUTBOX_RETENTION",
+	"WEBHOOK_TIMEOUT", "WEBHOOK_DISABLE_AFTER",
+	"WEBSOCKET_MAX_PER_WALLET", "WEBSOCKET_PING_INTERVAL", "WEBSOCKET_WRITE_TIMEOUT",
+	"TRANSFER_QUEUE_INTERVAL", "TRANSFER_QUEUE_WORKERS", "TRANSFER_QUEUE_RETENTION",
+}
+
+// settings are the raw values of the settings by name, before parsing.
+type settings map[string]string
+
+// loadSettings reads the config file at path, when there is one, and lays
+// the environment over it. NAME_FILE names a file holding the value of
+// NAME, which is how secrets mounted into a container are passed.
+func loadSettings(path string) (settings, error) {
+	s := settings{}
+	if path != "" {
+		if err := s.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range knownSettings {
+		v, set := os.LookupEnv(name)
+		file := os.Getenv(name + "_FILE")
+		if set && file != "" {
+			return nil, fmt.Errorf("%s and %s_FILE are both set", name, name)
+		}
+		if file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s_FILE: %w", name, err)
+			}
+			v, set = strings.TrimRight(string(b), "\r\n"), true
+		}
+		if set {
+			s[name] = v
+		}
+	}
+	return s, nil
+}
+
+// readFile reads a YAML config file. Values are scalars, lists for the
+// settings that take comma separated lists, or maps for the settings that
+// take name=value lists. Unknown keys are an error, so
+// that a misspelled setting doesn't go unnoticed.
+func (s settings) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(knownSettings))
+	for _, name := range knownSettings {
+		known[name] = true
+	}
+	var unknown []string
+	for key, value := range doc {
+		name := strings.ToUpper(key)
+		if !known[name] || key != strings.ToLower(key) {
+			unknown = append(unknown, key)
+			continue
+		}
+		v, err := scalar(value)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+		s[name] = v
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config file %s: unknown settings %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// scalar turns a YAML value into the string the environment would hold.
+func scalar(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q must not contain a comma", s)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.ContainsAny(key+s, ",=") {
+				return "", fmt.Errorf("%s must not contain a comma or =", key)
+			}
+			items = append(items, key+"="+s)
+		}
+		sort.Strings(items)
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("expected a value or a list of values")
+	}
+}
+
+func (s settings) get(name string) string {
+	return s[name]
+}
+
+func (s settings) lookup(name string) (string, bool) {
+	v, ok := s[name]
+	return v, ok
+}
+
+// integer reads an integer setting, falling back to def when unset.
+func (s settings) integer(name string, def int) (int, error) {
+	v := s.get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not an integer", name, v)
+	}
+	return n, nil
+}
+
+// boolean reads a boolean setting, falling back to def when unset.
+func (s settings) boolean(name string, def bool) (bool, error) {
+	v := s.get(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not a boolean", name, v)
+	}
+	return b, nil
+}
+
+// duration reads a duration like 30s or 2m, falling back to def when unset.
+func (s settings) duration(name string, def time.Duration) (time.Duration, error) {
+	v := s.get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not a duration", name, v)
+	}
+	return d, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestContract instead of comparing with them")
+
+// contractTime is the time of the clock of TestContract.
+var contractTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fixedClock is an api.Clock stopped at a time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// contractHeaders are the headers kept in the golden files, those a
+// client reads besides the body.
+var contractHeaders = []string{"Content-Type", "Content-Disposition", "Location", "Preference-Applied", "Retry-After", "X-Total-Count"}
+
+// TestContract pins the responses of every public endpoint, on success
+// and on their principal errors, to the golden files in
+// testdata/contract: the status, the headers a client reads and the body,
+// byte for byte. The requests run in order against a server on a seeded
+// database, with the clock stopped and wallet ids from a seeded source.
+// The fields listed as volatile of a step have their values replaced
+// before comparing, as they change from run to run.
+//
+// After an intended change of a response, rewrite the files with
+//
+//	go test . -run TestContract -update
+//
+// and review their diff like the code's.
+func TestContract(t *testing.T) {
+	db := openTestDB(t, true)
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(context.Background(), store.Wallet{Id: id, Balance: decimal.NewFromInt(100),
+			CreatedAt: sql.NullTime{Time: contractTime, Valid: true}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true, config.FeatureAsyncTransfers: true, config.FeatureImport: true}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AdminAllowedNets = []*net.IPNet{loopback}
+	cfg.BackupDir = t.TempDir()
+	cfg.WalletIds.Random = rand.New(rand.NewSource(1))
+	server, err := NewServer(db, fixedClock(contractTime), cfg, discardLogger(), new(slog.LevelVar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+
+	const webhook = `{"url":"https://example.com/hook","secret":"0123456789abcdef0123456789abcdef","events":["transfer.sent"]}`
+	steps := []struct {
+		name, method, path, body string
+		volatile                 []string
+	}{
+		{"health", http.MethodGet, "/healthz", "", []string{"since"}},
+		{"ready", http.MethodGet, "/readyz", "", nil},
+		{"version", http.MethodGet, "/api/v1/version", "", []string{"version", "commit", "date", "go_version"}},
+		{"not_found", http.MethodGet, "/api/v1/nothing", "", nil},
+
+		{"wallet_create", http.MethodPost, "/api/v1/wallet/", "", nil},
+		{"wallet", http.MethodGet, "/api/v1/wallet/AAAAAA", "", nil},
+		{"wallet_not_found", http.MethodGet, "/api/v1/wallet/ZZZZZZ", "", nil},
+		{"wallet_invalid_id", http.MethodGet, "/api/v1/wallet/AAA!AA", "", nil},
+		{"send", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"30.25"}`, nil},
+		{"send_insufficient_funds", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1000"}`, nil},
+		{"send_sender_not_found", http.MethodPost, "/api/v1/wallet/ZZZZZZ/send", `{"to":"BBBBBB","amount":"1"}`, nil},
+		{"send_recipient_not_found", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"ZZZZZZ","amount":"1"}`, nil},
+		{"send_invalid_amount", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"ten"}`, nil},
+		{"send_malformed_body", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":`, nil},
+		{"send_async", http.MethodPost, "/api/v1/wallet/AAAAAA/send?async=true", `{"to":"BBBBBB","amount":"2"}`, nil},
+		{"transfer", http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/1", "", nil},
+		{"transfer_not_found", http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/99", "", nil},
+		{"history", http.MethodGet, "/api/v1/wallet/AAAAAA/history?include_total=true", "", nil},
+		{"history_time_zone", http.MethodGet, "/api/v1/wallet/AAAAAA/history?tz=Europe/Berlin", "", nil},
+		{"history_invalid_time_zone", http.MethodGet, "/api/v1/wallet/AAAAAA/history?tz=Europe/Nowhere", "", nil},
+		{"history_not_found", http.MethodGet, "/api/v1/wallet/ZZZZZZ/history", "", nil},
+
+		{"webhook_create", http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", webhook, []string{"created_at"}},
+		{"webhook_create_invalid_url", http.MethodPost, "/api/v1/wallet/AAAAAA/webhooks", `{"url":"ftp://example.com"}`, nil},
+		{"webhook_create_wallet_not_found", http.MethodPost, "/api/v1/wallet/ZZZZZZ/webhooks", webhook, nil},
+		{"webhooks", http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks", "", []string{"created_at"}},
+		{"webhook_deliveries", http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks/1/deliveries", "", nil},
+		{"webhook_delete", http.MethodDelete, "/api/v1/wallet/AAAAAA/webhooks/1", "", nil},
+		{"webhook_delete_not_found", http.MethodDelete, "/api/v1/wallet/AAAAAA/webhooks/1", "", nil},
+
+		{"admin_maintenance_mode", http.MethodGet, "/api/v1/admin/maintenance", "", nil},
+		{"admin_maintenance_mode_set", http.MethodPut, "/api/v1/admin/maintenance", `{"enabled":true,"message":"back at 04:00 UTC"}`, []string{"since"}},
+		{"send_in_maintenance", http.MethodPost, "/api/v1/wallet/AAAAAA/send", `{"to":"BBBBBB","amount":"1"}`, nil},
+		{"admin_maintenance_mode_unset", http.MethodPut, "/api/v1/admin/maintenance", `{"enabled":false}`, nil},
+		{"admin_maintenance_mode_invalid", http.MethodPut, "/api/v1/admin/maintenance", `{"message":"soon"}`, nil},
+		{"admin_maintenance", http.MethodPost, "/api/v1/admin/maintenance", "", []string{"duration_ms", "reclaimed_bytes"}},
+		{"admin_backup", http.MethodPost, "/api/v1/admin/backup", "", []string{"path", "size"}},
+		{"admin_integrity_check", http.MethodGet, "/api/v1/admin/integrity-check", "", nil},
+		{"admin_export", http.MethodGet, "/api/v1/admin/export", "", nil},
+		{"admin_import_not_empty", http.MethodPost, "/api/v1/admin/import", `{"type":"header","version":1}`, nil},
+		{"admin_import_invalid", http.MethodPost, "/api/v1/admin/import", `{"type":"wallet"}`, nil},
+		{"admin_loglevel", http.MethodGet, "/api/v1/admin/loglevel", "", nil},
+		{"admin_loglevel_set", http.MethodPut, "/api/v1/admin/loglevel", `{"level":"warn"}`, nil},
+		{"admin_loglevel_invalid", http.MethodPut, "/api/v1/admin/loglevel", `{"level":"verbose"}`, nil},
+		{"admin_features", http.MethodGet, "/api/v1/admin/features", "", nil},
+		{"admin_jobs", http.MethodGet, "/api/v1/admin/jobs", "", nil},
+		{"admin_outbox", http.MethodGet, "/api/v1/admin/outbox?status=pending&include_total=true", "", nil},
+		{"admin_outbox_invalid_status", http.MethodGet, "/api/v1/admin/outbox?status=lost", "", nil},
+		{"admin_redrive_not_found", http.MethodPost, "/api/v1/admin/outbox/99/redrive", "", nil},
+	}
+	for _, step := range steps {
+		req, err := http.NewRequest(step.method, ts.URL+step.path, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := contractResponse(t, res, body, step.volatile)
+
+		golden := filepath.Join("testdata", "contract", step.name+".golden")
+		if *update {
+			if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(golden, got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s: %v, run with -update to write it", step.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %s changed, run with -update if it is intended\n--- got\n%s\n--- want\n%s", step.method, step.path, got, want)
+		}
+	}
+}
+
+// contractResponse writes a response the way the golden files keep it:
+// the status, the headers of contractHeaders that are set and the body,
+// its volatile fields replaced and indented when it is JSON.
+func contractResponse(t *testing.T, res *http.Response, body []byte, volatile []string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %s\n", res.StatusCode, http.StatusText(res.StatusCode))
+	for _, name := range contractHeaders {
+		if v := res.Header.Get(name); v != "" {
+			fmt.Fprintf(&b, "%s: %s\n", name, v)
+		}
+	}
+	b.WriteString("\n")
+	for _, field := range volatile {
+		// a string, a number or null, wherever the field is
+		value := regexp.MustCompile(`("` + regexp.QuoteMeta(field) + `":)("(?:[^"\\]|\\.)*"|-?[0-9.eE+-]+|null)`)
+		body = value.ReplaceAll(body, []byte(`$1"<volatile>"`))
+	}
+	// one document per line for application/x-ndjson
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := json.Indent(&b, bytes.TrimSpace(line), "", "  "); err != nil {
+			t.Fatalf("%s %s: %v in %s", res.Request.Method, res.Request.URL.Path, err, body)
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
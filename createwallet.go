@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// runCreateWallet implements the create-wallet command, which inserts one
+// wallet and prints it as JSON, for provisioning from scripts:
+//
+//	create-wallet                 a wallet with a generated id and the usual balance
+//	create-wallet -id ID          use ID instead of generating one
+//	create-wallet -balance 250    open the wallet with 250 instead
+//
+// The balance becomes the wallet's opening balance, so verify accepts it.
+// It returns the process exit code: 2 for bad arguments, 3 when the id is
+// already taken and 1 for anything else that went wrong.
+func runCreateWallet(db *store.DB, cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("create-wallet", flag.ContinueOnError)
+	id := fs.String("id", "", "id of the new wallet, generated when empty")
+	balance := fs.String("balance", store.InitialBalance.String(), "opening balance of the new wallet")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+
+	amount, err := decimal.NewFromString(*balance)
+	if err != nil || amount.IsNegative() {
+		fmt.Fprintf(os.Stderr, "-balance: %q is not a non-negative amount\n", *balance)
+		return 2
+	}
+	if _, err := db.ToMinor(amount); err != nil {
+		fmt.Fprintf(os.Stderr, "-balance: %v\n", err)
+		return 2
+	}
+	if *id != "" {
+		if !cfg.WalletIds.Matches(*id) {
+			fmt.Fprintf(os.Stderr, "-id: %s, got %q\n", cfg.WalletIds.Describe(), *id)
+			return 2
+		}
+		if err := cfg.WalletIds.Check(*id); err != nil {
+			fmt.Fprintf(os.Stderr, "-id: %v\n", err)
+			return 2
+		}
+		*id = cfg.WalletIds.Normalize(*id)
+	}
+
+	// wallets written into an old schema would lose their opening balance
+	if err := prepareSchema(db, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	if *id != "" {
+		err = db.CreateWallet(ctx, store.Wallet{Id: *id, Balance: amount, CreatedAt: sql.NullTime{Time: now, Valid: true}})
+	} else {
+		*id, err = ops.NewWallets(db, cfg.WalletIds, cfg.WalletIdAttempts).Create(ctx, amount, now)
+	}
+	if errors.Is(err, store.ErrDuplicateID) {
+		fmt.Fprintf(os.Stderr, "wallet %s already exists\n", *id)
+		return 3
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	json.NewEncoder(os.Stdout).Encode(struct {
+		Id      string          `json:"id"`
+		Balance decimal.Decimal `json:"balance"`
+	}{*id, amount})
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// freeBytes returns the space available to the process on the file
+// system holding dir.
+func freeBytes(dir string) (uint64, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	return st.Bavail * uint64(st.Bsize), true, nil
+}
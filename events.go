@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/outbox"
+	"kordimion/secure-web-service/store"
+)
+
+// eventSinks builds the sinks named by cfg.EventSinks, which config.Load
+// already checked against config.EventSinkNames, plus the webhook sink
+// with the webhooks feature.
+func eventSinks(db *store.DB, cfg config.Config, logger *slog.Logger) ([]outbox.Sink, error) {
+	var sinks []outbox.Sink
+	for _, name := range cfg.EventSinks {
+		switch name {
+		case "log":
+			sinks = append(sinks, outbox.LogSink{Log: logger})
+		case "nats":
+			sink, err := outbox.NewNATSSink(cfg.NATSURL, cfg.NATSSubject, cfg.NATSJetStream, cfg.NATSTimeout, logger)
+			if err != nil {
+				return nil, fmt.Errorf("NATS_URL: %w", err)
+			}
+			sinks = append(sinks, sink)
+		}
+	}
+	if cfg.Features.Enabled(config.FeatureWebhooks) {
+		sinks = append(sinks, outbox.NewWebhookSink(db, logger, cfg.WebhookTimeout, cfg.WebhookDisableAfter))
+	}
+	return sinks, nil
+}
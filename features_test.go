@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+)
+
+func TestFeatures(t *testing.T) {
+	optional := []string{config.FeatureImport, config.FeatureScheduledMaintenance, config.FeatureWebhooks,
+		config.FeatureWebSocket, config.FeatureAsyncTransfers}
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/admin/import"},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/webhooks"},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/ws"},
+		{http.MethodGet, "/api/v1/wallet/AAAAAA/transfers/1"},
+	}
+	gatedJobs := []string{"maintenance", ops.TransferQueueJob}
+
+	for _, enabled := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.MaintenanceAt = 3 * time.Hour
+		cfg.Features = config.Features{}
+		for _, name := range optional {
+			cfg.Features[name] = enabled
+		}
+		server, err := NewServer(openTestDB(t, true), api.SystemClock, cfg, discardLogger(), new(slog.LevelVar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(server.Handler)
+		defer ts.Close()
+
+		for _, route := range routes {
+			req, _ := http.NewRequest(route.method, ts.URL+route.path, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body struct{ Code string }
+			json.NewDecoder(res.Body).Decode(&body)
+			res.Body.Close()
+			// a disabled endpoint is unknown, an enabled one answers
+			// something else, such as a missing wallet
+			if unknown := body.Code == "not_found"; unknown == enabled {
+				t.Errorf("enabled %t: %s %s answered %d %q", enabled, route.method, route.path, res.StatusCode, body.Code)
+			}
+		}
+
+		jobs := map[string]bool{}
+		for _, s := range server.Jobs.Status() {
+			jobs[s.Name] = true
+		}
+		for _, name := range gatedJobs {
+			if jobs[name] != enabled {
+				t.Errorf("enabled %t: job %s added %t", enabled, name, jobs[name])
+			}
+		}
+
+		var listed map[string]bool
+		status, body := get(t, http.DefaultClient, ts.URL+"/api/v1/admin/features")
+		if err := json.Unmarshal([]byte(body), &listed); status != http.StatusOK || err != nil {
+			t.Fatalf("features: %d %s", status, body)
+		}
+		for _, name := range optional {
+			if listed[name] != enabled {
+				t.Errorf("enabled %t: %s listed as %t", enabled, name, listed[name])
+			}
+		}
+	}
+}
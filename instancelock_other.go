@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "log"
+
+// lockInstance can't lock on this platform; running two instances on
+// one database is up to the operator.
+func lockInstance(dbPath string) (unlock func(), err error) {
+	log.Printf("no instance lock on this platform, make sure only one server uses %s", dbPath)
+	return func() {}, nil
+}
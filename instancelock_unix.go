@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockInstance takes an exclusive flock on dbPath + ".lock", so that a
+// second server on the same SQLite database refuses to start. The kernel
+// drops the lock when the process dies, so a crashed instance never leaves
+// a stale one behind. The file records the holder's pid for the error of
+// the next one.
+func lockInstance(dbPath string) (unlock func(), err error) {
+	path := dbPath + ".lock"
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("instance lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another instance (pid %s) is serving %s, see %s",
+				strings.TrimSpace(string(holder)), dbPath, path)
+		}
+		return nil, fmt.Errorf("instance lock %s: %w", path, err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return func() {
+		f.Truncate(0)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
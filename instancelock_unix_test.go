@@ -0,0 +1,55 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockInstance(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "wallets.db")
+	unlock, err := lockInstance(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dbPath + ".lock"); strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("lock file holds %q, want the pid", b)
+	}
+
+	// a second instance in the same process opens the file again, which
+	// flock treats like another process
+	_, err = lockInstance(dbPath)
+	if err == nil || !strings.Contains(err.Error(), "another instance (pid "+strconv.Itoa(os.Getpid())+")") {
+		t.Fatalf("second lock: %v", err)
+	}
+
+	unlock()
+	unlock, err = lockInstance(dbPath)
+	if err != nil {
+		t.Fatalf("lock after the first instance stopped: %v", err)
+	}
+	unlock()
+}
+
+func TestSecondInstanceRefused(t *testing.T) {
+	db := openTestDB(t, true)
+	unlock, err := lockInstance(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	start := time.Now()
+	if code := runServe(db, testConfig(t), new(slog.LevelVar), discardLogger()); code != exitDatabase {
+		t.Fatalf("exit code %d, want %d", code, exitDatabase)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("refused after %s", elapsed)
+	}
+}
@@ -0,0 +1,249 @@
+// Package jobs runs the periodic background work of the service, such as
+// the daily maintenance, so that it is started, logged and stopped in one
+// place instead of in goroutines of its own.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is a named piece of periodic work.
+type Job struct {
+	Name string
+	// Next returns when the job runs next, given the time the runner
+	// started or the last run ended. A job without one only runs when
+	// triggered, see Runner.Trigger.
+	Next func(now time.Time) time.Time
+	// Timeout bounds a single run, 0 leaves it unbounded.
+	Timeout time.Duration
+	// Jitter delays every run by a random duration up to Jitter, so that
+	// several instances don't all run a job at the same moment.
+	Jitter time.Duration
+	// Quiet logs successful runs at debug level, for jobs that run often.
+	Quiet bool
+	// Run does the work. Its context is cancelled on shutdown and when the
+	// run times out.
+	Run func(ctx context.Context) error
+}
+
+// Every runs a job interval after the previous run ended.
+func Every(interval time.Duration) func(time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		return now.Add(interval)
+	}
+}
+
+// Daily runs a job every day at a UTC time of day, given as an offset
+// from midnight.
+func Daily(at time.Duration) func(time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		now = now.UTC()
+		next := now.Truncate(24 * time.Hour).Add(at)
+		if !next.After(now) {
+			next = next.Add(24 * time.Hour)
+		}
+		return next
+	}
+}
+
+var (
+	// ErrUnknownJob is returned by Trigger for a name that wasn't added.
+	ErrUnknownJob = errors.New("no such job")
+	// ErrJobRunning is returned by Trigger while the job runs or already
+	// waits to.
+	ErrJobRunning = errors.New("the job is already running")
+)
+
+// Status describes a job for GET /api/v1/admin/jobs.
+type Status struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	// Pending is a triggered run that hasn't started yet.
+	Pending        bool       `json:"pending,omitempty"`
+	Runs           int64      `json:"runs"`
+	Failures       int64      `json:"failures"`
+	LastRun        *time.Time `json:"last_run,omitempty"`
+	LastDurationMs int64      `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextRun        *time.Time `json:"next_run,omitempty"`
+}
+
+// entry is a registered job and its status.
+type entry struct {
+	job    Job
+	status Status
+	// trigger starts a run now, see Runner.Trigger.
+	trigger chan struct{}
+}
+
+// Runner runs registered jobs, each one in its own goroutine. A job never
+// overlaps with itself: its next run is only planned once the last one
+// has ended.
+type Runner struct {
+	log *slog.Logger
+
+	mu   sync.Mutex
+	jobs []*entry
+}
+
+func NewRunner(logger *slog.Logger) *Runner {
+	return &Runner{log: logger}
+}
+
+// Add registers job. Jobs must be added before Run and have unique names.
+func (r *Runner) Add(job Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.jobs {
+		if e.job.Name == job.Name {
+			panic(fmt.Sprintf("jobs: %s added twice", job.Name))
+		}
+	}
+	r.jobs = append(r.jobs, &entry{job: job, status: Status{Name: job.Name}, trigger: make(chan struct{}, 1)})
+}
+
+// Trigger runs a job now instead of at its next planned time, in the
+// background. A run requested before Run started happens once it does.
+func (r *Runner) Trigger(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.jobs {
+		if e.job.Name != name {
+			continue
+		}
+		// pending until the run starts, so a second trigger can't slip in
+		// between the loop taking the first one and the run starting
+		if e.status.Running || e.status.Pending {
+			return ErrJobRunning
+		}
+		e.status.Pending = true
+		e.trigger <- struct{}{}
+		return nil
+	}
+	return ErrUnknownJob
+}
+
+// Run runs the jobs until ctx is cancelled, then waits for the runs in
+// progress to return.
+func (r *Runner) Run(ctx context.Context) {
+	r.mu.Lock()
+	entries := append([]*entry(nil), r.jobs...)
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			r.loop(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Status returns the status of every job, by name.
+func (r *Runner) Status() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]Status, 0, len(r.jobs))
+	for _, e := range r.jobs {
+		statuses = append(statuses, e.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (r *Runner) loop(ctx context.Context, e *entry) {
+	for {
+		// a job without a schedule only waits for a trigger, on a nil
+		// channel that is never ready
+		var fire <-chan time.Time
+		stop := func() {}
+		if e.job.Next != nil {
+			next := e.job.Next(time.Now())
+			if e.job.Jitter > 0 {
+				next = next.Add(time.Duration(rand.Int63n(int64(e.job.Jitter))))
+			}
+			r.mu.Lock()
+			e.status.NextRun = &next
+			r.mu.Unlock()
+			timer := time.NewTimer(time.Until(next))
+			fire, stop = timer.C, func() { timer.Stop() }
+		}
+
+		select {
+		case <-ctx.Done():
+			stop()
+			return
+		case <-fire:
+		case <-e.trigger:
+			stop()
+		}
+		r.run(ctx, e)
+	}
+}
+
+// run runs the job once, turning a panic into an error of the run.
+func (r *Runner) run(ctx context.Context, e *entry) {
+	start := time.Now()
+	r.mu.Lock()
+	e.status.Running = true
+	e.status.NextRun = nil
+	if e.status.Pending {
+		// a planned run that started first serves the trigger too
+		e.status.Pending = false
+		select {
+		case <-e.trigger:
+		default:
+		}
+	}
+	r.mu.Unlock()
+	r.log.Debug("job started", "job", e.job.Name)
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				r.log.Error("job panicked", "job", e.job.Name, "panic", v, "stack", string(debug.Stack()))
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		runCtx := ctx
+		if e.job.Timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(ctx, e.job.Timeout)
+			defer cancel()
+		}
+		return e.job.Run(runCtx)
+	}()
+
+	duration := time.Since(start)
+	r.mu.Lock()
+	e.status.Running = false
+	e.status.Runs++
+	e.status.LastRun = &start
+	e.status.LastDurationMs = duration.Milliseconds()
+	e.status.LastError = ""
+	if err != nil {
+		e.status.Failures++
+		e.status.LastError = err.Error()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		r.log.Error("job failed", "job", e.job.Name, "duration_ms", duration.Milliseconds(), "err", err)
+		return
+	}
+	level := slog.LevelInfo
+	if e.job.Quiet {
+		level = slog.LevelDebug
+	}
+	r.log.Log(ctx, level, "job finished", "job", e.job.Name, "duration_ms", duration.Milliseconds())
+}
@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRunner() *Runner {
+	return NewRunner(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// start runs r until the test ends, and returns a function stopping it
+// that returns once Run did.
+func start(t *testing.T, r *Runner) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	stop = func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after the cancellation")
+		}
+	}
+	t.Cleanup(cancel)
+	return stop
+}
+
+// eventually waits for cond, failing the test after a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func status(r *Runner, name string) Status {
+	for _, s := range r.Status() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return Status{}
+}
+
+func TestDaily(t *testing.T) {
+	at := Daily(3*time.Hour + 30*time.Minute)
+	tests := []struct{ now, want time.Time }{
+		{time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 3, 30, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 3, 30, 0, 0, time.UTC), time.Date(2024, 3, 2, 3, 30, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC), time.Date(2024, 3, 2, 3, 30, 0, 0, time.UTC)},
+		// in UTC whatever the zone of now
+		{time.Date(2024, 3, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)), time.Date(2024, 3, 1, 3, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := at(tt.now); !got.Equal(tt.want) {
+			t.Errorf("Daily(03:30)(%s) = %s, want %s", tt.now, got, tt.want)
+		}
+	}
+	now := time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC)
+	if got := Every(time.Minute)(now); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("Every(1m)(%s) = %s", now, got)
+	}
+}
+
+func TestRunnerSchedulesAndStops(t *testing.T) {
+	r := newTestRunner()
+	var runs atomic.Int64
+	r.Add(Job{Name: "tick", Next: Every(5 * time.Millisecond), Run: func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}})
+	r.Add(Job{Name: "manual", Run: func(ctx context.Context) error { return nil }})
+	stop := start(t, r)
+
+	eventually(t, "three runs", func() bool { return runs.Load() >= 3 })
+	s := status(r, "tick")
+	if s.Runs < 3 || s.LastRun == nil || s.Failures != 0 {
+		t.Fatalf("status %+v", s)
+	}
+	if m := status(r, "manual"); m.Runs != 0 || m.NextRun != nil {
+		t.Fatalf("a job without a schedule ran or has a next run: %+v", m)
+	}
+
+	stop()
+	after := runs.Load()
+	time.Sleep(20 * time.Millisecond)
+	if runs.Load() != after {
+		t.Fatal("the job ran after the runner stopped")
+	}
+}
+
+func TestRunnerDoesNotOverlap(t *testing.T) {
+	r := newTestRunner()
+	var running, overlaps, runs atomic.Int64
+	release := make(chan struct{})
+	r.Add(Job{Name: "slow", Next: Every(time.Microsecond), Run: func(ctx context.Context) error {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		defer running.Add(-1)
+		runs.Add(1)
+		<-release
+		return nil
+	}})
+	stop := start(t, r)
+
+	eventually(t, "the first run", func() bool { return status(r, "slow").Running })
+	if err := r.Trigger("slow"); !errors.Is(err, ErrJobRunning) {
+		t.Fatalf("Trigger while running = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if runs.Load() != 1 {
+		t.Fatalf("%d runs while the first one was still going", runs.Load())
+	}
+	close(release)
+	eventually(t, "more runs", func() bool { return runs.Load() >= 5 })
+	stop()
+	if overlaps.Load() != 0 {
+		t.Fatalf("%d runs overlapped", overlaps.Load())
+	}
+}
+
+func TestRunnerTrigger(t *testing.T) {
+	r := newTestRunner()
+	ran := make(chan struct{}, 1)
+	r.Add(Job{Name: "integrity", Run: func(ctx context.Context) error {
+		ran <- struct{}{}
+		return nil
+	}})
+	if err := r.Trigger("nothing"); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("Trigger of an unknown job = %v", err)
+	}
+	// requested before Run, it runs once Run starts
+	if err := r.Trigger("integrity"); err != nil {
+		t.Fatal(err)
+	}
+	if !status(r, "integrity").Pending {
+		t.Fatal("the triggered run isn't pending")
+	}
+	if err := r.Trigger("integrity"); !errors.Is(err, ErrJobRunning) {
+		t.Fatalf("Trigger of a pending job = %v", err)
+	}
+	start(t, r)
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the triggered job did not run")
+	}
+}
+
+func TestRunnerFailures(t *testing.T) {
+	r := newTestRunner()
+	r.Add(Job{Name: "panics", Run: func(ctx context.Context) error { panic("boom") }})
+	r.Add(Job{Name: "slow", Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	start(t, r)
+	r.Trigger("panics")
+	r.Trigger("slow")
+
+	eventually(t, "both runs", func() bool { return status(r, "panics").Runs == 1 && status(r, "slow").Runs == 1 })
+	if s := status(r, "panics"); s.Failures != 1 || s.LastError != "panic: boom" {
+		t.Fatalf("panicking job: %+v", s)
+	}
+	if s := status(r, "slow"); s.Failures != 1 || s.LastError != context.DeadlineExceeded.Error() {
+		t.Fatalf("timed out job: %+v", s)
+	}
+	// the runner survived the panic
+	r.Trigger("panics")
+	eventually(t, "a second run", func() bool { return status(r, "panics").Runs == 2 })
+}
+
+func TestRunnerWaitsForRunsOnShutdown(t *testing.T) {
+	r := newTestRunner()
+	started := make(chan struct{})
+	var finished atomic.Bool
+	r.Add(Job{Name: "backup", Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		// cleaning up after the cancellation
+		time.Sleep(20 * time.Millisecond)
+		finished.Store(true)
+		return ctx.Err()
+	}})
+	stop := start(t, r)
+	r.Trigger("backup")
+	<-started
+	stop()
+	if !finished.Load() {
+		t.Fatal("Run returned before the run in progress")
+	}
+}
+
+func TestAddTwicePanics(t *testing.T) {
+	r := newTestRunner()
+	r.Add(Job{Name: "outbox"})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a second job with the same name was added")
+		}
+	}()
+	r.Add(Job{Name: "outbox"})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kordimion/secure-web-service/config"
+)
+
+// sdListenFdsStart is the first file descriptor systemd passes sockets on.
+const sdListenFdsStart = 3
+
+// listen returns the listener the server runs on. In order of preference
+// that is the socket systemd passed through socket activation, the one
+// given with -listen-fd, or a new listener on cfg.Addr, TCP or a Unix
+// domain socket.
+func listen(cfg config.Config) (net.Listener, error) {
+	fd, ok, err := systemdSocket()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return fileListener(fd, "systemd socket")
+	}
+	if cfg.ListenFD != 0 {
+		return fileListener(cfg.ListenFD, "-listen-fd")
+	}
+	if path, ok := strings.CutPrefix(cfg.Addr, config.UnixPrefix); ok {
+		return listenUnix(path, cfg.SocketMode)
+	}
+	return net.Listen("tcp", cfg.Addr)
+}
+
+// listenUnix listens on a Unix domain socket at path. A socket file left
+// behind by a process that died is removed first, one somebody still
+// listens on is an error. Closing the listener removes the file.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: another process is listening on the socket", path)
+	}
+	log.Printf("removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// systemdSocket reports the socket passed by systemd socket activation.
+// The LISTEN_ variables are meant for this process only and are removed,
+// so that child processes don't mistake them for their own.
+func systemdSocket() (fd int, ok bool, err error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return 0, false, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return 0, false, fmt.Errorf("LISTEN_FDS: %q is not a positive number of sockets", fds)
+	}
+	if n > 1 {
+		return 0, false, fmt.Errorf("LISTEN_FDS: systemd passed %d sockets, the server serves one", n)
+	}
+	return sdListenFdsStart, true, nil
+}
+
+// fileListener turns an inherited file descriptor into a listener.
+func fileListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("%s: %d is not a valid file descriptor", name, fd)
+	}
+	// net.FileListener duplicates the descriptor
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: file descriptor %d: %w", name, fd, err)
+	}
+	return l, nil
+}
+
+// limitListener returns a listener that keeps at most n of the
+// connections accepted from l open at once. Accept waits for one to
+// close, the clients in the meantime wait in the listen backlog.
+func limitListener(l net.Listener, n int) net.Listener {
+	return &limitedListener{Listener: l, slots: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+type limitedListener struct {
+	net.Listener
+	// slots holds a value for every open connection.
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitedListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitedConn gives its slot back when it is closed the first time.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
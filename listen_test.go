@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+)
+
+// newTestHandler is the whole service wired on a temporary database.
+func newTestHandler(t *testing.T) http.Handler {
+	t.Helper()
+	server, err := NewServer(openTestDB(t, true), api.SystemClock, testConfig(t), discardLogger(), new(slog.LevelVar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Hub.Close)
+	return server.Handler
+}
+
+// get fetches url with client and returns the status and body.
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestServeOnPortZero(t *testing.T) {
+	url, done := startServe(t, newTestHandler(t), time.Second)
+	if status, body := get(t, http.DefaultClient, url+"/healthz"); status != http.StatusOK {
+		t.Fatalf("healthz: %d %s", status, body)
+	}
+	shutdownSignal(t)
+	if err := waitServe(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenInheritedFD(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	f, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cfg := testConfig(t)
+	cfg.ListenFD = int(f.Fd())
+	l, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr().String() != parent.Addr().String() {
+		t.Fatalf("listening on %s, want the inherited %s", l.Addr(), parent.Addr())
+	}
+	handler := newTestHandler(t)
+	done := make(chan error, 1)
+	go func() { done <- serve(&http.Server{Handler: handler}, l, time.Second, nil) }()
+	if status, body := get(t, http.DefaultClient, "http://"+l.Addr().String()+"/readyz"); status != http.StatusOK {
+		t.Fatalf("readyz: %d %s", status, body)
+	}
+	shutdownSignal(t)
+	if err := waitServe(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ListenFD = 1 << 20
+	if _, err := listen(cfg); err == nil {
+		t.Fatal("listening on a descriptor that isn't open")
+	}
+}
+
+func TestSystemdSocket(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name, pid, fds string
+		ok, fail       bool
+	}{
+		{"not activated", "", "", false, false},
+		{"for another process", "1", "1", false, false},
+		{"one socket", pid, "1", true, false},
+		{"two sockets", pid, "2", false, true},
+		{"no sockets", pid, "0", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			fd, ok, err := systemdSocket()
+			if ok != tt.ok || (err != nil) != tt.fail || ok && fd != sdListenFdsStart {
+				t.Fatalf("systemdSocket() = %d, %t, %v", fd, ok, err)
+			}
+			if tt.pid == pid && (os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "") {
+				t.Fatal("the LISTEN_ variables were left for child processes")
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.sock")
+	cfg := testConfig(t)
+	cfg.Addr = config.UnixPrefix + path
+	cfg.SocketMode = 0o600
+	l, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket file: %v, %v", fi, err)
+	}
+	// nobody may take over a socket in use
+	if _, err := listenUnix(path, 0o600); err == nil {
+		t.Fatal("listening on a socket another listener serves")
+	}
+
+	handler := newTestHandler(t)
+	done := make(chan error, 1)
+	go func() { done <- serve(newHTTPServer(handler, cfg), l, time.Second, nil) }()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Post("http://wallets/api/v1/wallet/", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		Id string `json:"id"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("create over the socket: %d, %v", res.StatusCode, err)
+	}
+	if status, body := get(t, client, "http://wallets/api/v1/wallet/"+created.Id); status != http.StatusOK {
+		t.Fatalf("get over the socket: %d %s", status, body)
+	}
+	if status, body := get(t, client, "http://wallets/healthz"); status != http.StatusOK {
+		t.Fatalf("healthz over the socket: %d %s", status, body)
+	}
+	// a peer on the socket has no address for the admin allowlist, it is local
+	if status, body := get(t, client, "http://wallets/api/v1/admin/features"); status != http.StatusOK {
+		t.Fatalf("admin over the socket: %d %s", status, body)
+	}
+
+	shutdownSignal(t)
+	if err := waitServe(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallets.sock")
+	// left behind like by a process that was killed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l.Close()
+
+	file := filepath.Join(dir, "data.db")
+	if err := os.WriteFile(file, []byte("wallets"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, 0o660); err == nil {
+		t.Fatal("a regular file was replaced by the socket")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "wallets" {
+		t.Fatalf("the file was touched: %q, %v", b, err)
+	}
+}
+
+// TestLimitListener keeps two connections open under a cap of 2: a
+// third one is connected by the kernel but not served until one of the
+// first two closes.
+func TestLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(limitListener(l, 2))
+	t.Cleanup(func() { srv.Close() })
+
+	// request sends a request on conn and waits up to wait for the answer.
+	request := func(conn net.Conn, wait time.Duration) error {
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns[:2] {
+		if err := request(conn, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var netErr net.Error
+	if err := request(conns[2], 300*time.Millisecond); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("a third connection was served: %v", err)
+	}
+	conns[0].Close()
+	conns[2].SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conns[2]), nil)
+	if err != nil {
+		t.Fatalf("not served after a connection closed: %v", err)
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/client"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/jobs"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
+)
+
+// loadOps are the requests loadtest sends, in the order they are reported.
+var loadOps = []string{"create", "send", "history", "get"}
+
+// runLoadTest implements the loadtest command, which measures what one
+// instance does. It serves the API from a new SQLite database in a
+// temporary directory, drives it over HTTP with concurrent requests and
+// reports throughput, latency percentiles and the errors by code. At the
+// end the balances must still add up to the opening balances:
+//
+//	loadtest                                  8 workers for 10s, 100 wallets
+//	loadtest -workers 32 -duration 1m         more and longer
+//	loadtest -mix create=1,send=8,history=1   how often each request is sent, get is the fourth
+//	loadtest -dir /var/lib/web -keep          put the database on that disk and keep it
+//
+// The other settings come from the environment as for serve, DATABASE_URL
+// aside. It returns the process exit code: 2 for bad arguments, 1 when the
+// service couldn't run or the money doesn't add up.
+func runLoadTest(cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	workers := fs.Int("workers", 8, "concurrent clients")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	wallets := fs.Int("wallets", 100, "wallets created before the test")
+	mixFlag := fs.String("mix", "create=1,send=8,history=1", "relative weights of the create, send, history and get requests")
+	dir := fs.String("dir", "", "directory of the temporary database, the system's temporary directory when empty")
+	keep := fs.Bool("keep", false, "keep the database afterwards")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+	if *workers < 1 || *duration <= 0 || *wallets < 2 {
+		fmt.Fprintln(os.Stderr, "-workers and -duration must be positive and -wallets at least 2")
+		return 2
+	}
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-mix: %v\n", err)
+		return 2
+	}
+
+	tmp, err := os.MkdirTemp(*dir, "loadtest-")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if *keep {
+		log.Printf("the database stays in %s", tmp)
+	} else {
+		defer os.RemoveAll(tmp)
+	}
+	db, err := store.Open(filepath.Join(tmp, "data.db"))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer db.Close()
+	db.Scale = cfg.MoneyScale
+	db.Rounding = cfg.MoneyRounding
+	db.RecordFailures = cfg.RecordFailedTransfers
+	if cfg.BalanceCacheTTL > 0 {
+		db.Balances = store.NewBalanceCache(cfg.BalanceCacheTTL)
+	}
+	if err := prepareSchema(db, true); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err := db.DetectReturning(context.Background()); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	base, stop, err := serveLoadTest(db, cfg)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer stop()
+	// one kept-alive connection per worker, like a client with a pool
+	c, err := client.New(base, client.WithHTTPClient(&http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: *workers},
+	}))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	transfers := "locking reads"
+	if db.Returning {
+		transfers = "UPDATE ... RETURNING"
+	}
+	fmt.Printf("%d workers for %s on %s, transfers use %s\n", *workers, *duration, db.Path, transfers)
+	pool := &walletPool{}
+	for i := 0; i < *wallets; i++ {
+		w, err := c.CreateWallet(context.Background())
+		if err != nil {
+			log.Printf("create the wallets: %v", err)
+			return 1
+		}
+		pool.add(w.Id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	results := make([]*loadResults, *workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		results[i] = newLoadResults()
+		wg.Add(1)
+		go func(r *loadResults) {
+			defer wg.Done()
+			loadWorker(ctx, c, db, pool, mix, r)
+		}(results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := newLoadResults()
+	for _, r := range results {
+		total.merge(r)
+	}
+	total.print(elapsed)
+
+	// the requests have all returned, nothing moves money any more
+	balances, opening, err := db.MoneySupply(context.Background(), store.InitialBalance)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	mismatches := 0
+	err = db.LedgerMismatches(context.Background(), store.InitialBalance, func(store.LedgerMismatch) error {
+		mismatches++
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("%d wallets hold %s, they opened with %s, %d balances don't match the ledger\n",
+		len(pool.ids), balances.StringFixed(db.Scale), opening.StringFixed(db.Scale), mismatches)
+	if !balances.Equal(opening) || mismatches > 0 {
+		fmt.Println("money was created or lost")
+		return 1
+	}
+	return 0
+}
+
+// serveLoadTest serves the API from db on a free local port, quietly, and
+// returns its URL and a function that stops it.
+func serveLoadTest(db *store.DB, cfg config.Config) (string, func(), error) {
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelWarn)
+	logger := newLogger(cfg.LogFormat, level, cfg.LogRedact)
+	mode, err := api.NewMaintenanceMode(db, cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	hub := api.NewBalanceHub(cfg.WebSocketMaxPerWallet)
+	gin.SetMode(gin.ReleaseMode)
+	r, err := api.NewRouter(api.Handlers{
+		Wallets:     api.NewWalletHandler(db, api.SystemClock, hub, logger, cfg),
+		Admin:       api.NewAdminHandler(db, mode, jobs.NewRunner(logger), ops.NewIntegrity(db), logger, level, cfg),
+		Info:        api.NewInfoHandler(db, nil, version.Get(), logger, level),
+		Webhooks:    api.NewWebhookHandler(db, logger, cfg),
+		Live:        api.NewLiveHandler(db, hub, logger, cfg),
+		Maintenance: mode,
+	}, logger, cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: r}
+	go srv.Serve(l)
+	return "http://" + l.Addr().String(), func() {
+		hub.Close()
+		srv.Close()
+	}, nil
+}
+
+// loadMix says how often each of loadOps is sent, by weight.
+type loadMix struct {
+	ops   []string
+	total int
+}
+
+// parseMix reads weights like create=1,send=8,history=1; the ops left
+// out aren't sent.
+func parseMix(s string) (loadMix, error) {
+	var mix loadMix
+	for _, part := range strings.Split(s, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		weight, err := strconv.Atoi(v)
+		if !ok || err != nil || weight < 0 {
+			return mix, fmt.Errorf("%q is not op=weight", part)
+		}
+		known := false
+		for _, op := range loadOps {
+			known = known || op == name
+		}
+		if !known {
+			return mix, fmt.Errorf("unknown op %q, expected %s", name, strings.Join(loadOps, ", "))
+		}
+		for i := 0; i < weight; i++ {
+			mix.ops = append(mix.ops, name)
+		}
+		mix.total += weight
+	}
+	if mix.total == 0 {
+		return mix, errors.New("no op has a weight")
+	}
+	return mix, nil
+}
+
+func (m loadMix) pick() string {
+	return m.ops[rand.Intn(m.total)]
+}
+
+// walletPool are the wallets to send between, growing as workers create
+// more.
+type walletPool struct {
+	mu  sync.RWMutex
+	ids []string
+}
+
+func (p *walletPool) add(id string) {
+	p.mu.Lock()
+	p.ids = append(p.ids, id)
+	p.mu.Unlock()
+}
+
+// two returns two different wallets.
+func (p *walletPool) two() (string, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	i := rand.Intn(len(p.ids))
+	j := rand.Intn(len(p.ids) - 1)
+	if j >= i {
+		j++
+	}
+	return p.ids[i], p.ids[j]
+}
+
+// loadWorker sends requests until ctx is done. Requests cut short by the
+// end of the test aren't counted.
+func loadWorker(ctx context.Context, c *client.Client, db *store.DB, pool *walletPool, mix loadMix, r *loadResults) {
+	for ctx.Err() == nil {
+		op := mix.pick()
+		from, to := pool.two()
+		start := time.Now()
+		var err error
+		switch op {
+		case "create":
+			var w client.Wallet
+			if w, err = c.CreateWallet(ctx); err == nil {
+				pool.add(w.Id)
+			}
+		case "send":
+			// 0.01 to 1.00, so that most wallets can afford most of them
+			_, err = c.Send(ctx, from, to, db.FromMinor(int64(1+rand.Intn(100))))
+		case "history":
+			_, err = c.History(ctx, from, client.HistoryOptions{})
+		case "get":
+			_, err = c.GetWallet(ctx, from)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.record(op, time.Since(start), err)
+	}
+}
+
+// loadResults are the latencies and errors of requests, by op.
+type loadResults struct {
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newLoadResults() *loadResults {
+	return &loadResults{latencies: map[string][]time.Duration{}, errors: map[string]int{}}
+}
+
+// record adds a request. Errors are counted by op and by the code of the
+// API, or their HTTP status without one, or as transport errors.
+func (r *loadResults) record(op string, latency time.Duration, err error) {
+	r.latencies[op] = append(r.latencies[op], latency)
+	if err == nil {
+		return
+	}
+	kind := "transport"
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		kind = apiErr.Code
+		if kind == "" {
+			kind = strconv.Itoa(apiErr.StatusCode)
+		}
+	}
+	r.errors[op+" "+kind]++
+}
+
+func (r *loadResults) merge(other *loadResults) {
+	for op, latencies := range other.latencies {
+		r.latencies[op] = append(r.latencies[op], latencies...)
+	}
+	for kind, n := range other.errors {
+		r.errors[kind] += n
+	}
+}
+
+// print writes the throughput and latency of every op that was sent and
+// the errors.
+func (r *loadResults) print(elapsed time.Duration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "op\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+	var all []time.Duration
+	var failed int
+	for _, op := range loadOps {
+		latencies := r.latencies[op]
+		if len(latencies) == 0 {
+			continue
+		}
+		errs := 0
+		for kind, n := range r.errors {
+			if strings.HasPrefix(kind, op+" ") {
+				errs += n
+			}
+		}
+		printLoadRow(w, op, latencies, errs, elapsed)
+		all = append(all, latencies...)
+		failed += errs
+	}
+	printLoadRow(w, "all", all, failed, elapsed)
+	w.Flush()
+
+	kinds := make([]string, 0, len(r.errors))
+	for kind := range r.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("error %s: %d\n", kind, r.errors[kind])
+	}
+}
+
+func printLoadRow(w *tabwriter.Writer, op string, latencies []time.Duration, errs int, elapsed time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Fprintf(w, "%s\t0\t0\t0\t\t\t\t\t\n", op)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.0f\t%s\t%s\t%s\t%s\t\n", op, len(latencies), errs,
+		float64(len(latencies))/elapsed.Seconds(),
+		roundLatency(percentile(0.50)), roundLatency(percentile(0.90)), roundLatency(percentile(0.99)), roundLatency(latencies[len(latencies)-1]))
+}
+
+// roundLatency keeps three significant digits or so.
+func roundLatency(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/client"
+)
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]int
+		err  string
+	}{
+		{"create=1,send=8,history=1", map[string]int{"create": 1, "send": 8, "history": 1}, ""},
+		{" send=2 , get=1", map[string]int{"send": 2, "get": 1}, ""},
+		{"send=1,history=0", map[string]int{"send": 1}, ""},
+		{"send=1,teleport=1", nil, `unknown op "teleport"`},
+		{"send", nil, `"send" is not op=weight`},
+		{"send=-1", nil, `"send=-1" is not op=weight`},
+		{"send=0,get=0", nil, "no op has a weight"},
+	}
+	for _, tt := range tests {
+		mix, err := parseMix(tt.s)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseMix(%q) = %v, want %s", tt.s, err, tt.err)
+			}
+			continue
+		}
+		got := map[string]int{}
+		for _, op := range mix.ops {
+			got[op]++
+		}
+		if err != nil || mix.total != len(mix.ops) || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseMix(%q) = %v %d, %v, want %v", tt.s, got, mix.total, err, tt.want)
+		}
+	}
+}
+
+func TestLoadResults(t *testing.T) {
+	a, b := newLoadResults(), newLoadResults()
+	a.record("send", time.Millisecond, nil)
+	a.record("send", 2*time.Millisecond, &client.Error{StatusCode: 422, Code: "insufficient_funds"})
+	b.record("send", 3*time.Millisecond, &client.Error{StatusCode: 502})
+	b.record("history", time.Millisecond, errors.New("connection reset by peer"))
+	a.merge(b)
+
+	if len(a.latencies["send"]) != 3 || len(a.latencies["history"]) != 1 {
+		t.Fatalf("latencies: %v", a.latencies)
+	}
+	want := map[string]int{"send insufficient_funds": 1, "send 502": 1, "history transport": 1}
+	if fmt.Sprint(a.errors) != fmt.Sprint(want) {
+		t.Fatalf("errors: %v, want %v", a.errors, want)
+	}
+}
+
+// TestLoadTestCommand runs a short load test through the real HTTP stack
+// and reads its report, and checks the arguments it refuses.
+func TestLoadTestCommand(t *testing.T) {
+	code, out := captureStdout(t, func() int {
+		return runLoadTest(testConfig(t), []string{"-workers", "4", "-duration", "500ms", "-wallets", "5",
+			"-mix", "create=1,send=4,history=1,get=1", "-dir", t.TempDir()})
+	})
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, out)
+	}
+	for _, op := range append(loadOps, "all") {
+		// op, requests, errors, req/s and the four latencies
+		row := regexp.MustCompile(`(?m)^\s*` + op + `\s+[1-9]\d*\s+\d+\s+\d+(\s+\S+){4}\s*$`)
+		if !row.MatchString(out) {
+			t.Errorf("no row for %s:\n%s", op, out)
+		}
+	}
+	if !regexp.MustCompile(`\d+ wallets hold \S+, they opened with \S+, 0 balances don't match the ledger`).MatchString(out) ||
+		strings.Contains(out, "money was created or lost") {
+		t.Fatalf("money doesn't add up:\n%s", out)
+	}
+
+	for _, args := range [][]string{
+		{"-workers", "0"},
+		{"-wallets", "1"},
+		{"-duration", "-1s"},
+		{"-mix", "send=0"},
+		{"extra"},
+	} {
+		if code, out := captureStdout(t, func() int { return runLoadTest(testConfig(t), args) }); code != 2 {
+			t.Errorf("%v: exit code %d:\n%s", args, code, out)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// toggleDebugOnHangup switches level between debug and base, info when
+// base is debug itself, on every SIGHUP until ctx is cancelled.
+func toggleDebugOnHangup(ctx context.Context, level *slog.LevelVar, base slog.Level) {
+	if base == slog.LevelDebug {
+		base = slog.LevelInfo
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			next := slog.LevelDebug
+			if level.Level() == slog.LevelDebug {
+				next = base
+			}
+			level.Set(next)
+			slog.Warn("log level changed by SIGHUP", "level", strings.ToLower(next.String()))
+		}
+	}
+}
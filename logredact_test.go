@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// logTransfer writes the lines a transfer leaves in the log through a
+// handler writing to buf, at info and at debug.
+func logTransfer(buf *bytes.Buffer, redact bool) {
+	var h slog.Handler = slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	if redact {
+		h = redactingHandler{h}
+	}
+	log := slog.New(h)
+	log.Info("transfer", "from", "AAAAAA", "to", "BBBBBB", "amount", "12.34")
+	log.Debug("transfer", "from", "AAAAAA", "to", "BBBBBB", "amount", "12.34")
+	log.Info("event", slog.Group("payload", "wallet_id", "AAAAAA", "from_balance", "87.66"))
+	log.With("wallet", "BBBBBB", "balance", "112.34").Debug("live connection opened")
+}
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logTransfer(&buf, false)
+	for _, value := range []string{"AAAAAA", "BBBBBB", "12.34", "87.66", "112.34"} {
+		if !strings.Contains(buf.String(), value) {
+			t.Errorf("%s is missing without redaction:\n%s", value, &buf)
+		}
+	}
+
+	buf.Reset()
+	logTransfer(&buf, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d lines:\n%s", len(lines), &buf)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if strings.Contains(buf.String(), id) {
+			t.Errorf("the wallet id %s is in the log:\n%s", id, &buf)
+		}
+		if !strings.Contains(buf.String(), redactWalletId(id)) {
+			t.Errorf("the redacted %s is missing:\n%s", redactWalletId(id), &buf)
+		}
+	}
+	// amounts are only kept on debug lines, and never from With, which
+	// can't know the level of the lines to come
+	want := []struct{ present, absent []string }{
+		{nil, []string{"12.34"}},
+		{[]string{"12.34"}, nil},
+		{nil, []string{"87.66"}},
+		{nil, []string{"112.34"}},
+	}
+	for i, w := range want {
+		for _, value := range w.present {
+			if !strings.Contains(lines[i], value) {
+				t.Errorf("%s is missing from %s", value, lines[i])
+			}
+		}
+		for _, value := range w.absent {
+			if strings.Contains(lines[i], value) {
+				t.Errorf("%s is in %s", value, lines[i])
+			}
+		}
+	}
+}
+
+func TestRedactWalletId(t *testing.T) {
+	a := redactWalletId("AB1CDE")
+	if !strings.HasPrefix(a, "AB1***:") || len(a) != len("AB1***:9f3c") {
+		t.Fatalf("redactWalletId = %q", a)
+	}
+	// the same wallet can be followed through the log
+	if redactWalletId("AB1CDE") != a || redactWalletId("AB1CDF") == a {
+		t.Fatal("the hash doesn't tell wallets apart")
+	}
+	if got := redactWalletId("A"); !strings.HasPrefix(got, "A***:") {
+		t.Fatalf("redactWalletId of a short id = %q", got)
+	}
+}
@@ -1,328 +1,253 @@
 package main
 
 import (
-	"crypto/rand"
-	"database/sql"
-	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"math/big"
+	"log/slog"
+	"net"
 	"net/http"
-	"time"
+	"os"
+	"strings"
+	"sync"
 
-	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/shopspring/decimal"
 	"golang.org/x/net/context"
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/rpc"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
 )
 
-type Wallet struct {
-	Id      string
-	Balance decimal.Decimal
-}
-
-var walletsTableCreateSql = `
-	create table if not exists wallets (
-		id text not null primary key, 
-		balance decimal not null
-		);
-`
-
-type WalletTransaction struct {
-	AuthorId string
-	SenderId string
-	Balance  decimal.Decimal
-	Date     sql.NullTime
-}
-
-type WalletTransactionDTO struct {
-	AuthorId string          `json:"from"`
-	SenderId string          `json:"to"`
-	Balance  decimal.Decimal `json:"amount"`
-	Date     string          `json:"time"`
-}
-
-var walletsHistoryTableCreateSql = `
-	create table if not exists wallet_transactions (
-		author_id text not null, 
-		sender_id text not null, 
-		balance decimal not null,
-		date timestamp not null,
-
-		foreign key (author_id) references wallets (id),
-		foreign key (sender_id) references wallets (id)
-		);
-`
-
-func init() {
-	assertAvailablePRNG()
-}
-
-func assertAvailablePRNG() {
-	// Assert that a cryptographically secure PRNG is available.
-	// Panic otherwise.
-	buf := make([]byte, 1)
+func main() {
+	// the first argument names a command, flags without one configure the server
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "config" {
+		os.Exit(runConfig(args))
+	}
+	var serverArgs []string
+	if command == "" || command == "serve" {
+		serverArgs = args
+		for _, arg := range args {
+			if arg == "-version" || arg == "--version" {
+				info := version.Get()
+				fmt.Printf("%s (commit %s, built %s, %s)\n", info.Version, info.Commit, info.Date, info.GoVersion)
+				os.Exit(0)
+			}
+		}
+	}
 
-	_, err := io.ReadFull(rand.Reader, buf)
+	cfg, err := config.Load(serverArgs)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		panic(fmt.Sprintf("crypto/rand is unavailable: Read() failed with %#v", err))
+		log.Print(err)
+		os.Exit(exitConfig)
 	}
-}
-
-// GenerateRandomBytes returns securely generated random bytes.
-// It will return an error if the system's secure random
-// number generator fails to function correctly, in which
-// case the caller should not continue.
-func GenerateRandomBytes(n int) ([]byte, error) {
-	b := make([]byte, n)
-	_, err := rand.Read(b)
-	// Note that err == nil only if we read len(b) bytes.
+	// the standard log goes through the same handler from here on, so
+	// changing level changes the level of every log line
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel)
+	logger := newLogger(cfg.LogFormat, level, cfg.LogRedact)
+	slog.SetDefault(logger)
+
+	// loadtest serves from a database of its own
+	if command == "loadtest" {
+		os.Exit(runLoadTest(cfg, args))
+	}
+	db, err := store.Open(cfg.DatabaseURL)
 	if err != nil {
-		return nil, err
+		log.Print(err)
+		os.Exit(exitDatabase)
+	}
+	db.Scale = cfg.MoneyScale
+	db.Rounding = cfg.MoneyRounding
+	db.RecordFailures = cfg.RecordFailedTransfers
+	if cfg.BalanceCacheTTL > 0 {
+		db.Balances = store.NewBalanceCache(cfg.BalanceCacheTTL)
+	}
+	if db.Path != "" {
+		log.Printf("using SQLite database %s", db.Path)
 	}
 
-	return b, nil
+	var code int
+	switch command {
+	case "", "serve":
+		code = runServe(db, cfg, level, logger)
+	case "migrate":
+		code = runMigrate(db, args)
+	case "create-wallet":
+		code = runCreateWallet(db, cfg, args)
+	case "verify":
+		code = runVerify(db, args, os.Stdin)
+	case "backup":
+		code = runBackup(db, cfg, args)
+	case "maintenance":
+		code = runMaintenance(db, cfg, args)
+	case "archive":
+		code = runArchive(db, args)
+	default:
+		log.Printf("unknown command %q, expected serve, migrate, create-wallet, verify, backup, maintenance, archive, loadtest or config", command)
+		code = 2
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("close database: %v", err)
+	}
+	os.Exit(code)
 }
 
-// GenerateRandomString returns a securely generated random string.
-// It will return an error if the system's secure random
-// number generator fails to function correctly, in which
-// case the caller should not continue.
-func GenerateRandomString(n int) (string, error) {
-	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
-	ret := make([]byte, n)
-	for i := 0; i < n; i++ {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+// runServe implements the serve command, which is also what runs without
+// a command: check the environment, wire the service with NewServer,
+// start its background jobs and serve until a shutdown signal. It returns the process exit code, one of the
+// exit codes of selfCheck when the service can't start.
+func runServe(db *store.DB, cfg config.Config, level *slog.LevelVar, logger *slog.Logger) int {
+	// one server per SQLite database, other databases handle concurrent clients
+	if db.Path != "" {
+		unlock, err := lockInstance(db.Path)
 		if err != nil {
-			return "", err
+			log.Print(err)
+			return exitDatabase
 		}
-		ret[i] = letters[num.Int64()]
+		defer unlock()
 	}
 
-	return string(ret), nil
-}
-
-// GenerateRandomStringURLSafe returns a URL-safe, base64 encoded
-// securely generated random string.
-// It will return an error if the system's secure random
-// number generator fails to function correctly, in which
-// case the caller should not continue.
-func GenerateRandomStringURLSafe(n int) (string, error) {
-	b, err := GenerateRandomBytes(n)
-	return base64.URLEncoding.EncodeToString(b), err
-}
-
-type Result struct {
-	Wallet Wallet
-	Err    error
-}
-
-func loadByIdAsync(db *sql.Tx, channel chan Result, id string) {
-	var wallet Wallet
-	err := db.QueryRow("select * from wallets where id = ?", id).Scan(&wallet.Id, &wallet.Balance)
-	channel <- Result{
-		Wallet: wallet,
-		Err:    err,
+	if code := selfCheck(db, cfg, logger); code != 0 {
+		return code
+	}
+	if err := db.DetectReturning(context.Background()); err != nil {
+		log.Print(err)
+		return exitDatabase
+	}
+	if db.Returning {
+		log.Println("transfers use UPDATE ... RETURNING")
+	} else {
+		log.Println("transfers use locking reads, the database has no UPDATE ... RETURNING")
 	}
-}
-
-type SendWalletRequestBody struct {
-	ID     string          `json:"to"`
-	Amount decimal.Decimal `json:"amount"`
-}
 
-func main() {
-	db, err := sql.Open("sqlite3", "./data.db")
+	server, err := NewServer(db, api.SystemClock, cfg, logger, level)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return serverExitCode(err)
+	}
+	if state := server.Mode.State(); state.Enabled {
+		logger.Warn("maintenance mode is enabled, wallets are read-only", "message", state.Message, "since", state.Since)
 	}
-	defer db.Close()
-
-	sqlStmt := walletsTableCreateSql + walletsHistoryTableCreateSql
 
-	_, err = db.Exec(sqlStmt)
+	srv := newHTTPServer(server.Handler, cfg)
+	// live connections are hijacked, Shutdown doesn't wait for them
+	srv.RegisterOnShutdown(server.Hub.Close)
+	logger.Info("build", "version", version.Get())
+	logger.Info("effective configuration", "config", cfg)
+	l, err := listen(cfg)
 	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		return
+		log.Print(err)
+		return 1
+	}
+	if cfg.HTTPMaxConnections > 0 {
+		l = limitListener(l, cfg.HTTPMaxConnections)
 	}
 
-	r := gin.Default()
-	v1 := r.Group("/api/v1/wallet")
-	{
-		//curl -d "" http://localhost:8080/api/v1/wallet/
-		v1.POST("", func(c *gin.Context) {
-
-			// for my (and your) own convinience, i'll generate a random id of length 6
-			// it will be fine for this example app, but for a real application there should be either a retry policy, or a much bigger id
-			id, err := GenerateRandomString(6)
-			if err != nil {
-				panic(err)
-			}
-
-			_, err = db.Exec("insert into wallets(id, balance) values(?,100)", id)
-
-			if err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"id": id,
-				})
-			} else {
-				c.JSON(http.StatusCreated, gin.H{
-					"id":      id,
-					"balance": 100,
-				})
-			}
-
-		})
-
-		//curl --json '{"to":"TTTFGF","amount":10}' http://localhost:8080/api/v1/wallet/TTTFGF/send
-		v1.POST(":walletid/send", func(c *gin.Context) {
-			// this is a weird endpoint, because there is a lot of undefined behaviour.
-
-			// what happens when fromId == toId?
-			// Idk, so i'll allow those empty transactions to happen.
-			// So, you can transfer money to yourself, but it'll fail if you don't have enough money to do it.
-			// What a fancy way to check if your balance is above a certain threshold...
-
-			// what happens when amount is negative or zero?
-			// Idk, so i'll allow that as well.
-			// So, you can basically steal money from other people's wallets by specifying negative amount;
-			// It can also make other people's wallets negative, but that's a very weird thing to do.
-			// so i'll validate BOTH receiver and sender balances, even though it is not stated in the problem.
-
-			var requestBody SendWalletRequestBody
-			if err := c.ShouldBindJSON(&requestBody); err != nil {
-				log.Println(err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-
-			fromId := c.Param("walletid")
-			toId := requestBody.ID
-			amount := requestBody.Amount
-
-			ctx := context.Background()
-
-			tx, err := db.BeginTx(ctx, nil)
-			if err != nil {
-				tx.Rollback()
-				log.Fatal(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-
-			fromCh := make(chan Result)
-			toCh := make(chan Result)
-
-			go loadByIdAsync(tx, fromCh, fromId)
-			go loadByIdAsync(tx, toCh, toId)
-
-			log.Println("walletResFrom")
-			walletResFrom := <-fromCh
-			if walletResFrom.Err != nil {
-				tx.Rollback()
-				log.Println(walletResFrom.Err)
-				c.AbortWithStatus(http.StatusNotFound)
-				return
-			}
-			log.Println("walletResTo")
-			log.Println(toId)
-			walletResTo := <-toCh
-			if walletResTo.Err != nil {
-				tx.Rollback()
-				log.Println(walletResTo.Err)
-				c.AbortWithStatus(http.StatusBadRequest)
-				return
-			}
-
-			fromAmount := walletResFrom.Wallet.Balance.Sub(amount)
-			log.Println(fromAmount)
-			toAmount := walletResTo.Wallet.Balance.Add(amount)
-			log.Println(toAmount)
-
-			if !fromAmount.IsPositive() || !toAmount.IsPositive() {
-				log.Println(err)
-				c.AbortWithStatus(http.StatusBadRequest)
-				return
-			}
-			_, err = tx.ExecContext(ctx, `
-					update wallets set balance = ? where id = ? ;
-					update wallets set balance = ? where id = ? ;
-					insert into wallet_transactions(author_id, sender_id, balance, date) values(?,?,?,?);
-				`, fromAmount, fromId, toAmount, toId, fromId, toId, amount, time.Now())
-
-			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-			err = tx.Commit()
-			if err != nil {
-				log.Println(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-			c.Status(http.StatusOK)
-		})
-
-		//curl http://localhost:8080/api/v1/wallet/TTTFGF/history
-		v1.GET(":walletid/history", func(c *gin.Context) {
-			userInputId := c.Param("walletid")
-			var wallet Wallet
-			err := db.QueryRow(`select * from wallets where id = ? limit 1`, userInputId).Scan(&wallet.Id, &wallet.Balance)
-			if err != nil {
-				log.Println(err)
-				c.AbortWithStatus(http.StatusNotFound)
-				return
-			}
-			response, err := db.Query(`select * from wallet_transactions 
-			where author_id = ? or sender_id = ?`, userInputId, userInputId)
-			if err != nil {
-				log.Println(err)
-				c.AbortWithStatus(http.StatusNotFound)
-				return
+	workers, stopWorkers := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Jobs.Run(workers)
+	}()
+	if cfg.DebugEndpoints && cfg.DebugAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveDebug(workers, cfg.DebugAddr)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		toggleDebugOnHangup(workers, level, cfg.LogLevel)
+	}()
+	var rpcSrv *http.Server
+	if cfg.GRPCAddr != "" {
+		rpcs := rpc.NewServer(rpc.NewWalletService(db, api.SystemClock, server.Hub, server.Mode, cfg), logger, cfg)
+		if rpcSrv, err = rpcs.HTTPServer(); err != nil {
+			log.Print(err)
+			return 1
+		}
+		// calls are long lived HTTP/2 streams, only the preface is bounded
+		rpcSrv.ReadHeaderTimeout = cfg.HTTPReadHeaderTimeout
+		rpcSrv.MaxHeaderBytes = cfg.HTTPMaxHeaderBytes
+		gl, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Printf("gRPC listening on %s", gl.Addr())
+			// stops on the same signals as the main server, in parallel
+			if err := serve(rpcSrv, gl, cfg.ShutdownGrace, rpcs.Wait); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("gRPC server: %v", err)
 			}
+		}()
+	}
 
-			defer response.Close()
+	log.Printf("listening on %s", l.Addr())
+	code := 0
+	if err := serve(srv, l, cfg.ShutdownGrace, nil); err != nil {
+		if rpcSrv != nil {
+			rpcSrv.Close()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server: %v", err)
+			code = 1
+		}
+	}
 
-			var rows []WalletTransactionDTO = []WalletTransactionDTO{}
+	// the server is down, stop the background jobs before the database goes away
+	stopWorkers()
+	wg.Wait()
+	log.Println("stopped")
+	return code
+}
 
-			for response.Next() {
-				var row WalletTransaction
-				err = response.Scan(&row.AuthorId, &row.SenderId, &row.Balance, &row.Date)
-				if err != nil {
-					log.Println(err)
-					c.AbortWithStatus(http.StatusNotFound)
-					return
-				}
-				rows = append(rows, WalletTransactionDTO{
-					AuthorId: row.AuthorId,
-					SenderId: row.SenderId,
-					Balance:  row.Balance,
-					Date:     row.Date.Time.Format(time.RFC3339),
-				})
+// newHTTPServer returns the server of the main listener for handler,
+// with the timeouts and header limit of cfg. The requests of connections
+// on a Unix domain socket are marked with api.WithUnixPeer.
+func newHTTPServer(handler http.Handler, cfg config.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if c.LocalAddr().Network() == "unix" {
+				return api.WithUnixPeer(ctx)
 			}
+			return ctx
+		},
+	}
+}
 
-			c.JSON(http.StatusOK, rows)
-		})
- 
-		//curl http://localhost:8080/api/v1/wallet/TTTFGF
-		v1.GET(":walletid", func(c *gin.Context) {
-			userInputId := c.Param("walletid")
-			var wallet Wallet
-			err := db.QueryRow(`select * from wallets 
-			where id = ? limit 1`, userInputId).Scan(&wallet.Id, &wallet.Balance)
-			if err != nil {
-				c.AbortWithStatus(http.StatusNotFound)
-			} else {
-				c.JSON(http.StatusOK, gin.H{
-					"id":      wallet.Id,
-					"balance": wallet.Balance,
-				})
-			}
-		})
+// newLogger returns the logger of the service, writing to stderr in format
+// at level, through redactingHandler when redact is set.
+func newLogger(format string, level *slog.LevelVar, redact bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	// lines of requests the access log sampled out are dropped
+	h = api.SamplingHandler{Handler: h}
+	if redact {
+		h = redactingHandler{h}
 	}
-	r.Run(":8080")
+	return slog.New(h)
 }
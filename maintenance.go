@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// runMaintenance implements the maintenance command:
+//
+//	maintenance           optimize and checkpoint
+//	maintenance -vacuum   also vacuum
+//
+// It returns the process exit code.
+func runMaintenance(db *store.DB, cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	vacuum := fs.Bool("vacuum", cfg.MaintenanceVacuum, "also rebuild the database file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := ops.NewMaintenance(db, *vacuum).Run(context.Background(), *vacuum)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s in %s, reclaimed %d bytes\n", strings.Join(report.Steps, ", "), report.Duration, report.Reclaimed)
+	return 0
+}
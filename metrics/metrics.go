@@ -0,0 +1,232 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text format. There is no Prometheus client in the build
+// and the service only needs these three kinds, so they are written here.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metrics of a process, written in the order they were
+// added. It is an http.Handler serving them to Prometheus.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is one metric family of a Registry.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Counter adds a counter named name.
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.add(c)
+	return c
+}
+
+// Gauge adds a gauge named name.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.add(g)
+	return g
+}
+
+// Histogram adds a histogram named name. buckets are the upper bounds of
+// its buckets and must be increasing; the +Inf bucket is implied.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.add(&histogramFamily{name: name, help: help, series: func() []labeled { return []labeled{{"", h}} }})
+	return h
+}
+
+// HistogramVec adds a histogram named name with one label, a series per
+// value of the label. buckets are as for Histogram.
+func (r *Registry) HistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{label: label, buckets: newHistogram(buckets).buckets, series: map[string]*Histogram{}}
+	r.add(&histogramFamily{name: name, help: help, series: v.sorted})
+	return v
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Counter is a count that only goes up.
+type Counter struct {
+	name, help string
+	n          atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.n.Add(1)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	header(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.n.Load())
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	name, help string
+	v          atomic.Int64
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+}
+
+// Histogram counts observations in buckets and keeps their sum.
+type Histogram struct {
+	buckets []float64
+
+	mu sync.Mutex
+	// counts has a count per bucket and one for +Inf, not cumulative
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be increasing")
+	}
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	// the first bucket whose upper bound is at least v
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// HistogramVec is a histogram with a series per value of its label.
+type HistogramVec struct {
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*Histogram
+}
+
+// With returns the series of value, adding it on first use.
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[value]
+	if !ok {
+		h = newHistogram(v.buckets)
+		v.series[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) sorted() []labeled {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	series := make([]labeled, 0, len(v.series))
+	for value, h := range v.series {
+		series = append(series, labeled{v.label + `="` + escape(value) + `"`, h})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+	return series
+}
+
+// labeled is a series of a histogram family and its labels, as written
+// between the braces.
+type labeled struct {
+	labels string
+	h      *Histogram
+}
+
+type histogramFamily struct {
+	name, help string
+	series     func() []labeled
+}
+
+func (f *histogramFamily) write(w *bufio.Writer) {
+	header(w, f.name, f.help, "histogram")
+	for _, s := range f.series() {
+		prefix := ""
+		if s.labels != "" {
+			prefix = s.labels + ","
+		}
+		s.h.mu.Lock()
+		counts, sum := append([]uint64(nil), s.h.counts...), s.h.sum
+		s.h.mu.Unlock()
+
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(s.h.buckets) {
+				le = s.h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", f.name, prefix, formatFloat(le), cumulative)
+		}
+		labels := ""
+		if s.labels != "" {
+			labels = "{" + s.labels + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, cumulative)
+	}
+}
+
+func header(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, typ)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return labelEscaper.Replace(value)
+}
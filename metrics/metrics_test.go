@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests served.")
+	g := r.Gauge("healthy", "1 while healthy.")
+	h := r.Histogram("amount", "Amounts.", []float64{1, 10})
+	v := r.HistogramVec("duration_seconds", "Durations\nby statement.", "statement", []float64{0.5})
+
+	c.Inc()
+	c.Inc()
+	g.Set(1)
+	for _, x := range []float64{0.5, 1, 5, 50} {
+		h.Observe(x)
+	}
+	v.With("debit").Observe(0.25)
+	v.With(`say "hi"`).Observe(2)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total 2
+# HELP healthy 1 while healthy.
+# TYPE healthy gauge
+healthy 1
+# HELP amount Amounts.
+# TYPE amount histogram
+amount_bucket{le="1"} 2
+amount_bucket{le="10"} 3
+amount_bucket{le="+Inf"} 4
+amount_sum 56.5
+amount_count 4
+# HELP duration_seconds Durations by statement.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{statement="debit",le="0.5"} 1
+duration_seconds_bucket{statement="debit",le="+Inf"} 1
+duration_seconds_sum{statement="debit"} 0.25
+duration_seconds_count{statement="debit"} 1
+duration_seconds_bucket{statement="say \"hi\"",le="0.5"} 0
+duration_seconds_bucket{statement="say \"hi\"",le="+Inf"} 1
+duration_seconds_sum{statement="say \"hi\""} 2
+duration_seconds_count{statement="say \"hi\""} 1
+`
+	if w.Body.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", w.Body, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("content type %q", ct)
+	}
+}
+
+func TestUnsortedBucketsPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a histogram with unsorted buckets was added")
+		}
+	}()
+	NewRegistry().Histogram("amount", "Amounts.", []float64{10, 1})
+}
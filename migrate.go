@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"kordimion/secure-web-service/store"
+)
+
+// prepareSchema brings the schema up to date before serving, or only
+// checks that it is when migrations are not applied on start.
+func prepareSchema(db *store.DB, migrate bool) error {
+	ctx := context.Background()
+
+	legacy, err := db.Legacy(ctx)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		log.Println("database was created before schema migrations, adopting it as version 1")
+	}
+
+	if !migrate {
+		pending, err := db.Plan(ctx, store.LatestVersion())
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d schema migrations are pending, run the migrate command first", len(pending))
+		}
+		return nil
+	}
+
+	steps, err := db.Migrate(ctx)
+	for _, step := range steps {
+		log.Printf("schema migration %s", step)
+	}
+	return err
+}
+
+// runMigrate implements the migrate command:
+//
+//	migrate           apply all pending migrations
+//	migrate -plan     print what would run without changing anything
+//	migrate -to N     migrate up or down to version N
+//
+// It returns the process exit code.
+func runMigrate(db *store.DB, args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	plan := fs.Bool("plan", false, "print the migrations that would run and exit")
+	to := fs.Int("to", store.LatestVersion(), "schema version to migrate to, lower versions run down migrations")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	current, err := db.SchemaVersion(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	steps, err := db.Plan(ctx, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("schema version %d, target %d\n", current, *to)
+	if len(steps) == 0 {
+		fmt.Println("nothing to do")
+		return 0
+	}
+	for _, step := range steps {
+		fmt.Println(step)
+	}
+	if *plan {
+		return 0
+	}
+
+	if err := db.Apply(ctx, steps); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("schema is now at version %d\n", *to)
+	return 0
+}
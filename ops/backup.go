@@ -0,0 +1,106 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// Backup files are named backupPrefix + UTC timestamp + backupSuffix,
+// so sorting their names sorts them by age.
+const (
+	backupPrefix     = "backup-"
+	backupSuffix     = ".db"
+	backupTimeLayout = "20060102T150405.000Z"
+)
+
+// BackupInfo describes a snapshot written by Backups.Create.
+type BackupInfo struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Backups writes database snapshots into a directory and prunes the
+// oldest ones beyond the retention count, 0 keeping all of them.
+type Backups struct {
+	db        *store.DB
+	dir       string
+	retention int
+}
+
+func NewBackups(db *store.DB, dir string, retention int) *Backups {
+	return &Backups{db: db, dir: dir, retention: retention}
+}
+
+// Create writes a new snapshot and prunes old ones. A failed prune is
+// logged but doesn't fail the backup, which was written successfully.
+// It returns ErrBusy while another backup or maintenance run is in progress.
+func (b *Backups) Create(ctx context.Context) (BackupInfo, error) {
+	if !exclusive.TryLock() {
+		return BackupInfo{}, ErrBusy
+	}
+	defer exclusive.Unlock()
+
+	if err := os.MkdirAll(b.dir, 0o750); err != nil {
+		return BackupInfo{}, fmt.Errorf("create backup directory: %w", err)
+	}
+	dir, err := filepath.Abs(b.dir)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	path := filepath.Join(dir, backupPrefix+time.Now().UTC().Format(backupTimeLayout)+backupSuffix)
+
+	if err := b.db.Backup(ctx, path); err != nil {
+		// don't leave a partial snapshot behind for the next prune to count
+		os.Remove(path)
+		return BackupInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	if err := b.prune(); err != nil {
+		log.Printf("prune backups: %v", err)
+	}
+	return BackupInfo{Path: path, Size: info.Size()}, nil
+}
+
+// prune removes the oldest backups so that at most retention are kept.
+// A retention of 0 keeps all of them.
+func (b *Backups) prune() error {
+	if b.retention <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasPrefix(e.Name(), backupPrefix) && strings.HasSuffix(e.Name(), backupSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) <= b.retention {
+		return nil
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names[:len(names)-b.retention] {
+		if err := os.Remove(filepath.Join(b.dir, name)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("removed old backup %s", name)
+	}
+	return errors.Join(errs...)
+}
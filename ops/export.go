@@ -0,0 +1,229 @@
+package ops
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// Exports are JSON Lines: a header record, every wallet, every transaction
+// and an end record with the counts, so a truncated file is detected.
+//
+//	{"type":"header","version":1}
+//	{"type":"wallet","id":"TTTFGF","balance":"89.5","created_at":"2024-01-01T10:00:00Z"}
+//	{"type":"wallet","id":"Bzxjeg","balance":"10.5","opening":"0"}
+//	{"type":"transaction","from":"TTTFGF","to":"Bzxjeg","amount":"10.5","time":"2024-01-02T15:04:05.123456Z","status":"completed","from_balance_after":"89.5","to_balance_after":"110.5"}
+//	{"type":"end","wallets":2,"transactions":1}
+const exportVersion = 1
+
+// exportRecord is one line of an export. Only the fields of its type are set.
+type exportRecord struct {
+	Type         string           `json:"type"`
+	Version      int              `json:"version,omitempty"`
+	Id           string           `json:"id,omitempty"`
+	Balance      *decimal.Decimal `json:"balance,omitempty"`
+	Opening      *decimal.Decimal `json:"opening,omitempty"`
+	CreatedAt    *time.Time       `json:"created_at,omitempty"`
+	From         string           `json:"from,omitempty"`
+	To           string           `json:"to,omitempty"`
+	Amount       *decimal.Decimal `json:"amount,omitempty"`
+	Time         *time.Time       `json:"time,omitempty"`
+	Status       string           `json:"status,omitempty"`
+	Reason       string           `json:"failure_reason,omitempty"`
+	FromBalance  *decimal.Decimal `json:"from_balance_after,omitempty"`
+	ToBalance    *decimal.Decimal `json:"to_balance_after,omitempty"`
+	Wallets      *int             `json:"wallets,omitempty"`
+	Transactions *int             `json:"transactions,omitempty"`
+}
+
+// WriteExport streams every wallet and transaction of db to w.
+func WriteExport(ctx context.Context, db *store.DB, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(exportRecord{Type: "header", Version: exportVersion}); err != nil {
+		return err
+	}
+	wallets, transactions := 0, 0
+	err := db.Export(ctx, func(wallet store.Wallet) error {
+		wallets++
+		record := exportRecord{Type: "wallet", Id: wallet.Id, Balance: &wallet.Balance}
+		// only opening balances other than the usual credit are written, those
+		// files stay readable by versions without opening balances
+		if wallet.Opening.Valid && !wallet.Opening.Decimal.Equal(store.InitialBalance) {
+			record.Opening = &wallet.Opening.Decimal
+		}
+		if wallet.CreatedAt.Valid {
+			createdAt := wallet.CreatedAt.Time.UTC()
+			record.CreatedAt = &createdAt
+		}
+		return enc.Encode(record)
+	}, func(t store.Transaction) error {
+		transactions++
+		record := exportRecord{Type: "transaction", From: t.FromId, To: t.ToId, Amount: &t.Amount,
+			Status: t.Status, Reason: t.FailureReason}
+		if t.Date.Valid {
+			date := t.Date.Time.UTC()
+			record.Time = &date
+		}
+		if t.FromBalance.Valid {
+			record.FromBalance = &t.FromBalance.Decimal
+		}
+		if t.ToBalance.Valid {
+			record.ToBalance = &t.ToBalance.Decimal
+		}
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Encode(exportRecord{Type: "end", Wallets: &wallets, Transactions: &transactions})
+}
+
+// ImportError is a problem with the document being imported, as opposed
+// to a failure of the database.
+type ImportError struct {
+	Record int
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// decodeError rewords an error of the JSON decoder, whose messages name
+// the Go types the records are read into, as ImportErrors are shown to
+// the clients of the import endpoint.
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return err
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("malformed JSON at byte %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%s: must not be a %s", typeErr.Field, typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// from DisallowUnknownFields, which has no error type
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		return errors.New("a field has a value of the wrong format")
+	}
+}
+
+// ReadImport loads an export from r into db inside one transaction. Wallets
+// must come before the transactions that use them, and the balances must
+// equal their opening balance, store.InitialBalance unless the record says
+// otherwise, plus the transactions. With replace, existing data
+// is deleted first, otherwise the database must be empty.
+func ReadImport(ctx context.Context, db *store.DB, r io.Reader, replace bool) (wallets, transactions int, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var header exportRecord
+	if err := dec.Decode(&header); err != nil {
+		return 0, 0, &ImportError{1, decodeError(err)}
+	}
+	if header.Type != "header" || header.Version != exportVersion {
+		return 0, 0, &ImportError{1, fmt.Errorf("expected a version %d header", exportVersion)}
+	}
+
+	im, err := db.BeginImport(ctx, replace)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer im.Rollback()
+
+	for n := 2; ; n++ {
+		var record exportRecord
+		if err := dec.Decode(&record); err != nil {
+			err = decodeError(err)
+			if errors.Is(err, io.EOF) {
+				err = errors.New("missing end record, the export is truncated")
+			}
+			return 0, 0, &ImportError{n, err}
+		}
+		switch record.Type {
+		case "wallet":
+			if transactions > 0 {
+				return 0, 0, &ImportError{n, errors.New("wallets must come before transactions")}
+			}
+			if record.Id == "" || record.Balance == nil {
+				return 0, 0, &ImportError{n, errors.New("wallet needs an id and a balance")}
+			}
+			w := store.Wallet{Id: record.Id, Balance: *record.Balance, Opening: nullDecimal(record.Opening)}
+			if record.CreatedAt != nil {
+				w.CreatedAt = sql.NullTime{Time: *record.CreatedAt, Valid: true}
+			}
+			err := im.AddWallet(ctx, w)
+			if errors.Is(err, store.ErrDuplicateID) || errors.Is(err, store.ErrNegativeBalance) ||
+				errors.Is(err, store.ErrTooPrecise) || errors.Is(err, store.ErrOutOfRange) {
+				return 0, 0, &ImportError{n, fmt.Errorf("wallet %s: %w", record.Id, err)}
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			wallets++
+		case "transaction":
+			if record.From == "" || record.To == "" || record.Amount == nil || record.Time == nil {
+				return 0, 0, &ImportError{n, errors.New("transaction needs from, to, amount and time")}
+			}
+			err := im.AddTransaction(ctx, store.Transaction{
+				FromId:        record.From,
+				ToId:          record.To,
+				Amount:        *record.Amount,
+				Date:          sql.NullTime{Time: *record.Time, Valid: true},
+				Status:        record.Status,
+				FailureReason: record.Reason,
+				FromBalance:   nullDecimal(record.FromBalance),
+				ToBalance:     nullDecimal(record.ToBalance),
+			})
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrTooPrecise) || errors.Is(err, store.ErrOutOfRange) ||
+				errors.Is(err, store.ErrUnknownStatus) {
+				return 0, 0, &ImportError{n, fmt.Errorf("transaction %s -> %s: %w", record.From, record.To, err)}
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			transactions++
+		case "end":
+			if record.Wallets == nil || record.Transactions == nil ||
+				*record.Wallets != wallets || *record.Transactions != transactions {
+				return 0, 0, &ImportError{n, fmt.Errorf("end record doesn't match the %d wallets and %d transactions read", wallets, transactions)}
+			}
+			if dec.More() {
+				return 0, 0, &ImportError{n + 1, errors.New("unexpected data after the end record")}
+			}
+			var ledgerErr *store.LedgerError
+			err := im.Commit(ctx, store.InitialBalance)
+			if errors.As(err, &ledgerErr) {
+				return 0, 0, &ImportError{n, err}
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			return wallets, transactions, nil
+		default:
+			return 0, 0, &ImportError{n, fmt.Errorf("unknown record type %q", record.Type)}
+		}
+	}
+}
+
+// nullDecimal is d, or no amount when d is nil.
+func nullDecimal(d *decimal.Decimal) decimal.NullDecimal {
+	if d == nil {
+		return decimal.NullDecimal{}
+	}
+	return decimal.NewNullDecimal(*d)
+}
@@ -0,0 +1,237 @@
+package ops
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// seedExport fills db with what an export has to carry: opening balances
+// other than the usual credit, wallets without a creation date, failed
+// and archived transactions and sub-second times.
+func seedExport(t *testing.T, db *store.DB) {
+	t.Helper()
+	ctx := context.Background()
+	wallets := []store.Wallet{
+		{Id: "AAAAAA", Balance: store.InitialBalance, CreatedAt: sql.NullTime{Time: testTime, Valid: true}},
+		{Id: "BBBBBB", Balance: decimal.RequireFromString("0.5"), CreatedAt: sql.NullTime{Time: testTime.Add(time.Second), Valid: true}},
+		{Id: "CCCCCC", Balance: store.InitialBalance},
+	}
+	for _, w := range wallets {
+		if err := db.CreateWallet(ctx, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.RecordFailures = true
+	transfers := []struct {
+		from, to, amount string
+		at               time.Time
+	}{
+		{"AAAAAA", "BBBBBB", "12.34", testTime.Add(time.Hour + 123456*time.Microsecond)},
+		{"BBBBBB", "CCCCCC", "0.01", testTime.Add(2 * time.Hour)},
+		// refused, and kept as a failed transaction
+		{"BBBBBB", "AAAAAA", "1000", testTime.Add(3 * time.Hour)},
+		{"CCCCCC", "AAAAAA", "50", testTime.Add(24 * time.Hour)},
+	}
+	for _, tr := range transfers {
+		_, err := db.Transfer(ctx, tr.from, tr.to, decimal.RequireFromString(tr.amount), tr.at)
+		if err != nil && !errors.Is(err, store.ErrInsufficientFunds) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ArchiveTransactions(ctx, testTime.Add(90*time.Minute), 100, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func export(t *testing.T, db *store.DB) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteExport(context.Background(), db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// opening is the opening balance of w, InitialBalance when it wasn't
+// recorded, which is how the usual credit is exported.
+func opening(w store.Wallet) decimal.Decimal {
+	if !w.Opening.Valid {
+		return store.InitialBalance
+	}
+	return w.Opening.Decimal
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t)
+	seedExport(t, src)
+	exported := export(t, src)
+
+	dst := openTestDB(t)
+	wallets, transactions, err := ReadImport(ctx, dst, bytes.NewReader(exported), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wallets != 3 || transactions != 4 {
+		t.Fatalf("imported %d wallets and %d transactions, want 3 and 4", wallets, transactions)
+	}
+	if again := export(t, dst); !bytes.Equal(again, exported) {
+		t.Fatalf("export of the import differs:\n%s\nwant\n%s", again, exported)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB", "CCCCCC"} {
+		want, err := src.GetWallet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.GetWallet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Balance.Equal(want.Balance) || !opening(got).Equal(opening(want)) ||
+			got.CreatedAt.Valid != want.CreatedAt.Valid || !got.CreatedAt.Time.Equal(want.CreatedAt.Time) {
+			t.Errorf("%s imported as %+v, want %+v", id, got, want)
+		}
+	}
+	// the archive comes back as current transactions, none is lost
+	history, err := dst.History(ctx, "BBBBBB", store.HistoryFilter{IncludeArchived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Status != store.StatusFailed || history[0].FailureReason != "insufficient_funds" {
+		t.Fatalf("history after import: %+v", history)
+	}
+}
+
+func TestImportRefusals(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t)
+	seedExport(t, src)
+	exported := string(export(t, src))
+
+	t.Run("not empty", func(t *testing.T) {
+		dst := openTestDB(t)
+		seedExport(t, dst)
+		if _, _, err := ReadImport(ctx, dst, strings.NewReader(exported), false); !errors.Is(err, store.ErrNotEmpty) {
+			t.Fatalf("err = %v, want ErrNotEmpty", err)
+		}
+		// unless replacing is asked for
+		if _, _, err := ReadImport(ctx, dst, strings.NewReader(exported), true); err != nil {
+			t.Fatal(err)
+		}
+		if again := string(export(t, dst)); again != exported {
+			t.Fatalf("replaced database exports\n%s\nwant\n%s", again, exported)
+		}
+	})
+
+	lines := strings.SplitAfter(exported, "\n")
+	refused := []struct {
+		name     string
+		document string
+		want     string
+	}{
+		{"truncated", strings.Join(lines[:len(lines)-2], ""), "missing end record"},
+		{"balance off the ledger", strings.Replace(exported, `"id":"CCCCCC","balance":"50.01"`, `"id":"CCCCCC","balance":"60"`, 1),
+			"CCCCCC has 60 but its transactions add up to 50.01"},
+		{"unknown wallet", strings.Replace(exported, `"from":"CCCCCC"`, `"from":"ZZZZZZ"`, 1), "transaction ZZZZZZ -> AAAAAA"},
+		{"no header", strings.Join(lines[1:], ""), "record 1: expected a version 1 header"},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := openTestDB(t)
+			_, _, err := ReadImport(ctx, dst, strings.NewReader(tt.document), false)
+			var importErr *ImportError
+			if !errors.As(err, &importErr) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want an ImportError about %q", err, tt.want)
+			}
+			// nothing of a refused import is kept
+			if n := countWallets(t, dst); n != 0 {
+				t.Fatalf("%d wallets left by a refused import", n)
+			}
+		})
+	}
+}
+
+// sampledWriter discards an export, measuring the live heap every
+// sampleEvery writes, and cancels the export after cancelAfter writes
+// when set.
+type sampledWriter struct {
+	writes, bytes int
+	sampleEvery   int
+	peakHeap      uint64
+	cancelAfter   int
+	cancel        context.CancelFunc
+}
+
+func (w *sampledWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	if w.sampleEvery > 0 && w.writes%w.sampleEvery == 0 {
+		w.peakHeap = max(w.peakHeap, liveHeap())
+	}
+	if w.cancel != nil && w.writes == w.cancelAfter {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+// liveHeap returns the bytes of the heap still in use after a collection.
+func liveHeap() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// TestExportStreams exports a ledger larger than the memory it may use:
+// the live heap stays under the ceiling while the rows are written, and
+// canceling the export, as a client hanging up does, stops the scan.
+func TestExportStreams(t *testing.T) {
+	const transactions = 100000
+	const ceiling = 4 << 20
+	ctx := context.Background()
+	db := openTestDB(t)
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(ctx, store.Wallet{Id: id, Balance: store.InitialBalance}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.ExecContext(ctx, `with recursive n(i) as (select 1 union all select i + 1 from n where i < ?)
+		insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status)
+		select 'AAAAAA', 'BBBBBB', i, ?, 'completed' from n`, transactions, testTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := liveHeap()
+	w := &sampledWriter{sampleEvery: transactions / 20}
+	if err := WriteExport(ctx, db, w); err != nil {
+		t.Fatal(err)
+	}
+	// a header, two wallets, the transactions and the end
+	if w.writes != transactions+4 || w.bytes < 2*ceiling {
+		t.Fatalf("%d records of %d bytes exported, want %d records of more than %d bytes", w.writes, w.bytes, transactions+4, 2*ceiling)
+	}
+	if grown := int64(w.peakHeap) - int64(base); grown > ceiling {
+		t.Fatalf("the live heap grew by %d bytes exporting %d bytes, want at most %d", grown, w.bytes, ceiling)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w = &sampledWriter{cancelAfter: 1000, cancel: cancel}
+	if err := WriteExport(canceled, db, w); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled export: %v, want context.Canceled", err)
+	}
+	// rows already read may still be written, the scan stops at the next
+	if w.writes > w.cancelAfter+100 {
+		t.Fatalf("%d records written after the cancel", w.writes-w.cancelAfter)
+	}
+}
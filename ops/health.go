@@ -0,0 +1,149 @@
+package ops
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"kordimion/secure-web-service/metrics"
+	"kordimion/secure-web-service/store"
+)
+
+// DBHealthJob is the name of the database health check in the job runner.
+const DBHealthJob = "db_health"
+
+// DBHealthState is what the health checks found out about the database.
+type DBHealthState struct {
+	Healthy bool `json:"healthy"`
+	// Since is when the database became healthy or unhealthy, the start
+	// of the monitor when it never changed.
+	Since time.Time `json:"since"`
+	// LastCheck is nil before the first check.
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	// Failures counts the failed checks in a row.
+	Failures  int    `json:"consecutive_failures"`
+	LastError string `json:"last_error,omitempty"`
+	// PoolResets counts the times the connection pool was reset.
+	PoolResets int `json:"pool_resets"`
+}
+
+// DBHealth checks the database with store.Probe. After threshold failed
+// checks in a row the database is unhealthy: requests needing it are
+// refused right away instead of each waiting for its own timeout, and the
+// connection pool is reset so that connections broken meanwhile aren't
+// reused once it is back. The first check that passes makes it healthy
+// again. It starts out healthy, the server checked the database when it
+// started.
+//
+// A nil *DBHealth is always healthy.
+type DBHealth struct {
+	db        *store.DB
+	threshold int
+	timeout   time.Duration
+	log       *slog.Logger
+
+	healthy    *metrics.Gauge
+	failures   *metrics.Counter
+	poolResets *metrics.Counter
+
+	mu    sync.Mutex
+	state DBHealthState
+	// reset is whether the pool is reset and must be restored.
+	reset bool
+}
+
+// NewDBHealth returns a monitor declaring the database unhealthy after
+// threshold failed checks, each given timeout. Its metrics are added to
+// registry unless it is nil.
+func NewDBHealth(db *store.DB, threshold int, timeout time.Duration, logger *slog.Logger, registry *metrics.Registry) *DBHealth {
+	h := &DBHealth{
+		db:        db,
+		threshold: threshold,
+		timeout:   timeout,
+		log:       logger,
+		state:     DBHealthState{Healthy: true, Since: time.Now().UTC().Truncate(time.Second)},
+	}
+	if registry != nil {
+		h.healthy = registry.Gauge("wallet_db_healthy",
+			"1 while the database passes its health checks, 0 after DB_HEALTH_FAILURES failed ones in a row.")
+		h.failures = registry.Counter("wallet_db_health_check_failures_total",
+			"Failed database health checks.")
+		h.poolResets = registry.Counter("wallet_db_pool_resets_total",
+			"Times the database connection pool was reset after the database became unhealthy.")
+		h.healthy.Set(1)
+	}
+	return h
+}
+
+// Check runs a health check and records its outcome. It is run as a job
+// and only fails when ctx is done: an unhealthy database is logged when
+// it becomes so and shown by State.
+func (h *DBHealth) Check(ctx context.Context) error {
+	checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	err := h.db.Probe(checkCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UTC().Truncate(time.Second)
+	h.state.LastCheck = &now
+	if err == nil {
+		if !h.state.Healthy {
+			h.log.Info("database is healthy again", "failures", h.state.Failures, "unhealthy_since", h.state.Since)
+			h.state.Healthy, h.state.Since = true, now
+			h.setGauge(1)
+		}
+		if h.reset {
+			h.db.RestorePool()
+			h.reset = false
+		}
+		h.state.Failures, h.state.LastError = 0, ""
+		return nil
+	}
+
+	if h.failures != nil {
+		h.failures.Inc()
+	}
+	h.state.Failures++
+	h.state.LastError = err.Error()
+	if h.state.Healthy && h.state.Failures >= h.threshold {
+		h.log.Error("database is unhealthy, refusing the requests that need it", "failures", h.state.Failures, "err", err)
+		h.state.Healthy, h.state.Since = false, now
+		h.setGauge(0)
+	}
+	// retried while it does nothing, say until a removed SQLite file is back
+	if !h.state.Healthy && !h.reset && h.db.ResetPool() {
+		h.log.Warn("database connection pool reset")
+		h.reset = true
+		h.state.PoolResets++
+		if h.poolResets != nil {
+			h.poolResets.Inc()
+		}
+	}
+	return nil
+}
+
+func (h *DBHealth) setGauge(v int64) {
+	if h.healthy != nil {
+		h.healthy.Set(v)
+	}
+}
+
+// State returns what the last checks found.
+func (h *DBHealth) State() DBHealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Healthy reports whether the database is healthy.
+func (h *DBHealth) Healthy() bool {
+	if h == nil {
+		return true
+	}
+	return h.State().Healthy
+}
@@ -0,0 +1,91 @@
+package ops
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/metrics"
+)
+
+// TestDBHealth moves the database file away under the monitor, then
+// makes its checks time out with the file in place: the database turns
+// unhealthy after the threshold, the pool is reset once the file is there
+// to reconnect to, and the first check passing makes it healthy again.
+func TestDBHealth(t *testing.T) {
+	db := openTestDB(t)
+	registry := metrics.NewRegistry()
+	health := NewDBHealth(db, 2, time.Second, slog.New(slog.NewTextHandler(io.Discard, nil)), registry)
+	ctx := context.Background()
+	check := func(healthy bool, failures, resets int) {
+		t.Helper()
+		if err := health.Check(ctx); err != nil {
+			t.Fatal(err)
+		}
+		state := health.State()
+		if state.Healthy != healthy || state.Failures != failures || state.PoolResets != resets || state.LastCheck == nil ||
+			(state.LastError == "") != (failures == 0) || health.Healthy() != healthy {
+			t.Fatalf("%+v, want healthy %v after %d failures and %d resets", state, healthy, failures, resets)
+		}
+	}
+	move := func(from, to string) {
+		t.Helper()
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(from+suffix, to+suffix); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check(true, 0, 0)
+	move(db.Path, db.Path+".away")
+	check(true, 1, 0)
+	unhealthySince := time.Now()
+	check(false, 2, 0) // no reset, a new connection would create an empty file
+	if since := health.State().Since; since.Before(unhealthySince.Truncate(time.Second)) {
+		t.Fatalf("unhealthy since %s", since)
+	}
+	check(false, 3, 0)
+	move(db.Path+".away", db.Path)
+	check(true, 0, 0)
+
+	health.timeout = time.Nanosecond
+	check(true, 1, 0)
+	check(false, 2, 1)
+	if stats := db.Stats(); stats.Idle != 0 {
+		t.Fatalf("%d idle connections after the reset", stats.Idle)
+	}
+	check(false, 3, 1) // reset once until the database is back
+	health.timeout = time.Second
+	check(true, 0, 1)
+	db.Ping()
+	if stats := db.Stats(); stats.Idle == 0 {
+		t.Fatal("the pool keeps no idle connection after the database is back")
+	}
+
+	var b strings.Builder
+	if err := registry.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range []string{"wallet_db_healthy 1\n", "wallet_db_health_check_failures_total 6\n", "wallet_db_pool_resets_total 1\n"} {
+		if !strings.Contains(b.String(), sample) {
+			t.Errorf("no %q in\n%s", sample, b.String())
+		}
+	}
+
+	// a canceled check is the job stopping, not the database failing
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := health.Check(canceled); err == nil || health.State().Failures != 0 {
+		t.Fatalf("canceled check: %v, %+v", err, health.State())
+	}
+
+	var none *DBHealth
+	if !none.Healthy() {
+		t.Fatal("a nil monitor is unhealthy")
+	}
+}
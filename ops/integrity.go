@@ -0,0 +1,83 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// IntegrityJob is the name of the full check in the job runner.
+const IntegrityJob = "integrity_check"
+
+// IntegrityReport describes a finished integrity check.
+type IntegrityReport struct {
+	// Check is integrity_check or quick_check.
+	Check      string    `json:"check"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Ok         bool      `json:"ok"`
+	// Messages are what SQLite reported, "ok" alone when Ok.
+	Messages []string `json:"messages,omitempty"`
+	// Error is why the check couldn't run to the end.
+	Error string `json:"error,omitempty"`
+}
+
+// Integrity runs SQLite's integrity checks and keeps the report of the
+// last one. The report is only kept in memory: after a restart, which is
+// how a database restored from a snapshot is picked up, an older report
+// would describe another file.
+type Integrity struct {
+	db *store.DB
+
+	mu   sync.Mutex
+	last *IntegrityReport
+}
+
+func NewIntegrity(db *store.DB) *Integrity {
+	return &Integrity{db: db}
+}
+
+// Check runs the check and returns its report. A check that couldn't run
+// returns an error and the report saying so, a damaged database returns a
+// report that isn't Ok.
+func (i *Integrity) Check(ctx context.Context, quick bool) (IntegrityReport, error) {
+	start := time.Now()
+	report := IntegrityReport{Check: "integrity_check", StartedAt: start.UTC().Truncate(time.Second)}
+	if quick {
+		report.Check = "quick_check"
+	}
+	messages, err := i.db.IntegrityCheck(ctx, quick)
+	report.DurationMs = time.Since(start).Milliseconds()
+	report.Messages = messages
+	report.Ok = err == nil && store.Intact(messages)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	i.mu.Lock()
+	i.last = &report
+	i.mu.Unlock()
+	return report, err
+}
+
+// Last returns the report of the last check, nil before the first one.
+func (i *Integrity) Last() *IntegrityReport {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.last
+}
+
+// Job is the full check, as run by the IntegrityJob. A damaged
+// database fails the run, so the job status shows it too.
+func (i *Integrity) Job(ctx context.Context) error {
+	report, err := i.Check(ctx, false)
+	if err != nil {
+		return err
+	}
+	if !report.Ok {
+		return errors.New("the database is damaged, see GET /api/v1/admin/integrity-check")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// MaintenanceReport describes a finished maintenance run.
+type MaintenanceReport struct {
+	Steps      []string      `json:"steps"`
+	Duration   time.Duration `json:"-"`
+	DurationMs int64         `json:"duration_ms"`
+	Reclaimed  int64         `json:"reclaimed_bytes"`
+}
+
+type maintenanceStep struct {
+	name string
+	run  func(context.Context) error
+}
+
+// Maintenance runs SQLite housekeeping: optimize, optionally vacuum,
+// and checkpoint. It never overlaps with a backup.
+type Maintenance struct {
+	db *store.DB
+	// Vacuum is whether scheduled runs vacuum.
+	Vacuum bool
+}
+
+func NewMaintenance(db *store.DB, vacuum bool) *Maintenance {
+	return &Maintenance{db: db, Vacuum: vacuum}
+}
+
+// Run runs the maintenance steps in order, stopping between steps when
+// ctx is cancelled.
+func (m *Maintenance) Run(ctx context.Context, vacuum bool) (MaintenanceReport, error) {
+	if !exclusive.TryLock() {
+		return MaintenanceReport{}, ErrBusy
+	}
+	defer exclusive.Unlock()
+
+	steps := []maintenanceStep{{"optimize", m.db.Optimize}}
+	if vacuum {
+		steps = append(steps, maintenanceStep{"vacuum", m.db.Vacuum})
+	}
+	// last, vacuum goes through the write-ahead log as well
+	steps = append(steps, maintenanceStep{"checkpoint", m.db.Checkpoint})
+
+	var report MaintenanceReport
+	start := time.Now()
+	sizeBefore := m.db.FileSize()
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := step.run(ctx); err != nil {
+			return report, fmt.Errorf("%s: %w", step.name, err)
+		}
+		report.Steps = append(report.Steps, step.name)
+	}
+	report.Duration = time.Since(start)
+	report.DurationMs = report.Duration.Milliseconds()
+	report.Reclaimed = sizeBefore - m.db.FileSize()
+	return report, nil
+}
+
+// Scheduled is a scheduled run, with the configured vacuum setting. A run
+// that finds a backup in progress fails with ErrBusy.
+func (m *Maintenance) Scheduled(ctx context.Context) error {
+	report, err := m.Run(ctx, m.Vacuum)
+	if err != nil {
+		return err
+	}
+	log.Printf("scheduled maintenance: %s in %s, reclaimed %d bytes",
+		strings.Join(report.Steps, ", "), report.Duration, report.Reclaimed)
+	return nil
+}
@@ -0,0 +1,15 @@
+// Package ops holds the operational tasks shared by the admin endpoints
+// and the command line: backups, maintenance, export, import and wallet
+// creation.
+package ops
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrBusy is returned when a backup or maintenance run is already in progress.
+var ErrBusy = errors.New("a backup or maintenance run is already in progress")
+
+// exclusive keeps backups and maintenance runs of this process from overlapping.
+var exclusive sync.Mutex
@@ -0,0 +1,27 @@
+package ops
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// openTestDB opens a migrated SQLite database in a temporary directory,
+// closed when the test ends.
+func openTestDB(t *testing.T) *store.DB {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,159 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// TransferQueueJob is the name of the transfer queue in the job runner.
+const TransferQueueJob = "transfer_queue"
+
+// transferBatch is how many queued transfers one pass of the queue takes.
+const transferBatch = 500
+
+// TransferQueue applies the transfers queued by asynchronous sends. The
+// transfers of a sender are applied one after the other in the order
+// they were queued, those of different senders by up to workers at once.
+type TransferQueue struct {
+	db      *store.DB
+	workers int
+	// retention is how long processed transfers are kept.
+	retention time.Duration
+	log       *slog.Logger
+
+	// Paused reports whether queued transfers must wait, say while the
+	// wallets are read-only for maintenance. Nil never pauses.
+	Paused func() bool
+	// Applied is called with every transfer made, to publish the new
+	// balances. Nil does nothing.
+	Applied func(store.Transaction)
+}
+
+func NewTransferQueue(db *store.DB, workers int, retention time.Duration, logger *slog.Logger) *TransferQueue {
+	return &TransferQueue{db: db, workers: workers, retention: retention, log: logger}
+}
+
+// errHeldBack stops the transfers of a sender for this run, without
+// failing it: the transfer stays queued and is tried again by the next.
+var errHeldBack = errors.New("held back")
+
+// Run applies the queued transfers and prunes old processed ones. It is
+// run as a job. A refused transfer is marked failed with the error code
+// a synchronous send would have answered; any other error leaves it and
+// the sender's later transfers queued.
+func (q *TransferQueue) Run(ctx context.Context) error {
+	if q.Paused != nil && q.Paused() {
+		return nil
+	}
+	for {
+		transfers, err := q.db.QueuedTransfers(ctx, transferBatch)
+		if err != nil {
+			return err
+		}
+		heldBack, err := q.apply(ctx, transfers)
+		if err != nil {
+			return err
+		}
+		if heldBack || len(transfers) < transferBatch {
+			break
+		}
+	}
+	if _, err := q.db.PruneQueuedTransfers(ctx, time.Now().UTC().Add(-q.retention)); err != nil {
+		return fmt.Errorf("prune queued transfers: %w", err)
+	}
+	return nil
+}
+
+// apply applies transfers, grouped by sender, and reports whether the
+// transfers of some sender were held back.
+func (q *TransferQueue) apply(ctx context.Context, transfers []store.QueuedTransfer) (bool, error) {
+	var senders [][]store.QueuedTransfer
+	bySender := map[string]int{}
+	for _, t := range transfers {
+		i, ok := bySender[t.FromId]
+		if !ok {
+			i = len(senders)
+			bySender[t.FromId] = i
+			senders = append(senders, nil)
+		}
+		senders[i] = append(senders[i], t)
+	}
+
+	work := make(chan []store.QueuedTransfer)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		heldBack bool
+		errs     []error
+	)
+	for i := 0; i < min(q.workers, len(senders)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for list := range work {
+				for _, t := range list {
+					err := q.applyOne(ctx, t)
+					if err == nil {
+						continue
+					}
+					mu.Lock()
+					if errors.Is(err, errHeldBack) {
+						heldBack = true
+					} else {
+						errs = append(errs, err)
+					}
+					mu.Unlock()
+					break
+				}
+			}
+		}()
+	}
+	for _, list := range senders {
+		work <- list
+	}
+	close(work)
+	wg.Wait()
+	return heldBack, errors.Join(errs...)
+}
+
+// applyOne applies the queued transfer t, or marks it failed when it is
+// refused.
+func (q *TransferQueue) applyOne(ctx context.Context, t store.QueuedTransfer) error {
+	now := time.Now()
+	tr, err := q.db.ApplyQueuedTransfer(ctx, t, now)
+	if err == nil {
+		if q.Applied != nil {
+			q.Applied(tr)
+		}
+		return nil
+	}
+	var reason string
+	switch {
+	case errors.Is(err, store.ErrTransferProcessed):
+		// another server got to it first
+		return nil
+	case errors.Is(err, store.ErrNotFound):
+		reason = "wallet_not_found"
+	case errors.Is(err, store.ErrRecipientNotFound):
+		reason = "recipient_not_found"
+	case errors.Is(err, store.ErrInsufficientFunds):
+		reason = "insufficient_funds"
+	case errors.Is(err, store.ErrInvalidAmount), errors.Is(err, store.ErrTooPrecise), errors.Is(err, store.ErrOutOfRange):
+		reason = "invalid_amount"
+	case errors.Is(err, store.ErrConflict):
+		return errHeldBack
+	default:
+		return fmt.Errorf("transfer %d: %w", t.Id, err)
+	}
+	if err := q.db.FailQueuedTransfer(ctx, t.Id, reason, now); err != nil {
+		return fmt.Errorf("fail transfer %d: %w", t.Id, err)
+	}
+	q.log.Info("queued transfer failed", "id", t.Id, "from", t.FromId, "to", t.ToId, "reason", reason)
+	return nil
+}
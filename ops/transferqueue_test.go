@@ -0,0 +1,113 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// TestTransferQueue queues transfers of several senders and runs the
+// queue with as many workers: each sender's transfers are applied in the
+// order they were queued, so which of them are refused doesn't depend on
+// the workers, and the refused ones carry the error code of a send.
+func TestTransferQueue(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"AAAAAA", "BBBBBB", "CCCCCC", "DDDDDD"} {
+		if err := db.CreateWallet(ctx, store.Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no one sends to AAAAAA or DDDDDD, their outcomes only depend on their order
+	queued := []struct {
+		from, to string
+		amount   int64
+		status   string
+		reason   string
+	}{
+		{"AAAAAA", "BBBBBB", 60, store.TransferCompleted, ""},
+		{"AAAAAA", "CCCCCC", 50, store.TransferFailed, "insufficient_funds"},
+		{"BBBBBB", "CCCCCC", 1000, store.TransferFailed, "insufficient_funds"},
+		{"AAAAAA", "CCCCCC", 39, store.TransferCompleted, ""},
+		{"DDDDDD", "ZZZZZZ", 1, store.TransferFailed, "recipient_not_found"},
+		{"BBBBBB", "CCCCCC", 10, store.TransferCompleted, ""},
+	}
+	ids := make([]int64, len(queued))
+	for i, q := range queued {
+		tr, err := db.EnqueueTransfer(ctx, q.from, q.to, decimal.NewFromInt(q.amount), testTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = tr.Id
+	}
+	if _, err := db.EnqueueTransfer(ctx, "ZZZZZZ", "AAAAAA", decimal.NewFromInt(1), testTime); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown sender: %v", err)
+	}
+
+	queue := NewTransferQueue(db, 4, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	paused := true
+	queue.Paused = func() bool { return paused }
+	var mu sync.Mutex
+	var applied []store.Transaction
+	queue.Applied = func(tr store.Transaction) {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, tr)
+	}
+	if err := queue.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := db.QueuedTransfers(ctx, 10); err != nil || len(pending) != len(queued) {
+		t.Fatalf("%d transfers still queued while paused, %v", len(pending), err)
+	}
+
+	paused = false
+	if err := queue.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, q := range queued {
+		got, err := db.QueuedTransfer(ctx, q.from, ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != q.status || got.FailureReason != q.reason || !got.ProcessedAt.Valid || got.FromBalance.Valid != (q.status == store.TransferCompleted) {
+			t.Errorf("%s -> %s %d: %+v, want %s %s", q.from, q.to, q.amount, got, q.status, q.reason)
+		}
+	}
+	if len(applied) != 3 {
+		t.Errorf("%d transfers published, want 3", len(applied))
+	}
+	for id, want := range map[string]int64{"AAAAAA": 1, "BBBBBB": 150, "CCCCCC": 149, "DDDDDD": 100} {
+		w, err := db.GetWallet(ctx, id)
+		if err != nil || !w.Balance.Equal(decimal.NewFromInt(want)) {
+			t.Errorf("%s has %s, %v, want %d", id, w.Balance, err, want)
+		}
+	}
+
+	// a transfer is applied once, however often it is tried
+	last, err := db.QueuedTransfer(ctx, "BBBBBB", ids[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ApplyQueuedTransfer(ctx, last, testTime); !errors.Is(err, store.ErrTransferProcessed) {
+		t.Fatalf("applied again: %v", err)
+	}
+	if w, err := db.GetWallet(ctx, "BBBBBB"); err != nil || !w.Balance.Equal(decimal.NewFromInt(150)) {
+		t.Fatalf("BBBBBB has %s after a second try, %v", w.Balance, err)
+	}
+
+	// processed transfers are kept for the retention only
+	if err := NewTransferQueue(db, 1, 0, queue.log).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.QueuedTransfer(ctx, "AAAAAA", ids[0]); !errors.Is(err, store.ErrTransferNotFound) {
+		t.Fatalf("a processed transfer outlived the retention: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package ops
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+var (
+	// ErrRandomUnavailable wraps failures of the system RNG.
+	ErrRandomUnavailable = errors.New("random source unavailable")
+	// ErrWalletIdsExhausted is returned when every generated id was already taken.
+	ErrWalletIdsExhausted = errors.New("wallet ids exhausted")
+)
+
+// newWalletId generates the id of a new wallet.
+// It is a variable so that the generator can be stubbed.
+var newWalletId = func(format walletid.Format) (string, error) {
+	return format.Generate()
+}
+
+// Wallets creates wallets with generated ids, for POST /api/v1/wallet/
+// and the create-wallet command.
+type Wallets struct {
+	repo     store.WalletRepository
+	ids      walletid.Format
+	attempts int
+}
+
+func NewWallets(repo store.WalletRepository, ids walletid.Format, attempts int) *Wallets {
+	return &Wallets{repo: repo, ids: ids, attempts: attempts}
+}
+
+// Create inserts a wallet holding balance, created at at, under a freshly
+// generated id and returns the id. When the id is already taken a new one
+// is generated, up to attempts times.
+func (w *Wallets) Create(ctx context.Context, balance decimal.Decimal, at time.Time) (string, error) {
+	for i := 0; i < w.attempts; i++ {
+		id, err := newWalletId(w.ids)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrRandomUnavailable, err)
+		}
+
+		err = w.repo.CreateWallet(ctx, store.Wallet{Id: id, Balance: balance, CreatedAt: sql.NullTime{Time: at, Valid: true}})
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, store.ErrDuplicateID) {
+			return "", fmt.Errorf("insert wallet: %w", err)
+		}
+		log.Print("create wallet: the generated id is already taken, retrying")
+	}
+	return "", fmt.Errorf("%w after %d attempts", ErrWalletIdsExhausted, w.attempts)
+}
@@ -0,0 +1,116 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/metrics"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// stubWalletIds makes newWalletId return the results of gen until the
+// test ends.
+func stubWalletIds(t *testing.T, gen func(walletid.Format) (string, error)) {
+	t.Helper()
+	old := newWalletId
+	newWalletId = gen
+	t.Cleanup(func() { newWalletId = old })
+}
+
+func TestCreateWalletRandomUnavailable(t *testing.T) {
+	errBroken := errors.New("getrandom: broken")
+	stubWalletIds(t, func(walletid.Format) (string, error) { return "", errBroken })
+	db := openTestDB(t)
+
+	_, err := NewWallets(db, walletid.Format{}, 5).Create(context.Background(), decimal.NewFromInt(100), testTime)
+	if !errors.Is(err, ErrRandomUnavailable) || !errors.Is(err, errBroken) {
+		t.Fatalf("err = %v, want ErrRandomUnavailable wrapping the reader's error", err)
+	}
+	if n := countWallets(t, db); n != 0 {
+		t.Fatalf("%d wallets stored", n)
+	}
+}
+
+// countWallets counts the wallets of db.
+func countWallets(t *testing.T, db *store.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRowContext(context.Background(), "select count(*) from wallets").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// sequence returns a generator handing out ids in order, failing the
+// test when it runs out.
+func sequence(t *testing.T, ids ...string) func(walletid.Format) (string, error) {
+	return func(walletid.Format) (string, error) {
+		if len(ids) == 0 {
+			t.Fatal("generator called more often than expected")
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+}
+
+func TestCreateWalletRetriesCollisions(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(ctx, store.Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := metrics.NewRegistry()
+	db.Metrics = store.NewMetrics(registry, nil, nil)
+	stubWalletIds(t, sequence(t, "AAAAAA", "BBBBBB", "CCCCCC"))
+
+	id, err := NewWallets(db, walletid.Format{}, 3).Create(ctx, decimal.NewFromInt(100), testTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "CCCCCC" {
+		t.Fatalf("id = %q, want the first free one CCCCCC", id)
+	}
+	if n := countWallets(t, db); n != 3 {
+		t.Fatalf("%d wallets, want 3", n)
+	}
+	// each collision is counted, to notice the ids getting crowded
+	var b strings.Builder
+	if err := registry.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "\nwallet_id_collisions_total 2\n") {
+		t.Fatalf("collisions not counted:\n%s", b.String())
+	}
+}
+
+func TestCreateWalletIdsExhausted(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := db.CreateWallet(ctx, store.Wallet{Id: "AAAAAA", Balance: decimal.NewFromInt(100)}); err != nil {
+		t.Fatal(err)
+	}
+	stubWalletIds(t, sequence(t, "AAAAAA", "AAAAAA", "AAAAAA"))
+
+	_, err := NewWallets(db, walletid.Format{}, 3).Create(ctx, decimal.NewFromInt(100), testTime)
+	if !errors.Is(err, ErrWalletIdsExhausted) {
+		t.Fatalf("err = %v, want ErrWalletIdsExhausted", err)
+	}
+	// nothing left behind by the failed attempts
+	if n := countWallets(t, db); n != 1 {
+		t.Fatalf("%d wallets, want 1", n)
+	}
+	w, err := db.GetWallet(ctx, "AAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Balance.Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("balance of the taken wallet = %s, want 100", w.Balance)
+	}
+}
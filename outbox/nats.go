@@ -0,0 +1,391 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// NATS message headers. Event-Id and Event-Type let consumers drop the
+// duplicates at-least-once delivery brings; Nats-Msg-Id makes JetStream
+// drop them within its duplicate window already. The trace context of the
+// event goes in traceparent and tracestate, as on HTTP.
+const (
+	natsHeaderMsgId     = "Nats-Msg-Id"
+	natsHeaderEventId   = "Event-Id"
+	natsHeaderEventType = "Event-Type"
+)
+
+// Reconnect backoff limits of NATSSink. Events are retried by the
+// dispatcher anyway; this only keeps a broker that is down from costing a
+// dial timeout for every event of a batch.
+const (
+	natsMinBackoff = time.Second
+	natsMaxBackoff = time.Minute
+)
+
+// BusMessage is the body of the messages published to a message bus.
+type BusMessage struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// NATSSink publishes events to NATS, speaking the client protocol
+// directly over one connection. With JetStream every publish waits for
+// the stream's acknowledgement; without it, for the server to have read
+// it, which doesn't make core NATS keep it for absent subscribers.
+//
+// The subject is a template: {type} is the event type and {wallet_id} a
+// wallet of the transfer, in which case the event is published once for
+// each wallet.
+type NATSSink struct {
+	url       *url.URL
+	subject   string
+	jetStream bool
+	timeout   time.Duration
+	log       *slog.Logger
+
+	mu       sync.Mutex
+	conn     *natsConn
+	failures int
+	retryAt  time.Time
+}
+
+func NewNATSSink(rawURL, subject string, jetStream bool, timeout time.Duration, logger *slog.Logger) (*NATSSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%s is not a nats://host:port URL", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &NATSSink{url: u, subject: subject, jetStream: jetStream, timeout: timeout, log: logger}, nil
+}
+
+func (s *NATSSink) Name() string { return "nats" }
+
+func (s *NATSSink) Deliver(ctx context.Context, event store.Event) error {
+	subjects, err := s.subjects(event)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(BusMessage{Id: event.Id, Type: event.Type, CreatedAt: event.CreatedAt, Payload: event.Payload})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, subject := range subjects {
+		headers := [][2]string{
+			{natsHeaderMsgId, strconv.FormatInt(event.Id, 10) + ":" + subject},
+			{natsHeaderEventId, strconv.FormatInt(event.Id, 10)},
+			{natsHeaderEventType, event.Type},
+		}
+		if t, ok := tracectx.FromContext(ctx); ok {
+			headers = append(headers, [2]string{tracectx.HeaderParent, t.Child().Parent()})
+			if t.State != "" {
+				headers = append(headers, [2]string{tracectx.HeaderState, t.State})
+			}
+		}
+		if err := conn.publish(ctx, subject, headers, body, s.jetStream); err != nil {
+			// the connection is in an unknown state, start over next time
+			conn.close()
+			s.conn = nil
+			return fmt.Errorf("publish to %s: %w", subject, err)
+		}
+	}
+	return nil
+}
+
+// subjects expands the subject template for event.
+func (s *NATSSink) subjects(event store.Event) ([]string, error) {
+	subject := strings.ReplaceAll(s.subject, "{type}", event.Type)
+	if !strings.Contains(subject, "{wallet_id}") {
+		return []string{subject}, nil
+	}
+	if event.Type != store.EventTransferCompleted {
+		return nil, fmt.Errorf("%s events have no wallet for {wallet_id}", event.Type)
+	}
+	var t store.TransferEvent
+	if err := json.Unmarshal(event.Payload, &t); err != nil {
+		return nil, err
+	}
+	subjects := []string{strings.ReplaceAll(subject, "{wallet_id}", t.From)}
+	if t.To != t.From {
+		subjects = append(subjects, strings.ReplaceAll(subject, "{wallet_id}", t.To))
+	}
+	return subjects, nil
+}
+
+// connect returns the open connection or dials a new one, unless the
+// last attempt failed too recently.
+func (s *NATSSink) connect(ctx context.Context) (*natsConn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	if wait := time.Until(s.retryAt); wait > 0 {
+		return nil, fmt.Errorf("not connected to %s, retrying in %s", s.url.Host, wait.Round(time.Second))
+	}
+	conn, err := dialNATS(ctx, s.url, s.timeout)
+	if err != nil {
+		backoff := natsMinBackoff << min(s.failures, 6)
+		s.failures++
+		s.retryAt = time.Now().Add(min(backoff, natsMaxBackoff))
+		s.log.Warn("nats connect failed", "server", s.url.Host, "failures", s.failures, "err", err)
+		return nil, err
+	}
+	if s.failures > 0 {
+		s.log.Info("nats connected", "server", s.url.Host, "after_failures", s.failures)
+	}
+	s.failures = 0
+	s.conn = conn
+	return conn, nil
+}
+
+// natsConn is a connection speaking the NATS client protocol, used by one
+// publisher at a time.
+type natsConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	// inbox prefixes the reply subjects of JetStream acknowledgements.
+	inbox string
+	next  int
+}
+
+// natsInfo is the part of the server's INFO the client cares about.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+func dialNATS(ctx context.Context, u *url.URL, timeout time.Duration) (*natsConn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &natsConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout, inbox: "_INBOX." + hex.EncodeToString(b)}
+	if err := c.handshake(ctx, u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake reads the server's INFO, logs in and subscribes to the inbox.
+func (c *natsConn) handshake(ctx context.Context, u *url.URL) error {
+	c.deadline(ctx)
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if op != "INFO" {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return fmt.Errorf("INFO: %w", err)
+	}
+	if info.TLSRequired {
+		return errors.New("the server requires TLS, which isn't supported")
+	}
+	if !info.Headers {
+		return errors.New("the server doesn't support headers, NATS 2.2 or later is needed")
+	}
+
+	connect := map[string]any{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"lang":          "go",
+		"name":          "secure-web-service",
+		"protocol":      1,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect["user"], connect["pass"] = u.User.Username(), pass
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	// the PING makes the server answer -ERR for a refused login right away
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", b, c.inbox); err != nil {
+		return err
+	}
+	_, _, err = c.read()
+	return err
+}
+
+// publish sends one message. With jetStream it waits for the stream to
+// acknowledge it, otherwise for the server to answer a PING sent after it.
+func (c *natsConn) publish(ctx context.Context, subject string, headers [][2]string, body []byte, jetStream bool) error {
+	c.deadline(ctx)
+	var h strings.Builder
+	h.WriteString("NATS/1.0\r\n")
+	for _, kv := range headers {
+		h.WriteString(kv[0] + ": " + kv[1] + "\r\n")
+	}
+	h.WriteString("\r\n")
+
+	reply := ""
+	if jetStream {
+		c.next++
+		reply = c.inbox + "." + strconv.Itoa(c.next) + " "
+	}
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "HPUB %s %s%d %d\r\n", subject, reply, h.Len(), h.Len()+len(body))
+	w.WriteString(h.String())
+	w.Write(body)
+	w.WriteString("\r\n")
+	if !jetStream {
+		w.WriteString("PING\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		op, msg, err := c.read()
+		if err != nil {
+			return err
+		}
+		if !jetStream {
+			return nil
+		}
+		if op != "MSG" && op != "HMSG" {
+			continue
+		}
+		// an acknowledgement of an earlier publish that timed out would
+		// have closed the connection, so this one is ours
+		return jetStreamAck(op, msg)
+	}
+}
+
+// jetStreamAck turns the reply to a JetStream publish into an error.
+func jetStreamAck(op string, msg []byte) error {
+	if op == "HMSG" {
+		// a status header without a body, 503 when no stream has the subject
+		status, _, _ := strings.Cut(string(msg), "\r\n")
+		if code := strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0")); code != "" {
+			return fmt.Errorf("no JetStream acknowledgement: status %s", code)
+		}
+		if _, body, ok := strings.Cut(string(msg), "\r\n\r\n"); ok {
+			msg = []byte(body)
+		}
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(msg, &ack); err != nil {
+		return fmt.Errorf("JetStream acknowledgement: %w", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("JetStream: %s (%d)", ack.Error.Description, ack.Error.Code)
+	}
+	if ack.Stream == "" {
+		return errors.New("JetStream acknowledgement without a stream")
+	}
+	return nil
+}
+
+// read returns the next PONG, MSG or HMSG from the server, with the
+// message's headers and payload. Server PINGs are answered on the way.
+func (c *natsConn) read() (op string, msg []byte, err error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", nil, err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+				return "", nil, err
+			}
+		case "PONG":
+			return "PONG", nil, nil
+		case "+OK", "INFO":
+		case "-ERR":
+			return "", nil, fmt.Errorf("server error: %s", args)
+		case "MSG", "HMSG":
+			// the total size is the last argument of both
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return "", nil, fmt.Errorf("bad %s line %q", op, line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return "", nil, fmt.Errorf("bad %s line %q", op, line)
+			}
+			msg := make([]byte, size+2)
+			if _, err := io.ReadFull(c.r, msg); err != nil {
+				return "", nil, err
+			}
+			return strings.ToUpper(op), msg[:size], nil
+		default:
+			return "", nil, fmt.Errorf("unexpected %q from the server", line)
+		}
+	}
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// deadline bounds the next exchange by the timeout or ctx, whichever ends first.
+func (c *natsConn) deadline(ctx context.Context) {
+	t := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
+	}
+	c.conn.SetDeadline(t)
+}
+
+func (c *natsConn) close() {
+	c.conn.Close()
+}
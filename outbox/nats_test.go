@@ -0,0 +1,278 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// natsMessage is a message published to fakeNATS.
+type natsMessage struct {
+	subject string
+	header  textproto.MIMEHeader
+	body    []byte
+}
+
+// fakeNATS is a stand-in NATS server speaking just enough of the
+// protocol for NATSSink: INFO, CONNECT, SUB, PING and HPUB. Publishes
+// with a reply subject are acknowledged like JetStream does, or with
+// the status in noStream.
+type fakeNATS struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	noStream bool
+	connects []map[string]any
+	messages []natsMessage
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeNATS{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATS) url() string { return "nats://" + s.ln.Addr().String() }
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"headers\":true}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch op {
+		case "CONNECT":
+			var connect map[string]any
+			json.Unmarshal([]byte(args), &connect)
+			s.mu.Lock()
+			s.connects = append(s.connects, connect)
+			s.mu.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "HPUB":
+			// HPUB <subject> [reply] <header size> <total size>
+			fields := strings.Fields(args)
+			hsize, _ := strconv.Atoi(fields[len(fields)-2])
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			buf := make([]byte, total+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			header, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(string(buf[len("NATS/1.0\r\n"):hsize])))).ReadMIMEHeader()
+			s.mu.Lock()
+			s.messages = append(s.messages, natsMessage{fields[0], header, buf[hsize:total]})
+			noStream := s.noStream
+			s.mu.Unlock()
+			if len(fields) == 4 {
+				if noStream {
+					status := "NATS/1.0 503\r\n\r\n"
+					fmt.Fprintf(conn, "HMSG %s 1 %d %d\r\n%s\r\n", fields[1], len(status), len(status), status)
+				} else {
+					ack := `{"stream":"WALLETS","seq":1}`
+					fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[1], len(ack), ack)
+				}
+			}
+		}
+	}
+}
+
+func (s *fakeNATS) published() []natsMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]natsMessage(nil), s.messages...)
+}
+
+func newTestNATSSink(t *testing.T, url, subject string, jetStream bool) *NATSSink {
+	t.Helper()
+	s, err := NewNATSSink(url, subject, jetStream, time.Second, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testTransferEvent is the event of a transfer from "AAAAAA" to to.
+func testTransferEvent(to string) store.Event {
+	payload, _ := json.Marshal(store.TransferEvent{From: "AAAAAA", To: to})
+	return store.Event{Id: 42, Type: store.EventTransferCompleted, Payload: payload,
+		CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func TestNATSSubjects(t *testing.T) {
+	tests := []struct {
+		template string
+		event    store.Event
+		want     string
+	}{
+		{"wallets.{wallet_id}.transfers", testTransferEvent("BBBBBB"), "wallets.AAAAAA.transfers wallets.BBBBBB.transfers"},
+		{"wallets.{wallet_id}.transfers", testTransferEvent("AAAAAA"), "wallets.AAAAAA.transfers"},
+		{"events.{type}", testTransferEvent("BBBBBB"), "events." + store.EventTransferCompleted},
+		{"events", testTransferEvent("BBBBBB"), "events"},
+	}
+	for _, tt := range tests {
+		s := newTestNATSSink(t, "nats://localhost", tt.template, false)
+		got, err := s.subjects(tt.event)
+		if err != nil || strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+	s := newTestNATSSink(t, "nats://localhost", "wallets.{wallet_id}", false)
+	if _, err := s.subjects(store.Event{Type: "wallet.created"}); err == nil {
+		t.Error("{wallet_id} expanded for an event without a transfer")
+	}
+}
+
+func TestNewNATSSink(t *testing.T) {
+	s := newTestNATSSink(t, "nats://localhost", "events", false)
+	if s.url.Host != "localhost:4222" {
+		t.Errorf("default port: %s", s.url.Host)
+	}
+	for _, url := range []string{"http://localhost:4222", "nats://", "nats://%zz"} {
+		if _, err := NewNATSSink(url, "events", false, time.Second, nil); err == nil {
+			t.Errorf("%s accepted", url)
+		}
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		server := newFakeNATS(t)
+		s := newTestNATSSink(t, server.url(), "wallets.{wallet_id}.transfers", jetStream)
+		event := testTransferEvent("BBBBBB")
+		if err := s.Deliver(context.Background(), event); err != nil {
+			t.Fatalf("jetstream %t: %v", jetStream, err)
+		}
+
+		messages := server.published()
+		if len(messages) != 2 || messages[0].subject != "wallets.AAAAAA.transfers" || messages[1].subject != "wallets.BBBBBB.transfers" {
+			t.Fatalf("jetstream %t: published %+v", jetStream, messages)
+		}
+		for _, m := range messages {
+			if m.header.Get(natsHeaderEventId) != "42" || m.header.Get(natsHeaderEventType) != store.EventTransferCompleted ||
+				m.header.Get(natsHeaderMsgId) != "42:"+m.subject {
+				t.Errorf("jetstream %t: headers %v", jetStream, m.header)
+			}
+			var body BusMessage
+			if err := json.Unmarshal(m.body, &body); err != nil || body.Id != 42 || body.Type != event.Type ||
+				!body.CreatedAt.Equal(event.CreatedAt) || string(body.Payload) != string(event.Payload) {
+				t.Errorf("jetstream %t: body %s, %v", jetStream, m.body, err)
+			}
+		}
+
+		// the connection is kept for the next event
+		if err := s.Deliver(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		n := len(server.connects)
+		server.mu.Unlock()
+		if n != 1 {
+			t.Errorf("jetstream %t: %d connections", jetStream, n)
+		}
+	}
+}
+
+func TestNATSCredentials(t *testing.T) {
+	server := newFakeNATS(t)
+	for _, userinfo := range []string{"wallets:s3cret@", "t0ken@"} {
+		s := newTestNATSSink(t, strings.Replace(server.url(), "//", "//"+userinfo, 1), "events", false)
+		if err := s.Deliver(context.Background(), testTransferEvent("BBBBBB")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if c := server.connects[0]; c["user"] != "wallets" || c["pass"] != "s3cret" || c["headers"] != true {
+		t.Errorf("CONNECT with a user %v", c)
+	}
+	if c := server.connects[1]; c["auth_token"] != "t0ken" || c["user"] != nil {
+		t.Errorf("CONNECT with a token %v", c)
+	}
+}
+
+func TestNATSNoStream(t *testing.T) {
+	server := newFakeNATS(t)
+	server.mu.Lock()
+	server.noStream = true
+	server.mu.Unlock()
+	s := newTestNATSSink(t, server.url(), "events", true)
+	err := s.Deliver(context.Background(), testTransferEvent("BBBBBB"))
+	if err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("publish without a stream = %v", err)
+	}
+	if s.conn != nil {
+		t.Fatal("the connection was kept after a failed publish")
+	}
+
+	server.mu.Lock()
+	server.noStream = false
+	server.mu.Unlock()
+	if err := s.Deliver(context.Background(), testTransferEvent("BBBBBB")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNATSReconnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := newTestNATSSink(t, "nats://"+addr, "events", false)
+
+	if err := s.Deliver(context.Background(), testTransferEvent("BBBBBB")); err == nil {
+		t.Fatal("delivered with the server down")
+	}
+	err = s.Deliver(context.Background(), testTransferEvent("BBBBBB"))
+	if err == nil || !strings.Contains(err.Error(), "retrying in") {
+		t.Fatalf("second delivery = %v, want it refused until the backoff passed", err)
+	}
+	if s.failures != 1 || time.Until(s.retryAt) <= 0 || time.Until(s.retryAt) > natsMinBackoff {
+		t.Fatalf("failures %d, retry in %s", s.failures, time.Until(s.retryAt))
+	}
+}
+
+// TestNATSServer publishes to the NATS server at NATS_TEST_URL, such as
+// one started with "docker run -p 4222:4222 nats", when it is set.
+func TestNATSServer(t *testing.T) {
+	url := os.Getenv("NATS_TEST_URL")
+	if url == "" {
+		t.Skip("NATS_TEST_URL is not set")
+	}
+	s := newTestNATSSink(t, url, "wallets.{wallet_id}.transfers", os.Getenv("NATS_TEST_JETSTREAM") != "")
+	if err := s.Deliver(context.Background(), testTransferEvent("BBBBBB")); err != nil {
+		t.Fatal(err)
+	}
+}
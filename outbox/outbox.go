@@ -0,0 +1,157 @@
+// Package outbox delivers the events the store writes to its outbox table
+// in the same transaction as the change they describe. An event is
+// delivered only once its change committed, and it stays in the table
+// until every sink took it, so a crash between commit and delivery
+// delays it instead of losing it. Delivery is at least once: sinks may
+// see an event again after a crash or after another sink failed.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// Sink is somewhere events are delivered to.
+type Sink interface {
+	// Name identifies the sink in logs and errors.
+	Name() string
+	// Deliver hands the event over. An error makes the dispatcher try
+	// again later.
+	Deliver(ctx context.Context, event store.Event) error
+}
+
+// LogSink writes events to the service log, which is mostly useful to see
+// the outbox work.
+type LogSink struct {
+	Log *slog.Logger
+}
+
+func (s LogSink) Name() string { return "log" }
+
+func (s LogSink) Deliver(ctx context.Context, event store.Event) error {
+	s.Log.Info("event", "id", event.Id, "type", event.Type, payloadAttr(event.Payload))
+	return nil
+}
+
+// payloadAttr logs a payload as a group of its fields rather than a
+// string, so that handlers see them, say to redact the wallet ids.
+func payloadAttr(payload []byte) slog.Attr {
+	var fields map[string]any
+	d := json.NewDecoder(bytes.NewReader(payload))
+	// amounts stay as written instead of becoming floats
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return slog.String("payload", string(payload))
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, fields[key]))
+	}
+	return slog.Group("payload", attrs...)
+}
+
+// Backoff limits between the attempts to deliver an event.
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Hour
+)
+
+// batchSize is how many due events one dispatch delivers at most.
+const batchSize = 100
+
+// Dispatcher delivers due events to its sinks, oldest first.
+type Dispatcher struct {
+	db    *store.DB
+	sinks []Sink
+	log   *slog.Logger
+	// maxAttempts is how many failed attempts make an event dead.
+	maxAttempts int
+	// retention is how long sent events are kept.
+	retention time.Duration
+}
+
+func NewDispatcher(db *store.DB, sinks []Sink, logger *slog.Logger, maxAttempts int, retention time.Duration) *Dispatcher {
+	return &Dispatcher{db: db, sinks: sinks, log: logger, maxAttempts: maxAttempts, retention: retention}
+}
+
+// Dispatch delivers the due events and prunes old sent ones. It is run
+// as a job. A failing event is retried with exponential backoff and
+// doesn't hold up the events behind it.
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	for {
+		events, err := d.db.DueEvents(ctx, time.Now().UTC(), batchSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := d.deliver(ctx, event); err != nil {
+				return err
+			}
+		}
+		if len(events) < batchSize {
+			break
+		}
+	}
+	if _, err := d.db.PruneEvents(ctx, time.Now().UTC().Add(-d.retention)); err != nil {
+		return fmt.Errorf("prune events: %w", err)
+	}
+	return nil
+}
+
+// deliver hands event to every sink and records the outcome. Only
+// failures to record it are returned. The sinks get the event's trace in
+// their context, to send on with it.
+func (d *Dispatcher) deliver(ctx context.Context, event store.Event) error {
+	t := event.Trace
+	if t.TraceId == ([16]byte{}) {
+		// written before events kept their trace
+		t = tracectx.New()
+	}
+	sinkCtx := tracectx.NewContext(ctx, t)
+	var failures []string
+	for _, sink := range d.sinks {
+		if err := sink.Deliver(sinkCtx, event); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", sink.Name(), err))
+		}
+	}
+	now := time.Now().UTC()
+	if len(failures) == 0 {
+		return d.db.MarkEventSent(ctx, event.Id, now)
+	}
+
+	attempts := event.Attempts + 1
+	dead := attempts >= d.maxAttempts
+	reason := strings.Join(failures, "; ")
+	if dead {
+		d.log.Error("event is dead after too many attempts", "id", event.Id, "type", event.Type, "attempts", attempts, "err", reason)
+	} else {
+		d.log.Warn("event delivery failed", "id", event.Id, "type", event.Type, "attempts", attempts, "err", reason)
+	}
+	return d.db.MarkEventFailed(ctx, event.Id, now.Add(backoff(attempts)), dead, reason)
+}
+
+// backoff is the delay after the given number of failed attempts.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,238 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// recordingSink keeps the events delivered to it. While err is set it
+// fails them instead; afterDeliver runs after each delivery.
+type recordingSink struct {
+	mu           sync.Mutex
+	err          error
+	events       []store.Event
+	afterDeliver func()
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Deliver(ctx context.Context, event store.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	if s.afterDeliver != nil {
+		s.afterDeliver()
+	}
+	return nil
+}
+
+func (s *recordingSink) delivered() []store.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]store.Event(nil), s.events...)
+}
+
+// openDB opens the SQLite database at path, migrated and writing events.
+func openDB(t *testing.T, path string) *store.DB {
+	t.Helper()
+	db, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.RecordEvents = true
+	return db
+}
+
+// seed creates the wallets AAAAAA and BBBBBB with 100 each.
+func seed(t *testing.T, db *store.DB) {
+	t.Helper()
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(context.Background(), store.Wallet{Id: id, Balance: store.InitialBalance}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestDispatcher(db *store.DB, sink Sink, maxAttempts int) *Dispatcher {
+	return NewDispatcher(db, []Sink{sink}, slog.New(slog.NewTextHandler(io.Discard, nil)), maxAttempts, time.Hour)
+}
+
+func countEvents(t *testing.T, db *store.DB, status string) int64 {
+	t.Helper()
+	n, err := db.CountEvents(context.Background(), status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNoEventForFailedTransfer(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	seed(t, db)
+	_, err := db.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.NewFromInt(1000), time.Now())
+	if !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("transfer = %v", err)
+	}
+	if n := countEvents(t, db, store.EventPending); n != 0 {
+		t.Fatalf("%d events for a transfer that rolled back", n)
+	}
+}
+
+// TestCrashBeforeDispatch commits a transfer and stops without
+// dispatching, like a process killed right after the commit. The event
+// is delivered once the database is opened again.
+func TestCrashBeforeDispatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	db := openDB(t, path)
+	seed(t, db)
+	if _, err := db.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.NewFromInt(25), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	sink := &recordingSink{}
+	d := newTestDispatcher(db, sink, 5)
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events := sink.delivered()
+	if len(events) != 1 || events[0].Type != store.EventTransferCompleted {
+		t.Fatalf("delivered %+v", events)
+	}
+	var payload store.TransferEvent
+	if err := json.Unmarshal(events[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.From != "AAAAAA" || payload.To != "BBBBBB" || !payload.Amount.Equal(decimal.NewFromInt(25)) {
+		t.Fatalf("payload %+v", payload)
+	}
+
+	// sent, so not delivered again
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.delivered()) != 1 || countEvents(t, db, store.EventSent) != 1 {
+		t.Fatalf("delivered %d times", len(sink.delivered()))
+	}
+}
+
+// TestCrashDuringDispatch stops the dispatcher after a sink took the event
+// but before it was marked sent. The event is delivered again after the
+// restart: at least once, never lost.
+func TestCrashDuringDispatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	db := openDB(t, path)
+	seed(t, db)
+	if _, err := db.Transfer(context.Background(), "AAAAAA", "BBBBBB", decimal.NewFromInt(25), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, crash := context.WithCancel(context.Background())
+	sink := &recordingSink{afterDeliver: crash}
+	if err := newTestDispatcher(db, sink, 5).Dispatch(ctx); err == nil {
+		t.Fatal("marking the event sent succeeded after the crash")
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	if err := newTestDispatcher(db, sink, 5).Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events := sink.delivered()
+	if len(events) != 2 || events[0].Id != events[1].Id {
+		t.Fatalf("delivered %+v, want the event twice", events)
+	}
+	if countEvents(t, db, store.EventSent) != 1 || countEvents(t, db, store.EventPending) != 0 {
+		t.Fatal("the event is not sent after the second delivery")
+	}
+}
+
+func TestRetriesUntilDead(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	seed(t, db)
+	ctx := context.Background()
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(25), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{err: errors.New("connection refused")}
+	d := newTestDispatcher(db, sink, 2)
+
+	if err := d.Dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := db.Events(ctx, store.EventPending, 10)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("pending %+v, %v", pending, err)
+	}
+	e := pending[0]
+	if e.Attempts != 1 || e.LastError != "recording: connection refused" || time.Until(e.NextAttemptAt) < 500*time.Millisecond {
+		t.Fatalf("after the first failure %+v", e)
+	}
+	// not due yet
+	if err := d.Dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := db.Events(ctx, store.EventPending, 10); pending[0].Attempts != 1 {
+		t.Fatalf("retried before the backoff: %+v", pending[0])
+	}
+
+	if _, err := db.Exec("update outbox set next_attempt_at = ? where id = ?", time.Now().UTC().Add(-time.Second), e.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if countEvents(t, db, store.EventDead) != 1 {
+		t.Fatal("the event isn't dead after the last attempt")
+	}
+
+	if err := db.RedriveEvent(ctx, e.Id, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	sink.err = nil
+	if err := d.Dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.delivered()) != 1 || countEvents(t, db, store.EventSent) != 1 {
+		t.Fatal("the redriven event was not delivered")
+	}
+	if err := db.RedriveEvent(ctx, e.Id, time.Now().UTC()); !errors.Is(err, store.ErrEventNotFound) {
+		t.Fatalf("redriving a sent event = %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{13, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
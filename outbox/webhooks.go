@@ -0,0 +1,193 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// Webhook request headers. The signature is an HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed with the webhook's secret:
+//
+//	X-Webhook-Signature: t=1700000000,v1=5257a869...
+const (
+	headerSignature = "X-Webhook-Signature"
+	headerEventId   = "X-Webhook-Event-Id"
+	headerEventType = "X-Webhook-Event-Type"
+)
+
+// WebhookPayload is the body posted to a webhook.
+type WebhookPayload struct {
+	EventId   int64              `json:"event_id"`
+	Type      string             `json:"type"`
+	CreatedAt time.Time          `json:"created_at"`
+	Data      WebhookTransaction `json:"data"`
+}
+
+// WebhookTransaction is a transfer as seen by the subscribed wallet.
+type WebhookTransaction struct {
+	WalletId     string          `json:"wallet_id"`
+	Counterparty string          `json:"counterparty"`
+	Amount       decimal.Decimal `json:"amount"`
+	Time         time.Time       `json:"time"`
+	// Balance is the subscribed wallet's balance after the transfer.
+	Balance decimal.Decimal `json:"balance"`
+}
+
+// WebhookSink posts transfer events to the webhooks of both wallets of the
+// transfer. A webhook that already took an event isn't posted it again
+// when the event is retried for another one.
+type WebhookSink struct {
+	db     *store.DB
+	client *http.Client
+	log    *slog.Logger
+	// disableAfter is how long a webhook may fail before it is disabled.
+	disableAfter time.Duration
+}
+
+func NewWebhookSink(db *store.DB, logger *slog.Logger, timeout, disableAfter time.Duration) *WebhookSink {
+	return &WebhookSink{
+		db: db,
+		client: &http.Client{
+			Timeout: timeout,
+			// a redirect could point anywhere, the subscriber has to give the final URL
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		log:          logger,
+		disableAfter: disableAfter,
+	}
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Deliver(ctx context.Context, event store.Event) error {
+	if event.Type != store.EventTransferCompleted {
+		return nil
+	}
+	var t store.TransferEvent
+	if err := json.Unmarshal(event.Payload, &t); err != nil {
+		return err
+	}
+	sides := []struct {
+		eventType string
+		data      WebhookTransaction
+	}{
+		{store.WebhookTransferReceived, WebhookTransaction{WalletId: t.To, Counterparty: t.From, Amount: t.Amount, Time: t.Time, Balance: t.ToBalance}},
+		{store.WebhookTransferSent, WebhookTransaction{WalletId: t.From, Counterparty: t.To, Amount: t.Amount, Time: t.Time, Balance: t.FromBalance}},
+	}
+
+	var failed int
+	for _, side := range sides {
+		webhooks, err := s.db.Webhooks(ctx, side.data.WalletId)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		payload := WebhookPayload{EventId: event.Id, Type: side.eventType, CreatedAt: event.CreatedAt, Data: side.data}
+		for _, w := range webhooks {
+			if !w.Wants(side.eventType) {
+				continue
+			}
+			delivered, err := s.db.Delivered(ctx, w.Id, event.Id, side.eventType)
+			if err != nil {
+				return err
+			}
+			if delivered {
+				continue
+			}
+			if err := s.deliver(ctx, w, payload); err != nil {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d webhooks failed", failed)
+	}
+	return nil
+}
+
+// deliver posts payload to w and records the attempt. Only the error of
+// the post is returned; failing to record it is logged.
+func (s *WebhookSink) deliver(ctx context.Context, w store.Webhook, payload WebhookPayload) error {
+	start := time.Now()
+	status, err := s.post(ctx, w, payload)
+	d := store.WebhookDelivery{
+		WebhookId:   w.Id,
+		EventId:     payload.EventId,
+		EventType:   payload.Type,
+		AttemptedAt: start.UTC(),
+		Duration:    time.Since(start),
+		StatusCode:  status,
+	}
+	if err != nil {
+		d.Error = err.Error()
+		s.log.Warn("webhook delivery failed", "webhook", w.Id, "wallet", w.WalletId, "event", payload.EventId, "status", status, "err", err)
+	}
+	disabled, recordErr := s.db.RecordDelivery(ctx, d, s.disableAfter)
+	if recordErr != nil {
+		s.log.Error("record webhook delivery", "webhook", w.Id, "err", recordErr)
+	}
+	if disabled {
+		s.log.Warn("webhook disabled after failing too long", "webhook", w.Id, "wallet", w.WalletId, "failing_since", w.FailingSince.Time)
+	}
+	return err
+}
+
+// post sends payload and returns the response status, 0 without a response.
+func (s *WebhookSink) post(ctx context.Context, w store.Webhook, payload WebhookPayload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEventId, strconv.FormatInt(payload.EventId, 10))
+	req.Header.Set(headerEventType, payload.Type)
+	req.Header.Set(headerSignature, Sign(w.Secret, time.Now(), body))
+	if t, ok := tracectx.FromContext(ctx); ok {
+		tracectx.Inject(req.Header, t)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drained so the connection can be reused, but never more than a little
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header of a webhook body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
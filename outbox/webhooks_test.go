@@ -0,0 +1,250 @@
+package outbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/store"
+)
+
+// webhookRequest is a request a test webhook received.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer records the requests it gets and answers them with
+// handler, 204 when it is nil.
+func webhookServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{r.Header.Clone(), body})
+		mu.Unlock()
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+// subscribe adds a webhook of walletId to url for events.
+func subscribe(t *testing.T, db *store.DB, walletId, url string, events ...string) store.Webhook {
+	t.Helper()
+	w := store.Webhook{WalletId: walletId, URL: url, Secret: "0123456789abcdef", Events: events, CreatedAt: time.Now().UTC()}
+	if err := db.CreateWebhook(context.Background(), &w); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// transferEvent makes a transfer of amount from AAAAAA to BBBBBB and
+// returns its event.
+func transferEvent(t *testing.T, db *store.DB, amount int64) store.Event {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(amount), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	events, err := db.Events(ctx, store.EventPending, 1)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("events %+v, %v", events, err)
+	}
+	return events[0]
+}
+
+func newTestWebhookSink(db *store.DB, timeout, disableAfter time.Duration) *WebhookSink {
+	return NewWebhookSink(db, slog.New(slog.NewTextHandler(io.Discard, nil)), timeout, disableAfter)
+}
+
+// checkSignature verifies the signature header of r with secret.
+func checkSignature(t *testing.T, r webhookRequest, secret string) {
+	t.Helper()
+	ts, sig, ok := strings.Cut(strings.TrimPrefix(r.header.Get(headerSignature), "t="), ",v1=")
+	if !ok {
+		t.Fatalf("signature header %q", r.header.Get(headerSignature))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(r.body)
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Fatal("the signature does not match the body")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	seed(t, db)
+	srv, received := webhookServer(t, nil)
+	w := subscribe(t, db, "BBBBBB", srv.URL, store.WebhookTransferReceived)
+	// the sender side isn't subscribed to
+	subscribe(t, db, "AAAAAA", srv.URL, store.WebhookTransferReceived)
+	sink := newTestWebhookSink(db, time.Second, time.Hour)
+	ctx := context.Background()
+
+	event := transferEvent(t, db, 25)
+	if err := sink.Deliver(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	r := requests[0]
+	checkSignature(t, r, w.Secret)
+	if r.header.Get(headerEventType) != store.WebhookTransferReceived || r.header.Get(headerEventId) == "" {
+		t.Fatalf("headers %v", r.header)
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.EventId != event.Id || payload.Data.WalletId != "BBBBBB" || payload.Data.Counterparty != "AAAAAA" ||
+		!payload.Data.Amount.Equal(decimal.NewFromInt(25)) || !payload.Data.Balance.Equal(decimal.NewFromInt(125)) {
+		t.Fatalf("payload %+v", payload)
+	}
+
+	deliveries, err := db.Deliveries(ctx, w.Id, 10)
+	if err != nil || len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusNoContent || deliveries[0].Error != "" {
+		t.Fatalf("deliveries %+v, %v", deliveries, err)
+	}
+	// an event retried for another sink isn't posted again
+	if err := sink.Deliver(ctx, event); err != nil || len(received()) != 1 {
+		t.Fatalf("redelivered: %d requests, %v", len(received()), err)
+	}
+}
+
+func TestWebhookFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"redirect", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://example.com/", http.StatusFound)
+		}, http.StatusFound},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusInternalServerError},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+			seed(t, db)
+			srv, received := webhookServer(t, tt.handler)
+			w := subscribe(t, db, "BBBBBB", srv.URL, store.WebhookTransferReceived)
+			sink := newTestWebhookSink(db, 50*time.Millisecond, time.Hour)
+			ctx := context.Background()
+
+			if err := sink.Deliver(ctx, transferEvent(t, db, 25)); err == nil {
+				t.Fatal("the failed delivery succeeded")
+			}
+			if len(received()) != 1 {
+				t.Fatalf("%d requests, the redirect must not be followed", len(received()))
+			}
+			deliveries, err := db.Deliveries(ctx, w.Id, 10)
+			if err != nil || len(deliveries) != 1 || deliveries[0].StatusCode != tt.status || deliveries[0].Error == "" {
+				t.Fatalf("deliveries %+v, %v", deliveries, err)
+			}
+			if w, _ := db.Webhook(ctx, "BBBBBB", w.Id); w.Failures != 1 || !w.FailingSince.Valid || w.DisabledAt.Valid {
+				t.Fatalf("webhook after one failure %+v", w)
+			}
+		})
+	}
+}
+
+func TestWebhookDisabledAfterFailingTooLong(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	seed(t, db)
+	srv, received := webhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	w := subscribe(t, db, "BBBBBB", srv.URL, store.WebhookTransferReceived)
+	sink := newTestWebhookSink(db, time.Second, 24*time.Hour)
+	ctx := context.Background()
+
+	sink.Deliver(ctx, transferEvent(t, db, 1))
+	if w, _ := db.Webhook(ctx, "BBBBBB", w.Id); w.DisabledAt.Valid {
+		t.Fatal("disabled after its first failure")
+	}
+	// failing for a day now
+	if _, err := db.Exec("update webhooks set failing_since = ? where id = ?", time.Now().UTC().Add(-25*time.Hour), w.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("update outbox set status = ?", store.EventSent); err != nil {
+		t.Fatal(err)
+	}
+	sink.Deliver(ctx, transferEvent(t, db, 1))
+	if w, _ := db.Webhook(ctx, "BBBBBB", w.Id); !w.DisabledAt.Valid || w.Failures != 2 {
+		t.Fatalf("not disabled after failing for a day: %+v", w)
+	}
+
+	if _, err := db.Exec("update outbox set status = ?", store.EventSent); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(ctx, transferEvent(t, db, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(received()) != 2 {
+		t.Fatalf("%d requests, a disabled webhook was posted to", len(received()))
+	}
+}
+
+func TestWebhookRecoveryResetsFailures(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	seed(t, db)
+	var mu sync.Mutex
+	status := http.StatusBadGateway
+	srv, _ := webhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+	})
+	w := subscribe(t, db, "BBBBBB", srv.URL, store.WebhookTransferReceived)
+	sink := newTestWebhookSink(db, time.Second, time.Hour)
+	ctx := context.Background()
+
+	event := transferEvent(t, db, 1)
+	sink.Deliver(ctx, event)
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	if err := sink.Deliver(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := db.Webhook(ctx, "BBBBBB", w.Id); w.Failures != 0 || w.FailingSince.Valid {
+		t.Fatalf("failures kept after a success: %+v", w)
+	}
+	if n, _ := db.CountDeliveries(ctx, w.Id); n != 2 {
+		t.Fatalf("%d deliveries recorded, want both attempts", n)
+	}
+}
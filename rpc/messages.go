@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of proto/wallet/v1/wallet.proto, encoded by hand with
+// protowire since there is no protoc in the build. Unknown fields are
+// skipped as protobuf asks, so newer clients keep working.
+
+type GetWalletRequest struct {
+	Id string
+}
+
+type CreateWalletRequest struct{}
+
+type Wallet struct {
+	Id      string
+	Balance string
+}
+
+type TransferRequest struct {
+	From   string
+	To     string
+	Amount string
+}
+
+type TransferResponse struct {
+	Id      string
+	Balance string
+}
+
+type ListHistoryRequest struct {
+	Id              string
+	IncludeArchived bool
+	Status          string
+	Counterparty    string
+}
+
+type ListHistoryResponse struct {
+	Transactions []Transaction
+}
+
+type Transaction struct {
+	From          string
+	To            string
+	Amount        string
+	Time          string
+	Status        string
+	FailureReason string
+}
+
+func (m *GetWalletRequest) unmarshal(b []byte) error {
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if num == 1 {
+			return str(typ, v, &m.Id)
+		}
+		return skip(num, typ, v)
+	})
+}
+
+func (m *CreateWalletRequest) unmarshal(b []byte) error {
+	return fields(b, skip)
+}
+
+func (m *Wallet) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Id)
+	b = appendString(b, 2, m.Balance)
+	return b
+}
+
+func (m *TransferRequest) unmarshal(b []byte) error {
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch num {
+		case 1:
+			return str(typ, v, &m.From)
+		case 2:
+			return str(typ, v, &m.To)
+		case 3:
+			return str(typ, v, &m.Amount)
+		}
+		return skip(num, typ, v)
+	})
+}
+
+func (m *TransferResponse) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Id)
+	b = appendString(b, 2, m.Balance)
+	return b
+}
+
+func (m *ListHistoryRequest) unmarshal(b []byte) error {
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch num {
+		case 1:
+			return str(typ, v, &m.Id)
+		case 2:
+			if typ != protowire.VarintType {
+				return 0, errWireType
+			}
+			x, n := protowire.ConsumeVarint(v)
+			m.IncludeArchived = x != 0
+			return n, nil
+		case 3:
+			return str(typ, v, &m.Status)
+		case 4:
+			return str(typ, v, &m.Counterparty)
+		}
+		return skip(num, typ, v)
+	})
+}
+
+func (m *ListHistoryResponse) marshal() []byte {
+	var b []byte
+	for i := range m.Transactions {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Transactions[i].marshal())
+	}
+	return b
+}
+
+func (m *Transaction) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.From)
+	b = appendString(b, 2, m.To)
+	b = appendString(b, 3, m.Amount)
+	b = appendString(b, 4, m.Time)
+	b = appendString(b, 5, m.Status)
+	b = appendString(b, 6, m.FailureReason)
+	return b
+}
+
+var errWireType = errors.New("field has the wrong wire type")
+
+// fields calls field for every field of the message b. field consumes the
+// value, which starts the slice it is given, and returns its length.
+func fields(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// str consumes a string field into s.
+func str(typ protowire.Type, v []byte, s *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, errWireType
+	}
+	x, n := protowire.ConsumeString(v)
+	*s = x
+	return n, nil
+}
+
+// skip consumes a field the message doesn't know.
+func skip(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+	return protowire.ConsumeFieldValue(num, typ, v), nil
+}
+
+// appendString appends a string field, leaving it out when empty like
+// proto3 does.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
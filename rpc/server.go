@@ -0,0 +1,324 @@
+// Package rpc serves the wallets over gRPC, next to the REST API of
+// package api. The service is defined in proto/wallet/v1/wallet.proto.
+//
+// There is no gRPC library in the build, so the protocol is spoken
+// directly: calls are HTTP/2 POSTs of length-prefixed protobuf messages
+// ending with grpc-status trailers, served over cleartext HTTP/2 (h2c).
+// Compression isn't supported. It is experimental: the tests only send it
+// frames built by hand, and no client generated from the .proto has been
+// run against it, so wire compatibility with grpc-go and other
+// implementations is untested. Moving it to grpc-go with generated stubs
+// and interceptors is still to be done.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/tracectx"
+	"kordimion/secure-web-service/walletid"
+)
+
+// maxMessageBytes bounds a request message, the default of gRPC servers.
+const maxMessageBytes = 4 << 20
+
+// maxRequestIdBytes bounds a request id sent by the client, as in package api.
+const maxRequestIdBytes = 128
+
+// requestIdHeader carries the request id in both directions, as the
+// X-Request-ID header does for the REST API.
+const requestIdHeader = "X-Request-Id"
+
+// method is a call of the service. It gets the request message and sends
+// its responses, exactly one for unary calls.
+type method struct {
+	call    func(ctx context.Context, req []byte, send func(msg []byte) error) error
+	timeout time.Duration
+}
+
+// Server serves WalletService. Its calls go through the members of
+// cfg.Middleware the REST API has too: recovery, request_id, trace_context
+// and access_log.
+type Server struct {
+	methods map[string]method
+	log     *slog.Logger
+
+	recovery, requestId, traceContext, accessLog bool
+
+	// active counts the calls in progress, see Wait.
+	active atomic.Int64
+}
+
+func NewServer(wallets *WalletService, logger *slog.Logger, cfg config.Config) *Server {
+	s := &Server{log: logger}
+	for _, name := range cfg.Middleware {
+		switch name {
+		case "recovery":
+			s.recovery = true
+		case "request_id":
+			s.requestId = true
+		case "trace_context":
+			s.traceContext = true
+		case "access_log":
+			s.accessLog = true
+		}
+	}
+	s.methods = map[string]method{
+		"/wallet.v1.WalletService/GetWallet":     {unary(wallets.GetWallet), cfg.RequestTimeout},
+		"/wallet.v1.WalletService/CreateWallet":  {unary(wallets.CreateWallet), cfg.RequestTimeout},
+		"/wallet.v1.WalletService/Transfer":      {unary(wallets.Transfer), cfg.SendTimeout},
+		"/wallet.v1.WalletService/ListHistory":   {unary(wallets.ListHistory), cfg.RequestTimeout},
+		"/wallet.v1.WalletService/StreamHistory": {wallets.streamHistory, cfg.RequestTimeout},
+	}
+	return s
+}
+
+// request and response are the messages unary adapts.
+type request[T any] interface {
+	*T
+	unmarshal([]byte) error
+}
+
+type response interface {
+	marshal() []byte
+}
+
+// unary adapts a method taking and returning messages to a call.
+func unary[Req any, PReq request[Req], Resp response](f func(context.Context, *Req) (Resp, error)) func(context.Context, []byte, func([]byte) error) error {
+	return func(ctx context.Context, b []byte, send func([]byte) error) error {
+		req := PReq(new(Req))
+		if err := req.unmarshal(b); err != nil {
+			return statusf(InvalidArgument, "malformed request: %v", err)
+		}
+		resp, err := f(ctx, (*Req)(req))
+		if err != nil {
+			return err
+		}
+		return send(resp.marshal())
+	}
+}
+
+// HTTPServer returns the server to serve s with, speaking cleartext HTTP/2.
+func (s *Server) HTTPServer() (*http.Server, error) {
+	h2s := &http2.Server{}
+	srv := &http.Server{Handler: h2c.NewHandler(s, h2s)}
+	// Shutdown then sends GOAWAY on the connections h2c took over; it
+	// doesn't wait for their calls, Wait does
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Wait waits for the calls in progress to finish, or for ctx to end. The
+// connections h2c took over from the http.Server aren't tracked by its
+// Shutdown, so this is the gRPC part of a graceful shutdown.
+func (s *Server) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "gRPC calls are POSTs", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") && !strings.HasPrefix(ct, "application/grpc;") {
+		http.Error(w, "content type must be application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	start := time.Now()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	var id string
+	if s.requestId {
+		var err error
+		if id, err = requestId(r); err != nil {
+			s.finish(w, false, statusf(Unavailable, "could not generate a request id"))
+			return
+		}
+		w.Header().Set(requestIdHeader, id)
+	}
+
+	var sent bool
+	st := s.call(w, r, &sent)
+	if st.Code == Internal {
+		s.log.Error("rpc failed", "method", r.URL.Path, "request_id", id, "err", st.Message)
+		st = statusf(Internal, "internal error")
+	}
+	s.finish(w, sent, st)
+
+	if s.accessLog {
+		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		s.log.LogAttrs(r.Context(), slog.LevelInfo, "rpc",
+			slog.String("method", r.URL.Path),
+			slog.String("code", st.Code.String()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP),
+			slog.String("request_id", id),
+		)
+	}
+}
+
+// call runs the method of r and returns the status it ends with. Internal
+// statuses carry the error for the log, not for the client.
+func (s *Server) call(w http.ResponseWriter, r *http.Request, sent *bool) (st *Status) {
+	m, ok := s.methods[r.URL.Path]
+	if !ok {
+		return statusf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	if s.recovery {
+		defer func() {
+			if err := recover(); err != nil {
+				s.log.Error("panic while serving rpc", "err", err, "method", r.URL.Path, "stack", string(debug.Stack()))
+				st = statusf(Internal, "panic: %v", err)
+			}
+		}()
+	}
+
+	ctx := r.Context()
+	if s.traceContext {
+		// the traceparent metadata of the call
+		ctx = tracectx.NewContext(ctx, tracectx.FromRequest(r.Header))
+	}
+	timeout := m.timeout
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		d, err := parseTimeout(v)
+		if err != nil {
+			return statusf(InvalidArgument, "grpc-timeout: %v", err)
+		}
+		if timeout <= 0 || d < timeout {
+			timeout = d
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, st := readMessage(r.Body)
+	if st != nil {
+		return st
+	}
+	flusher, _ := w.(http.Flusher)
+	send := func(msg []byte) error {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		if _, err := w.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		*sent = true
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if err := m.call(ctx, req, send); err != nil {
+		st := toStatus(err)
+		if st.Code == Internal && !errors.As(err, new(*Status)) {
+			st.Message = err.Error()
+		}
+		return st
+	}
+	return &Status{Code: OK}
+}
+
+// finish ends the call with st, in the headers when nothing was sent and
+// in the trailers otherwise.
+func (s *Server) finish(w http.ResponseWriter, sent bool, st *Status) {
+	prefix := ""
+	if sent {
+		prefix = http.TrailerPrefix
+	}
+	w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(int(st.Code)))
+	if st.Message != "" {
+		w.Header().Set(prefix+"Grpc-Message", encodeMessage(st.Message))
+	}
+	if !sent {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// readMessage reads the one request message of a call.
+func readMessage(body io.Reader) ([]byte, *Status) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, statusf(InvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, statusf(Unimplemented, "compressed messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessageBytes {
+		return nil, statusf(ResourceExhausted, "request message is larger than %d bytes", maxMessageBytes)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, statusf(InvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+// requestId keeps the x-request-id metadata of the call or makes one up,
+// like the request_id middleware of the REST API.
+func requestId(r *http.Request) (string, error) {
+	id := r.Header.Get(requestIdHeader)
+	if id != "" && len(id) <= maxRequestIdBytes && printable(id) {
+		return id, nil
+	}
+	return walletid.GenerateRandomStringURLSafe(12)
+}
+
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTimeout parses a grpc-timeout header: up to 8 digits and a unit.
+func parseTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, errors.New("malformed")
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("malformed")
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, errors.New("unknown unit")
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,403 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+// pipeListener is an in-memory listener: dial hands the server one end of
+// a net.Pipe, like grpc's bufconn.
+type pipeListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+func (l *pipeListener) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// testServer is a Server on a migrated SQLite database, served over a
+// pipeListener, with an HTTP/2 client sending it calls framed by hand.
+type testServer struct {
+	*Server
+	db     *store.DB
+	mode   *api.MaintenanceMode
+	hub    *api.BalanceHub
+	client *http.Client
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := store.Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(context.Background(), store.Wallet{Id: id, Balance: store.InitialBalance}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mode, err := api.NewMaintenanceMode(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := api.NewBalanceHub(5)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(NewWalletService(db, fixedClock(testTime), hub, mode, cfg), logger, cfg)
+
+	srv, err := s.HTTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newPipeListener()
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return l.dial(ctx)
+		},
+	}}
+	return &testServer{Server: s, db: db, mode: mode, hub: hub, client: client}
+}
+
+// result is how a call ended.
+type result struct {
+	header   http.Header
+	messages [][]byte
+	code     Code
+	message  string
+}
+
+// call makes the call of method with the request message req and the
+// metadata in md.
+func (s *testServer) call(t *testing.T, method string, req []byte, md ...string) result {
+	t.Helper()
+	frame := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://wallets/wallet.v1.WalletService/"+method, bytes.NewReader(append(frame, req...)))
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("Te", "trailers")
+	for i := 0; i+1 < len(md); i += 2 {
+		httpReq.Header.Set(md[i], md[i+1])
+	}
+	res, err := s.client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := result{header: res.Header}
+	for len(body) >= 5 {
+		n := binary.BigEndian.Uint32(body[1:5])
+		r.messages = append(r.messages, body[5:5+n])
+		body = body[5+n:]
+	}
+	// a call that sent nothing ends in the headers
+	status := res.Trailer
+	if status.Get("Grpc-Status") == "" {
+		status = res.Header
+	}
+	code, err := strconv.Atoi(status.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: no grpc-status in %v", method, status)
+	}
+	r.code, r.message = Code(code), status.Get("Grpc-Message")
+	return r
+}
+
+// message encodes string fields, numbered from 1; empty ones are left out.
+func message(values ...string) []byte {
+	var b []byte
+	for i, v := range values {
+		b = appendString(b, protowire.Number(i+1), v)
+	}
+	return b
+}
+
+// decode returns the string and bytes fields of the message b by number.
+func decode(t *testing.T, b []byte) map[protowire.Number][]string {
+	t.Helper()
+	fieldsOf := map[protowire.Number][]string{}
+	err := fields(b, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		var s string
+		n, err := str(typ, v, &s)
+		fieldsOf[num] = append(fieldsOf[num], s)
+		return n, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fieldsOf
+}
+
+func TestWalletService(t *testing.T) {
+	s := newTestServer(t)
+
+	r := s.call(t, "CreateWallet", nil)
+	if r.code != OK || len(r.messages) != 1 {
+		t.Fatalf("CreateWallet: %s %s", r.code, r.message)
+	}
+	created := decode(t, r.messages[0])
+	if len(created[1]) != 1 || created[2][0] != store.InitialBalance.String() {
+		t.Fatalf("created %v", created)
+	}
+	if w, err := s.db.GetWallet(context.Background(), created[1][0]); err != nil || !w.CreatedAt.Time.Equal(testTime) {
+		t.Fatalf("stored %+v, %v", w, err)
+	}
+
+	r = s.call(t, "GetWallet", message("AAAAAA"))
+	if w := decode(t, r.messages[0]); r.code != OK || w[1][0] != "AAAAAA" || w[2][0] != "100" {
+		t.Fatalf("GetWallet: %s %v", r.code, w)
+	}
+
+	updates, unsubscribe, err := s.hub.Subscribe("BBBBBB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	for _, amount := range []string{"30.25", "5"} {
+		r = s.call(t, "Transfer", message("AAAAAA", "BBBBBB", amount))
+		if r.code != OK {
+			t.Fatalf("Transfer %s: %s %s", amount, r.code, r.message)
+		}
+	}
+	if sent := decode(t, r.messages[0]); sent[1][0] != "AAAAAA" || sent[2][0] != "64.75" {
+		t.Fatalf("Transfer answered %v", sent)
+	}
+	for _, want := range []string{"130.25", "135.25"} {
+		if u := <-updates; !u.Balance.Equal(decimal.RequireFromString(want)) {
+			t.Fatalf("published %+v, want %s", u, want)
+		}
+	}
+
+	r = s.call(t, "ListHistory", message("AAAAAA"))
+	if r.code != OK || len(r.messages) != 1 {
+		t.Fatalf("ListHistory: %s %s", r.code, r.message)
+	}
+	list := decode(t, r.messages[0])[1]
+	if len(list) != 2 {
+		t.Fatalf("%d transactions, want 2", len(list))
+	}
+	tx := decode(t, []byte(list[0]))
+	if tx[1][0] != "AAAAAA" || tx[2][0] != "BBBBBB" || tx[4][0] != "2024-03-01T12:00:00Z" || tx[5][0] != store.StatusCompleted {
+		t.Fatalf("transaction %v", tx)
+	}
+
+	r = s.call(t, "StreamHistory", message("AAAAAA"))
+	if r.code != OK || len(r.messages) != 2 {
+		t.Fatalf("StreamHistory: %s, %d messages", r.code, len(r.messages))
+	}
+	for i, m := range r.messages {
+		if !bytes.Equal(m, []byte(list[i])) {
+			t.Errorf("streamed transaction %d differs from the listed one", i)
+		}
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		method string
+		req    []byte
+		code   Code
+	}{
+		{"GetWallet", message("ZZZZZZ"), NotFound},
+		{"GetWallet", message("A"), InvalidArgument},
+		{"GetWallet", []byte{0xff}, InvalidArgument},
+		{"Transfer", message("AAAAAA", "BBBBBB", "1000"), FailedPrecondition},
+		{"Transfer", message("AAAAAA", "ZZZZZZ", "1"), NotFound},
+		{"Transfer", message("AAAAAA", "BBBBBB", "lots"), InvalidArgument},
+		{"Transfer", message("AAAAAA", "BBBBBB", "0.001"), InvalidArgument},
+		{"ListHistory", message("AAAAAA", "", "lost"), InvalidArgument},
+		{"Nothing", nil, Unimplemented},
+	}
+	for _, tt := range tests {
+		if r := s.call(t, tt.method, tt.req); r.code != tt.code {
+			t.Errorf("%s %x: %s %q, want %s", tt.method, tt.req, r.code, r.message, tt.code)
+		}
+	}
+
+	if _, err := s.mode.Set(true, "upgrading"); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"CreateWallet", "Transfer"} {
+		if r := s.call(t, method, message("AAAAAA", "BBBBBB", "1")); r.code != Unavailable {
+			t.Errorf("%s in maintenance: %s %q", method, r.code, r.message)
+		}
+	}
+	if r := s.call(t, "GetWallet", message("AAAAAA")); r.code != OK {
+		t.Errorf("GetWallet in maintenance: %s", r.code)
+	}
+}
+
+func TestToStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code Code
+	}{
+		{store.ErrDuplicateID, AlreadyExists},
+		{store.ErrConflict, Aborted},
+		{store.ErrInsufficientFunds, FailedPrecondition},
+		{context.DeadlineExceeded, DeadlineExceeded},
+		{context.Canceled, Canceled},
+		{statusf(NotFound, "gone"), NotFound},
+		{errors.New("disk full"), Internal},
+	}
+	for _, tt := range tests {
+		if got := toStatus(tt.err); got.Code != tt.code {
+			t.Errorf("toStatus(%v) = %s, want %s", tt.err, got.Code, tt.code)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.methods["/wallet.v1.WalletService/Slow"] = method{call: func(ctx context.Context, req []byte, send func([]byte) error) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	if r := s.call(t, "Slow", nil, "Grpc-Timeout", "20m"); r.code != DeadlineExceeded {
+		t.Fatalf("past grpc-timeout: %s %q", r.code, r.message)
+	}
+	if r := s.call(t, "GetWallet", message("AAAAAA"), "Grpc-Timeout", "soon"); r.code != InvalidArgument {
+		t.Fatalf("malformed grpc-timeout: %s", r.code)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		v    string
+		want time.Duration
+		ok   bool
+	}{
+		{"1H", time.Hour, true},
+		{"100m", 100 * time.Millisecond, true},
+		{"99999999S", 99999999 * time.Second, true},
+		{"5u", 5 * time.Microsecond, true},
+		{"S", 0, false},
+		{"999999999S", 0, false},
+		{"10x", 0, false},
+		{"-1S", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeout(tt.v)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTimeout(%q) = %s, %v", tt.v, got, err)
+		}
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	s := newTestServer(t)
+	s.methods["/wallet.v1.WalletService/Panic"] = method{call: func(ctx context.Context, req []byte, send func([]byte) error) error {
+		panic("boom")
+	}}
+
+	r := s.call(t, "Panic", nil)
+	if r.code != Internal || r.message != "internal error" {
+		t.Fatalf("panic: %s %q", r.code, r.message)
+	}
+	if r.header.Get(requestIdHeader) == "" {
+		t.Fatal("no request id")
+	}
+	// the server survived
+	if r := s.call(t, "GetWallet", message("AAAAAA"), requestIdHeader, "abc-123"); r.code != OK || r.header.Get(requestIdHeader) != "abc-123" {
+		t.Fatalf("after the panic: %s, request id %q", r.code, r.header.Get(requestIdHeader))
+	}
+	// messages are percent-encoded
+	if got := encodeMessage("100% sûr\n"); got != "100%25 s%C3%BBr%0A" {
+		t.Fatalf("encodeMessage = %q", got)
+	}
+}
+
+func TestWaitForCalls(t *testing.T) {
+	s := newTestServer(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	s.methods["/wallet.v1.WalletService/Slow"] = method{call: func(ctx context.Context, req []byte, send func([]byte) error) error {
+		close(started)
+		<-release
+		return nil
+	}}
+	done := make(chan result)
+	go func() { done <- s.call(t, "Slow", nil) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with a call in progress = %v", err)
+	}
+	close(release)
+	if r := <-done; r.code != OK {
+		t.Fatalf("slow call: %s", r.code)
+	}
+	if err := s.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+)
+
+// Code is a gRPC status code. Only the codes the service returns are named.
+type Code int
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Status is an error with the code and message a call ends with.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("%s: %s", s.Code, s.Message)
+}
+
+func statusf(code Code, format string, args ...any) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// toStatus maps the errors of the store and of the call's context to
+// status codes, the way api.abortTransferError maps them to HTTP statuses.
+// Errors it doesn't know are Internal; the caller logs those.
+func toStatus(err error) *Status {
+	var s *Status
+	switch {
+	case errors.As(err, &s):
+		return s
+	case errors.Is(err, store.ErrNotFound):
+		return statusf(NotFound, "wallet not found")
+	case errors.Is(err, store.ErrRecipientNotFound):
+		return statusf(NotFound, "recipient wallet not found")
+	case errors.Is(err, store.ErrInsufficientFunds):
+		return statusf(FailedPrecondition, "insufficient funds")
+	case errors.Is(err, store.ErrInvalidAmount),
+		errors.Is(err, store.ErrTooPrecise),
+		errors.Is(err, store.ErrOutOfRange):
+		return statusf(InvalidArgument, "amount: %v", err)
+	case errors.Is(err, store.ErrDuplicateID):
+		return statusf(AlreadyExists, "wallet id already exists")
+	case errors.Is(err, store.ErrConflict):
+		return statusf(Aborted, "a wallet changed during the transfer, try again")
+	case errors.Is(err, ops.ErrRandomUnavailable):
+		return statusf(Unavailable, "could not generate a wallet id")
+	case errors.Is(err, ops.ErrWalletIdsExhausted):
+		return statusf(Unavailable, "no free wallet id found")
+	case errors.Is(err, context.DeadlineExceeded):
+		return statusf(DeadlineExceeded, "deadline exceeded")
+	case errors.Is(err, context.Canceled):
+		return statusf(Canceled, "canceled")
+	default:
+		return statusf(Internal, "internal error")
+	}
+}
+
+// encodeMessage percent-encodes a grpc-message trailer the way the
+// protocol asks for: only % and bytes outside printable ASCII.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// WalletService implements the calls of wallet.v1.WalletService with the
+// same store, rules and maintenance mode as api.WalletHandler.
+type WalletService struct {
+	store   store.WalletRepository
+	clock   api.Clock
+	hub     *api.BalanceHub
+	mode    *api.MaintenanceMode
+	ids     walletid.Format
+	wallets *ops.Wallets
+	// strictAmounts is config.StrictAmounts.
+	strictAmounts bool
+}
+
+func NewWalletService(repo store.WalletRepository, clock api.Clock, hub *api.BalanceHub, mode *api.MaintenanceMode, cfg config.Config) *WalletService {
+	return &WalletService{
+		store:   repo,
+		clock:   clock,
+		hub:     hub,
+		mode:    mode,
+		ids:     cfg.WalletIds,
+		wallets: ops.NewWallets(repo, cfg.WalletIds, cfg.WalletIdAttempts),
+
+		strictAmounts: cfg.StrictAmounts,
+	}
+}
+
+// walletId validates and normalizes a wallet id taken from field.
+func (s *WalletService) walletId(field, id string) (string, error) {
+	if len(id) > walletid.MaxBytes || !s.ids.Matches(id) {
+		return "", statusf(InvalidArgument, "%s: %s", field, s.ids.Describe())
+	}
+	if err := s.ids.Check(id); err != nil {
+		return "", statusf(InvalidArgument, "%s: has a mistyped character, its checksum does not match", field)
+	}
+	return s.ids.Normalize(id), nil
+}
+
+// writable refuses calls that change wallets in maintenance mode.
+func (s *WalletService) writable() error {
+	if message, refused := s.mode.Refusal(); refused {
+		return statusf(Unavailable, "%s", message)
+	}
+	return nil
+}
+
+func (s *WalletService) GetWallet(ctx context.Context, req *GetWalletRequest) (*Wallet, error) {
+	id, err := s.walletId("id", req.Id)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.store.GetWallet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{Id: w.Id, Balance: w.Balance.String()}, nil
+}
+
+func (s *WalletService) CreateWallet(ctx context.Context, req *CreateWalletRequest) (*Wallet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	id, err := s.wallets.Create(ctx, store.InitialBalance, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{Id: id, Balance: store.InitialBalance.String()}, nil
+}
+
+func (s *WalletService) Transfer(ctx context.Context, req *TransferRequest) (*TransferResponse, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	from, err := s.walletId("from", req.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.walletId("to", req.To)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := api.ParseAmount(req.Amount, s.strictAmounts)
+	if err != nil {
+		return nil, statusf(InvalidArgument, "amount %q: %v", req.Amount, err)
+	}
+	t, err := s.store.Transfer(ctx, from, to, amount, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.hub.Publish(api.BalanceUpdate{WalletId: from, Balance: t.FromBalance.Decimal, Time: t.Date.Time.UTC()})
+	if to != from {
+		s.hub.Publish(api.BalanceUpdate{WalletId: to, Balance: t.ToBalance.Decimal, Time: t.Date.Time.UTC()})
+	}
+	return &TransferResponse{Id: t.FromId, Balance: t.FromBalance.Decimal.String()}, nil
+}
+
+func (s *WalletService) ListHistory(ctx context.Context, req *ListHistoryRequest) (*ListHistoryResponse, error) {
+	transactions, err := s.history(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ListHistoryResponse{Transactions: []Transaction{}}
+	for _, t := range transactions {
+		resp.Transactions = append(resp.Transactions, newTransaction(t))
+	}
+	return resp, nil
+}
+
+// streamHistory is StreamHistory, sending a message per transaction.
+func (s *WalletService) streamHistory(ctx context.Context, b []byte, send func([]byte) error) error {
+	var req ListHistoryRequest
+	if err := req.unmarshal(b); err != nil {
+		return statusf(InvalidArgument, "malformed request: %v", err)
+	}
+	transactions, err := s.history(ctx, &req)
+	if err != nil {
+		return err
+	}
+	for _, t := range transactions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg := newTransaction(t)
+		if err := send(msg.marshal()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WalletService) history(ctx context.Context, req *ListHistoryRequest) ([]store.Transaction, error) {
+	id, err := s.walletId("id", req.Id)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Status {
+	case "", store.StatusPending, store.StatusCompleted, store.StatusFailed:
+	default:
+		return nil, statusf(InvalidArgument, "status: must be one of %s, %s or %s", store.StatusPending, store.StatusCompleted, store.StatusFailed)
+	}
+	filter := store.HistoryFilter{IncludeArchived: req.IncludeArchived, Status: req.Status}
+	if req.Counterparty != "" {
+		if filter.Counterparty, err = s.walletId("counterparty", req.Counterparty); err != nil {
+			return nil, err
+		}
+	}
+	return s.store.History(ctx, id, filter)
+}
+
+func newTransaction(t store.Transaction) Transaction {
+	return Transaction{
+		From:          t.FromId,
+		To:            t.ToId,
+		Amount:        t.Amount.String(),
+		Time:          t.Date.Time.UTC().Format(time.RFC3339),
+		Status:        t.Status,
+		FailureReason: t.FailureReason,
+	}
+}
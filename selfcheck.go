@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// Exit codes of a failed startup, from sysexits.h, so that orchestration
+// can tell a bad configuration from a bad disk.
+const (
+	exitConfig   = 78 // EX_CONFIG: the settings are invalid or don't fit the database
+	exitDatabase = 69 // EX_UNAVAILABLE: the database can't be opened or written
+	exitSchema   = 65 // EX_DATAERR: the schema can't be brought up to date
+	exitCorrupt  = 65 // EX_DATAERR: the database file is damaged
+	exitDisk     = 73 // EX_CANTCREAT: too little free space next to the database
+	exitRandom   = 71 // EX_OSERR: the system random source fails
+	exitClock    = 75 // EX_TEMPFAIL: the clock is behind the stored transactions
+)
+
+// clockTolerance is how far the clock may be behind the newest transaction,
+// which covers transactions written by another instance with a slightly
+// different clock.
+const clockTolerance = time.Minute
+
+type startupCheck struct {
+	name string
+	exit int
+	run  func(ctx context.Context) error
+	// timeout bounds the check, a minute when 0.
+	timeout time.Duration
+}
+
+// selfCheck runs the startup checks in order and logs the outcome of each.
+// It returns 0 when all of them pass, otherwise the exit code of the
+// first one that failed.
+func selfCheck(db *store.DB, cfg config.Config, logger *slog.Logger) int {
+	checks := []startupCheck{
+		{"database", exitDatabase, func(ctx context.Context) error {
+			return db.CheckWritable(ctx)
+		}, 0},
+		{"integrity", exitCorrupt, func(ctx context.Context) error {
+			return checkIntegrity(ctx, db, cfg.StartupIntegrityCheck, logger)
+		}, time.Hour},
+		{"schema", exitSchema, func(ctx context.Context) error {
+			if err := prepareSchema(db, cfg.MigrateOnStart); err != nil {
+				return err
+			}
+			return db.CheckColumns(ctx)
+		}, 0},
+		{"settings", exitConfig, func(ctx context.Context) error {
+			if err := checkIdStrategy(db, cfg.WalletIds.Strategy); err != nil {
+				return err
+			}
+			return checkMoneyScale(db)
+		}, 0},
+		{"random", exitRandom, func(ctx context.Context) error {
+			_, err := walletid.GenerateRandomBytes(16)
+			return err
+		}, 0},
+		{"disk", exitDisk, func(ctx context.Context) error {
+			return checkFreeSpace(db, cfg.MinFreeDiskBytes)
+		}, 0},
+		{"clock", exitClock, func(ctx context.Context) error {
+			latest, err := db.LatestTransactionDate(ctx)
+			if err != nil {
+				return err
+			}
+			if now := time.Now(); latest.Sub(now) > clockTolerance {
+				return fmt.Errorf("the clock says %s but the newest transaction is from %s", now.Format(time.RFC3339), latest.Format(time.RFC3339))
+			}
+			return nil
+		}, 0},
+	}
+
+	for _, check := range checks {
+		timeout := check.timeout
+		if timeout == 0 {
+			timeout = time.Minute
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		err := check.run(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("startup check failed", "check", check.name, "err", err, "exit_code", check.exit)
+			return check.exit
+		}
+		logger.Info("startup check passed", "check", check.name, "duration_ms", time.Since(start).Milliseconds())
+	}
+	return 0
+}
+
+// checkFreeSpace refuses to start with less than min bytes free next to a
+// SQLite database. Other databases keep their files elsewhere.
+func checkFreeSpace(db *store.DB, min int64) error {
+	if db.Path == "" || min <= 0 {
+		return nil
+	}
+	free, ok, err := freeBytes(filepath.Dir(db.Path))
+	if err != nil || !ok {
+		return err
+	}
+	if free < uint64(min) {
+		return fmt.Errorf("%d MB free next to %s, at least %d MB are needed", free>>20, db.Path, min>>20)
+	}
+	return nil
+}
+
+// checkIntegrity runs SQLite's quick_check with mode warn or fail, see
+// config.Config.StartupIntegrityCheck. Other databases are skipped.
+func checkIntegrity(ctx context.Context, db *store.DB, mode string, logger *slog.Logger) error {
+	if mode == "off" || db.Driver != store.SQLite {
+		return nil
+	}
+	messages, err := db.IntegrityCheck(ctx, true)
+	if err == nil && store.Intact(messages) {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("quick_check: %s", strings.Join(messages, "; "))
+	}
+	if mode == "warn" {
+		logger.Warn("the database failed the integrity check, starting anyway", "err", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/store"
+)
+
+// openTestDB opens a SQLite database in a temporary directory, migrated
+// when migrate is set.
+func openTestDB(t *testing.T, migrate bool) *store.DB {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if migrate {
+		if _, err := db.Migrate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestSelfCheckPasses(t *testing.T) {
+	var logs bytes.Buffer
+	code := selfCheck(openTestDB(t, false), testConfig(t), slog.New(slog.NewTextHandler(&logs, nil)))
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, logs.String())
+	}
+	for _, check := range []string{"database", "integrity", "schema", "settings", "random", "disk", "clock"} {
+		if !strings.Contains(logs.String(), "check="+check+" ") {
+			t.Errorf("no line for the %s check:\n%s", check, logs.String())
+		}
+	}
+}
+
+func TestSelfCheckFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, db *store.DB, cfg *config.Config)
+		want  int
+	}{
+		{"database removed", func(t *testing.T, db *store.DB, cfg *config.Config) {
+			// removed once open, like by a cleanup job
+			if err := db.Ping(); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(db.Path); err != nil {
+				t.Fatal(err)
+			}
+		}, exitDatabase},
+		{"pending migrations", func(t *testing.T, db *store.DB, cfg *config.Config) {
+			cfg.MigrateOnStart = false
+		}, exitSchema},
+		{"missing column", func(t *testing.T, db *store.DB, cfg *config.Config) {
+			if _, err := db.Migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec("alter table wallets drop column opening_cents"); err != nil {
+				t.Fatal(err)
+			}
+		}, exitSchema},
+		{"disk full", func(t *testing.T, db *store.DB, cfg *config.Config) {
+			cfg.MinFreeDiskBytes = 1 << 62
+		}, exitDisk},
+		{"clock behind", func(t *testing.T, db *store.DB, cfg *config.Config) {
+			ctx := context.Background()
+			if _, err := db.Migrate(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"AAAAAA", "BBBBBB"} {
+				if err := db.CreateWallet(ctx, store.Wallet{Id: id, Balance: store.InitialBalance}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1), time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}, exitClock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cfg := openTestDB(t, false), testConfig(t)
+			tt.setup(t, db, &cfg)
+			if code := selfCheck(db, cfg, discardLogger()); code != tt.want {
+				t.Fatalf("exit code %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+// TestStartupIntegrityCheck makes a page of a scratch database
+// unreadable and starts with each mode of STARTUP_INTEGRITY_CHECK. The
+// page is one of an index no other startup check reads.
+func TestStartupIntegrityCheck(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, true)
+	var pageSize, root int64
+	if err := db.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select rootpage from sqlite_master where type = 'index' and name = 'webhooks_wallet'").Scan(&root); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	file, err := os.OpenFile(db.Path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not a valid page type
+	if _, err := file.WriteAt([]byte{0xff}, (root-1)*pageSize); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	tests := []struct {
+		mode string
+		want int
+		log  string
+	}{
+		{"off", 0, ""},
+		{"warn", 0, "the database failed the integrity check, starting anyway"},
+		{"fail", exitCorrupt, "check=integrity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			db, err := store.Open(db.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			cfg := testConfig(t)
+			cfg.StartupIntegrityCheck = tt.mode
+			var logs bytes.Buffer
+			if code := selfCheck(db, cfg, slog.New(slog.NewTextHandler(&logs, nil))); code != tt.want {
+				t.Fatalf("exit code %d, want %d:\n%s", code, tt.want, &logs)
+			}
+			logged := strings.Contains(logs.String(), "btreeInitPage() returns error code 11")
+			if logged != (tt.log != "") || !strings.Contains(logs.String(), tt.log) {
+				t.Fatalf("logs with the check %s:\n%s", tt.mode, &logs)
+			}
+		})
+	}
+}
+
+// TestStartupMigrationFailure starts the service, in a process of its
+// own, on a database it can't write and on one whose schema can't be
+// brought up to date: it must exit with the check's code and log what
+// failed, down to the migration and its statement.
+func TestStartupMigrationFailure(t *testing.T) {
+	if os.Getenv("WALLET_TEST_MAIN") == "1" {
+		os.Args = []string{"wallet"}
+		main()
+		return
+	}
+	dir := t.TempDir()
+	readOnly := filepath.Join(dir, "readonly.db")
+	if err := os.WriteFile(readOnly, nil, 0o444); err != nil {
+		t.Fatal(err)
+	}
+	// as left behind by a migration done by hand
+	clashing := filepath.Join(dir, "clashing.db")
+	db, err := store.Open(clashing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	steps, err := db.Plan(ctx, 15)
+	if err == nil {
+		err = db.Apply(ctx, steps)
+	}
+	if err == nil {
+		_, err = db.Exec("alter table wallets add column created_at timestamp")
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, url string
+		exit      int
+		logged    []string
+	}{
+		// found by the database check, before any migration
+		{"read-only", "file:" + readOnly + "?mode=ro", exitDatabase, []string{
+			`"check":"database"`, "attempt to write a readonly database"}},
+		{"clashing column", clashing, exitSchema, []string{
+			`"check":"schema"`, "migration 16 up (wallet creation time)", "duplicate column name: created_at",
+			"alter table wallets add column created_at timestamp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a service that starts anyway is stopped
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestStartupMigrationFailure$")
+			cmd.Env = append(os.Environ(), "WALLET_TEST_MAIN=1", "DATABASE_URL="+tt.url, "LOG_FORMAT=json")
+			out, err := cmd.CombinedOutput()
+			var exit *exec.ExitError
+			if !errors.As(err, &exit) || exit.ExitCode() != tt.exit {
+				t.Fatalf("exit: %v, want code %d:\n%s", err, tt.exit, out)
+			}
+			var failed string
+			for _, line := range strings.Split(string(out), "\n") {
+				if strings.Contains(line, "startup check failed") {
+					failed = line
+				}
+			}
+			for _, want := range tt.logged {
+				if !strings.Contains(failed, want) {
+					t.Errorf("%q is missing from the failure:\n%s", want, out)
+				}
+			}
+			if strings.Contains(string(out), "schema migration 16") {
+				t.Errorf("the failed migration is logged as applied:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"kordimion/secure-web-service/api"
+)
+
+// serve runs srv on l until it fails or the process gets SIGINT or SIGTERM.
+// On a signal it stops accepting connections and waits up to grace for
+// in-flight requests to finish; requests still running after that have
+// their context cancelled, so their transactions roll back, and their
+// connections are closed. drain, when not nil, waits for the requests on
+// connections Shutdown doesn't track, within the same grace period.
+func serve(srv *http.Server, l net.Listener, grace time.Duration, drain func(context.Context) error) error {
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context {
+		return requests
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-signals.Done():
+	}
+	// a second signal kills the process the usual way
+	stop()
+
+	log.Printf("shutting down, waiting up to %s for requests to finish", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil && drain != nil {
+		err = drain(ctx)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Println("grace period over, cancelling the remaining requests")
+		cancelRequests()
+		return srv.Close()
+	}
+	return err
+}
+
+// serveDebug serves api.DebugHandler on addr until ctx is cancelled.
+func serveDebug(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: api.DebugHandler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("debug endpoints listening on %s", addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("debug endpoints: %v", err)
+	}
+}
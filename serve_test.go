@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServe runs serve with handler on a local port and returns its
+// address and the error serve returns.
+func startServe(t *testing.T, handler http.Handler, grace time.Duration) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(&http.Server{Handler: handler}, l, grace, nil)
+	}()
+	return "http://" + l.Addr().String(), done
+}
+
+// shutdownSignal sends the process SIGTERM, which serve catches.
+func shutdownSignal(t *testing.T) {
+	t.Helper()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitServe(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
+		return nil
+	}
+}
+
+func TestServeFinishesRequestsOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	url, done := startServe(t, handler, 5*time.Second)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+	shutdownSignal(t)
+
+	if err := waitServe(t, done); err != nil {
+		t.Fatalf("serve = %v", err)
+	}
+	// the request in flight got its whole answer
+	select {
+	case r := <-results:
+		if r.err != nil || r.body != "done" {
+			t.Fatalf("slow request: %q, %v", r.body, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request in flight got no answer")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("the listener still accepts connections")
+	}
+}
+
+func TestServeCancelsRequestsAfterGrace(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+	url, done := startServe(t, handler, 100*time.Millisecond)
+
+	go http.Get(url)
+	<-started
+	shutdownSignal(t)
+
+	if err := waitServe(t, done); err != nil {
+		t.Fatalf("serve = %v", err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("request context: %v, want it cancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request outliving the grace period was not cancelled")
+	}
+}
+
+func TestServeListenerFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	// runServe exits with 1 on anything but a shutdown
+	err = serve(&http.Server{}, l, time.Second, nil)
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("serve on a closed listener = %v, want its error", err)
+	}
+}
+
+// TestSlowHeaders trickles header lines to the server of the main
+// listener: the connection is closed once HTTPReadHeaderTimeout is up,
+// however steadily lines keep coming, while other clients are served.
+func TestSlowHeaders(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HTTPReadHeaderTimeout = 200 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), cfg)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := io.WriteString(conn, "X-Slow: 1\r\n"); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("still connected after %s", time.Since(start))
+	}
+	if elapsed := time.Since(start); elapsed < cfg.HTTPReadHeaderTimeout || strings.Contains(string(got), "200 OK") {
+		t.Fatalf("closed after %s with %q", elapsed, got)
+	}
+
+	if status, body := get(t, http.DefaultClient, "http://"+l.Addr().String()); status != http.StatusOK || body != "ok" {
+		t.Fatalf("a prompt client got %d %s", status, body)
+	}
+}
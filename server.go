@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/jobs"
+	"kordimion/secure-web-service/metrics"
+	"kordimion/secure-web-service/ops"
+	"kordimion/secure-web-service/outbox"
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/version"
+)
+
+// Server is the service wired up on a database, without listening:
+// Handler serves the whole API, so a test can wrap it in
+// httptest.NewServer, and Jobs runs beside it once started.
+type Server struct {
+	Handler *gin.Engine
+	// Jobs are the background jobs, not yet running, see jobs.Runner.Run.
+	Jobs *jobs.Runner
+	// Hub gets the balance updates of transfers; closing it ends the live
+	// connections, which Shutdown doesn't wait for.
+	Hub *api.BalanceHub
+	// Mode is the maintenance mode, shared with the gRPC service.
+	Mode *api.MaintenanceMode
+}
+
+// configError marks the errors of NewServer caused by the settings rather
+// than the database, for the exit code.
+type configError struct{ error }
+
+func (e configError) Unwrap() error { return e.error }
+
+// NewServer registers every route, middleware and background job of the
+// service on db, which must be migrated and checked already, see
+// selfCheck. The wallet endpoints take the time of their transfers from
+// clock, api.SystemClock outside tests. It opens no listener and starts
+// nothing, that is up to runServe. It sets gin's mode to cfg.GinMode.
+func NewServer(db *store.DB, clock api.Clock, cfg config.Config, logger *slog.Logger, level *slog.LevelVar) (*Server, error) {
+	mode, err := api.NewMaintenanceMode(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	runner := jobs.NewRunner(logger)
+	if cfg.MaintenanceAt >= 0 && cfg.Features.Enabled(config.FeatureScheduledMaintenance) {
+		runner.Add(jobs.Job{
+			Name: "maintenance",
+			Next: jobs.Daily(cfg.MaintenanceAt),
+			Run:  ops.NewMaintenance(db, cfg.MaintenanceVacuum).Scheduled,
+		})
+	}
+	integrity := ops.NewIntegrity(db)
+	if db.Driver == store.SQLite {
+		runner.Add(jobs.Job{Name: ops.IntegrityJob, Run: integrity.Job})
+	}
+	sinks, err := eventSinks(db, cfg, logger)
+	if err != nil {
+		return nil, configError{err}
+	}
+	db.RecordEvents = len(sinks) > 0
+	if len(sinks) > 0 {
+		dispatcher := outbox.NewDispatcher(db, sinks, logger, cfg.OutboxMaxAttempts, cfg.OutboxRetention)
+		runner.Add(jobs.Job{
+			Name:  "outbox",
+			Next:  jobs.Every(cfg.OutboxInterval),
+			Quiet: true,
+			Run:   dispatcher.Dispatch,
+		})
+	}
+
+	hub := api.NewBalanceHub(cfg.WebSocketMaxPerWallet)
+	if cfg.Features.Enabled(config.FeatureAsyncTransfers) {
+		queue := ops.NewTransferQueue(db, cfg.TransferQueueWorkers, cfg.TransferQueueRetention, logger)
+		// queued transfers wait out maintenance like synchronous sends are refused
+		queue.Paused = func() bool { return mode.State().Enabled }
+		queue.Applied = func(t store.Transaction) {
+			hub.Publish(api.BalanceUpdate{WalletId: t.FromId, Balance: t.FromBalance.Decimal, Time: t.Date.Time.UTC()})
+			if t.ToId != t.FromId {
+				hub.Publish(api.BalanceUpdate{WalletId: t.ToId, Balance: t.ToBalance.Decimal, Time: t.Date.Time.UTC()})
+			}
+		}
+		runner.Add(jobs.Job{
+			Name:  ops.TransferQueueJob,
+			Next:  jobs.Every(cfg.TransferQueueInterval),
+			Quiet: true,
+			Run:   queue.Run,
+		})
+	}
+
+	var registry *metrics.Registry
+	if cfg.Metrics {
+		registry = metrics.NewRegistry()
+		db.Metrics = store.NewMetrics(registry, cfg.MetricsAmountBuckets, cfg.MetricsLatencyBuckets)
+	}
+	health := ops.NewDBHealth(db, cfg.DBHealthFailures, cfg.DBHealthTimeout, logger, registry)
+	runner.Add(jobs.Job{
+		Name:  ops.DBHealthJob,
+		Next:  jobs.Every(cfg.DBHealthInterval),
+		Quiet: true,
+		Run:   health.Check,
+	})
+
+	gin.SetMode(cfg.GinMode)
+	r, err := api.NewRouter(api.Handlers{
+		Wallets:     api.NewWalletHandler(db, clock, hub, logger, cfg),
+		Admin:       api.NewAdminHandler(db, mode, runner, integrity, logger, level, cfg),
+		Info:        api.NewInfoHandler(db, health, version.Get(), logger, level),
+		Webhooks:    api.NewWebhookHandler(db, logger, cfg),
+		Live:        api.NewLiveHandler(db, hub, logger, cfg),
+		Maintenance: mode,
+		Health:      health,
+		Metrics:     registry,
+	}, logger, cfg)
+	if err != nil {
+		return nil, configError{err}
+	}
+	return &Server{Handler: r, Jobs: runner, Hub: hub, Mode: mode}, nil
+}
+
+// serverExitCode is the exit code for an error of NewServer.
+func serverExitCode(err error) int {
+	if errors.As(err, new(configError)) {
+		return exitConfig
+	}
+	return exitDatabase
+}
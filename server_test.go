@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestServerEndToEnd drives the service NewServer wires over real HTTP:
+// two wallets are created, money moves between them, and the balances
+// and histories read back are the ones the transfer left.
+func TestServerEndToEnd(t *testing.T) {
+	server, err := NewServer(openTestDB(t, true), fixedClock(contractTime), testConfig(t), discardLogger(), new(slog.LevelVar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+
+	do := func(method, path, body string, status int, out any) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("%s %s: %d %s, want %d", method, path, res.StatusCode, b, status)
+		}
+		if err := json.Unmarshal(b, out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, b)
+		}
+	}
+	type wallet struct {
+		Id      string `json:"id"`
+		Balance string `json:"balance"`
+	}
+	type transaction struct {
+		From         string `json:"from"`
+		To           string `json:"to"`
+		Amount       string `json:"amount"`
+		Time         string `json:"time"`
+		Status       string `json:"status"`
+		BalanceAfter string `json:"balance_after"`
+	}
+	balance := func(id, want string) {
+		t.Helper()
+		var w wallet
+		do(http.MethodGet, "/api/v1/wallet/"+id, "", http.StatusOK, &w)
+		if w.Id != id || w.Balance != want {
+			t.Fatalf("%s: %+v, want a balance of %s", id, w, want)
+		}
+	}
+
+	var a, b wallet
+	do(http.MethodPost, "/api/v1/wallet", "", http.StatusCreated, &a)
+	do(http.MethodPost, "/api/v1/wallet", "", http.StatusCreated, &b)
+	if a.Id == b.Id || a.Balance != "100" || b.Balance != "100" {
+		t.Fatalf("created %+v and %+v", a, b)
+	}
+
+	var sent wallet
+	do(http.MethodPost, "/api/v1/wallet/"+a.Id+"/send", `{"to":"`+b.Id+`","amount":"30.25"}`, http.StatusOK, &sent)
+	if sent.Id != a.Id || sent.Balance != "69.75" {
+		t.Fatalf("send answered %+v", sent)
+	}
+	var refused struct{ Code string }
+	do(http.MethodPost, "/api/v1/wallet/"+b.Id+"/send", `{"to":"`+a.Id+`","amount":"1000"}`, http.StatusUnprocessableEntity, &refused)
+	if refused.Code != "insufficient_funds" {
+		t.Fatalf("send over the balance: %s", refused.Code)
+	}
+	balance(a.Id, "69.75")
+	balance(b.Id, "130.25")
+
+	want := transaction{From: a.Id, To: b.Id, Amount: "30.25", Time: "2024-03-01T12:00:00Z", Status: "completed"}
+	for id, balanceAfter := range map[string]string{a.Id: "69.75", b.Id: "130.25"} {
+		var history []transaction
+		do(http.MethodGet, "/api/v1/wallet/"+id+"/history", "", http.StatusOK, &history)
+		want.BalanceAfter = balanceAfter
+		if len(history) != 1 || history[0] != want {
+			t.Errorf("history of %s: %+v, want %+v", id, history, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"kordimion/secure-web-service/store"
+	"kordimion/secure-web-service/walletid"
+)
+
+// checkIdStrategy makes sure the database is only ever used with one wallet
+// id strategy. The first start records the strategy; databases from before
+// the setting existed can only contain short ids.
+func checkIdStrategy(db *store.DB, strategy string) error {
+	stored, ok, err := db.GetSetting("wallet_id_strategy")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var wallets int
+		if err := db.QueryRow("select count(*) from wallets").Scan(&wallets); err != nil {
+			return err
+		}
+		stored = strategy
+		if wallets > 0 {
+			stored = walletid.StrategyShort
+		}
+		if err := db.PutSetting("wallet_id_strategy", stored); err != nil {
+			return err
+		}
+	}
+	if stored != strategy {
+		return fmt.Errorf("database was created with wallet id strategy %q, refusing to run with %q", stored, strategy)
+	}
+	return nil
+}
+
+// checkMoneyScale refuses to run with a different scale than the one the
+// stored minor units were converted with.
+func checkMoneyScale(db *store.DB) error {
+	stored, ok, err := db.GetSetting("money_scale")
+	if err != nil || !ok {
+		return err
+	}
+	if stored != fmt.Sprint(db.Scale) {
+		return fmt.Errorf("database stores money with scale %s, refusing to run with scale %d", stored, db.Scale)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ArchiveTransactions moves the transactions dated before cutoff from
+// wallet_transactions to wallet_transactions_archive, oldest first, in
+// batches of about batch rows. Every batch is copied and deleted in one
+// transaction, so a row is in exactly one of the tables at any commit and
+// an interrupted run can simply be started again. progress, when set, is
+// called with the running total after each batch.
+func (db *DB) ArchiveTransactions(ctx context.Context, cutoff time.Time, batch int, progress func(moved int64)) (int64, error) {
+	var moved int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		n, done, err := db.archiveBatch(ctx, cutoff, batch)
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+		if progress != nil && n > 0 {
+			progress(moved)
+		}
+		if done {
+			return moved, nil
+		}
+	}
+}
+
+// archiveBatch moves one batch and reports whether it was the last one.
+// Batches end on a date rather than on a row count because the table has
+// no key, so rows sharing the boundary date all go in the same batch.
+func (db *DB) archiveBatch(ctx context.Context, cutoff time.Time, batch int) (int64, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	where := "date < ?"
+	args := []any{cutoff}
+	done := false
+	var last time.Time
+	err = tx.QueryRowContext(ctx, "select date from wallet_transactions where date < ? order by date limit 1 offset ?",
+		cutoff, batch-1).Scan(&last)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// fewer than batch rows are left
+		done = true
+	case err != nil:
+		return 0, false, err
+	default:
+		where = "date <= ?"
+		args = []any{last}
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into wallet_transactions_archive(`+transactionColumns+`)
+		select `+transactionColumns+` from wallet_transactions where `+where, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	res, err := tx.ExecContext(ctx, "delete from wallet_transactions where "+where, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	return n, done, tx.Commit()
+}
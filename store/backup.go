@@ -0,0 +1,21 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrBackupUnsupported is returned by Backup for databases that have
+// their own backup tooling (pg_dump, mysqldump).
+var ErrBackupUnsupported = errors.New("online backups are only supported for SQLite")
+
+// Backup writes a consistent snapshot of the database to path, which
+// must not exist yet. It uses VACUUM INTO, which reads the database in a
+// single read transaction, so writers are not blocked in WAL mode.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	if db.Driver != SQLite {
+		return ErrBackupUnsupported
+	}
+	_, err := db.ExecContext(ctx, "vacuum into ?", path)
+	return err
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// defaultVariableLimit is the most ? placeholders a statement may have
+// when the database can't tell: SQLite's limit before 3.32, which every
+// supported database accepts.
+const defaultVariableLimit = 999
+
+// variableLimit returns the most ? placeholders a statement may have on
+// db. SQLite's depends on how it was built and is read from a connection;
+// PostgreSQL and MySQL count them in 16 bits.
+func (db *DB) variableLimit(ctx context.Context) (int, error) {
+	switch db.Driver {
+	case Postgres, MySQL:
+		return 65535, nil
+	case SQLite:
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		limit := defaultVariableLimit
+		err = conn.Raw(func(dc any) error {
+			if c, ok := dc.(*sqlite3.SQLiteConn); ok {
+				limit = c.GetLimit(sqlite3.SQLITE_LIMIT_VARIABLE_NUMBER)
+			}
+			return nil
+		})
+		return limit, err
+	}
+	return defaultVariableLimit, nil
+}
+
+// bulkInsert gathers the rows of one table and inserts them with
+// multi-row INSERT statements, as many rows to a statement as the
+// variable limit allows, saving the round trip and statement overhead of
+// one INSERT per row. Rows go in in the order they were added.
+type bulkInsert struct {
+	table   string
+	columns int
+	// perStatement is how many rows an INSERT holds.
+	perStatement int
+	// full is the INSERT of perStatement rows, built once.
+	full string
+	args []any
+}
+
+// newBulkInsert returns a bulkInsert into table, whose columns are a
+// comma separated list, with statements of at most limit variables.
+func newBulkInsert(table, columns string, limit int) *bulkInsert {
+	n := strings.Count(columns, ",") + 1
+	b := &bulkInsert{table: table + "(" + columns + ")", columns: n, perStatement: max(limit/n, 1)}
+	b.full = b.statement(b.perStatement)
+	return b
+}
+
+// statement returns the INSERT of rows rows.
+func (b *bulkInsert) statement(rows int) string {
+	row := "(" + strings.Repeat("?,", b.columns-1) + "?)"
+	return "insert into " + b.table + " values" + strings.Repeat(row+",", rows-1) + row
+}
+
+// add queues a row of values, one per column, and inserts the queued
+// rows with tx once they fill a statement.
+func (b *bulkInsert) add(ctx context.Context, tx *Tx, values ...any) error {
+	b.args = append(b.args, values...)
+	if len(b.args) < b.perStatement*b.columns {
+		return nil
+	}
+	return b.flush(ctx, tx)
+}
+
+// flush inserts the queued rows with tx.
+func (b *bulkInsert) flush(ctx context.Context, tx *Tx) error {
+	if len(b.args) == 0 {
+		return nil
+	}
+	query := b.full
+	if rows := len(b.args) / b.columns; rows < b.perStatement {
+		query = b.statement(rows)
+	}
+	_, err := tx.ExecContext(ctx, query, b.args...)
+	b.args = b.args[:0]
+	return err
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// limitImport makes the statements of im hold at most limit variables.
+func limitImport(im *Importer, limit int) {
+	for _, b := range []*bulkInsert{im.walletRows, im.transactions} {
+		b.perStatement = max(limit/b.columns, 1)
+		b.full = b.statement(b.perStatement)
+	}
+}
+
+// importRing imports n wallets of 100 and n transfers of 1 around them,
+// each wallet sending to the next, with statements of at most limit
+// variables.
+func importRing(ctx context.Context, db *DB, n, limit int) error {
+	im, err := db.BeginImport(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer im.Rollback()
+	if limit > 0 {
+		limitImport(im, limit)
+	}
+	for i := 0; i < n; i++ {
+		if err := im.AddWallet(ctx, Wallet{Id: fmt.Sprintf("W%05d", i), Balance: decimal.NewFromInt(100)}); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		t := Transaction{FromId: fmt.Sprintf("W%05d", i), ToId: fmt.Sprintf("W%05d", (i+1)%n),
+			Amount: decimal.NewFromInt(1), Date: testDate(i)}
+		if err := im.AddTransaction(ctx, t); err != nil {
+			return err
+		}
+	}
+	return im.Commit(ctx, decimal.NewFromInt(100))
+}
+
+func TestVariableLimit(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	limit, err := db.variableLimit(context.Background())
+	if err != nil || limit < defaultVariableLimit {
+		t.Fatalf("variableLimit = %d, %v", limit, err)
+	}
+}
+
+// TestImportChunks imports around the chunk boundaries of a limit of 999
+// variables, 249 wallets or 124 transactions to a statement: every row
+// must be there, in the order it was added.
+func TestImportChunks(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{1, 123, 124, 125, 248, 249, 250, 1000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+			if err := importRing(ctx, db, n, defaultVariableLimit); err != nil {
+				t.Fatal(err)
+			}
+			var wallets, transactions, misplaced int
+			if err := db.QueryRowContext(ctx, "select count(*), sum(balance_cents <> 10000) from wallets").Scan(&wallets, &misplaced); err != nil {
+				t.Fatal(err)
+			}
+			if wallets != n || misplaced != 0 {
+				t.Fatalf("%d wallets, %d with the wrong balance", wallets, misplaced)
+			}
+			rows, err := db.QueryContext(ctx, "select from_wallet_id, date from wallet_transactions order by rowid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			for ; rows.Next(); transactions++ {
+				var from string
+				var date sql.NullTime
+				if err := rows.Scan(&from, &date); err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("W%05d", transactions); from != want || !date.Time.Equal(testDate(transactions).Time) {
+					t.Fatalf("transaction %d is from %s at %s, want %s", transactions, from, date.Time, want)
+				}
+			}
+			if err := rows.Err(); err != nil || transactions != n {
+				t.Fatalf("%d transactions, %v", transactions, err)
+			}
+		})
+	}
+}
+
+// TestImportFlushesFullStatements checks that rows wait until they fill a
+// statement, and that the statement then holds all of them.
+func TestImportFlushesFullStatements(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	im, err := db.BeginImport(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Rollback()
+	limitImport(im, 12) // 3 wallets to a statement
+	inserted := func() (n int) {
+		t.Helper()
+		if err := im.tx.QueryRowContext(ctx, "select count(*) from wallets").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for i, want := range []int{0, 0, 3, 3, 3, 6, 6} {
+		if err := im.AddWallet(ctx, Wallet{Id: fmt.Sprintf("W%05d", i), Balance: decimal.NewFromInt(100)}); err != nil {
+			t.Fatal(err)
+		}
+		if got := inserted(); got != want {
+			t.Fatalf("after %d wallets, %d inserted, want %d", i+1, got, want)
+		}
+	}
+	// a transaction flushes the wallets it may need
+	if err := im.AddTransaction(ctx, Transaction{FromId: "W00006", ToId: "W00000", Amount: decimal.NewFromInt(1), Date: testDate(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := inserted(); got != 7 {
+		t.Fatalf("%d wallets inserted before a transaction, want 7", got)
+	}
+}
+
+// TestImportRefusesRow checks that a row breaking a constraint is refused
+// by the call adding it, although rows are inserted later.
+func TestImportRefusesRow(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		add  func(im *Importer) error
+		want error
+	}{
+		{"duplicate id", func(im *Importer) error {
+			return im.AddWallet(ctx, Wallet{Id: "AAAAAA", Balance: decimal.NewFromInt(1)})
+		}, ErrDuplicateID},
+		{"negative balance", func(im *Importer) error {
+			return im.AddWallet(ctx, Wallet{Id: "CCCCCC", Balance: decimal.NewFromInt(-1)})
+		}, ErrNegativeBalance},
+		{"unknown sender", func(im *Importer) error {
+			return im.AddTransaction(ctx, Transaction{FromId: "ZZZZZZ", ToId: "AAAAAA", Amount: decimal.NewFromInt(1), Date: testDate(0)})
+		}, ErrNotFound},
+		{"unknown recipient", func(im *Importer) error {
+			return im.AddTransaction(ctx, Transaction{FromId: "AAAAAA", ToId: "ZZZZZZ", Amount: decimal.NewFromInt(1), Date: testDate(0)})
+		}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+			im, err := db.BeginImport(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer im.Rollback()
+			for _, id := range []string{"AAAAAA", "BBBBBB"} {
+				if err := im.AddWallet(ctx, Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tt.add(im); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// testDate is the date of the i-th transaction of an import, a second
+// after the previous one.
+func testDate(i int) sql.NullTime {
+	return sql.NullTime{Time: testTime.Add(time.Duration(i) * time.Second), Valid: true}
+}
+
+// BenchmarkImport compares an INSERT per row with the chunks of the
+// database's variable limit, for 1000 wallets and 1000 transactions.
+func BenchmarkImport(b *testing.B) {
+	ctx := context.Background()
+	for _, bm := range []struct {
+		name  string
+		limit int
+	}{
+		// one row to a statement
+		{"row by row", 1},
+		{"chunked", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "wallets.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			steps, err := db.Plan(ctx, LatestVersion())
+			if err == nil {
+				err = db.Apply(ctx, steps)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := importRing(ctx, db, 1000, bm.limit); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// balanceCacheMax bounds the wallets a BalanceCache holds. When it is
+// full, expired entries are dropped, and if none are, new reads aren't
+// cached until some expire.
+const balanceCacheMax = 100_000
+
+// BalanceCache keeps the wallets GetWallet read for a short while, see
+// DB.Balances. Every write of a balance through the DB invalidates the
+// wallets it touched before it returns, so this process never reads its
+// own writes stale. Writes by other servers sharing the database aren't
+// seen: their balances can be up to the TTL old.
+//
+// A nil *BalanceCache caches nothing.
+type BalanceCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	wallets map[string]cachedWallet
+	// epoch counts invalidations. A read that started before one isn't
+	// cached, it may have seen the balance from before the write.
+	epoch uint64
+}
+
+type cachedWallet struct {
+	wallet  Wallet
+	expires time.Time
+}
+
+func NewBalanceCache(ttl time.Duration) *BalanceCache {
+	return &BalanceCache{ttl: ttl, wallets: map[string]cachedWallet{}}
+}
+
+// get returns the cached wallet id, if it hasn't expired.
+func (c *BalanceCache) get(id string) (Wallet, bool) {
+	if c == nil {
+		return Wallet{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.wallets[id]
+	if !ok || !time.Now().Before(e.expires) {
+		return Wallet{}, false
+	}
+	return e.wallet, true
+}
+
+// begin returns the epoch to pass to put for a read starting now.
+func (c *BalanceCache) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// put caches w as read by a read that began at epoch, unless a write
+// invalidated wallets since.
+func (c *BalanceCache) put(w Wallet, epoch uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch != epoch {
+		return
+	}
+	now := time.Now()
+	if len(c.wallets) >= balanceCacheMax {
+		for id, e := range c.wallets {
+			if !now.Before(e.expires) {
+				delete(c.wallets, id)
+			}
+		}
+		if len(c.wallets) >= balanceCacheMax {
+			return
+		}
+	}
+	c.wallets[w.Id] = cachedWallet{wallet: w, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the wallets ids, for writes that changed their balances.
+func (c *BalanceCache) invalidate(ids ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, id := range ids {
+		delete(c.wallets, id)
+	}
+}
+
+// clear drops every wallet, for writes that can change any balance.
+func (c *BalanceCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	clear(c.wallets)
+}
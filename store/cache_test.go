@@ -0,0 +1,179 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/metrics"
+)
+
+// TestBalanceCache reads wallets through a cache with a long TTL: a
+// balance written behind the store's back stays cached, while those of a
+// transfer, FixBalances and the expiry are read at once.
+func TestBalanceCache(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	registry := metrics.NewRegistry()
+	db.Metrics = NewMetrics(registry, []float64{1}, []float64{1})
+	db.Balances = NewBalanceCache(time.Hour)
+	ctx := context.Background()
+	mustCreate(t, db, "100", "AAAAAA", "BBBBBB", "CCCCCC")
+	check := func(when string, want map[string]string) {
+		t.Helper()
+		for id, balance := range want {
+			if got := balanceOf(t, db, id); got.String() != balance {
+				t.Errorf("%s: %s has %s, want %s", when, id, got, balance)
+			}
+		}
+	}
+	setBalance := func(id string, cents int64) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, "update wallets set balance_cents = ? where id = ?", cents, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check("first read", map[string]string{"AAAAAA": "100", "BBBBBB": "100", "CCCCCC": "100"})
+	setBalance("CCCCCC", 1)
+	check("written behind the cache", map[string]string{"CCCCCC": "100"})
+
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(10), testTime); err != nil {
+		t.Fatal(err)
+	}
+	check("after a transfer", map[string]string{"AAAAAA": "90", "BBBBBB": "110", "CCCCCC": "100"})
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1000), testTime); err == nil {
+		t.Fatal("transfer over the balance went through")
+	}
+	check("after a refused transfer", map[string]string{"AAAAAA": "90", "BBBBBB": "110"})
+
+	if _, err := db.FixBalances(ctx, decimal.NewFromInt(100)); err != nil {
+		t.Fatal(err)
+	}
+	check("after FixBalances", map[string]string{"AAAAAA": "90", "BBBBBB": "110", "CCCCCC": "100"})
+
+	samples := scrape(t, registry)
+	// CCCCCC was read from the cache twice, every other read missed: the
+	// first ones and those after a transfer, refused or not, or FixBalances
+	if hits, misses := samples["wallet_balance_cache_hits_total"], samples["wallet_balance_cache_misses_total"]; hits != 2 || misses != 10 {
+		t.Errorf("%v hits, %v misses, want 2 and 10", hits, misses)
+	}
+
+	db.Balances = NewBalanceCache(50 * time.Millisecond)
+	check("with a short TTL", map[string]string{"CCCCCC": "100"})
+	setBalance("CCCCCC", 7)
+	time.Sleep(60 * time.Millisecond)
+	check("after the TTL", map[string]string{"CCCCCC": "0.07"})
+}
+
+// TestBalanceCacheSlowRead plays the race the epoch guards against: a
+// read of the database that began before a transfer puts its wallet in
+// the cache only after the transfer invalidated it. It mustn't be cached,
+// or the balance from before the transfer would be read until the TTL.
+func TestBalanceCacheSlowRead(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	db.Balances = NewBalanceCache(time.Hour)
+	ctx := context.Background()
+	mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+
+	// GetWallet, stopped between the query and put
+	epoch := db.Balances.begin()
+	before, err := db.scanWallet(db.QueryRowContext(ctx, "select "+walletColumns+" from wallets where id = ?", "AAAAAA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(10), testTime); err != nil {
+		t.Fatal(err)
+	}
+	db.Balances.put(before, epoch)
+	if got := balanceOf(t, db, "AAAAAA"); got.String() != "90" {
+		t.Fatalf("read %s after the transfer, want 90", got)
+	}
+	// a read starting after the transfer is cached
+	if _, ok := db.Balances.get("AAAAAA"); !ok {
+		t.Fatal("the read after the transfer wasn't cached")
+	}
+
+	var none *BalanceCache
+	none.put(Wallet{Id: "AAAAAA"}, none.begin())
+	none.invalidate("AAAAAA")
+	none.clear()
+	if _, ok := none.get("AAAAAA"); ok {
+		t.Fatal("a nil cache returned a wallet")
+	}
+}
+
+// TestBalanceCacheConcurrent has writers move money back and forth, each
+// within its own pair of wallets, while readers keep the cache filled
+// with the same wallets. As only its writer changes a pair, the balances
+// read right after a transfer must be the ones it recorded, whatever the
+// readers cached in between.
+func TestBalanceCacheConcurrent(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	db.Balances = NewBalanceCache(time.Hour)
+	ctx := context.Background()
+	const writers, transfers = 4, 100
+	var ids []string
+	for i := 0; i < 2*writers; i++ {
+		ids = append(ids, fmt.Sprintf("W%05d", i))
+	}
+	mustCreate(t, db, "1000", ids...)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				for _, id := range ids {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := db.GetWallet(ctx, id); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var writing sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writing.Add(1)
+		go func(a, b string) {
+			defer writing.Done()
+			for i := 0; i < transfers; i++ {
+				from, to := a, b
+				if i%2 == 1 {
+					from, to = b, a
+				}
+				tx, err := db.Transfer(ctx, from, to, decimal.NewFromInt(int64(i+1)), testTime)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for id, want := range map[string]decimal.Decimal{from: tx.FromBalance.Decimal, to: tx.ToBalance.Decimal} {
+					got, err := db.GetWallet(ctx, id)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !got.Balance.Equal(want) {
+						t.Errorf("transfer %d: %s read as %s, the transfer left %s", i, id, got.Balance, want)
+						return
+					}
+				}
+			}
+		}(ids[2*w], ids[2*w+1])
+	}
+	writing.Wait()
+	close(done)
+	readers.Wait()
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// inZone runs the rest of the test with the process in a zone east of
+// UTC, like a server that isn't configured for UTC.
+func inZone(t *testing.T) *time.Location {
+	t.Helper()
+	local := time.Local
+	zone := time.FixedZone("CEST", 2*60*60)
+	time.Local = zone
+	t.Cleanup(func() { time.Local = local })
+	return zone
+}
+
+// TestTransactionDatesInUTC writes a transfer at a time in the local zone
+// and checks it is stored and read back in UTC.
+func TestTransactionDatesInUTC(t *testing.T) {
+	zone := inZone(t)
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(ctx, Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2024, 3, 1, 14, 0, 0, 0, zone)
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1), at); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := db.QueryRowContext(ctx, "select cast(date as text) from wallet_transactions").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "2024-03-01 12:00:00") || strings.Contains(stored, "+02:00") {
+		t.Fatalf("stored the date %q, want it in UTC", stored)
+	}
+	history, err := db.History(ctx, "AAAAAA", HistoryFilter{})
+	if err != nil || len(history) != 1 {
+		t.Fatalf("History = %+v, %v", history, err)
+	}
+	if d := history[0].Date.Time; !d.Equal(at) || d.Location() != time.UTC {
+		t.Fatalf("read back %s, want %s in UTC", d, at)
+	}
+}
+
+// TestTransactionDatesMigratedToUTC checks that migration 13 rewrites the
+// dates stored with a local offset before it.
+func TestTransactionDatesMigratedToUTC(t *testing.T) {
+	inZone(t)
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	steps, err := db.Plan(ctx, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Apply(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if _, err := db.ExecContext(ctx, "insert into wallets(id, balance_cents) values(?, 10000)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// as the driver wrote a local time: with its offset, which sorts
+	// wrongly as text against other offsets
+	for _, date := range []string{"2024-03-01 14:00:00+02:00", "2024-03-01 12:30:00+00:00"} {
+		if _, err := db.ExecContext(ctx, "insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status) values('AAAAAA', 'BBBBBB', 100, ?, 'completed')", date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(ctx, "select cast(date as text) from wallet_transactions order by date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var dates []string
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			t.Fatal(err)
+		}
+		dates = append(dates, d)
+	}
+	if len(dates) != 2 || !strings.HasPrefix(dates[0], "2024-03-01 12:00:00") || !strings.HasPrefix(dates[1], "2024-03-01 12:30:00") {
+		t.Fatalf("dates after the migration, in order: %q", dates)
+	}
+	for _, d := range dates {
+		if strings.Contains(d, "+02:00") {
+			t.Fatalf("a date kept its local offset: %q", dates)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Package store hides the differences between the supported databases.
+// Handlers write queries with ? placeholders and the store rewrites them
+// for the driver selected by the database URL.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Supported drivers, named after the database/sql driver they use.
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+	MySQL    = "mysql"
+)
+
+// DB is a database handle that knows which driver it talks to.
+// Its query methods accept ? placeholders regardless of the driver.
+type DB struct {
+	*sql.DB
+	Driver string
+	// Scale is the number of decimal places of a stored minor unit,
+	// see ToMinor and FromMinor.
+	Scale int32
+	// Returning makes Transfer use guarded UPDATE ... RETURNING statements
+	// instead of locking reads, see DetectReturning.
+	Returning bool
+	// Path is the absolute path of a SQLite database file, "" otherwise.
+	Path string
+	// RecordFailures makes Transfer write a failed transaction when a
+	// transfer is refused for insufficient funds.
+	RecordFailures bool
+	// RecordEvents makes Transfer write an event to the outbox in the
+	// transaction of the transfer, see DueEvents.
+	RecordEvents bool
+	// Metrics, when set, records the statements and transfers of the
+	// wallet store.
+	Metrics *Metrics
+	// Balances, when set, caches the wallets read by GetWallet. The reads
+	// in the transaction of a transfer don't go through it.
+	Balances *BalanceCache
+	// Rounding is how ToMinorRounded rounds, RoundHalfUp when empty.
+	Rounding string
+}
+
+// Open opens the database described by databaseURL.
+// postgres:// and postgresql:// URLs select PostgreSQL, mysql:// URLs
+// followed by a go-sql-driver DSN (user:pass@tcp(host:3306)/db) select
+// MySQL; sqlite:// URLs, file: URIs and plain paths select SQLite.
+//
+// For SQLite files the parent directory is created if needed, and Open
+// fails when the file isn't writable or isn't a SQLite database.
+func Open(databaseURL string) (*DB, error) {
+	driver, dsn := parseURL(databaseURL)
+	var path string
+	if driver == SQLite {
+		if p := sqlitePath(dsn); p != "" {
+			var err error
+			path, err = prepareSQLiteFile(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: db, Driver: driver, Scale: 2, Path: path}, nil
+}
+
+func parseURL(databaseURL string) (driver string, dsn string) {
+	switch {
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		return Postgres, databaseURL
+	case strings.HasPrefix(databaseURL, "mysql://"):
+		dsn := strings.TrimPrefix(databaseURL, "mysql://")
+		// timestamps must come back as time.Time, not []byte
+		if !strings.Contains(dsn, "parseTime=") {
+			if strings.Contains(dsn, "?") {
+				dsn += "&parseTime=true"
+			} else {
+				dsn += "?parseTime=true"
+			}
+		}
+		return MySQL, dsn
+	case strings.HasPrefix(databaseURL, "sqlite3://"):
+		return SQLite, sqliteDSN(strings.TrimPrefix(databaseURL, "sqlite3://"))
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		return SQLite, sqliteDSN(strings.TrimPrefix(databaseURL, "sqlite://"))
+	default:
+		return SQLite, sqliteDSN(databaseURL)
+	}
+}
+
+// sqliteDSN turns on foreign key enforcement, which SQLite leaves off
+// unless asked on every connection. Passing it in the DSN makes the
+// driver set it for each connection of the pool.
+// It also selects WAL journaling so that long reads such as backups
+// don't block transfers, and reads timestamps back in UTC rather than
+// in the offset they were written with; each can be overridden in the DSN.
+func sqliteDSN(dsn string) string {
+	if !strings.Contains(dsn, "_foreign_keys=") && !strings.Contains(dsn, "_fk=") {
+		dsn = withParam(dsn, "_foreign_keys=on")
+	}
+	if !strings.Contains(dsn, "_journal_mode=") && !strings.Contains(dsn, "_journal=") {
+		dsn = withParam(dsn, "_journal_mode=WAL")
+	}
+	if !strings.Contains(dsn, "_loc=") {
+		dsn = withParam(dsn, "_loc=UTC")
+	}
+	return dsn
+}
+
+func withParam(dsn, param string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + param
+	}
+	return dsn + "?" + param
+}
+
+// Rebind rewrites the ? placeholders of query into the driver's style.
+func (db *DB) Rebind(query string) string {
+	return rebind(db.Driver, query)
+}
+
+func rebind(driver, query string) string {
+	if driver != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
+
+// ForUpdate is the suffix that locks the rows a select reads until the
+// transaction ends. SQLite locks the whole database on write instead.
+func (db *DB) ForUpdate() string {
+	if db.Driver == SQLite {
+		return ""
+	}
+	return " for update"
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.Rebind(query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.Rebind(query), args...)
+}
+
+// BeginTx starts a transaction whose query methods also accept ? placeholders.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, driver: db.Driver}, nil
+}
+
+// Tx is a transaction started by DB.BeginTx.
+type Tx struct {
+	*sql.Tx
+	driver string
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, rebind(tx.driver, query), args...)
+}
+
+// IsForeignKeyViolation reports whether err is a foreign key constraint failure,
+// e.g. a transaction row pointing at a wallet that doesn't exist (anymore).
+func IsForeignKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1451 || mysqlErr.Number == 1452 // ER_ROW_IS_REFERENCED_2, ER_NO_REFERENCED_ROW_2
+	}
+	return false
+}
+
+// IsCheckViolation reports whether err comes from the constraint that keeps
+// balances from going negative (a CHECK, or a trigger on SQLite).
+func IsCheckViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintCheck ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintTrigger
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23514"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 3819 // ER_CHECK_CONSTRAINT_VIOLATED
+	}
+	return false
+}
+
+// IsUniqueViolation reports whether err is a primary key or unique constraint failure.
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	}
+	return false
+}
+
+// IsDeadlock reports whether the database rolled back the transaction of
+// err to break a deadlock.
+func IsDeadlock(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40P01"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 // ER_LOCK_DEADLOCK
+	}
+	return false
+}
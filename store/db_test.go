@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestForeignKeys(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+		insert := `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status) values(?,?,?,?,?)`
+
+		for _, ids := range [][2]string{{"ZZZZZZ", "BBBBBB"}, {"AAAAAA", "ZZZZZZ"}} {
+			_, err := db.ExecContext(ctx, insert, ids[0], ids[1], 100, testTime, StatusCompleted)
+			if !IsForeignKeyViolation(err) {
+				t.Fatalf("transaction from %s to %s: %v, want a foreign key violation", ids[0], ids[1], err)
+			}
+			// a wallet vanishing mid-transfer is a conflict for the client
+			if !errors.Is(transferError(err), ErrConflict) {
+				t.Fatalf("transferError(%v) is not ErrConflict", err)
+			}
+		}
+
+		// wallets with transactions can't be deleted, nor take them along
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(10), testTime); err != nil {
+			t.Fatal(err)
+		}
+		_, err := db.ExecContext(ctx, "delete from wallets where id = ?", "BBBBBB")
+		if !IsForeignKeyViolation(err) {
+			t.Fatalf("deleting a wallet with transactions: %v, want a foreign key violation", err)
+		}
+		if n, err := db.TransactionCount(ctx, "AAAAAA"); err != nil || n != 1 {
+			t.Fatalf("transactions after the refused delete: %d, %v", n, err)
+		}
+	})
+}
+
+func TestSQLiteForeignKeysOnEveryConnection(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	ctx := context.Background()
+	db.SetMaxOpenConns(4)
+	// hold a few connections at once so that the pool opens new ones
+	var conns []*sql.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		var on int
+		if err := conn.QueryRowContext(ctx, "pragma foreign_keys").Scan(&on); err != nil {
+			t.Fatal(err)
+		}
+		if on != 1 {
+			t.Fatalf("connection %d has foreign keys off", i)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrNotEmpty is returned by BeginImport when the database already holds
+// wallets and replacing them wasn't asked for.
+var ErrNotEmpty = errors.New("database already contains wallets")
+
+// ErrUnknownStatus is returned for transaction statuses other than the Status constants.
+var ErrUnknownStatus = errors.New("unknown transaction status")
+
+// ErrNegativeBalance is returned by Importer.AddWallet for a balance below zero.
+var ErrNegativeBalance = errors.New("balance must not be negative")
+
+// LedgerError is returned by Importer.Commit when imported balances don't
+// match the imported transactions.
+type LedgerError struct {
+	Mismatches []LedgerMismatch
+	// Count is the total number of mismatches, Mismatches holds the first few.
+	Count int
+}
+
+func (e *LedgerError) Error() string {
+	msg := fmt.Sprintf("%d wallets don't match their transactions", e.Count)
+	for _, m := range e.Mismatches {
+		msg += fmt.Sprintf(", %s has %s but its transactions add up to %s", m.WalletId, m.Balance, m.Expected)
+	}
+	return msg
+}
+
+// Export calls wallet for every wallet and then transaction for every
+// transaction, reading rows one at a time from a single snapshot so that
+// balances and transactions agree even while transfers go on.
+func (db *DB) Export(ctx context.Context, wallet func(Wallet) error, transaction func(Transaction) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "select "+walletColumns+" from wallets order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w, err := db.scanWallet(rows)
+		if err != nil {
+			return err
+		}
+		if err := wallet(w); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// archived transactions are exported, and imported, like any other
+	rows, err = tx.QueryContext(ctx, "select "+transactionColumns+" from wallet_transactions_archive"+
+		" union all select "+transactionColumns+" from wallet_transactions"+transactionOrder)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := db.scanTransaction(rows)
+		if err != nil {
+			return err
+		}
+		if err := transaction(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Importer loads wallets and transactions inside one transaction, see
+// BeginImport. Nothing is visible until Commit succeeds.
+//
+// Rows are inserted in chunks, see bulkInsert, so a row breaking a
+// constraint would fail its whole chunk, some rows after it was added.
+// The Importer checks the constraints itself instead, for AddWallet and
+// AddTransaction to refuse the very row that breaks one.
+type Importer struct {
+	db *DB
+	tx *Tx
+	// wallets holds the ids added, the only wallets there are: the
+	// database was empty or emptied.
+	wallets      map[string]bool
+	walletRows   *bulkInsert
+	transactions *bulkInsert
+}
+
+// BeginImport starts an import. It fails with ErrNotEmpty when the
+// database already has wallets, unless replace is set, in which case all
+// existing wallets and transactions, archived or not, are deleted first.
+func (db *DB) BeginImport(ctx context.Context, replace bool) (*Importer, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, "select count(*) from wallets").Scan(&count); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if count > 0 {
+		if !replace {
+			tx.Rollback()
+			return nil, ErrNotEmpty
+		}
+		// queued transfers and webhooks belong to the replaced wallets and go with them
+		for _, stmt := range []string{
+			"delete from transfer_queue", "delete from webhook_deliveries", "delete from webhooks",
+			"delete from wallet_transactions", "delete from wallet_transactions_archive", "delete from wallets",
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	limit, err := db.variableLimit(ctx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &Importer{
+		db:           db,
+		tx:           tx,
+		wallets:      map[string]bool{},
+		walletRows:   newBulkInsert("wallets", "id, balance_cents, opening_cents, created_at", limit),
+		transactions: newBulkInsert("wallet_transactions", transactionColumns, limit),
+	}, nil
+}
+
+// AddWallet inserts a wallet. It returns ErrDuplicateID when the id was
+// already imported and ErrNegativeBalance for a balance below zero.
+func (im *Importer) AddWallet(ctx context.Context, w Wallet) error {
+	balance, err := im.db.ToMinor(w.Balance)
+	if err != nil {
+		return err
+	}
+	opening, err := im.nullMinor(w.Opening)
+	if err != nil {
+		return err
+	}
+	if im.wallets[w.Id] {
+		return ErrDuplicateID
+	}
+	if balance < 0 {
+		return ErrNegativeBalance
+	}
+	im.wallets[w.Id] = true
+	return im.walletRows.add(ctx, im.tx, w.Id, balance, opening, utcTime(w.CreatedAt))
+}
+
+// AddTransaction inserts a transaction, completed unless it has another
+// status. Both wallets must have been added before, otherwise it returns ErrNotFound.
+func (im *Importer) AddTransaction(ctx context.Context, t Transaction) error {
+	amount, err := im.db.ToMinor(t.Amount)
+	if err != nil {
+		return err
+	}
+	if !t.Date.Valid {
+		return errors.New("transaction has no date")
+	}
+	status := t.Status
+	if status == "" {
+		status = StatusCompleted
+	}
+	if status != StatusPending && status != StatusCompleted && status != StatusFailed {
+		return fmt.Errorf("%w %q", ErrUnknownStatus, status)
+	}
+	var reason sql.NullString
+	if t.FailureReason != "" {
+		reason = sql.NullString{String: t.FailureReason, Valid: true}
+	}
+	fromBalance, err := im.nullMinor(t.FromBalance)
+	if err != nil {
+		return err
+	}
+	toBalance, err := im.nullMinor(t.ToBalance)
+	if err != nil {
+		return err
+	}
+	if !im.wallets[t.FromId] || !im.wallets[t.ToId] {
+		return ErrNotFound
+	}
+	// the wallets go in first, for the foreign keys
+	if err := im.walletRows.flush(ctx, im.tx); err != nil {
+		return err
+	}
+	return im.transactions.add(ctx, im.tx, t.FromId, t.ToId, amount, t.Date.Time.UTC(), status, reason, fromBalance, toBalance)
+}
+
+// nullMinor converts an amount that may be missing to minor units.
+func (im *Importer) nullMinor(d decimal.NullDecimal) (sql.NullInt64, error) {
+	if !d.Valid {
+		return sql.NullInt64{}, nil
+	}
+	v, err := im.db.ToMinor(d.Decimal)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	return sql.NullInt64{Int64: v, Valid: true}, nil
+}
+
+// Commit checks that every wallet's balance equals initial plus what its
+// transactions add up to and commits the import. On a mismatch it rolls
+// back and returns a *LedgerError.
+func (im *Importer) Commit(ctx context.Context, initial decimal.Decimal) error {
+	defer im.tx.Rollback()
+	if err := im.walletRows.flush(ctx, im.tx); err != nil {
+		return err
+	}
+	if err := im.transactions.flush(ctx, im.tx); err != nil {
+		return err
+	}
+	ledgerErr := &LedgerError{}
+	err := im.db.ledgerMismatches(ctx, im.tx, initial, func(m LedgerMismatch) error {
+		if len(ledgerErr.Mismatches) < 10 {
+			ledgerErr.Mismatches = append(ledgerErr.Mismatches, m)
+		}
+		ledgerErr.Count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ledgerErr.Count > 0 {
+		return ledgerErr
+	}
+	defer im.db.Balances.clear()
+	return im.tx.Commit()
+}
+
+// Rollback abandons the import.
+func (im *Importer) Rollback() error {
+	return im.tx.Rollback()
+}
@@ -0,0 +1,295 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// querier is implemented by *DB and *Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// LedgerMismatch is a wallet whose stored balance differs from the one
+// its transactions add up to.
+type LedgerMismatch struct {
+	WalletId string
+	Balance  decimal.Decimal
+	Expected decimal.Decimal
+}
+
+// ledgerBalance computes a wallet's balance from its opening balance, the
+// initial credit (the one parameter) for wallets that don't record one,
+// plus what it received minus what it sent in completed transactions,
+// archived ones included. Self transfers cancel out.
+const ledgerBalance = `coalesce(wallets.opening_cents, ?) + coalesce((select sum(amount_cents) from wallet_transactions where to_wallet_id = wallets.id and status = 'completed'), 0)
+			  - coalesce((select sum(amount_cents) from wallet_transactions where from_wallet_id = wallets.id and status = 'completed'), 0)
+			  + coalesce((select sum(amount_cents) from wallet_transactions_archive where to_wallet_id = wallets.id and status = 'completed'), 0)
+			  - coalesce((select sum(amount_cents) from wallet_transactions_archive where from_wallet_id = wallets.id and status = 'completed'), 0)`
+
+const ledgerMismatchesQuery = `select id, balance_cents, expected from (
+		select id, balance_cents, ` + ledgerBalance + ` as expected
+		from wallets
+	) ledger where balance_cents <> expected order by id`
+
+// ledgerMismatches calls fn for every wallet whose balance doesn't match
+// its ledger, given the initial credit of wallets without an opening balance.
+func (db *DB) ledgerMismatches(ctx context.Context, q querier, initial decimal.Decimal, fn func(LedgerMismatch) error) error {
+	initialCents, err := db.ToMinor(initial)
+	if err != nil {
+		return err
+	}
+	rows, err := q.QueryContext(ctx, ledgerMismatchesQuery, initialCents)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m LedgerMismatch
+		var balance, expected int64
+		if err := rows.Scan(&m.WalletId, &balance, &expected); err != nil {
+			return err
+		}
+		m.Balance = db.FromMinor(balance)
+		m.Expected = db.FromMinor(expected)
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LedgerMismatches calls fn for every wallet whose balance doesn't match
+// its ledger, reading one wallet at a time.
+func (db *DB) LedgerMismatches(ctx context.Context, initial decimal.Decimal, fn func(LedgerMismatch) error) error {
+	return db.ledgerMismatches(ctx, db, initial, fn)
+}
+
+// MoneySupply returns the sum of every balance and the sum of the
+// opening balances, with initial for wallets that don't record one.
+// Transfers only move money between wallets, so the two are equal.
+func (db *DB) MoneySupply(ctx context.Context, initial decimal.Decimal) (balances, opening decimal.Decimal, err error) {
+	initialCents, err := db.ToMinor(initial)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	var balanceCents, openingCents int64
+	err = db.QueryRowContext(ctx, "select coalesce(sum(balance_cents), 0), coalesce(sum(coalesce(opening_cents, ?)), 0) from wallets",
+		initialCents).Scan(&balanceCents, &openingCents)
+	return db.FromMinor(balanceCents), db.FromMinor(openingCents), err
+}
+
+// FixBalances sets every wallet's balance to what its ledger adds up to
+// and returns the number of wallets that changed.
+func (db *DB) FixBalances(ctx context.Context, initial decimal.Decimal) (int64, error) {
+	initialCents, err := db.ToMinor(initial)
+	if err != nil {
+		return 0, err
+	}
+	// the balance is computed twice so that unchanged rows aren't written or counted
+	res, err := db.ExecContext(ctx, "update wallets set balance_cents = "+ledgerBalance+
+		" where balance_cents <> "+ledgerBalance, initialCents, initialCents)
+	db.Balances.clear()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// NegativeWallets calls fn for every wallet with a negative balance.
+func (db *DB) NegativeWallets(ctx context.Context, fn func(Wallet) error) error {
+	rows, err := db.QueryContext(ctx, "select "+walletColumns+" from wallets where balance_cents < 0 order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w, err := db.scanWallet(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(w); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// OrphanTransactions calls fn for every transaction, archived or not, that
+// refers to a wallet which doesn't exist. Foreign keys prevent those, but
+// only where they were enforced when the row was written.
+func (db *DB) OrphanTransactions(ctx context.Context, fn func(Transaction) error) error {
+	var parts []string
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		parts = append(parts, "select "+transactionColumns+" from "+table+" t"+
+			" where not exists (select 1 from wallets where id = t.from_wallet_id)"+
+			" or not exists (select 1 from wallets where id = t.to_wallet_id)")
+	}
+	return db.eachTransaction(ctx, strings.Join(parts, " union all "), fn)
+}
+
+// UndatedTransactions calls fn for every transaction, archived or not,
+// whose date is missing or can't be read. History refuses to show them
+// rather than make up a date, so they have to be fixed by hand.
+func (db *DB) UndatedTransactions(ctx context.Context, fn func(Transaction) error) error {
+	var parts []string
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		parts = append(parts, "select "+transactionColumns+" from "+table)
+	}
+	return db.eachTransaction(ctx, strings.Join(parts, " union all "), func(t Transaction) error {
+		if hasDate(t) {
+			return nil
+		}
+		return fn(t)
+	})
+}
+
+// eachTransaction calls fn for every row of query, which selects
+// transactionColumns, including rows without a valid date.
+func (db *DB) eachTransaction(ctx context.Context, query string, fn func(Transaction) error) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := db.scanAnyTransaction(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// BalanceGap is a completed transaction whose recorded balance of one of
+// its wallets doesn't follow from the one recorded before it.
+type BalanceGap struct {
+	WalletId    string
+	Transaction Transaction
+	Recorded    decimal.Decimal
+	Expected    decimal.Decimal
+}
+
+// balanceStep is what a transaction did to one of its wallets.
+type balanceStep struct {
+	t     Transaction
+	delta decimal.Decimal
+	after decimal.NullDecimal
+}
+
+// BalanceGaps calls fn for every completed transaction, archived or not,
+// whose balance after it of one of its wallets isn't that wallet's
+// balance after the transaction before plus or minus the amount.
+// Transactions without balances, written before they were recorded, are
+// skipped, and the wallet's next one starts over. Transactions made at
+// the same time may have been made in either order, so between them the
+// order in which the balances follow is taken.
+func (db *DB) BalanceGaps(ctx context.Context, fn func(BalanceGap) error) error {
+	var parts []string
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		parts = append(parts, "select "+transactionColumns+" from "+table+" where status = '"+StatusCompleted+"'")
+	}
+	last := map[string]decimal.Decimal{}
+	var group []Transaction
+	flush := func() error {
+		err := db.balanceGaps(group, last, fn)
+		group = group[:0]
+		return err
+	}
+	err := db.eachTransaction(ctx, strings.Join(parts, " union all ")+" order by date", func(t Transaction) error {
+		if len(group) > 0 && !group[0].Date.Time.Equal(t.Date.Time) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		group = append(group, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// balanceGaps checks the transactions of group, all made at the same
+// time, against the balances last recorded for their wallets and records
+// the new ones in last.
+func (db *DB) balanceGaps(group []Transaction, last map[string]decimal.Decimal, fn func(BalanceGap) error) error {
+	var wallets []string
+	steps := map[string][]balanceStep{}
+	add := func(wallet string, s balanceStep) {
+		if _, ok := steps[wallet]; !ok {
+			wallets = append(wallets, wallet)
+		}
+		steps[wallet] = append(steps[wallet], s)
+	}
+	for _, t := range group {
+		if t.FromId == t.ToId {
+			// a self transfer changes nothing
+			add(t.FromId, balanceStep{t: t, after: t.ToBalance})
+			continue
+		}
+		add(t.FromId, balanceStep{t: t, delta: t.Amount.Neg(), after: t.FromBalance})
+		add(t.ToId, balanceStep{t: t, delta: t.Amount, after: t.ToBalance})
+	}
+
+	for _, wallet := range wallets {
+		pending := steps[wallet]
+		balance, known := last[wallet]
+		for len(pending) > 0 {
+			i := nextBalanceStep(pending, balance, known)
+			s := pending[i]
+			pending = append(pending[:i], pending[i+1:]...)
+			if !s.after.Valid {
+				known = false
+				continue
+			}
+			if expected := balance.Add(s.delta); known && !s.after.Decimal.Equal(expected) {
+				if err := fn(BalanceGap{WalletId: wallet, Transaction: s.t, Recorded: s.after.Decimal, Expected: expected}); err != nil {
+					return err
+				}
+			}
+			balance, known = s.after.Decimal, true
+		}
+		if known {
+			last[wallet] = balance
+		} else {
+			delete(last, wallet)
+		}
+	}
+	return nil
+}
+
+// nextBalanceStep picks which of the steps of a wallet made at the same
+// time came first: the one following from balance when it is known, else
+// one no other step leads to. It is the first one when none fits.
+func nextBalanceStep(steps []balanceStep, balance decimal.Decimal, known bool) int {
+	for i, s := range steps {
+		if !s.after.Valid {
+			continue
+		}
+		if known {
+			if s.after.Decimal.Equal(balance.Add(s.delta)) {
+				return i
+			}
+			continue
+		}
+		first := true
+		for j, other := range steps {
+			if j != i && other.after.Valid && other.after.Decimal.Add(s.delta).Equal(s.after.Decimal) {
+				first = false
+				break
+			}
+		}
+		if first {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// gapsOf returns the balance gaps of db.
+func gapsOf(t *testing.T, db *DB) []BalanceGap {
+	t.Helper()
+	var gaps []BalanceGap
+	if err := db.BalanceGaps(context.Background(), func(g BalanceGap) error {
+		gaps = append(gaps, g)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return gaps
+}
+
+// TestBalanceGaps follows the balances recorded after each transfer,
+// across a transaction written before they were, failed ones, transfers
+// made at the same time and the archive, then breaks one of them.
+func TestBalanceGaps(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		db.RecordFailures = true
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB", "CCCCCC")
+		// as written before the balances were recorded
+		if _, err := db.ExecContext(ctx, `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status)
+			values('AAAAAA', 'BBBBBB', 500, ?, 'completed')`, testTime); err != nil {
+			t.Fatal(err)
+		}
+		transfers := []struct {
+			from, to, amount string
+			at               time.Duration
+		}{
+			{"AAAAAA", "BBBBBB", "10", time.Minute},
+			{"BBBBBB", "CCCCCC", "20", 2 * time.Minute},
+			{"CCCCCC", "AAAAAA", "1000", 2 * time.Minute},
+			{"AAAAAA", "CCCCCC", "1", 3 * time.Minute},
+			{"AAAAAA", "CCCCCC", "2", 3 * time.Minute},
+			{"BBBBBB", "BBBBBB", "5", 3 * time.Minute},
+		}
+		for _, tr := range transfers {
+			_, err := db.Transfer(ctx, tr.from, tr.to, decimal.RequireFromString(tr.amount), testTime.Add(tr.at))
+			if err != nil && tr.amount != "1000" {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.ArchiveTransactions(ctx, testTime.Add(2*time.Minute+time.Second), 2, nil); err != nil {
+			t.Fatal(err)
+		}
+		if gaps := gapsOf(t, db); len(gaps) != 0 {
+			t.Fatalf("gaps in a consistent ledger: %+v", gaps)
+		}
+
+		// CCCCCC got 1 then 2 after 120: 121 and 123, not 223
+		if _, err := db.ExecContext(ctx, `update wallet_transactions set to_balance_after_cents = 22300
+			where to_wallet_id = 'CCCCCC' and amount_cents = 200`); err != nil {
+			t.Fatal(err)
+		}
+		gaps := gapsOf(t, db)
+		if len(gaps) != 1 {
+			t.Fatalf("gaps: %+v", gaps)
+		}
+		g := gaps[0]
+		if g.WalletId != "CCCCCC" || !g.Transaction.Amount.Equal(decimal.NewFromInt(2)) ||
+			!g.Recorded.Equal(decimal.NewFromInt(223)) || !g.Expected.Equal(decimal.NewFromInt(123)) {
+			t.Fatalf("gap: %+v", g)
+		}
+	})
+}
+
+// TestBalanceAfterMigration checks that migration 15 leaves the balances
+// of the transactions before it unknown, and that going back below it
+// and up again keeps the transactions.
+func TestBalanceAfterMigration(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	migrateTo := func(version int) {
+		t.Helper()
+		steps, err := db.Plan(ctx, version)
+		if err == nil {
+			err = db.Apply(ctx, steps)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	countNull := func() (rows, null int) {
+		t.Helper()
+		if err := db.QueryRowContext(ctx, `select count(*), count(*) - count(from_balance_after_cents) from wallet_transactions`).Scan(&rows, &null); err != nil {
+			t.Fatal(err)
+		}
+		return rows, null
+	}
+
+	migrateTo(14)
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if _, err := db.ExecContext(ctx, "insert into wallets(id, balance_cents) values(?, 10000)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status)
+		values('AAAAAA', 'BBBBBB', 100, ?, 'completed')`, testTime); err != nil {
+		t.Fatal(err)
+	}
+
+	migrateTo(15)
+	if rows, null := countNull(); rows != 1 || null != 1 {
+		t.Fatalf("%d transactions, %d without balances after migrating", rows, null)
+	}
+	migrateTo(LatestVersion())
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1), testTime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if rows, null := countNull(); rows != 2 || null != 1 {
+		t.Fatalf("%d transactions, %d without balances after a transfer", rows, null)
+	}
+	if gaps := gapsOf(t, db); len(gaps) != 0 {
+		t.Fatalf("gaps: %+v", gaps)
+	}
+
+	migrateTo(14)
+	var rows int
+	if err := db.QueryRowContext(ctx, "select count(*) from wallet_transactions").Scan(&rows); err != nil || rows != 2 {
+		t.Fatalf("%d transactions after going down, %v", rows, err)
+	}
+	if _, err := db.ExecContext(ctx, "select from_balance_after_cents from wallet_transactions"); err == nil {
+		t.Fatal("the column is still there after going down")
+	}
+	migrateTo(LatestVersion())
+	if rows, null := countNull(); rows != 2 || null != 2 {
+		t.Fatalf("%d transactions, %d without balances after going up again", rows, null)
+	}
+}
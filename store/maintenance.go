@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrMaintenanceUnsupported is returned by the maintenance helpers for
+// databases that run their own housekeeping.
+var ErrMaintenanceUnsupported = errors.New("maintenance is only supported for SQLite")
+
+// Optimize lets SQLite refresh the statistics its query planner uses.
+func (db *DB) Optimize(ctx context.Context) error {
+	if db.Driver != SQLite {
+		return ErrMaintenanceUnsupported
+	}
+	_, err := db.ExecContext(ctx, "pragma optimize")
+	return err
+}
+
+// Checkpoint copies the write-ahead log into the database file and
+// truncates it. It fails when readers kept the checkpoint from finishing.
+func (db *DB) Checkpoint(ctx context.Context) error {
+	if db.Driver != SQLite {
+		return ErrMaintenanceUnsupported
+	}
+	var busy, logFrames, checkpointed int
+	err := db.QueryRowContext(ctx, "pragma wal_checkpoint(truncate)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint incomplete, %d of %d frames copied", checkpointed, logFrames)
+	}
+	return nil
+}
+
+// Vacuum rebuilds the database file, returning free pages to the
+// file system. Writers are blocked while it runs.
+func (db *DB) Vacuum(ctx context.Context) error {
+	if db.Driver != SQLite {
+		return ErrMaintenanceUnsupported
+	}
+	_, err := db.ExecContext(ctx, "vacuum")
+	return err
+}
+
+// FileSize returns the size of the SQLite database file plus its
+// write-ahead log, 0 for databases that aren't files.
+func (db *DB) FileSize() int64 {
+	if db.Path == "" {
+		return 0
+	}
+	var size int64
+	for _, name := range []string{db.Path, db.Path + "-wal"} {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// IntegrityCheck runs PRAGMA integrity_check, or the faster quick_check
+// which skips comparing the indexes with their tables, and returns what
+// SQLite reports: a single "ok" for an intact database, otherwise one
+// message per problem found, at most the first 100.
+func (db *DB) IntegrityCheck(ctx context.Context, quick bool) ([]string, error) {
+	if db.Driver != SQLite {
+		return nil, ErrMaintenanceUnsupported
+	}
+	pragma := "pragma integrity_check"
+	if quick {
+		pragma = "pragma quick_check"
+	}
+	rows, err := db.QueryContext(ctx, pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []string
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// Intact reports whether the messages of IntegrityCheck found no problem.
+func Intact(messages []string) bool {
+	return len(messages) == 1 && messages[0] == "ok"
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// damageWalletsIndex closes db and edits its file behind SQLite's back:
+// the key of wallet id in the primary key index of wallets gets its last
+// letter changed, which keeps the index in order but no longer matching
+// the table, and with page set the index page itself is made unreadable.
+// It returns the database opened again.
+func damageWalletsIndex(t *testing.T, db *DB, id string, page bool) *DB {
+	t.Helper()
+	ctx := context.Background()
+	var pageSize, root int64
+	if err := db.QueryRowContext(ctx, "pragma page_size").Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRowContext(ctx, "select rootpage from sqlite_master where type = 'index' and tbl_name = 'wallets' and name like 'sqlite_autoindex_%'").Scan(&root); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	file, err := os.ReadFile(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := (root - 1) * pageSize
+	i := bytes.Index(file[start:start+pageSize], []byte(id))
+	if i < 0 {
+		t.Fatalf("%s is not on page %d", id, root)
+	}
+	file[start+int64(i+len(id)-1)]++
+	if page {
+		// not a valid page type
+		file[start] = 0xff
+	}
+	if err := os.WriteFile(db.Path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestIntegrityCheck damages a scratch database: only the full check
+// compares the indexes with their tables, and a page SQLite can't read
+// fails both, the full check without getting to a report.
+func TestIntegrityCheck(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		page bool
+		// quick and full are what each check reports, nil for intact; a
+		// full check that can't run fails with fullErr
+		quick, full []string
+		fullErr     string
+	}{
+		{"intact", false, nil, nil, ""},
+		{"index not matching its table", false, nil, []string{"row 2 missing from index sqlite_autoindex_wallets_1"}, ""},
+		{"unreadable index page", true, []string{"btreeInitPage() returns error code 11"}, nil, "database disk image is malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+			mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+			if tt.name != "intact" {
+				db = damageWalletsIndex(t, db, "BBBBBB", tt.page)
+			}
+			messages, err := db.IntegrityCheck(ctx, true)
+			if err != nil || Intact(messages) != (tt.quick == nil) || !containsAll(messages, tt.quick) {
+				t.Errorf("quick_check = %q, %v, want %q", messages, err, tt.quick)
+			}
+			messages, err = db.IntegrityCheck(ctx, false)
+			if tt.fullErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fullErr) {
+					t.Errorf("integrity_check = %q, %v, want %s", messages, err, tt.fullErr)
+				}
+				return
+			}
+			if err != nil || Intact(messages) != (tt.full == nil) || !containsAll(messages, tt.full) {
+				t.Errorf("integrity_check = %q, %v, want %q", messages, err, tt.full)
+			}
+		})
+	}
+}
+
+// containsAll reports whether each of want is found in messages.
+func containsAll(messages, want []string) bool {
+	all := strings.Join(messages, "\n")
+	for _, w := range want {
+		if !strings.Contains(all, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIntact(t *testing.T) {
+	tests := []struct {
+		messages []string
+		want     bool
+	}{
+		{[]string{"ok"}, true},
+		{nil, false},
+		{[]string{"ok", "ok"}, false},
+		{[]string{"row 2 missing from index sqlite_autoindex_wallets_1"}, false},
+	}
+	for _, tt := range tests {
+		if got := Intact(tt.messages); got != tt.want {
+			t.Errorf("Intact(%q) = %t", tt.messages, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/metrics"
+)
+
+// Metrics are what the store records about wallets and transfers, for the
+// HTTP and gRPC APIs alike. A nil *Metrics records nothing.
+type Metrics struct {
+	transferAmount     *metrics.Histogram
+	transferDuration   *metrics.Histogram
+	statement          *metrics.HistogramVec
+	insufficientFunds  *metrics.Counter
+	idCollisions       *metrics.Counter
+	balanceCacheHits   *metrics.Counter
+	balanceCacheMisses *metrics.Counter
+}
+
+// NewMetrics adds the store's metrics to r. amountBuckets bound the
+// transfer amounts in currency units, latencyBuckets the durations in
+// seconds.
+func NewMetrics(r *metrics.Registry, amountBuckets, latencyBuckets []float64) *Metrics {
+	return &Metrics{
+		transferAmount: r.Histogram("wallet_transfer_amount",
+			"Amounts of completed transfers.", amountBuckets),
+		transferDuration: r.Histogram("wallet_transfer_duration_seconds",
+			"Time a transfer takes in the store, from the start of its transaction to the commit or the refusal.", latencyBuckets),
+		statement: r.HistogramVec("wallet_db_statement_duration_seconds",
+			"Time taken by the statements of the wallet store, by statement.", "statement", latencyBuckets),
+		insufficientFunds: r.Counter("wallet_insufficient_funds_total",
+			"Transfers refused because the sender's balance was too low."),
+		idCollisions: r.Counter("wallet_id_collisions_total",
+			"Wallets not created because their generated id was taken, each followed by a retry with a new id."),
+		balanceCacheHits: r.Counter("wallet_balance_cache_hits_total",
+			"Wallet reads answered from the balance cache, see BALANCE_CACHE_TTL."),
+		balanceCacheMisses: r.Counter("wallet_balance_cache_misses_total",
+			"Wallet reads the balance cache didn't have and sent to the database."),
+	}
+}
+
+// The statements the store times, the values of the statement label.
+const (
+	stmtGetWallet    = "get_wallet"
+	stmtDebit        = "debit"
+	stmtCredit       = "credit"
+	stmtInsertTx     = "insert_tx"
+	stmtHistory      = "history"
+	stmtHistoryCount = "history_count"
+)
+
+// observeStatement records how long the statement name took since start.
+func (m *Metrics) observeStatement(name string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.statement.With(name).Observe(time.Since(start).Seconds())
+}
+
+// observeTransfer records a transfer that started at start and ended with
+// err, nil for a completed one.
+func (m *Metrics) observeTransfer(amount decimal.Decimal, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.transferDuration.Observe(time.Since(start).Seconds())
+	switch {
+	case err == nil:
+		m.transferAmount.Observe(amount.InexactFloat64())
+	case errors.Is(err, ErrInsufficientFunds):
+		m.insufficientFunds.Inc()
+	}
+}
+
+func (m *Metrics) idCollision() {
+	if m == nil {
+		return
+	}
+	m.idCollisions.Inc()
+}
+
+func (m *Metrics) balanceCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.balanceCacheHits.Inc()
+	} else {
+		m.balanceCacheMisses.Inc()
+	}
+}
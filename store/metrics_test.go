@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/metrics"
+)
+
+// scrape returns the samples r exposes, by series.
+func scrape(t *testing.T, r *metrics.Registry) map[string]float64 {
+	t.Helper()
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string]float64{}
+	s := bufio.NewScanner(strings.NewReader(b.String()))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	registry := metrics.NewRegistry()
+	db.Metrics = NewMetrics(registry, []float64{1, 10, 100}, []float64{0.001, 0.1, 10})
+	ctx := context.Background()
+
+	for _, id := range []string{"AAAAAA", "BBBBBB"} {
+		if err := db.CreateWallet(ctx, Wallet{Id: id, Balance: InitialBalance}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateWallet(ctx, Wallet{Id: "AAAAAA", Balance: InitialBalance}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("duplicate id: %v", err)
+	}
+	for _, amount := range []string{"5", "50.5"} {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString(amount), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1000), time.Now()); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("transfer over the balance: %v", err)
+	}
+	if _, err := db.GetWallet(ctx, "AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.History(ctx, "AAAAAA", HistoryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := scrape(t, registry)
+	want := map[string]float64{
+		`wallet_transfer_amount_bucket{le="1"}`:    0,
+		`wallet_transfer_amount_bucket{le="10"}`:   1,
+		`wallet_transfer_amount_bucket{le="100"}`:  2,
+		`wallet_transfer_amount_bucket{le="+Inf"}`: 2,
+		`wallet_transfer_amount_sum`:               55.5,
+		`wallet_transfer_amount_count`:             2,
+		// refused transfers are timed too
+		`wallet_transfer_duration_seconds_count`: 3,
+		`wallet_insufficient_funds_total`:        1,
+		`wallet_id_collisions_total`:             1,
+	}
+	for series, v := range want {
+		if got, ok := samples[series]; !ok || got != v {
+			t.Errorf("%s = %v (present %t), want %v", series, got, ok, v)
+		}
+	}
+	for _, stmt := range []string{stmtGetWallet, stmtDebit, stmtCredit, stmtInsertTx, stmtHistory} {
+		count := samples[`wallet_db_statement_duration_seconds_count{statement="`+stmt+`"}`]
+		sum := samples[`wallet_db_statement_duration_seconds_sum{statement="`+stmt+`"}`]
+		inf := samples[`wallet_db_statement_duration_seconds_bucket{statement="`+stmt+`",le="+Inf"}`]
+		if count < 1 || inf != count || sum <= 0 || sum > 10*count {
+			t.Errorf("statement %s: count %v, +Inf bucket %v, sum %v", stmt, count, inf, sum)
+		}
+	}
+	if d := samples["wallet_transfer_duration_seconds_sum"]; d <= 0 || d > 30 {
+		t.Errorf("transfers took %vs in all", d)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	// recording nothing, without a registry
+	if err := db.CreateWallet(context.Background(), Wallet{Id: "AAAAAA", Balance: InitialBalance}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateWallet(context.Background(), Wallet{Id: "AAAAAA", Balance: InitialBalance}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatal(err)
+	}
+}
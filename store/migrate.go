@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var migrationsTableCreateSql = `
+	create table if not exists schema_migrations (
+		version integer not null primary key,
+		name varchar(255) not null,
+		applied_at timestamp not null
+		);
+`
+
+// Step is a migration to run, either up or down.
+type Step struct {
+	Migration Migration
+	Up        bool
+}
+
+func (s Step) String() string {
+	direction := "up"
+	if !s.Up {
+		direction = "down"
+	}
+	return fmt.Sprintf("%d %s (%s)", s.Migration.Version, direction, s.Migration.Name)
+}
+
+// LatestVersion is the version the schema has after all migrations ran.
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the highest applied migration, 0 for an empty database.
+func (db *DB) SchemaVersion(ctx context.Context) (int, error) {
+	if _, err := db.DB.ExecContext(ctx, migrationsTableCreateSql); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRowContext(ctx, "select coalesce(max(version), 0) from schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Legacy reports whether the database was created before migrations
+// existed: it has the wallets table but no recorded schema version.
+// Such databases are adopted as version 1 by the first migration.
+func (db *DB) Legacy(ctx context.Context) (bool, error) {
+	version, err := db.SchemaVersion(ctx)
+	if err != nil || version > 0 {
+		return false, err
+	}
+	return db.tableExists(ctx, "wallets")
+}
+
+func (db *DB) tableExists(ctx context.Context, name string) (bool, error) {
+	var query string
+	switch db.Driver {
+	case Postgres:
+		query = "select count(*) from information_schema.tables where table_schema = current_schema() and table_name = ?"
+	case MySQL:
+		query = "select count(*) from information_schema.tables where table_schema = database() and table_name = ?"
+	default:
+		query = "select count(*) from sqlite_master where type = 'table' and name = ?"
+	}
+	var n int
+	err := db.QueryRowContext(ctx, query, name).Scan(&n)
+	return n > 0, err
+}
+
+// readColumns are the column lists the store reads, by table.
+var readColumns = []struct{ table, columns string }{
+	{"wallets", walletColumns},
+	{"wallet_transactions", transactionColumns},
+	{"wallet_transactions_archive", transactionColumns},
+	{"outbox", eventColumns},
+	{"webhooks", webhookColumns},
+}
+
+// CheckColumns returns an error naming the table when one of the columns
+// the store reads is missing, say after the schema was changed by hand
+// under a version that doesn't say so. Every read names its columns, so
+// columns added or reordered don't matter.
+func (db *DB) CheckColumns(ctx context.Context) error {
+	for _, r := range readColumns {
+		rows, err := db.QueryContext(ctx, "select "+r.columns+" from "+r.table+" where 1 = 0")
+		if err != nil {
+			return fmt.Errorf("table %s doesn't have the columns this binary reads: %w", r.table, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// Plan returns the steps that bring the schema from its current version to target.
+func (db *DB) Plan(ctx context.Context, target int) ([]Step, error) {
+	if target < 0 || target > LatestVersion() {
+		return nil, fmt.Errorf("unknown schema version %d, latest is %d", target, LatestVersion())
+	}
+	current, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary (%d)", current, LatestVersion())
+	}
+
+	var steps []Step
+	if target >= current {
+		for _, m := range Migrations {
+			if m.Version > current && m.Version <= target {
+				steps = append(steps, Step{Migration: m, Up: true})
+			}
+		}
+		return steps, nil
+	}
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m := Migrations[i]
+		if m.Version <= current && m.Version > target {
+			steps = append(steps, Step{Migration: m, Up: false})
+		}
+	}
+	return steps, nil
+}
+
+// Apply runs the steps in order, each inside its own transaction, and
+// records them in schema_migrations. MySQL commits DDL implicitly, so
+// there a failing step can leave a partially applied migration behind.
+func (db *DB) Apply(ctx context.Context, steps []Step) error {
+	for _, step := range steps {
+		statements := step.Migration.Down[db.Driver]
+		fn := step.Migration.DownFunc
+		if step.Up {
+			statements = step.Migration.Up[db.Driver]
+			fn = step.Migration.UpFunc
+		}
+		if statements == nil && fn == nil {
+			return fmt.Errorf("migration %s has no statements for %s", step, db.Driver)
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %s: %w: %s", step, err, stmt)
+			}
+		}
+		if fn != nil {
+			if err := fn(ctx, db, tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %s: %w", step, err)
+			}
+		}
+		if step.Up {
+			_, err = tx.ExecContext(ctx, "insert into schema_migrations(version, name, applied_at) values(?, ?, ?)",
+				step.Migration.Version, step.Migration.Name, time.Now().UTC())
+		} else {
+			_, err = tx.ExecContext(ctx, "delete from schema_migrations where version = ?", step.Migration.Version)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", step, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", step, err)
+		}
+	}
+	return nil
+}
+
+// Migrate applies every pending migration and returns the steps it ran.
+// When one fails, only the steps before it are returned, with its error.
+func (db *DB) Migrate(ctx context.Context) ([]Step, error) {
+	steps, err := db.Plan(ctx, LatestVersion())
+	if err != nil {
+		return nil, err
+	}
+	for i, step := range steps {
+		if err := db.Apply(ctx, []Step{step}); err != nil {
+			return steps[:i], err
+		}
+	}
+	return steps, nil
+}
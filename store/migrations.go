@@ -0,0 +1,889 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Migration is one step of the schema history. Up and Down hold the
+// statements for every driver; the resulting schemas must stay equivalent
+// across drivers: same tables, columns and constraints.
+// UpFunc and DownFunc, when set, run after the statements in the same
+// transaction, for data changes that need more than plain SQL.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       map[string][]string
+	Down     map[string][]string
+	UpFunc   func(ctx context.Context, db *DB, tx *Tx) error
+	DownFunc func(ctx context.Context, db *DB, tx *Tx) error
+}
+
+// Migrations is the ordered schema history. Never edit an applied
+// migration, append a new one instead.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      initialSchema,
+		Down: map[string][]string{
+			SQLite:   {"drop table settings", "drop table wallet_transactions", "drop table wallets"},
+			Postgres: {"drop table settings", "drop table wallet_transactions", "drop table wallets"},
+			MySQL:    {"drop table settings", "drop table wallet_transactions", "drop table wallets"},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index wallet_transactions lookups",
+		Up: map[string][]string{
+			SQLite:   transactionIndexes,
+			Postgres: transactionIndexes,
+			MySQL:    transactionIndexes,
+		},
+		Down: map[string][]string{
+			SQLite:   {"drop index wallet_transactions_author_date", "drop index wallet_transactions_sender_date", "drop index wallet_transactions_date"},
+			Postgres: {"drop index wallet_transactions_author_date", "drop index wallet_transactions_sender_date", "drop index wallet_transactions_date"},
+			MySQL: {
+				"drop index wallet_transactions_author_date on wallet_transactions",
+				"drop index wallet_transactions_sender_date on wallet_transactions",
+				"drop index wallet_transactions_date on wallet_transactions",
+			},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add minor unit money columns",
+		Up: map[string][]string{
+			SQLite: {
+				"alter table wallets add column balance_cents integer not null default 0",
+				"alter table wallet_transactions add column amount_cents integer not null default 0",
+			},
+			Postgres: {
+				"alter table wallets add column balance_cents bigint not null default 0",
+				"alter table wallet_transactions add column amount_cents bigint not null default 0",
+			},
+			MySQL: {
+				"alter table wallets add column balance_cents bigint not null default 0",
+				"alter table wallet_transactions add column amount_cents bigint not null default 0",
+			},
+		},
+		UpFunc: backfillMinorUnits,
+		Down: map[string][]string{
+			SQLite:   {"alter table wallets drop column balance_cents", "alter table wallet_transactions drop column amount_cents"},
+			Postgres: {"alter table wallets drop column balance_cents", "alter table wallet_transactions drop column amount_cents"},
+			MySQL:    {"alter table wallets drop column balance_cents", "alter table wallet_transactions drop column amount_cents"},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "drop decimal money columns",
+		Up: map[string][]string{
+			SQLite:   {"alter table wallets drop column balance", "alter table wallet_transactions drop column balance"},
+			Postgres: {"alter table wallets drop column balance", "alter table wallet_transactions drop column balance"},
+			MySQL:    {"alter table wallets drop column balance", "alter table wallet_transactions drop column balance"},
+		},
+		Down: map[string][]string{
+			SQLite: {
+				"alter table wallets add column balance decimal not null default 0",
+				"alter table wallet_transactions add column balance decimal not null default 0",
+			},
+			Postgres: {
+				"alter table wallets add column balance numeric not null default 0",
+				"alter table wallet_transactions add column balance numeric not null default 0",
+			},
+			MySQL: {
+				"alter table wallets add column balance decimal(36,18) not null default 0",
+				"alter table wallet_transactions add column balance decimal(36,18) not null default 0",
+			},
+		},
+		DownFunc: restoreDecimalColumns,
+	},
+	{
+		Version: 5,
+		Name:    "forbid negative balances",
+		UpFunc:  addNonNegativeBalanceConstraint,
+		Down: map[string][]string{
+			SQLite: {
+				"drop trigger wallets_balance_non_negative_insert",
+				"drop trigger wallets_balance_non_negative_update",
+			},
+			Postgres: {"alter table wallets drop constraint wallets_balance_non_negative"},
+			MySQL:    {"alter table wallets drop check wallets_balance_non_negative"},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "archive table for old transactions",
+		Up: map[string][]string{
+			SQLite: append([]string{`
+	create table wallet_transactions_archive (
+		author_id text not null,
+		sender_id text not null,
+		amount_cents integer not null,
+		date timestamp not null,
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		);
+`}, archiveIndexes...),
+			Postgres: append([]string{`
+	create table wallet_transactions_archive (
+		author_id text not null,
+		sender_id text not null,
+		amount_cents bigint not null,
+		date timestamptz not null,
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		);
+`}, archiveIndexes...),
+			MySQL: append([]string{`
+	create table wallet_transactions_archive (
+		author_id varchar(64) not null,
+		sender_id varchar(64) not null,
+		amount_cents bigint not null,
+		date timestamp(6) not null,
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		) engine=InnoDB;
+`}, archiveIndexes...),
+		},
+		// archived rows go back to the live table instead of being lost
+		Down: map[string][]string{
+			SQLite:   unarchive,
+			Postgres: unarchive,
+			MySQL:    unarchive,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "transaction status",
+		Up: map[string][]string{
+			SQLite: {
+				"alter table wallet_transactions add column status text not null default 'completed'",
+				"alter table wallet_transactions add column failure_reason text",
+				"alter table wallet_transactions_archive add column status text not null default 'completed'",
+				"alter table wallet_transactions_archive add column failure_reason text",
+			},
+			Postgres: {
+				"alter table wallet_transactions add column status text not null default 'completed'",
+				"alter table wallet_transactions add column failure_reason text",
+				"alter table wallet_transactions_archive add column status text not null default 'completed'",
+				"alter table wallet_transactions_archive add column failure_reason text",
+			},
+			MySQL: {
+				"alter table wallet_transactions add column status varchar(16) not null default 'completed'",
+				"alter table wallet_transactions add column failure_reason varchar(64)",
+				"alter table wallet_transactions_archive add column status varchar(16) not null default 'completed'",
+				"alter table wallet_transactions_archive add column failure_reason varchar(64)",
+			},
+		},
+		Down: map[string][]string{
+			// failed transactions never moved money, without a status they would look like they did
+			SQLite:   dropTransactionStatus,
+			Postgres: dropTransactionStatus,
+			MySQL:    dropTransactionStatus,
+		},
+	},
+	{
+		// wallets created before kept the initial credit of the service,
+		// which null stands for
+		Version: 8,
+		Name:    "wallet opening balance",
+		Up: map[string][]string{
+			SQLite:   {"alter table wallets add column opening_cents integer"},
+			Postgres: {"alter table wallets add column opening_cents bigint"},
+			MySQL:    {"alter table wallets add column opening_cents bigint"},
+		},
+		Down: map[string][]string{
+			SQLite:   {"alter table wallets drop column opening_cents"},
+			Postgres: {"alter table wallets drop column opening_cents"},
+			MySQL:    {"alter table wallets drop column opening_cents"},
+		},
+	},
+	{
+		Version: 9,
+		Name:    "event outbox",
+		Up: map[string][]string{
+			SQLite: {`
+	create table outbox (
+		id integer not null primary key autoincrement,
+		type text not null,
+		payload text not null,
+		created_at timestamp not null,
+		status text not null,
+		attempts integer not null,
+		next_attempt_at timestamp not null,
+		last_error text
+		);
+`, outboxIndex},
+			Postgres: {`
+	create table outbox (
+		id bigserial not null primary key,
+		type text not null,
+		payload text not null,
+		created_at timestamptz not null,
+		status text not null,
+		attempts integer not null,
+		next_attempt_at timestamptz not null,
+		last_error text
+		);
+`, outboxIndex},
+			MySQL: {`
+	create table outbox (
+		id bigint not null auto_increment primary key,
+		type varchar(64) not null,
+		payload text not null,
+		created_at timestamp(6) not null,
+		status varchar(16) not null,
+		attempts integer not null,
+		next_attempt_at timestamp(6) not null,
+		last_error text
+		) engine=InnoDB;
+`, outboxIndex},
+		},
+		Down: map[string][]string{
+			SQLite:   {"drop table outbox"},
+			Postgres: {"drop table outbox"},
+			MySQL:    {"drop table outbox"},
+		},
+	},
+	{
+		Version: 10,
+		Name:    "webhook subscriptions",
+		Up: map[string][]string{
+			SQLite: {`
+	create table webhooks (
+		id integer not null primary key autoincrement,
+		wallet_id text not null,
+		url text not null,
+		secret text not null,
+		events text not null,
+		created_at timestamp not null,
+		failures integer not null default 0,
+		failing_since timestamp,
+		disabled_at timestamp,
+
+		foreign key (wallet_id) references wallets (id)
+		);
+`, `
+	create table webhook_deliveries (
+		id integer not null primary key autoincrement,
+		webhook_id integer not null,
+		event_id integer not null,
+		event_type text not null,
+		attempted_at timestamp not null,
+		duration_ms integer not null,
+		status_code integer,
+		error text,
+
+		foreign key (webhook_id) references webhooks (id)
+		);
+`, webhooksIndex, webhookDeliveriesIndex},
+			Postgres: {`
+	create table webhooks (
+		id bigserial not null primary key,
+		wallet_id text not null,
+		url text not null,
+		secret text not null,
+		events text not null,
+		created_at timestamptz not null,
+		failures integer not null default 0,
+		failing_since timestamptz,
+		disabled_at timestamptz,
+
+		foreign key (wallet_id) references wallets (id)
+		);
+`, `
+	create table webhook_deliveries (
+		id bigserial not null primary key,
+		webhook_id bigint not null,
+		event_id bigint not null,
+		event_type text not null,
+		attempted_at timestamptz not null,
+		duration_ms integer not null,
+		status_code integer,
+		error text,
+
+		foreign key (webhook_id) references webhooks (id)
+		);
+`, webhooksIndex, webhookDeliveriesIndex},
+			MySQL: {`
+	create table webhooks (
+		id bigint not null auto_increment primary key,
+		wallet_id varchar(64) not null,
+		url text not null,
+		secret text not null,
+		events varchar(255) not null,
+		created_at timestamp(6) not null,
+		failures integer not null default 0,
+		failing_since timestamp(6) null,
+		disabled_at timestamp(6) null,
+
+		foreign key (wallet_id) references wallets (id)
+		) engine=InnoDB;
+`, `
+	create table webhook_deliveries (
+		id bigint not null auto_increment primary key,
+		webhook_id bigint not null,
+		event_id bigint not null,
+		event_type varchar(64) not null,
+		attempted_at timestamp(6) not null,
+		duration_ms integer not null,
+		status_code integer,
+		error text,
+
+		foreign key (webhook_id) references webhooks (id)
+		) engine=InnoDB;
+`, webhooksIndex, webhookDeliveriesIndex},
+		},
+		Down: map[string][]string{
+			SQLite:   {"drop table webhook_deliveries", "drop table webhooks"},
+			Postgres: {"drop table webhook_deliveries", "drop table webhooks"},
+			MySQL:    {"drop table webhook_deliveries", "drop table webhooks"},
+		},
+	},
+	{
+		// events written before have no trace, the dispatcher starts one
+		Version: 11,
+		Name:    "outbox trace context",
+		Up: map[string][]string{
+			SQLite:   {"alter table outbox add column traceparent text", "alter table outbox add column tracestate text"},
+			Postgres: {"alter table outbox add column traceparent text", "alter table outbox add column tracestate text"},
+			MySQL:    {"alter table outbox add column traceparent text", "alter table outbox add column tracestate text"},
+		},
+		Down: map[string][]string{
+			SQLite:   {"alter table outbox drop column traceparent", "alter table outbox drop column tracestate"},
+			Postgres: {"alter table outbox drop column traceparent", "alter table outbox drop column tracestate"},
+			MySQL:    {"alter table outbox drop column traceparent", "alter table outbox drop column tracestate"},
+		},
+	},
+	{
+		// author_id was the sending wallet and sender_id the receiving one
+		Version: 12,
+		Name:    "name the sides of a transaction",
+		Up: map[string][]string{
+			SQLite:   renameTransactionSides(SQLite, transactionSidesOld, transactionSidesNew),
+			Postgres: renameTransactionSides(Postgres, transactionSidesOld, transactionSidesNew),
+			MySQL:    renameTransactionSides(MySQL, transactionSidesOld, transactionSidesNew),
+		},
+		Down: map[string][]string{
+			SQLite:   renameTransactionSides(SQLite, transactionSidesNew, transactionSidesOld),
+			Postgres: renameTransactionSides(Postgres, transactionSidesNew, transactionSidesOld),
+			MySQL:    renameTransactionSides(MySQL, transactionSidesNew, transactionSidesOld),
+		},
+	},
+	{
+		// nothing to undo, the dates stay the same instants
+		Version: 13,
+		Name:    "transaction dates in UTC",
+		UpFunc:  transactionDatesToUTC,
+		Down:    map[string][]string{SQLite: {}, Postgres: {}, MySQL: {}},
+	},
+	{
+		// a wallet that is already negative may stay negative, as long as
+		// an update only raises its balance. PostgreSQL and MySQL can't compare
+		// with the old row in a CHECK, so there the rule becomes a trigger
+		// failing like the CHECK did, for IsCheckViolation.
+		Version: 14,
+		Name:    "allow negative balances to go up",
+		Up: map[string][]string{
+			SQLite: {
+				"drop trigger wallets_balance_non_negative_update",
+				`create trigger wallets_balance_non_negative_update before update of balance_cents on wallets
+				when new.balance_cents < 0 and new.balance_cents < old.balance_cents
+				begin select raise(abort, 'insufficient_funds'); end`,
+			},
+			Postgres: {
+				"alter table wallets drop constraint wallets_balance_non_negative",
+				`create function wallets_balance_non_negative() returns trigger as $$
+				begin
+					if new.balance_cents < 0 and (tg_op = 'INSERT' or new.balance_cents < old.balance_cents) then
+						raise exception 'insufficient_funds' using errcode = 'check_violation';
+					end if;
+					return new;
+				end
+				$$ language plpgsql`,
+				`create trigger wallets_balance_non_negative before insert or update of balance_cents on wallets
+				for each row execute function wallets_balance_non_negative()`,
+			},
+			MySQL: {
+				"alter table wallets drop check wallets_balance_non_negative",
+				`create trigger wallets_balance_non_negative_insert before insert on wallets for each row
+				if new.balance_cents < 0 then
+					signal sqlstate '45000' set mysql_errno = 3819, message_text = 'insufficient_funds';
+				end if`,
+				`create trigger wallets_balance_non_negative_update before update on wallets for each row
+				if new.balance_cents < 0 and new.balance_cents < old.balance_cents then
+					signal sqlstate '45000' set mysql_errno = 3819, message_text = 'insufficient_funds';
+				end if`,
+			},
+		},
+		Down: map[string][]string{
+			SQLite: {
+				"drop trigger wallets_balance_non_negative_update",
+				`create trigger wallets_balance_non_negative_update before update of balance_cents on wallets
+				when new.balance_cents < 0
+				begin select raise(abort, 'insufficient_funds'); end`,
+			},
+			Postgres: {
+				"drop trigger wallets_balance_non_negative on wallets",
+				"drop function wallets_balance_non_negative()",
+				"alter table wallets add constraint wallets_balance_non_negative check (balance_cents >= 0)",
+			},
+			MySQL: {
+				"drop trigger wallets_balance_non_negative_insert",
+				"drop trigger wallets_balance_non_negative_update",
+				"alter table wallets add constraint wallets_balance_non_negative check (balance_cents >= 0)",
+			},
+		},
+	},
+	{
+		// older rows keep NULL, their balances are unknown
+		Version: 15,
+		Name:    "balances after each transaction",
+		Up: map[string][]string{
+			SQLite:   balanceAfterColumns("add", "integer"),
+			Postgres: balanceAfterColumns("add", "bigint"),
+			MySQL:    balanceAfterColumns("add", "bigint"),
+		},
+		Down: map[string][]string{
+			SQLite:   balanceAfterColumns("drop", ""),
+			Postgres: balanceAfterColumns("drop", ""),
+			MySQL:    balanceAfterColumns("drop", ""),
+		},
+	},
+	{
+		// wallets from before get the date of their first transaction, the
+		// latest they can have been created at, or none
+		Version: 16,
+		Name:    "wallet creation time",
+		Up: map[string][]string{
+			SQLite: {
+				"alter table wallets add column created_at timestamp",
+				"update wallets set created_at = (select min(date) from wallet_transactions where from_wallet_id = wallets.id or to_wallet_id = wallets.id)",
+				walletCreatedFromArchive,
+			},
+			Postgres: {
+				"alter table wallets add column created_at timestamptz",
+				"update wallets set created_at = (select min(date) from wallet_transactions where from_wallet_id = wallets.id or to_wallet_id = wallets.id)",
+				walletCreatedFromArchive,
+			},
+			MySQL: {
+				"alter table wallets add column created_at timestamp(6) null",
+				"update wallets set created_at = (select min(date) from wallet_transactions where from_wallet_id = wallets.id or to_wallet_id = wallets.id)",
+				walletCreatedFromArchive,
+			},
+		},
+		Down: map[string][]string{
+			SQLite:   {"alter table wallets drop column created_at"},
+			Postgres: {"alter table wallets drop column created_at"},
+			MySQL:    {"alter table wallets drop column created_at"},
+		},
+	},
+	{
+		Version: 17,
+		Name:    "transfer queue",
+		Up: map[string][]string{
+			SQLite: {`
+	create table transfer_queue (
+		id integer not null primary key autoincrement,
+		from_wallet_id text not null,
+		to_wallet_id text not null,
+		amount_cents integer not null,
+		status text not null,
+		failure_reason text,
+		created_at timestamp not null,
+		processed_at timestamp,
+		from_balance_after_cents integer
+		);
+`, transferQueueIndex},
+			Postgres: {`
+	create table transfer_queue (
+		id bigserial not null primary key,
+		from_wallet_id text not null,
+		to_wallet_id text not null,
+		amount_cents bigint not null,
+		status text not null,
+		failure_reason text,
+		created_at timestamptz not null,
+		processed_at timestamptz,
+		from_balance_after_cents bigint
+		);
+`, transferQueueIndex},
+			MySQL: {`
+	create table transfer_queue (
+		id bigint not null auto_increment primary key,
+		from_wallet_id varchar(64) not null,
+		to_wallet_id varchar(64) not null,
+		amount_cents bigint not null,
+		status varchar(16) not null,
+		failure_reason text,
+		created_at timestamp(6) not null,
+		processed_at timestamp(6) null,
+		from_balance_after_cents bigint
+		) engine=InnoDB;
+`, transferQueueIndex},
+		},
+		Down: map[string][]string{
+			SQLite:   {"drop table transfer_queue"},
+			Postgres: {"drop table transfer_queue"},
+			MySQL:    {"drop table transfer_queue"},
+		},
+	},
+}
+
+// walletCreatedFromArchive moves created_at back to the first archived
+// transaction of a wallet, archived ones being older.
+const walletCreatedFromArchive = `update wallets set created_at = (select min(date) from wallet_transactions_archive
+	where from_wallet_id = wallets.id or to_wallet_id = wallets.id)
+	where exists (select 1 from wallet_transactions_archive a
+		where (a.from_wallet_id = wallets.id or a.to_wallet_id = wallets.id)
+		and (wallets.created_at is null or a.date < wallets.created_at))`
+
+// balanceAfterColumns adds, with type typ, or drops the columns of the
+// balances after a transaction in wallet_transactions and its archive.
+func balanceAfterColumns(op, typ string) []string {
+	var statements []string
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		for _, column := range []string{"from_balance_after_cents", "to_balance_after_cents"} {
+			statements = append(statements, strings.TrimSpace(fmt.Sprintf("alter table %s %s column %s %s", table, op, column, typ)))
+		}
+	}
+	return statements
+}
+
+// transactionSides are the column names of both sides of a transaction and
+// the infix of the names of their indexes.
+type transactionSides struct {
+	fromColumn, toColumn string
+	fromIndex, toIndex   string
+}
+
+var (
+	transactionSidesOld = transactionSides{"author_id", "sender_id", "author", "sender"}
+	transactionSidesNew = transactionSides{"from_wallet_id", "to_wallet_id", "from", "to"}
+)
+
+// renameTransactionSides renames the side columns of wallet_transactions
+// and its archive, and their date indexes along with them. SQLite can't
+// rename an index, so there they are created again.
+func renameTransactionSides(driver string, old, renamed transactionSides) []string {
+	var statements []string
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		columns := [][2]string{{old.fromColumn, renamed.fromColumn}, {old.toColumn, renamed.toColumn}}
+		indexes := [][2]string{
+			{table + "_" + old.fromIndex + "_date", table + "_" + renamed.fromIndex + "_date"},
+			{table + "_" + old.toIndex + "_date", table + "_" + renamed.toIndex + "_date"},
+		}
+		for _, c := range columns {
+			statements = append(statements, fmt.Sprintf("alter table %s rename column %s to %s", table, c[0], c[1]))
+		}
+		for i, idx := range indexes {
+			switch driver {
+			case SQLite:
+				statements = append(statements,
+					"drop index "+idx[0],
+					fmt.Sprintf("create index %s on %s (%s, date)", idx[1], table, columns[i][1]))
+			case Postgres:
+				statements = append(statements, fmt.Sprintf("alter index %s rename to %s", idx[0], idx[1]))
+			case MySQL:
+				statements = append(statements, fmt.Sprintf("alter table %s rename index %s to %s", table, idx[0], idx[1]))
+			}
+		}
+	}
+	return statements
+}
+
+// webhooksIndex finds the subscriptions of a wallet.
+const webhooksIndex = "create index webhooks_wallet on webhooks (wallet_id)"
+
+// webhookDeliveriesIndex serves the delivery history of a subscription and
+// the check whether an event already reached it.
+const webhookDeliveriesIndex = "create index webhook_deliveries_webhook_event on webhook_deliveries (webhook_id, event_id)"
+
+// outboxIndex finds the due events of the dispatcher.
+const outboxIndex = "create index outbox_status_next on outbox (status, next_attempt_at)"
+
+// transferQueueIndex finds the queued transfers in the order they came in.
+const transferQueueIndex = "create index transfer_queue_status on transfer_queue (status, id)"
+
+var dropTransactionStatus = []string{
+	"delete from wallet_transactions where status <> 'completed'",
+	"delete from wallet_transactions_archive where status <> 'completed'",
+	"alter table wallet_transactions drop column status",
+	"alter table wallet_transactions drop column failure_reason",
+	"alter table wallet_transactions_archive drop column status",
+	"alter table wallet_transactions_archive drop column failure_reason",
+}
+
+// archiveIndexes support history lookups that include archived transactions.
+var archiveIndexes = []string{
+	"create index wallet_transactions_archive_author_date on wallet_transactions_archive (author_id, date)",
+	"create index wallet_transactions_archive_sender_date on wallet_transactions_archive (sender_id, date)",
+}
+
+var unarchive = []string{
+	`insert into wallet_transactions(author_id, sender_id, amount_cents, date)
+		select author_id, sender_id, amount_cents, date from wallet_transactions_archive`,
+	"drop table wallet_transactions_archive",
+}
+
+// transactionIndexes support history lookups by either side of a transfer,
+// ordered or ranged by date.
+var transactionIndexes = []string{
+	"create index wallet_transactions_author_date on wallet_transactions (author_id, date)",
+	"create index wallet_transactions_sender_date on wallet_transactions (sender_id, date)",
+	"create index wallet_transactions_date on wallet_transactions (date)",
+}
+
+// initialSchema is the schema as it was before migrations existed.
+// The foreign keys use the default (restrict) action, so a wallet that
+// still has transactions can't be deleted. It uses
+// "if not exists" so that databases created by older versions can be
+// adopted as version 1 by simply running it.
+var initialSchema = map[string][]string{
+	SQLite: {
+		`
+	create table if not exists wallets (
+		id text not null primary key, 
+		balance decimal not null
+		);
+`,
+		`
+	create table if not exists wallet_transactions (
+		author_id text not null, 
+		sender_id text not null, 
+		balance decimal not null,
+		date timestamp not null,
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		);
+`,
+		`
+	create table if not exists settings (
+		key text not null primary key,
+		value text not null
+		);
+`,
+	},
+	Postgres: {
+		`
+	create table if not exists wallets (
+		id text not null primary key,
+		balance numeric not null
+		);
+`,
+		`
+	create table if not exists wallet_transactions (
+		author_id text not null,
+		sender_id text not null,
+		balance numeric not null,
+		date timestamptz not null,
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		);
+`,
+		`
+	create table if not exists settings (
+		key text not null primary key,
+		value text not null
+		);
+`,
+	},
+	MySQL: {
+		`
+	create table if not exists wallets (
+		id varchar(64) not null primary key,
+		balance decimal(36,18) not null
+		) engine=InnoDB;
+`,
+		`
+	create table if not exists wallet_transactions (
+		author_id varchar(64) not null,
+		sender_id varchar(64) not null,
+		balance decimal(36,18) not null,
+		date timestamp(6) not null default current_timestamp(6),
+
+		foreign key (author_id) references wallets (id),
+		foreign key (sender_id) references wallets (id)
+		) engine=InnoDB;
+`,
+		`
+	create table if not exists settings (
+		` + "`key`" + ` varchar(191) not null primary key,
+		value text not null
+		) engine=InnoDB;
+`,
+	},
+}
+
+// transactionDatesToUTC rewrites the dates of transactions written in the
+// server's local time in UTC. SQLite kept the offset of every date, so
+// they are only rewritten in UTC, which also makes them sort as text
+// again. PostgreSQL's timestamp columns dropped the offset and kept the
+// local wall clock, which is read as time.Local here: the migration must
+// run in the zone the service ran in. MySQL's driver already wrote them
+// in UTC.
+func transactionDatesToUTC(ctx context.Context, db *DB, tx *Tx) error {
+	var key, where string
+	switch db.Driver {
+	case SQLite:
+		key, where = "rowid", "rowid = ?"
+	case Postgres:
+		key, where = "ctid::text", "ctid = ?::tid"
+	default:
+		return nil
+	}
+	for _, table := range []string{"wallet_transactions", "wallet_transactions_archive"} {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("select %s, date from %s", key, table))
+		if err != nil {
+			return err
+		}
+		type dated struct {
+			key  string
+			date time.Time
+		}
+		var all []dated
+		for rows.Next() {
+			var d dated
+			if err := rows.Scan(&d.key, &d.date); err != nil {
+				rows.Close()
+				return err
+			}
+			all = append(all, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, d := range all {
+			date := d.date
+			if db.Driver == Postgres {
+				date = time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.Local)
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("update %s set date = ? where %s", table, where), date.UTC(), d.key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backfillMinorUnits fills the minor unit columns from the decimal ones and
+// verifies every converted value, failing the migration if an amount has
+// more decimal places than the scale can represent.
+func backfillMinorUnits(ctx context.Context, db *DB, tx *Tx) error {
+	factor := decimal.New(1, db.Scale).String()
+	for _, table := range []struct{ name, from, to string }{
+		{"wallets", "balance", "balance_cents"},
+		{"wallet_transactions", "balance", "amount_cents"},
+	} {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("update %s set %s = round(%s * %s)", table.name, table.to, table.from, factor))
+		if err != nil {
+			return err
+		}
+		if err := verifyMinorUnits(ctx, db, tx, table.name, table.from, table.to); err != nil {
+			return err
+		}
+	}
+	return db.putSetting(ctx, tx, "money_scale", fmt.Sprint(db.Scale))
+}
+
+// verifyMinorUnits compares every decimal value with its minor unit copy.
+func verifyMinorUnits(ctx context.Context, db *DB, tx *Tx, table, decimalColumn, minorColumn string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("select %s, %s from %s", decimalColumn, minorColumn, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var mismatches []string
+	for rows.Next() {
+		var value decimal.Decimal
+		var minor int64
+		if err := rows.Scan(&value, &minor); err != nil {
+			return err
+		}
+		if !db.FromMinor(minor).Equal(value) {
+			mismatches = append(mismatches, value.String())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		if len(mismatches) > 10 {
+			mismatches = append(mismatches[:10], "...")
+		}
+		return fmt.Errorf("%d values in %s.%s can't be represented with %d decimal places: %s",
+			len(mismatches), table, decimalColumn, db.Scale, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// restoreDecimalColumns is the reverse of backfillMinorUnits.
+func restoreDecimalColumns(ctx context.Context, db *DB, tx *Tx) error {
+	factor := decimal.New(1, db.Scale).String() + ".0"
+	for _, table := range []struct{ name, from, to string }{
+		{"wallets", "balance_cents", "balance"},
+		{"wallet_transactions", "amount_cents", "balance"},
+	} {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("update %s set %s = %s / %s", table.name, table.to, table.from, factor))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNonNegativeBalanceConstraint forbids balances going below zero.
+// Wallets left negative by versions that allowed it keep their balance,
+// migration 14 lets them receive money again. If there are any, the
+// constraint is added NOT VALID on PostgreSQL, so the rows already there
+// aren't checked, and NOT ENFORCED on MySQL, which can't skip them, until
+// migration 14 replaces it with triggers. SQLite can't add a CHECK to an
+// existing table, so there the same rule is enforced by triggers, which
+// never look at existing rows.
+func addNonNegativeBalanceConstraint(ctx context.Context, db *DB, tx *Tx) error {
+	var negative bool
+	err := tx.QueryRowContext(ctx, "select exists (select 1 from wallets where balance_cents < 0)").Scan(&negative)
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	switch db.Driver {
+	case SQLite:
+		statements = []string{
+			`create trigger wallets_balance_non_negative_insert before insert on wallets
+			when new.balance_cents < 0
+			begin select raise(abort, 'insufficient_funds'); end`,
+			`create trigger wallets_balance_non_negative_update before update of balance_cents on wallets
+			when new.balance_cents < 0
+			begin select raise(abort, 'insufficient_funds'); end`,
+		}
+	default:
+		stmt := "alter table wallets add constraint wallets_balance_non_negative check (balance_cents >= 0)"
+		switch {
+		case negative && db.Driver == Postgres:
+			stmt += " not valid"
+		case negative && db.Driver == MySQL:
+			stmt += " not enforced"
+		}
+		statements = []string{stmt}
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/shopspring/decimal"
+)
+
+// Money is stored as integer minor units (e.g. cents) so that comparisons,
+// sums and ordering in SQL are exact. DB.Scale is the number of decimal
+// places a minor unit represents; these helpers are the only place where
+// amounts cross between decimal.Decimal and the stored integers.
+
+var (
+	// ErrTooPrecise is returned for amounts with more decimal places than the scale.
+	ErrTooPrecise = errors.New("amount has more decimal places than supported")
+	// ErrOutOfRange is returned for amounts that don't fit the storage type.
+	ErrOutOfRange = errors.New("amount is out of range")
+)
+
+// ToMinor converts an amount to minor units.
+func (db *DB) ToMinor(d decimal.Decimal) (int64, error) {
+	shifted := d.Shift(db.Scale)
+	if !shifted.IsInteger() {
+		return 0, ErrTooPrecise
+	}
+	if !shifted.BigInt().IsInt64() {
+		return 0, ErrOutOfRange
+	}
+	return shifted.IntPart(), nil
+}
+
+// Rounding modes of DB.Rounding.
+const (
+	// RoundHalfUp rounds ties away from zero: 0.005 to 0.01, -0.005 to -0.01.
+	RoundHalfUp = "half_up"
+	// RoundHalfEven rounds ties to the even neighbour: 0.005 to 0.00,
+	// 0.015 to 0.02.
+	RoundHalfEven = "half_even"
+)
+
+// ToMinorRounded converts an amount the service computed, such as a fee,
+// a conversion or interest, to minor units. It is the one place such
+// amounts are rounded to the scale, with db.Rounding, so they are rounded
+// once and always the same way. Amounts clients send aren't rounded but
+// refused by ToMinor.
+func (db *DB) ToMinorRounded(d decimal.Decimal) (int64, error) {
+	if db.Rounding == RoundHalfEven {
+		d = d.RoundBank(db.Scale)
+	} else {
+		d = d.Round(db.Scale)
+	}
+	return db.ToMinor(d)
+}
+
+// FromMinor converts minor units back to an amount.
+func (db *DB) FromMinor(v int64) decimal.Decimal {
+	return decimal.New(v, -db.Scale)
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestToMinor(t *testing.T) {
+	tests := []struct {
+		scale  int32
+		amount string
+		minor  int64
+		err    error
+	}{
+		{2, "0", 0, nil},
+		{2, "0.01", 1, nil},
+		{2, "-0.01", -1, nil},
+		{2, "0.1", 10, nil},
+		{2, "1.10", 110, nil},
+		{2, "1.100000", 110, nil},
+		{2, "100", 10000, nil},
+		{2, "92233720368547758.07", 1<<63 - 1, nil},
+		{2, "-92233720368547758.08", -1 << 63, nil},
+		{2, "92233720368547758.08", 0, ErrOutOfRange},
+		{2, "0.001", 0, ErrTooPrecise},
+		{2, "0.0000000000000000001", 0, ErrTooPrecise},
+		{0, "12", 12, nil},
+		{0, "0.5", 0, ErrTooPrecise},
+		{3, "0.001", 1, nil},
+		{3, "1.2345", 0, ErrTooPrecise},
+	}
+	for _, tt := range tests {
+		db := &DB{Scale: tt.scale}
+		minor, err := db.ToMinor(decimal.RequireFromString(tt.amount))
+		if !errors.Is(err, tt.err) || minor != tt.minor {
+			t.Errorf("scale %d: ToMinor(%s) = %d, %v, want %d, %v", tt.scale, tt.amount, minor, err, tt.minor, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// and back, to the same value
+		if back := db.FromMinor(minor); !back.Equal(decimal.RequireFromString(tt.amount)) {
+			t.Errorf("scale %d: FromMinor(%d) = %s, want %s", tt.scale, minor, back, tt.amount)
+		}
+	}
+}
+
+func TestToMinorRounded(t *testing.T) {
+	tests := []struct {
+		amount           string
+		halfUp, halfEven int64
+	}{
+		{"0.005", 1, 0},
+		{"0.015", 2, 2},
+		{"0.025", 3, 2},
+		{"-0.005", -1, 0},
+		{"0.0049999", 0, 0},
+		{"1.234", 123, 123},
+	}
+	for _, tt := range tests {
+		amount := decimal.RequireFromString(tt.amount)
+		for _, r := range []struct {
+			rounding string
+			want     int64
+		}{{"", tt.halfUp}, {RoundHalfUp, tt.halfUp}, {RoundHalfEven, tt.halfEven}} {
+			db := &DB{Scale: 2, Rounding: r.rounding}
+			got, err := db.ToMinorRounded(amount)
+			if err != nil || got != r.want {
+				t.Errorf("%q: ToMinorRounded(%s) = %d, %v, want %d", r.rounding, tt.amount, got, err, r.want)
+			}
+		}
+	}
+}
+
+// TestRoundingPolicy locks in the rounding of computed amounts at scales
+// 2 and 3: ties, negative amounts, amounts already exact, which rounding
+// again leaves as they are, and amounts out of range.
+func TestRoundingPolicy(t *testing.T) {
+	tests := []struct {
+		scale            int32
+		amount           string
+		halfUp, halfEven int64
+		err              error
+	}{
+		{2, "0.005", 1, 0, nil},
+		{2, "0.015", 2, 2, nil},
+		{2, "-0.005", -1, 0, nil},
+		{2, "-0.015", -2, -2, nil},
+		{2, "-0.025", -3, -2, nil},
+		{2, "10.25", 1025, 1025, nil},
+		{2, "-10.25", -1025, -1025, nil},
+		{2, "33.333333333333", 3333, 3333, nil},
+		{2, "66.666666666666", 6667, 6667, nil},
+		{3, "0.0005", 1, 0, nil},
+		{3, "0.0015", 2, 2, nil},
+		{0, "2.5", 3, 2, nil},
+		{2, "1e30", 0, 0, ErrOutOfRange},
+	}
+	for _, tt := range tests {
+		for _, r := range []struct {
+			rounding string
+			want     int64
+		}{{RoundHalfUp, tt.halfUp}, {RoundHalfEven, tt.halfEven}} {
+			db := &DB{Scale: tt.scale, Rounding: r.rounding}
+			got, err := db.ToMinorRounded(decimal.RequireFromString(tt.amount))
+			if !errors.Is(err, tt.err) || got != r.want {
+				t.Errorf("%s at scale %d: ToMinorRounded(%s) = %d, %v, want %d, %v", r.rounding, tt.scale, tt.amount, got, err, r.want, tt.err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			// rounded once: the result is exact, and rounding it again changes nothing
+			again, err := db.ToMinorRounded(db.FromMinor(got))
+			if err != nil || again != got {
+				t.Errorf("%s at scale %d: rounding %s twice gives %d, %v", r.rounding, tt.scale, tt.amount, again, err)
+			}
+			if exact, err := db.ToMinor(db.FromMinor(got)); err != nil || exact != got {
+				t.Errorf("%s at scale %d: %d isn't exact: %v", r.rounding, tt.scale, got, err)
+			}
+		}
+	}
+}
+
+// openLegacyDB opens a SQLite database migrated up to the last version
+// that still stored money as decimals.
+func openLegacyDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	steps, err := db.Plan(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Apply(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMinorUnitBackfill(t *testing.T) {
+	db := openLegacyDB(t)
+	ctx := context.Background()
+	// values that a float can't hold exactly
+	balances := map[string]string{"AAAAAA": "0.3", "BBBBBB": "0.1", "CCCCCC": "12345678.91", "DDDDDD": "100"}
+	for id, balance := range balances {
+		if _, err := db.ExecContext(ctx, "insert into wallets(id, balance) values(?, ?)", id, balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, "insert into wallet_transactions(author_id, sender_id, balance, date) values(?, ?, ?, ?)",
+		"AAAAAA", "BBBBBB", "0.07", testTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for id, balance := range balances {
+		if got := balanceOf(t, db, id); got.String() != balance {
+			t.Errorf("%s: balance %s after the backfill, want %s", id, got, balance)
+		}
+	}
+	history, err := db.History(ctx, "AAAAAA", HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Amount.String() != "0.07" {
+		t.Fatalf("history after the backfill: %+v", history)
+	}
+}
+
+func TestMinorUnitBackfillRefusesTooPrecise(t *testing.T) {
+	db := openLegacyDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "insert into wallets(id, balance) values(?, ?)", "AAAAAA", "0.005"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Migrate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "can't be represented with 2 decimal places: 0.005") {
+		t.Fatalf("Migrate = %v, want the value it can't convert", err)
+	}
+	// the failed migration left the decimal column as it was
+	if version, err := db.SchemaVersion(ctx); err != nil || version != 2 {
+		t.Fatalf("schema version %d, %v, want 2", version, err)
+	}
+}
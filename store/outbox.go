@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// Event types written to the outbox.
+const (
+	EventTransferCompleted = "transfer.completed"
+)
+
+// Outbox statuses. An event is pending until every sink took it, and dead
+// once it ran out of attempts; dead events wait for RedriveEvent.
+const (
+	EventPending = "pending"
+	EventSent    = "sent"
+	EventDead    = "dead"
+)
+
+// ErrEventNotFound is returned by RedriveEvent for ids that aren't dead events.
+var ErrEventNotFound = errors.New("no dead event with this id")
+
+// Event is a row of the outbox: something that happened, committed
+// together with the change it describes and delivered afterwards.
+type Event struct {
+	Id            int64           `json:"id"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	// Trace is the trace context of the request that caused the event,
+	// for its deliveries to continue it.
+	Trace tracectx.Trace `json:"-"`
+}
+
+// TransferEvent is the payload of EventTransferCompleted.
+type TransferEvent struct {
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Amount      decimal.Decimal `json:"amount"`
+	Time        time.Time       `json:"time"`
+	FromBalance decimal.Decimal `json:"from_balance"`
+	ToBalance   decimal.Decimal `json:"to_balance"`
+}
+
+const eventColumns = "id, type, payload, created_at, status, attempts, next_attempt_at, last_error, traceparent, tracestate"
+
+// addEvent writes an event inside tx, so that it exists exactly when the
+// change it describes was committed. It keeps the trace of ctx, or starts
+// one.
+func addEvent(ctx context.Context, tx *Tx, eventType string, payload any, at time.Time) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	t, ok := tracectx.FromContext(ctx)
+	if !ok {
+		t = tracectx.New()
+	}
+	_, err = tx.ExecContext(ctx, "insert into outbox(type, payload, created_at, status, attempts, next_attempt_at, traceparent, tracestate) values(?, ?, ?, ?, 0, ?, ?, ?)",
+		eventType, string(b), at.UTC(), EventPending, at.UTC(), t.Parent(), t.State)
+	return err
+}
+
+func scanEvent(rows *sql.Rows) (Event, error) {
+	var e Event
+	var payload string
+	var lastError, traceparent, tracestate sql.NullString
+	err := rows.Scan(&e.Id, &e.Type, &payload, &e.CreatedAt, &e.Status, &e.Attempts, &e.NextAttemptAt, &lastError, &traceparent, &tracestate)
+	e.Payload = json.RawMessage(payload)
+	e.LastError = lastError.String
+	e.Trace, _ = tracectx.Parse(traceparent.String, tracestate.String)
+	return e, err
+}
+
+func (db *DB) queryEvents(ctx context.Context, query string, args ...any) ([]Event, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// DueEvents returns up to limit pending events whose next attempt is due
+// at now, oldest first.
+func (db *DB) DueEvents(ctx context.Context, now time.Time, limit int) ([]Event, error) {
+	return db.queryEvents(ctx, "select "+eventColumns+" from outbox where status = ? and next_attempt_at <= ? order by id limit ?",
+		EventPending, now, limit)
+}
+
+// eventsWithStatus is the from clause shared by Events and CountEvents.
+const eventsWithStatus = " from outbox where status = ?"
+
+// Events returns up to limit events with status, newest first.
+func (db *DB) Events(ctx context.Context, status string, limit int) ([]Event, error) {
+	return db.queryEvents(ctx, "select "+eventColumns+eventsWithStatus+" order by id desc limit ?", status, limit)
+}
+
+// CountEvents returns how many events have status.
+func (db *DB) CountEvents(ctx context.Context, status string) (int64, error) {
+	var count int64
+	err := db.QueryRowContext(ctx, "select count(*)"+eventsWithStatus, status).Scan(&count)
+	return count, err
+}
+
+// MarkEventSent records that every sink took the event.
+func (db *DB) MarkEventSent(ctx context.Context, id int64, at time.Time) error {
+	_, err := db.ExecContext(ctx, "update outbox set status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = null where id = ?",
+		EventSent, at, id)
+	return err
+}
+
+// MarkEventFailed records a failed attempt. The event is tried again at
+// next, or becomes dead when dead is set.
+func (db *DB) MarkEventFailed(ctx context.Context, id int64, next time.Time, dead bool, reason string) error {
+	status := EventPending
+	if dead {
+		status = EventDead
+	}
+	_, err := db.ExecContext(ctx, "update outbox set status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = ? where id = ?",
+		status, next, reason, id)
+	return err
+}
+
+// RedriveEvent makes a dead event pending again with a fresh set of
+// attempts, due at now.
+func (db *DB) RedriveEvent(ctx context.Context, id int64, now time.Time) error {
+	res, err := db.ExecContext(ctx, "update outbox set status = ?, attempts = 0, next_attempt_at = ? where id = ? and status = ?",
+		EventPending, now, id, EventDead)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+// PruneEvents deletes the sent events created before cutoff.
+func (db *DB) PruneEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "delete from outbox where status = ? and created_at < ?", EventSent, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The codes of a NotWritableError.
+const (
+	NotWritableMissing  = "database_missing"
+	NotWritableReadOnly = "database_read_only"
+	NotWritableCantOpen = "database_cant_open"
+)
+
+// NotWritableError is a database that can't take writes for a reason an
+// operator can fix, as told by CheckWritable.
+type NotWritableError struct {
+	// Code is one of the NotWritable constants.
+	Code string
+	// Reason says what is wrong and what to do about it, without the
+	// path, so that it can be shown to clients.
+	Reason string
+	// Path is the SQLite file, empty for the other databases.
+	Path string
+	Err  error
+}
+
+func (e *NotWritableError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Reason, e.Err)
+}
+
+func (e *NotWritableError) Unwrap() error { return e.Err }
+
+// CheckWritable makes sure the database takes writes: it pings it, then
+// records a probe in schema_migrations and rolls it back, so nothing is
+// left behind. The usual reasons for it failing are returned as a
+// *NotWritableError, from the ping too: SQLite sets the journal mode as
+// it connects, which a read-only or unopenable file already refuses.
+func (db *DB) CheckWritable(ctx context.Context) error {
+	// first, as the first connection creates a new SQLite file
+	if err := db.PingContext(ctx); err != nil {
+		return db.notWritable(err)
+	}
+	// a SQLite file removed while it is open still takes writes, which
+	// are lost with the last handle on it
+	if db.Path != "" {
+		if _, err := os.Stat(db.Path); errors.Is(err, os.ErrNotExist) {
+			return &NotWritableError{NotWritableMissing, "the database file was removed or renamed while the server runs, restart it to open it again", db.Path, err}
+		}
+	}
+	if _, err := db.DB.ExecContext(ctx, migrationsTableCreateSql); err != nil {
+		return db.notWritable(err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return db.notWritable(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "insert into schema_migrations(version, name, applied_at) values(?, ?, ?)",
+		-1, "write probe", time.Now().UTC())
+	return db.notWritable(err)
+}
+
+// Probe checks that the database answers queries: it pings it and reads
+// from it, as pinging SQLite doesn't touch the file. A SQLite file that
+// was removed fails it, although the connections still open can read it.
+func (db *DB) Probe(ctx context.Context) error {
+	if db.Path != "" {
+		if _, err := os.Stat(db.Path); err != nil {
+			return err
+		}
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+	var n int
+	return db.QueryRowContext(ctx, "select count(*) from schema_migrations").Scan(&n)
+}
+
+// defaultIdleConns is how many idle connections database/sql keeps unless
+// told otherwise, what RestorePool goes back to.
+const defaultIdleConns = 2
+
+// ResetPool closes the idle connections and keeps none until RestorePool,
+// so that every statement gets a new connection and those in use are
+// closed when they are done. It is how a connection broken by the
+// database going away recovers once it is back. It does nothing and
+// returns false for an in-memory SQLite database, which is gone with its
+// connections, and for a SQLite file that is missing, which new
+// connections would create empty.
+func (db *DB) ResetPool() bool {
+	if db.Driver == SQLite {
+		if db.Path == "" {
+			return false
+		}
+		if _, err := os.Stat(db.Path); err != nil {
+			return false
+		}
+	}
+	db.SetMaxIdleConns(0)
+	return true
+}
+
+// RestorePool keeps idle connections again after ResetPool.
+func (db *DB) RestorePool() {
+	db.SetMaxIdleConns(defaultIdleConns)
+}
+
+// notWritable turns the driver errors of a database that refuses writes
+// into a *NotWritableError and returns any other err as it is.
+func (db *DB) notWritable(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.ExtendedCode == sqlite3.ErrReadonlyDbMoved:
+			return &NotWritableError{NotWritableMissing, "the database file was removed or renamed while the server runs, restart it to open it again", db.Path, err}
+		case sqliteErr.Code == sqlite3.ErrReadonly, sqliteErr.Code == sqlite3.ErrPerm:
+			return &NotWritableError{NotWritableReadOnly, "the database file or its directory is read-only, give the service's user write access to both and check that the filesystem isn't mounted read-only", db.Path, err}
+		case sqliteErr.Code == sqlite3.ErrCantOpen:
+			return &NotWritableError{NotWritableCantOpen, "SQLite can't open the database file or its journal next to it, check that both the file and its directory exist and are writable by the service's user", db.Path, err}
+		}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "25006" { // read_only_sql_transaction
+		return &NotWritableError{NotWritableReadOnly, "the database is read-only, such as a standby or one with default_transaction_read_only", "", err}
+	}
+	var mysqlErr *mysql.MySQLError
+	// ER_OPTION_PREVENTS_STATEMENT is what read_only gives
+	if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1290 || mysqlErr.Number == 1792) {
+		return &NotWritableError{NotWritableReadOnly, "the database is read-only, such as a replica or a server started with read_only", "", err}
+	}
+	return err
+}
+
+// fileNotWritable classifies an error opening a SQLite file for writing
+// before SQLite gets to it, see prepareSQLiteFile.
+func fileNotWritable(path string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return &NotWritableError{NotWritableReadOnly, "the database file is on a filesystem mounted read-only", path, err}
+	case errors.Is(err, os.ErrPermission):
+		return &NotWritableError{NotWritableReadOnly, "the database file is read-only, give the service's user write access to it", path, err}
+	}
+	return fmt.Errorf("database file %s is not writable: %w", path, err)
+}
+
+// LatestTransactionDate returns the date of the newest transaction that
+// isn't archived, the zero time when there is none.
+func (db *DB) LatestTransactionDate(ctx context.Context) (time.Time, error) {
+	var date sql.NullTime
+	err := db.QueryRowContext(ctx, "select date from wallet_transactions order by date desc limit 1").Scan(&date)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return date.Time, err
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckWritable reproduces the usual reasons a SQLite database can't
+// be written and checks each gets its own code. Permissions don't stop
+// root, so those cases only run as another user.
+func TestCheckWritable(t *testing.T) {
+	tests := []struct {
+		name string
+		// open returns the database to check, or the error opening it
+		open     func(t *testing.T, dir string) (*DB, error)
+		code     string
+		needUser bool
+	}{
+		{"writable", func(t *testing.T, dir string) (*DB, error) {
+			return openTestDB(t, filepath.Join(dir, "wallets.db")), nil
+		}, "", false},
+		{"read-only", func(t *testing.T, dir string) (*DB, error) {
+			path := filepath.Join(dir, "wallets.db")
+			openTestDB(t, path).Close()
+			return Open("file:" + path + "?mode=ro")
+		}, NotWritableReadOnly, false},
+		// refused as SQLite connects, when it sets the journal mode
+		{"read-only and empty", func(t *testing.T, dir string) (*DB, error) {
+			path := filepath.Join(dir, "wallets.db")
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			return Open("file:" + path + "?mode=ro")
+		}, NotWritableReadOnly, false},
+		{"can't open", func(t *testing.T, dir string) (*DB, error) {
+			return Open("file:" + filepath.Join(dir, "wallets.db") + "?mode=rw")
+		}, NotWritableCantOpen, false},
+		{"removed while open", func(t *testing.T, dir string) (*DB, error) {
+			path := filepath.Join(dir, "wallets.db")
+			db := openTestDB(t, path)
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(path + suffix)
+			}
+			return db, nil
+		}, NotWritableMissing, false},
+		{"file without write permission", func(t *testing.T, dir string) (*DB, error) {
+			path := filepath.Join(dir, "wallets.db")
+			openTestDB(t, path).Close()
+			if err := os.Chmod(path, 0o444); err != nil {
+				t.Fatal(err)
+			}
+			return Open(path)
+		}, NotWritableReadOnly, true},
+		{"missing in a read-only directory", func(t *testing.T, dir string) (*DB, error) {
+			if err := os.Chmod(dir, 0o555); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chmod(dir, 0o755) })
+			return Open(filepath.Join(dir, "wallets.db"))
+		}, NotWritableCantOpen, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.needUser && os.Geteuid() == 0 {
+				t.Skip("root ignores permissions")
+			}
+			db, err := tt.open(t, t.TempDir())
+			if err == nil {
+				t.Cleanup(func() { db.Close() })
+				err = db.CheckWritable(context.Background())
+			}
+			if tt.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var probes int
+				if err := db.QueryRow("select count(*) from schema_migrations where version = -1").Scan(&probes); err != nil || probes != 0 {
+					t.Fatalf("%d probes left behind, %v", probes, err)
+				}
+				return
+			}
+			var notWritable *NotWritableError
+			if !errors.As(err, &notWritable) || notWritable.Code != tt.code || notWritable.Reason == "" {
+				t.Fatalf("error %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+// TestProbe checks that a probe fails once the database file is gone,
+// which pinging alone doesn't notice, and that the pool is only reset
+// where new connections find the same database.
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	if err := db.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !db.ResetPool() {
+		t.Fatal("the pool of a file database wasn't reset")
+	}
+	db.RestorePool()
+	if err := db.Probe(ctx); err != nil {
+		t.Fatalf("after a reset: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := db.Probe(canceled); err == nil {
+		t.Fatal("a canceled probe passed")
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(db.Path + suffix)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Probe(ctx); err == nil {
+		t.Fatal("the probe passed without the file")
+	}
+	if db.ResetPool() {
+		t.Fatal("the pool was reset without the file")
+	}
+
+	memory, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	if memory.ResetPool() {
+		t.Fatal("the pool of an in-memory database was reset")
+	}
+}
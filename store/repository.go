@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Domain errors returned by WalletRepository. Handlers map them to HTTP
+// status codes; anything else is an internal error.
+var (
+	ErrNotFound          = errors.New("wallet not found")
+	ErrRecipientNotFound = errors.New("recipient wallet not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidAmount     = errors.New("transfer would leave the recipient with a non-positive balance")
+	ErrDuplicateID       = errors.New("wallet id already exists")
+	ErrConflict          = errors.New("a wallet changed during the transfer")
+)
+
+// HistoryFilter narrows down the transactions returned by History.
+// The zero value returns all transactions that aren't archived.
+type HistoryFilter struct {
+	// IncludeArchived adds the transactions moved to the archive table,
+	// see ArchiveTransactions.
+	IncludeArchived bool
+	// Status, when set, only returns transactions with that status.
+	Status string
+	// Counterparty, when set, only returns the transactions with that
+	// wallet, in either direction. The wallet itself gives its self
+	// transfers.
+	Counterparty string
+	// Limit, when positive, only returns that many of the newest
+	// transactions.
+	Limit int
+	// Offset skips that many of the newest transactions first. It is
+	// only used with a Limit.
+	Offset int
+}
+
+// WalletRepository is the storage the HTTP handlers depend on.
+type WalletRepository interface {
+	// GetWallet returns ErrNotFound for unknown ids.
+	GetWallet(ctx context.Context, id string) (Wallet, error)
+	// CreateWallet returns ErrDuplicateID when the id is taken.
+	CreateWallet(ctx context.Context, w Wallet) error
+	// Transfer moves amount from one wallet to another and records it
+	// with at as its date.
+	Transfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (Transaction, error)
+	// History returns ErrNotFound for unknown ids.
+	History(ctx context.Context, id string, filter HistoryFilter) ([]Transaction, error)
+	// EachHistory is History one transaction at a time.
+	EachHistory(ctx context.Context, id string, filter HistoryFilter, fn func(Transaction) error) error
+	// CountHistory counts History without its limit, ErrNotFound for
+	// unknown ids.
+	CountHistory(ctx context.Context, id string, filter HistoryFilter) (int64, error)
+	// EnqueueTransfer queues a transfer for the transfer queue, it returns
+	// ErrNotFound for an unknown sender.
+	EnqueueTransfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (QueuedTransfer, error)
+	// QueuedTransfer returns ErrTransferNotFound for ids that aren't
+	// queued transfers of the wallet from.
+	QueuedTransfer(ctx context.Context, from string, id int64) (QueuedTransfer, error)
+	// TransactionCount returns 0 for unknown ids.
+	TransactionCount(ctx context.Context, id string) (int64, error)
+}
+
+var _ WalletRepository = (*DB)(nil)
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// GetSetting returns the stored value for key and whether it was present.
+func (db *DB) GetSetting(key string) (string, bool, error) {
+	query := "select value from settings where key = ?"
+	if db.Driver == MySQL {
+		// key is a reserved word in MySQL
+		query = "select value from settings where `key` = ?"
+	}
+	var value string
+	err := db.QueryRow(query, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// PutSetting stores value under key, replacing any previous value.
+func (db *DB) PutSetting(key, value string) error {
+	_, err := db.Exec(db.putSettingQuery(), key, value)
+	return err
+}
+
+// putSetting is PutSetting inside a transaction.
+func (db *DB) putSetting(ctx context.Context, tx *Tx, key, value string) error {
+	_, err := tx.ExecContext(ctx, db.putSettingQuery(), key, value)
+	return err
+}
+
+func (db *DB) putSettingQuery() string {
+	if db.Driver == MySQL {
+		return "insert into settings(`key`, value) values(?, ?) on duplicate key update value = values(value)"
+	}
+	return "insert into settings(key, value) values(?, ?) on conflict(key) do update set value = excluded.value"
+}
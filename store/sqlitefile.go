@@ -0,0 +1,80 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sqliteMagic is the header every SQLite database file starts with.
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// sqlitePath returns the file a SQLite DSN points at, or "" for
+// in-memory databases.
+func sqlitePath(dsn string) string {
+	path, query, _ := strings.Cut(dsn, "?")
+	path = strings.TrimPrefix(path, "file:")
+	if path == "" || path == ":memory:" || strings.Contains(query, "mode=memory") {
+		return ""
+	}
+	return path
+}
+
+// prepareSQLiteFile makes sure the database file at path can be used:
+// missing parent directories are created, the file or directory must be
+// writable, and an existing non-empty file must be a SQLite database so
+// that a wrong path doesn't get clobbered. It returns the absolute path.
+func prepareSQLiteFile(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(abs)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", fmt.Errorf("create database directory: %w", err)
+	}
+
+	if info, err := os.Stat(abs); err == nil && info.IsDir() {
+		return "", fmt.Errorf("database path %s is a directory, not a file", abs)
+	}
+	f, err := os.OpenFile(abs, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// SQLite creates the file, check that it will be able to
+		probe, err := os.CreateTemp(dir, ".write-check-*")
+		if err != nil {
+			return "", &NotWritableError{NotWritableMissing, "the database file doesn't exist and its directory isn't writable, so it can't be created", abs, err}
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		return abs, nil
+	}
+	if err != nil {
+		return "", fileNotWritable(abs, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("database path %s is not a regular file", abs)
+	}
+	header := make([]byte, len(sqliteMagic))
+	n, err := io.ReadFull(f, header)
+	if n == 0 && err == io.EOF {
+		// an empty file is what SQLite leaves when nothing was written yet
+		return abs, nil
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("read database file %s: %w", abs, err)
+	}
+	if !bytes.Equal(header[:n], sqliteMagic) {
+		return "", fmt.Errorf("%s exists but is not a SQLite database, refusing to use it", abs)
+	}
+	return abs, nil
+}
@@ -0,0 +1,350 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testBackends are the databases the store tests run against. SQLite
+// always runs; the others run when their URL is set in the environment
+// and are emptied first, so point them at a database kept for the tests.
+var testBackends = []struct {
+	name string
+	env  string
+}{
+	{"sqlite", ""},
+	{"postgres", "STORE_TEST_POSTGRES_URL"},
+	{"mysql", "STORE_TEST_MYSQL_URL"},
+}
+
+// testTables are dropped, in this order, before the schema of a test
+// is migrated on a server database.
+var testTables = []string{
+	"webhook_deliveries", "webhooks", "outbox", "transfer_queue",
+	"wallet_transactions_archive", "wallet_transactions", "settings", "wallets",
+	"schema_migrations",
+}
+
+// forEachBackend runs fn as a subtest with a freshly migrated database of
+// each backend, skipping those without a URL.
+func forEachBackend(t *testing.T, fn func(t *testing.T, db *DB)) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			url := filepath.Join(t.TempDir(), "wallets.db")
+			if b.env != "" {
+				url = os.Getenv(b.env)
+				if url == "" {
+					t.Skipf("%s is not set", b.env)
+				}
+			}
+			fn(t, openTestDB(t, url))
+		})
+	}
+}
+
+// openTestDB opens and migrates the database at url, dropping the tables
+// of a server database first, and closes it when the test ends.
+func openTestDB(t *testing.T, url string) *DB {
+	t.Helper()
+	ctx := context.Background()
+	db, err := Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if db.Driver != SQLite {
+		for _, table := range testTables {
+			query := "drop table if exists " + table
+			if db.Driver == Postgres {
+				query += " cascade"
+			}
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+		}
+	}
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DetectReturning(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mustCreate creates wallets holding balance.
+func mustCreate(t *testing.T, db *DB, balance string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		w := Wallet{Id: id, Balance: decimal.RequireFromString(balance), CreatedAt: sql.NullTime{Time: testTime, Valid: true}}
+		if err := db.CreateWallet(context.Background(), w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// balanceOf returns the balance of the wallet id.
+func balanceOf(t *testing.T, db *DB, id string) decimal.Decimal {
+	t.Helper()
+	w, err := db.GetWallet(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Balance
+}
+
+func TestRebind(t *testing.T) {
+	query := "update wallets set balance_cents = ? where id = ? and balance_cents > ?"
+	if got := rebind(SQLite, query); got != query {
+		t.Errorf("sqlite: %s", got)
+	}
+	if got := rebind(MySQL, query); got != query {
+		t.Errorf("mysql: %s", got)
+	}
+	want := "update wallets set balance_cents = $1 where id = $2 and balance_cents > $3"
+	if got := rebind(Postgres, query); got != want {
+		t.Errorf("postgres: %s, want %s", got, want)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url, driver, dsn string
+	}{
+		{"postgres://u:p@db/wallets", Postgres, "postgres://u:p@db/wallets"},
+		{"postgresql://u:p@db/wallets?sslmode=disable", Postgres, "postgresql://u:p@db/wallets?sslmode=disable"},
+		{"data.db", SQLite, "data.db?_foreign_keys=on&_journal_mode=WAL&_loc=UTC"},
+		{"sqlite:///var/lib/wallets.db", SQLite, "/var/lib/wallets.db?_foreign_keys=on&_journal_mode=WAL&_loc=UTC"},
+		{"file:data.db?_fk=1&_journal=DELETE&_loc=auto", SQLite, "file:data.db?_fk=1&_journal=DELETE&_loc=auto"},
+	}
+	for _, tt := range tests {
+		driver, dsn := parseURL(tt.url)
+		if driver != tt.driver || dsn != tt.dsn {
+			t.Errorf("parseURL(%q) = %s %q, want %s %q", tt.url, driver, dsn, tt.driver, tt.dsn)
+		}
+	}
+}
+
+func TestBackendTransfer(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+		if err := db.CreateWallet(ctx, Wallet{Id: "AAAAAA", Balance: decimal.NewFromInt(1)}); !errors.Is(err, ErrDuplicateID) {
+			t.Fatalf("duplicate id: %v, want ErrDuplicateID", err)
+		}
+
+		tr, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString("12.34"), testTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tr.FromBalance.Decimal.Equal(decimal.RequireFromString("87.66")) || !tr.ToBalance.Decimal.Equal(decimal.RequireFromString("112.34")) {
+			t.Fatalf("balances after the transfer: %s %s", tr.FromBalance.Decimal, tr.ToBalance.Decimal)
+		}
+		if got := balanceOf(t, db, "AAAAAA"); !got.Equal(decimal.RequireFromString("87.66")) {
+			t.Fatalf("sender balance %s", got)
+		}
+		if got := balanceOf(t, db, "BBBBBB"); !got.Equal(decimal.RequireFromString("112.34")) {
+			t.Fatalf("recipient balance %s", got)
+		}
+
+		refused := []struct {
+			name     string
+			from, to string
+			amount   string
+			want     error
+		}{
+			{"unknown sender", "ZZZZZZ", "BBBBBB", "1", ErrNotFound},
+			{"unknown recipient", "AAAAAA", "ZZZZZZ", "1", ErrRecipientNotFound},
+			{"more than the balance", "AAAAAA", "BBBBBB", "87.66", ErrInsufficientFunds},
+			{"draining the recipient", "AAAAAA", "BBBBBB", "-112.34", ErrInvalidAmount},
+		}
+		for _, r := range refused {
+			_, err := db.Transfer(ctx, r.from, r.to, decimal.RequireFromString(r.amount), testTime)
+			if !errors.Is(err, r.want) {
+				t.Errorf("%s: %v, want %v", r.name, err, r.want)
+			}
+		}
+		// the refusals changed nothing
+		if got := balanceOf(t, db, "AAAAAA"); !got.Equal(decimal.RequireFromString("87.66")) {
+			t.Fatalf("sender balance after refusals %s", got)
+		}
+
+		history, err := db.History(ctx, "BBBBBB", HistoryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || history[0].FromId != "AAAAAA" || !history[0].Amount.Equal(decimal.RequireFromString("12.34")) ||
+			!history[0].Date.Time.Equal(testTime) || history[0].Status != StatusCompleted {
+			t.Fatalf("history = %+v", history)
+		}
+		if _, err := db.History(ctx, "ZZZZZZ", HistoryFilter{}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("history of an unknown wallet: %v", err)
+		}
+	})
+}
+
+// TestBackendTransferLocking runs the transfers of every backend through
+// the locking reads, which only MySQL uses otherwise.
+func TestBackendTransferLocking(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.Returning = false
+		ctx := context.Background()
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(40), testTime); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Transfer(ctx, "BBBBBB", "AAAAAA", decimal.NewFromInt(140), testTime); !errors.Is(err, ErrInsufficientFunds) {
+			t.Fatalf("more than the balance: %v", err)
+		}
+		if _, err := db.Transfer(ctx, "BBBBBB", "ZZZZZZ", decimal.NewFromInt(1), testTime); !errors.Is(err, ErrRecipientNotFound) {
+			t.Fatalf("unknown recipient: %v", err)
+		}
+		if _, err := db.Transfer(ctx, "ZZZZZZ", "BBBBBB", decimal.NewFromInt(1), testTime); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("unknown sender: %v", err)
+		}
+		// to itself: nothing moves, but the balance must cover the amount
+		tr, err := db.Transfer(ctx, "AAAAAA", "AAAAAA", decimal.NewFromInt(50), testTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tr.FromBalance.Decimal.Equal(decimal.NewFromInt(60)) || !tr.ToBalance.Decimal.Equal(decimal.NewFromInt(60)) {
+			t.Fatalf("balances of a self transfer: %s %s", tr.FromBalance.Decimal, tr.ToBalance.Decimal)
+		}
+		if got := balanceOf(t, db, "BBBBBB"); !got.Equal(decimal.NewFromInt(140)) {
+			t.Fatalf("recipient balance %s", got)
+		}
+	})
+}
+
+func TestBackendDecimalRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		balances := []string{"0.01", "0.1", "1", "100", "99999999.99"}
+		for i, b := range balances {
+			id := fmt.Sprintf("W%05d", i)
+			mustCreate(t, db, b, id)
+			w, err := db.GetWallet(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := decimal.RequireFromString(b)
+			if !w.Balance.Equal(want) || !w.Opening.Valid || !w.Opening.Decimal.Equal(want) {
+				t.Errorf("balance %s came back as %s, opening %v", b, w.Balance, w.Opening)
+			}
+			if w.Balance.StringFixed(2) != want.StringFixed(2) {
+				t.Errorf("balance %s formats as %s", b, w.Balance.StringFixed(2))
+			}
+		}
+
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+		// a tenth and a hundredth, which don't add up exactly as floats
+		for i, amount := range []string{"0.1", "0.01", "0.1", "0.01", "0.1"} {
+			at := testTime.Add(time.Duration(i) * time.Second)
+			if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString(amount), at); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := balanceOf(t, db, "AAAAAA"); got.String() != "99.68" {
+			t.Errorf("sender balance %s, want 99.68", got)
+		}
+		if got := balanceOf(t, db, "BBBBBB"); got.String() != "100.32" {
+			t.Errorf("recipient balance %s, want 100.32", got)
+		}
+		history, err := db.History(ctx, "AAAAAA", HistoryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum decimal.Decimal
+		for _, tr := range history {
+			sum = sum.Add(tr.Amount)
+		}
+		if sum.String() != "0.32" || history[0].FromBalance.Decimal.String() != "99.68" {
+			t.Errorf("history adds up to %s, last balance %s", sum, history[0].FromBalance.Decimal)
+		}
+
+		// more decimal places than a minor unit holds are refused, not rounded
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString("0.001"), testTime); !errors.Is(err, ErrTooPrecise) {
+			t.Errorf("0.001: %v, want ErrTooPrecise", err)
+		}
+
+		// the largest balance a minor unit column holds comes back byte for byte
+		mustCreate(t, db, "92233720368547758.07", "MAXXXX")
+		if got := balanceOf(t, db, "MAXXXX"); got.String() != "92233720368547758.07" {
+			t.Errorf("largest balance came back as %s", got)
+		}
+		for _, refused := range []struct {
+			balance string
+			err     error
+		}{
+			{"123456789.123456789", ErrTooPrecise},
+			{"92233720368547758.08", ErrOutOfRange},
+			{"123456789012345678901234567890", ErrOutOfRange},
+		} {
+			w := Wallet{Id: "REFUSE", Balance: decimal.RequireFromString(refused.balance)}
+			if err := db.CreateWallet(ctx, w); !errors.Is(err, refused.err) {
+				t.Errorf("balance %s: %v, want %v", refused.balance, err, refused.err)
+			}
+			if _, err := db.GetWallet(ctx, "REFUSE"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("balance %s was stored: %v", refused.balance, err)
+			}
+		}
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString("123456789.123456789"), testTime); !errors.Is(err, ErrTooPrecise) {
+			t.Errorf("123456789.123456789: %v, want ErrTooPrecise", err)
+		}
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.RequireFromString("123456789012345678901234567890"), testTime); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("huge amount: %v, want ErrOutOfRange", err)
+		}
+	})
+}
+
+// TestBackendOppositeTransfers sends between two wallets in both
+// directions at once through the locking reads. Locking in the order of
+// the ids, none of them may deadlock; a conflict reported by the database
+// is the only refusal allowed, and no money is made or lost.
+func TestBackendOppositeTransfers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if db.Driver == SQLite {
+			// locks the whole database, nothing to order
+			t.Skip("SQLite has no row locks")
+		}
+		db.Returning = false
+		ctx := context.Background()
+		mustCreate(t, db, "1000", "AAAAAA", "BBBBBB")
+
+		const n = 20
+		errs := make(chan error, 2*n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			for _, pair := range [][2]string{{"AAAAAA", "BBBBBB"}, {"BBBBBB", "AAAAAA"}} {
+				wg.Add(1)
+				go func(from, to string) {
+					defer wg.Done()
+					_, err := db.Transfer(ctx, from, to, decimal.NewFromInt(1), testTime)
+					errs <- err
+				}(pair[0], pair[1])
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil && !errors.Is(err, ErrConflict) {
+				t.Errorf("transfer: %v", err)
+			}
+		}
+		total := balanceOf(t, db, "AAAAAA").Add(balanceOf(t, db, "BBBBBB"))
+		if !total.Equal(decimal.NewFromInt(2000)) {
+			t.Fatalf("the wallets hold %s together, want 2000", total)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// DetectReturning sets db.Returning when the database supports
+// UPDATE ... RETURNING: PostgreSQL always does, SQLite since 3.35.0 and
+// MySQL not at all.
+func (db *DB) DetectReturning(ctx context.Context) error {
+	switch db.Driver {
+	case Postgres:
+		db.Returning = true
+	case SQLite:
+		var version string
+		if err := db.QueryRowContext(ctx, "select sqlite_version()").Scan(&version); err != nil {
+			return fmt.Errorf("read sqlite version: %w", err)
+		}
+		db.Returning = versionAtLeast(version, 3, 35)
+	default:
+		db.Returning = false
+	}
+	return nil
+}
+
+// versionAtLeast reports whether a dotted version string is at least major.minor.
+func versionAtLeast(version string, major, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	gotMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	gotMinor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+// Transfer moves amount from one wallet to another and records the
+// transaction as made at at, stored in UTC. Both balances must stay positive afterwards, which also
+// means a negative amount can't be used to drain the recipient. A recipient
+// that is already negative may stay negative, as a positive amount only
+// raises its balance; a sender that is negative can't send until it is
+// positive again.
+func (db *DB) Transfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (Transaction, error) {
+	return db.transfer(ctx, from, to, amount, at, nil)
+}
+
+// transfer is Transfer, calling commit, when set, with the transaction
+// just before it commits. An error from commit rolls the transfer back.
+func (db *DB) transfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time,
+	commit func(tx *Tx, t Transaction) error) (_ Transaction, err error) {
+	start := time.Now()
+	at = at.UTC()
+	defer func() { db.Metrics.observeTransfer(amount, start, err) }()
+
+	amountCents, err := db.ToMinor(amount)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	// after the commit, and after a failed one too, which may have committed
+	defer db.Balances.invalidate(from, to)
+
+	var fromCents, toCents int64
+	if db.Returning {
+		fromCents, toCents, err = db.transferReturning(ctx, tx, from, to, amountCents)
+	} else {
+		fromCents, toCents, err = db.transferLocking(ctx, tx, from, to, amount)
+	}
+	if err != nil {
+		err = transferError(err)
+		if errors.Is(err, ErrInsufficientFunds) && db.RecordFailures {
+			tx.Rollback()
+			db.recordFailure(ctx, from, to, amountCents, at, "insufficient_funds")
+		}
+		return Transaction{}, err
+	}
+
+	t := Transaction{
+		FromId:      from,
+		ToId:        to,
+		Amount:      amount,
+		Date:        sql.NullTime{Time: at, Valid: true},
+		Status:      StatusCompleted,
+		FromBalance: decimal.NewNullDecimal(db.FromMinor(fromCents)),
+		ToBalance:   decimal.NewNullDecimal(db.FromMinor(toCents)),
+	}
+	insertStart := time.Now()
+	_, err = tx.ExecContext(ctx, `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status,
+		from_balance_after_cents, to_balance_after_cents) values(?,?,?,?,?,?,?)`,
+		t.FromId, t.ToId, amountCents, t.Date.Time, t.Status, fromCents, toCents)
+	db.Metrics.observeStatement(stmtInsertTx, insertStart)
+	if err != nil {
+		return Transaction{}, transferError(err)
+	}
+	if db.RecordEvents {
+		err = addEvent(ctx, tx, EventTransferCompleted, TransferEvent{
+			From:        t.FromId,
+			To:          t.ToId,
+			Amount:      t.Amount,
+			Time:        t.Date.Time,
+			FromBalance: t.FromBalance.Decimal,
+			ToBalance:   t.ToBalance.Decimal,
+		}, at)
+		if err != nil {
+			return Transaction{}, fmt.Errorf("outbox: %w", err)
+		}
+	}
+	if commit != nil {
+		if err := commit(tx, t); err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Transaction{}, fmt.Errorf("commit: %w", err)
+	}
+	return t, nil
+}
+
+// recordFailure writes a failed transaction for a refused transfer. It is
+// best effort: failing to record the refusal must not change the answer
+// the client gets, which is the refusal itself.
+func (db *DB) recordFailure(ctx context.Context, from, to string, amountCents int64, at time.Time, reason string) {
+	db.ExecContext(ctx, `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status, failure_reason) values(?,?,?,?,?,?)`,
+		from, to, amountCents, at, StatusFailed, reason)
+}
+
+// transferError maps the constraint violations and deadlocks raised by the
+// statements of a transfer.
+func transferError(err error) error {
+	switch {
+	case IsCheckViolation(err):
+		// the database refused to make a balance negative, e.g. after a concurrent transfer
+		return ErrInsufficientFunds
+	case IsForeignKeyViolation(err):
+		// one of the wallets disappeared between the lookup and the write
+		return ErrConflict
+	case IsDeadlock(err):
+		// the database picked this transfer to roll back, retrying it is fine
+		return ErrConflict
+	}
+	return err
+}
+
+// transferReturning applies the transfer as two guarded updates that
+// return the new balances, so no row is read before it is written.
+// When a guard refuses the update the wallets are looked up to tell why.
+func (db *DB) transferReturning(ctx context.Context, tx *Tx, from, to string, amountCents int64) (fromCents, toCents int64, err error) {
+	start := time.Now()
+	err = tx.QueryRowContext(ctx, `update wallets set balance_cents = balance_cents - ?
+		where id = ? and balance_cents > ? returning balance_cents`,
+		amountCents, from, amountCents).Scan(&fromCents)
+	db.Metrics.observeStatement(stmtDebit, start)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := walletsExist(ctx, tx, from, to); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, ErrInsufficientFunds
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start = time.Now()
+	err = tx.QueryRowContext(ctx, `update wallets set balance_cents = balance_cents + ?
+		where id = ? and (balance_cents + ? > 0 or ? > 0) returning balance_cents`,
+		amountCents, to, amountCents, amountCents).Scan(&toCents)
+	db.Metrics.observeStatement(stmtCredit, start)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := walletsExist(ctx, tx, from, to); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, ErrInvalidAmount
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		fromCents = toCents
+	}
+	return fromCents, toCents, nil
+}
+
+// walletsExist returns ErrNotFound or ErrRecipientNotFound when one of
+// the wallets of a transfer doesn't exist, checking the sender first.
+func walletsExist(ctx context.Context, tx *Tx, from, to string) error {
+	for _, w := range []struct {
+		id      string
+		missing error
+	}{{from, ErrNotFound}, {to, ErrRecipientNotFound}} {
+		var one int
+		err := tx.QueryRowContext(ctx, "select 1 from wallets where id = ?", w.id).Scan(&one)
+		if errors.Is(err, sql.ErrNoRows) {
+			return w.missing
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockWallet reads a wallet inside tx, locking its row until the
+// transaction ends where the driver supports it.
+func (db *DB) lockWallet(ctx context.Context, tx *Tx, id string) (Wallet, error) {
+	start := time.Now()
+	wallet, err := db.scanWallet(tx.QueryRowContext(ctx, "select "+walletColumns+" from wallets where id = ?"+db.ForUpdate(), id))
+	db.Metrics.observeStatement(stmtGetWallet, start)
+	return wallet, err
+}
+
+// transferLocking reads both wallets, checks the new balances and writes
+// them back. It is used where the database has no UPDATE ... RETURNING.
+//
+// The rows are locked one after the other in the order of their ids, so
+// that transfers between the same wallets in opposite directions queue up
+// instead of deadlocking. A transaction runs one statement at a time
+// anyway: MySQL refuses a second query while the first one's rows are
+// still being read.
+func (db *DB) transferLocking(ctx context.Context, tx *Tx, from, to string, amount decimal.Decimal) (fromCents, toCents int64, err error) {
+	order := []string{from, to}
+	if to < from {
+		order = []string{to, from}
+	}
+	if from == to {
+		order = order[:1]
+	}
+	if db.Driver == SQLite {
+		// SQLite can't turn the read lock of the selects below into a write
+		// lock while another transfer holds one, it fails with "database is
+		// locked" instead of waiting. Writing first waits for the write lock.
+		if _, err := tx.ExecContext(ctx, "update wallets set balance_cents = balance_cents where id = ?", from); err != nil {
+			return 0, 0, err
+		}
+	}
+	wallets := make(map[string]Wallet, 2)
+	for _, id := range order {
+		w, err := db.lockWallet(ctx, tx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		wallets[id] = w
+	}
+	fromWallet, ok := wallets[from]
+	if !ok {
+		return 0, 0, ErrNotFound
+	}
+	toWallet, ok := wallets[to]
+	if !ok {
+		return 0, 0, ErrRecipientNotFound
+	}
+
+	fromAmount := fromWallet.Balance.Sub(amount)
+	if from == to {
+		// the wallet was read once, before the debit
+		toWallet.Balance = fromAmount
+	}
+	toAmount := toWallet.Balance.Add(amount)
+	if !fromAmount.IsPositive() {
+		return 0, 0, ErrInsufficientFunds
+	}
+	if !toAmount.IsPositive() && !amount.IsPositive() {
+		return 0, 0, ErrInvalidAmount
+	}
+	fromCents, err = db.ToMinor(fromAmount)
+	if err != nil {
+		return 0, 0, err
+	}
+	toCents, err = db.ToMinor(toAmount)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// one statement per Exec, postgres doesn't take parameters for multi-statement queries
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `update wallets set balance_cents = ? where id = ?`, fromCents, from)
+	db.Metrics.observeStatement(stmtDebit, start)
+	if err == nil {
+		start = time.Now()
+		_, err = tx.ExecContext(ctx, `update wallets set balance_cents = ? where id = ?`, toCents, to)
+		db.Metrics.observeStatement(stmtCredit, start)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		fromCents = toCents
+	}
+	return fromCents, toCents, nil
+}
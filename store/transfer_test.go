@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestNonNegativeBalanceConstraint(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		mustCreate(t, db, "10", "AAAAAA")
+		_, err := db.ExecContext(ctx, "update wallets set balance_cents = ? where id = ?", -1, "AAAAAA")
+		if !IsCheckViolation(err) {
+			t.Fatalf("negative balance: %v, want a check violation", err)
+		}
+		// which a transfer reports as a refusal, not an internal error
+		if !errors.Is(transferError(err), ErrInsufficientFunds) {
+			t.Fatalf("transferError(%v) is not ErrInsufficientFunds", err)
+		}
+		err = db.CreateWallet(ctx, Wallet{Id: "BBBBBB", Balance: decimal.NewFromInt(-1)})
+		if !IsCheckViolation(err) {
+			t.Fatalf("wallet created negative: %v, want a check violation", err)
+		}
+	})
+}
+
+// TestConcurrentTransfersStayCovered sends more than the balance in many
+// concurrent transfers, with each way of applying them. Only as many as
+// the balance covers may go through.
+func TestConcurrentTransfersStayCovered(t *testing.T) {
+	for _, returning := range []bool{true, false} {
+		name := "locking"
+		if returning {
+			name = "returning"
+		}
+		t.Run(name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if returning && !db.Returning {
+					t.Skip("no UPDATE ... RETURNING")
+				}
+				db.Returning = returning
+				ctx := context.Background()
+				mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+
+				const n = 25
+				var wg sync.WaitGroup
+				errs := make(chan error, n)
+				for i := 0; i < n; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(30), testTime)
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				completed, conflicts := 0, 0
+				for err := range errs {
+					switch {
+					case err == nil:
+						completed++
+					case errors.Is(err, ErrConflict):
+						conflicts++
+					case errors.Is(err, ErrInsufficientFunds):
+					default:
+						t.Errorf("transfer: %v", err)
+					}
+				}
+				// 100 covers three transfers of 30, a fourth would leave it negative
+				if completed > 3 || completed < 3 && conflicts == 0 {
+					t.Fatalf("%d transfers of 30 went through on a balance of 100, want 3", completed)
+				}
+				balance := balanceOf(t, db, "AAAAAA")
+				if balance.IsNegative() || !balance.Equal(decimal.NewFromInt(int64(100-30*completed))) {
+					t.Fatalf("balance %s after %d transfers", balance, completed)
+				}
+				if got := balanceOf(t, db, "BBBBBB"); !got.Add(balance).Equal(decimal.NewFromInt(200)) {
+					t.Fatalf("recipient balance %s, money was made or lost", got)
+				}
+			})
+		})
+	}
+}
+
+// TestNonNegativeMigrationKeepsNegativeWallets migrates a database whose
+// wallets went negative before balances were checked: the migration
+// keeps them, they may receive money but not send it, and no other
+// wallet may go negative.
+func TestNonNegativeMigrationKeepsNegativeWallets(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	steps, err := db.Plan(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Apply(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+	for id, cents := range map[string]int64{"NNNNNN": -5000, "AAAAAA": 10000} {
+		if _, err := db.ExecContext(ctx, "insert into wallets(id, balance_cents) values(?, ?)", id, cents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := balanceOf(t, db, "NNNNNN"); got.String() != "-50" {
+		t.Fatalf("negative wallet migrated to %s", got)
+	}
+
+	if _, err := db.Transfer(ctx, "AAAAAA", "NNNNNN", decimal.NewFromInt(10), testTime); err != nil {
+		t.Fatalf("sending to the negative wallet: %v", err)
+	}
+	if got := balanceOf(t, db, "NNNNNN"); got.String() != "-40" {
+		t.Fatalf("negative wallet has %s after receiving 10, want -40", got)
+	}
+	if _, err := db.Transfer(ctx, "NNNNNN", "AAAAAA", decimal.RequireFromString("0.01"), testTime); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("sending from the negative wallet: %v, want ErrInsufficientFunds", err)
+	}
+	err = db.CreateWallet(ctx, Wallet{Id: "BBBBBB", Balance: decimal.NewFromInt(-1)})
+	if !IsCheckViolation(err) {
+		t.Fatalf("new negative wallet: %v, want a check violation", err)
+	}
+}
+
+// BenchmarkTransfer compares the guarded UPDATE ... RETURNING statements
+// with the locking reads, with transfers running in parallel between a
+// few wallets.
+func BenchmarkTransfer(b *testing.B) {
+	for _, returning := range []bool{true, false} {
+		name := "locking"
+		if returning {
+			name = "returning"
+		}
+		b.Run(name, func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "wallets.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			ctx := context.Background()
+			if _, err := db.Migrate(ctx); err != nil {
+				b.Fatal(err)
+			}
+			if err := db.DetectReturning(ctx); err != nil {
+				b.Fatal(err)
+			}
+			if returning && !db.Returning {
+				b.Skip("no UPDATE ... RETURNING")
+			}
+			db.Returning = returning
+			ids := []string{"AAAAAA", "BBBBBB", "CCCCCC", "DDDDDD"}
+			for _, id := range ids {
+				if err := db.CreateWallet(ctx, Wallet{Id: id, Balance: decimal.NewFromInt(1_000_000_000)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var next sync.Mutex
+			n := 0
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					next.Lock()
+					from, to := ids[n%len(ids)], ids[(n+1)%len(ids)]
+					n++
+					next.Unlock()
+					if _, err := db.Transfer(ctx, from, to, decimal.NewFromInt(1), testTime); err != nil && !errors.Is(err, ErrConflict) {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
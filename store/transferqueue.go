@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Statuses of a queued transfer. It is queued until the transfer queue
+// gets to it, then completed, or failed when the transfer was refused.
+const (
+	TransferQueued    = "queued"
+	TransferCompleted = "completed"
+	TransferFailed    = "failed"
+)
+
+var (
+	// ErrTransferNotFound is returned for ids that aren't queued
+	// transfers of the wallet.
+	ErrTransferNotFound = errors.New("transfer not found")
+	// ErrTransferProcessed is returned by ApplyQueuedTransfer for a
+	// transfer that isn't queued anymore. Nothing was changed.
+	ErrTransferProcessed = errors.New("transfer was already processed")
+)
+
+// QueuedTransfer is a row of the transfer_queue table: a transfer asked
+// for asynchronously, and what became of it.
+type QueuedTransfer struct {
+	Id     int64
+	FromId string
+	ToId   string
+	Amount decimal.Decimal
+	Status string
+	// FailureReason is the error code a failed transfer was refused
+	// with, such as insufficient_funds.
+	FailureReason string
+	CreatedAt     time.Time
+	// ProcessedAt is when the transfer completed or failed.
+	ProcessedAt sql.NullTime
+	// FromBalance is the sender's balance right after a completed transfer.
+	FromBalance decimal.NullDecimal
+}
+
+const queuedTransferColumns = "id, from_wallet_id, to_wallet_id, amount_cents, status, failure_reason, created_at, processed_at, from_balance_after_cents"
+
+func (db *DB) scanQueuedTransfer(row scanner) (QueuedTransfer, error) {
+	var q QueuedTransfer
+	var amount int64
+	var reason sql.NullString
+	var fromBalance sql.NullInt64
+	err := row.Scan(&q.Id, &q.FromId, &q.ToId, &amount, &q.Status, &reason, &q.CreatedAt, &q.ProcessedAt, &fromBalance)
+	if err != nil {
+		return QueuedTransfer{}, err
+	}
+	q.Amount = db.FromMinor(amount)
+	q.FailureReason = reason.String
+	if fromBalance.Valid {
+		q.FromBalance = decimal.NewNullDecimal(db.FromMinor(fromBalance.Int64))
+	}
+	return q, nil
+}
+
+// EnqueueTransfer queues a transfer of amount from one wallet to another,
+// for the transfer queue to apply after the ones queued before it. It
+// returns ErrNotFound for an unknown sender; the recipient is only looked
+// up when the transfer is applied.
+func (db *DB) EnqueueTransfer(ctx context.Context, from, to string, amount decimal.Decimal, at time.Time) (QueuedTransfer, error) {
+	amountCents, err := db.ToMinor(amount)
+	if err != nil {
+		return QueuedTransfer{}, err
+	}
+	if _, err := db.GetWallet(ctx, from); err != nil {
+		return QueuedTransfer{}, err
+	}
+	q := QueuedTransfer{FromId: from, ToId: to, Amount: amount, Status: TransferQueued, CreatedAt: at.UTC()}
+	query := "insert into transfer_queue(from_wallet_id, to_wallet_id, amount_cents, status, created_at) values(?, ?, ?, ?, ?)"
+	args := []any{from, to, amountCents, TransferQueued, q.CreatedAt}
+	if db.Driver == Postgres {
+		err := db.QueryRowContext(ctx, query+" returning id", args...).Scan(&q.Id)
+		return q, err
+	}
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return QueuedTransfer{}, err
+	}
+	q.Id, err = res.LastInsertId()
+	return q, err
+}
+
+// QueuedTransfer returns the queued transfer id of the wallet from, or
+// ErrTransferNotFound.
+func (db *DB) QueuedTransfer(ctx context.Context, from string, id int64) (QueuedTransfer, error) {
+	q, err := db.scanQueuedTransfer(db.QueryRowContext(ctx,
+		"select "+queuedTransferColumns+" from transfer_queue where id = ? and from_wallet_id = ?", id, from))
+	if errors.Is(err, sql.ErrNoRows) {
+		return QueuedTransfer{}, ErrTransferNotFound
+	}
+	return q, err
+}
+
+// QueuedTransfers returns up to limit transfers still queued, in the order
+// they were queued.
+func (db *DB) QueuedTransfers(ctx context.Context, limit int) ([]QueuedTransfer, error) {
+	rows, err := db.QueryContext(ctx, "select "+queuedTransferColumns+" from transfer_queue where status = ? order by id limit ?",
+		TransferQueued, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transfers []QueuedTransfer
+	for rows.Next() {
+		q, err := db.scanQueuedTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, q)
+	}
+	return transfers, rows.Err()
+}
+
+// ApplyQueuedTransfer makes the queued transfer q with Transfer and marks
+// it completed in the same database transaction, so that it is applied
+// exactly once however often this is called. A refused transfer returns
+// the error of Transfer and stays queued, see FailQueuedTransfer.
+func (db *DB) ApplyQueuedTransfer(ctx context.Context, q QueuedTransfer, at time.Time) (Transaction, error) {
+	return db.transfer(ctx, q.FromId, q.ToId, q.Amount, at, func(tx *Tx, t Transaction) error {
+		fromCents, err := db.ToMinor(t.FromBalance.Decimal)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "update transfer_queue set status = ?, processed_at = ?, from_balance_after_cents = ? where id = ? and status = ?",
+			TransferCompleted, at.UTC(), fromCents, q.Id, TransferQueued)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrTransferProcessed
+		}
+		return nil
+	})
+}
+
+// FailQueuedTransfer marks the queued transfer id failed with reason, if
+// it is still queued.
+func (db *DB) FailQueuedTransfer(ctx context.Context, id int64, reason string, at time.Time) error {
+	_, err := db.ExecContext(ctx, "update transfer_queue set status = ?, failure_reason = ?, processed_at = ? where id = ? and status = ?",
+		TransferFailed, reason, at.UTC(), id, TransferQueued)
+	return err
+}
+
+// PruneQueuedTransfers deletes the completed and failed transfers
+// processed before cutoff and returns how many there were.
+func (db *DB) PruneQueuedTransfers(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "delete from transfer_queue where status <> ? and processed_at < ?", TransferQueued, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
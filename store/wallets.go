@@ -0,0 +1,321 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Wallet is a row of the wallets table.
+type Wallet struct {
+	Id      string
+	Balance decimal.Decimal
+	// Opening is the balance the wallet was created with. It isn't set
+	// for wallets from before it was recorded, which got InitialBalance.
+	Opening decimal.NullDecimal
+	// CreatedAt is when the wallet was created, in UTC. Wallets from before
+	// it was recorded have the date of their first transaction, or none.
+	CreatedAt sql.NullTime
+}
+
+// InitialBalance is credited to every new wallet. The ledger checks count
+// it in as well.
+var InitialBalance = decimal.NewFromInt(100)
+
+// Transaction statuses. Only completed transactions move money; failed
+// ones are kept for analytics, see DB.RecordFailures.
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Transaction is a row of the wallet_transactions table.
+type Transaction struct {
+	// FromId is the wallet the amount was taken from, ToId the one it
+	// was sent to.
+	FromId string
+	ToId   string
+	Amount decimal.Decimal
+	Date   sql.NullTime
+	Status string
+	// FailureReason says why a failed transaction was refused, "" otherwise.
+	FailureReason string
+
+	// Balances of both wallets right after the transfer. Failed
+	// transactions, and those written before migration 15, have none.
+	FromBalance decimal.NullDecimal
+	ToBalance   decimal.NullDecimal
+}
+
+// Column lists used by every query that reads whole rows. Selecting
+// columns by name keeps the scans below correct when columns are added.
+const (
+	walletColumns      = "id, balance_cents, opening_cents, created_at"
+	transactionColumns = "from_wallet_id, to_wallet_id, amount_cents, date, status, failure_reason, from_balance_after_cents, to_balance_after_cents"
+)
+
+// transactionOrder lists transactions newest first. Rows have no id, so
+// ties in date are broken by the other columns: the order is the same on
+// every read, and rows equal in all of them can't be told apart anyway.
+const transactionOrder = " order by date desc, from_wallet_id, to_wallet_id, amount_cents, status, failure_reason"
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanWallet reads a row selected with walletColumns.
+func (db *DB) scanWallet(row scanner) (Wallet, error) {
+	var w Wallet
+	var balance int64
+	var opening sql.NullInt64
+	if err := row.Scan(&w.Id, &balance, &opening, &w.CreatedAt); err != nil {
+		return Wallet{}, err
+	}
+	w.Balance = db.FromMinor(balance)
+	if opening.Valid {
+		w.Opening = decimal.NewNullDecimal(db.FromMinor(opening.Int64))
+	}
+	return w, nil
+}
+
+// scanTransaction reads a row selected with transactionColumns. A row
+// without a valid date is an error rather than a transaction made in year
+// 1, see UndatedTransactions.
+func (db *DB) scanTransaction(row scanner) (Transaction, error) {
+	t, err := db.scanAnyTransaction(row)
+	if err == nil && !hasDate(t) {
+		return Transaction{}, fmt.Errorf("transaction %s -> %s: malformed date", t.FromId, t.ToId)
+	}
+	return t, err
+}
+
+// scanAnyTransaction is scanTransaction accepting rows without a valid
+// date, for the checks that report them.
+func (db *DB) scanAnyTransaction(row scanner) (Transaction, error) {
+	var t Transaction
+	var amount int64
+	var reason sql.NullString
+	var fromBalance, toBalance sql.NullInt64
+	if err := row.Scan(&t.FromId, &t.ToId, &amount, &t.Date, &t.Status, &reason, &fromBalance, &toBalance); err != nil {
+		return Transaction{}, err
+	}
+	t.FailureReason = reason.String
+	t.Amount = db.FromMinor(amount)
+	if fromBalance.Valid {
+		t.FromBalance = decimal.NewNullDecimal(db.FromMinor(fromBalance.Int64))
+	}
+	if toBalance.Valid {
+		t.ToBalance = decimal.NewNullDecimal(db.FromMinor(toBalance.Int64))
+	}
+	return t, nil
+}
+
+// hasDate reports whether t has a valid date. The column is not null, but
+// the SQLite driver reads a date it can't parse, and MySQL's driver a zero
+// date, as the zero time instead of failing.
+func hasDate(t Transaction) bool {
+	return t.Date.Valid && !t.Date.Time.IsZero()
+}
+
+// GetWallet returns the wallet with the given id, from db.Balances when
+// it is cached there.
+func (db *DB) GetWallet(ctx context.Context, id string) (Wallet, error) {
+	if db.Balances != nil {
+		w, ok := db.Balances.get(id)
+		db.Metrics.balanceCacheLookup(ok)
+		if ok {
+			return w, nil
+		}
+	}
+	epoch := db.Balances.begin()
+	start := time.Now()
+	w, err := db.scanWallet(db.QueryRowContext(ctx, "select "+walletColumns+" from wallets where id = ?", id))
+	db.Metrics.observeStatement(stmtGetWallet, start)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wallet{}, ErrNotFound
+	}
+	if err == nil {
+		db.Balances.put(w, epoch)
+	}
+	return w, err
+}
+
+// TransactionCount returns the number of completed transactions of the
+// wallet with the given id, archived ones included; self transfers count
+// once. The indexes on both sides of the transactions serve it.
+func (db *DB) TransactionCount(ctx context.Context, id string) (int64, error) {
+	var count int64
+	err := db.QueryRowContext(ctx, `select (select count(*) from wallet_transactions where from_wallet_id = ? and status = ?)
+		+ (select count(*) from wallet_transactions where to_wallet_id = ? and from_wallet_id <> ? and status = ?)
+		+ (select count(*) from wallet_transactions_archive where from_wallet_id = ? and status = ?)
+		+ (select count(*) from wallet_transactions_archive where to_wallet_id = ? and from_wallet_id <> ? and status = ?)`,
+		id, StatusCompleted, id, id, StatusCompleted, id, StatusCompleted, id, id, StatusCompleted).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// utcTime is t in UTC for a statement, or NULL.
+func utcTime(t sql.NullTime) any {
+	if !t.Valid {
+		return nil
+	}
+	return t.Time.UTC()
+}
+
+// CreateWallet inserts a new wallet. Its balance is recorded as its
+// opening balance.
+func (db *DB) CreateWallet(ctx context.Context, w Wallet) error {
+	balance, err := db.ToMinor(w.Balance)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "insert into wallets(id, balance_cents, opening_cents, created_at) values(?, ?, ?, ?)",
+		w.Id, balance, balance, utcTime(w.CreatedAt))
+	if IsUniqueViolation(err) {
+		db.Metrics.idCollision()
+		return ErrDuplicateID
+	}
+	return err
+}
+
+// CountHistory returns how many transactions History returns without
+// filter.Limit. It runs the same conditions as a count, see historyQuery.
+func (db *DB) CountHistory(ctx context.Context, id string, filter HistoryFilter) (int64, error) {
+	if _, err := db.GetWallet(ctx, id); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	query, args := newHistoryQuery(id, filter).count()
+	var count int64
+	err := db.QueryRowContext(ctx, query, args...).Scan(&count)
+	db.Metrics.observeStatement(stmtHistoryCount, start)
+	return count, err
+}
+
+// History returns every transaction the wallet took part in, on either
+// side, newest first, see transactionOrder.
+func (db *DB) History(ctx context.Context, id string, filter HistoryFilter) ([]Transaction, error) {
+	var transactions []Transaction
+	err := db.EachHistory(ctx, id, filter, func(t Transaction) error {
+		transactions = append(transactions, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// EachHistory calls fn with the transactions History returns, one at a
+// time as they are read, and stops at the first error fn returns. An
+// unknown id returns ErrNotFound before fn is called.
+func (db *DB) EachHistory(ctx context.Context, id string, filter HistoryFilter, fn func(Transaction) error) error {
+	if _, err := db.GetWallet(ctx, id); err != nil {
+		return err
+	}
+
+	// timed until the last row is read, the query runs as they are; that
+	// includes fn, which for the HTTP history writes the response
+	defer db.Metrics.observeStatement(stmtHistory, time.Now())
+	query, args := newHistoryQuery(id, filter).rows(filter.Limit, filter.Offset)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := db.scanTransaction(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// historyQuery holds the conditions of a wallet's history, from which
+// both the rows and their count are built so that the two can't disagree.
+type historyQuery struct {
+	// froms are "from table where ..." clauses, one per table and side,
+	// and args their arguments in order.
+	froms []string
+	args  []any
+}
+
+func newHistoryQuery(id string, filter HistoryFilter) historyQuery {
+	tables := []string{"wallet_transactions"}
+	if filter.IncludeArchived {
+		tables = append(tables, "wallet_transactions_archive")
+	}
+	// sqlite won't use the indexes for "from_wallet_id = ? or to_wallet_id = ?",
+	// so each side gets its own indexed query. self transfers are only taken from the first one.
+	var status string
+	var statusArgs []any
+	if filter.Status != "" {
+		status = " and status = ?"
+		statusArgs = []any{filter.Status}
+	}
+	// the counterparty is the other side of each query
+	var sent, received string
+	var sentArgs, receivedArgs []any
+	if filter.Counterparty != "" {
+		sent, received = " and to_wallet_id = ?", " and from_wallet_id = ?"
+		sentArgs, receivedArgs = []any{filter.Counterparty}, []any{filter.Counterparty}
+	}
+	var q historyQuery
+	for _, table := range tables {
+		q.froms = append(q.froms,
+			`from `+table+` where from_wallet_id = ?`+sent+status,
+			`from `+table+` where to_wallet_id = ? and from_wallet_id <> ?`+received+status)
+		q.args = append(q.args, id)
+		q.args = append(q.args, sentArgs...)
+		q.args = append(q.args, statusArgs...)
+		q.args = append(q.args, id, id)
+		q.args = append(q.args, receivedArgs...)
+		q.args = append(q.args, statusArgs...)
+	}
+	return q
+}
+
+// rows returns the query of the transactions, newest first, at most limit
+// of them after the first offset when limit is positive.
+func (q historyQuery) rows(limit, offset int) (string, []any) {
+	selects := make([]string, len(q.froms))
+	for i, from := range q.froms {
+		selects[i] = "select " + transactionColumns + " " + from
+	}
+	query := strings.Join(selects, " union all ") + transactionOrder
+	args := slices.Clone(q.args)
+	if limit > 0 {
+		query += " limit ?"
+		args = append(args, limit)
+		if offset > 0 {
+			query += " offset ?"
+			args = append(args, offset)
+		}
+	}
+	return query, args
+}
+
+// count returns the query of the number of transactions, a sum of one
+// count per side so that each still uses its index.
+func (q historyQuery) count() (string, []any) {
+	counts := make([]string, len(q.froms))
+	for i, from := range q.froms {
+		counts[i] = "(select count(*) " + from + ")"
+	}
+	return "select " + strings.Join(counts, " + "), slices.Clone(q.args)
+}
@@ -0,0 +1,638 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// queryPlan returns the details of the SQLite query plan of query.
+func queryPlan(t *testing.T, db *DB, query string, args ...any) []string {
+	t.Helper()
+	rows, err := db.QueryContext(context.Background(), "explain query plan "+query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var details []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		details = append(details, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return details
+}
+
+func TestHistoryUsesIndexes(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	filters := []HistoryFilter{
+		{},
+		{Limit: 50},
+		{IncludeArchived: true},
+		{Status: StatusCompleted},
+		{Counterparty: "BBBBBB"},
+		{IncludeArchived: true, Status: StatusFailed, Counterparty: "BBBBBB", Limit: 10},
+		{Limit: 50, Offset: 100},
+	}
+	for _, filter := range filters {
+		t.Run(fmt.Sprintf("%+v", filter), func(t *testing.T) {
+			q := newHistoryQuery("AAAAAA", filter)
+			query, args := q.rows(filter.Limit, filter.Offset)
+			count, countArgs := q.count()
+			for _, plan := range [][]string{queryPlan(t, db, query, args...), queryPlan(t, db, count, countArgs...)} {
+				searches := 0
+				for _, detail := range plan {
+					if !strings.Contains(detail, "wallet_transactions") {
+						continue
+					}
+					if !strings.HasPrefix(detail, "SEARCH") || !strings.Contains(detail, "INDEX") {
+						t.Errorf("not an index lookup: %s\nplan: %q", detail, plan)
+					}
+					searches++
+				}
+				// each side of each table is looked up on its own
+				if want := len(q.froms); searches != want {
+					t.Errorf("%d index lookups, want %d\nplan: %q", searches, want, plan)
+				}
+			}
+		})
+	}
+}
+
+// TestQueriesWithExtraColumns adds columns the code doesn't know about,
+// like a later migration would, and runs the queries reading whole rows.
+func TestQueriesWithExtraColumns(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		for _, table := range []string{"wallets", "wallet_transactions", "wallet_transactions_archive"} {
+			if _, err := db.ExecContext(ctx, "alter table "+table+" add column currency varchar(3) not null default 'EUR'"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(10), testTime); err != nil {
+			t.Fatal(err)
+		}
+		db.Returning = false
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(5), testTime.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		w, err := db.GetWallet(ctx, "AAAAAA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Id != "AAAAAA" || !w.Balance.Equal(decimal.NewFromInt(85)) || !w.CreatedAt.Time.Equal(testTime) {
+			t.Fatalf("wallet = %+v", w)
+		}
+
+		if _, err := db.ArchiveTransactions(ctx, testTime.Add(time.Minute), 100, nil); err != nil {
+			t.Fatal(err)
+		}
+		history, err := db.History(ctx, "BBBBBB", HistoryFilter{IncludeArchived: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 || !history[0].Amount.Equal(decimal.NewFromInt(5)) || !history[1].Amount.Equal(decimal.NewFromInt(10)) ||
+			history[1].FromId != "AAAAAA" || history[1].ToId != "BBBBBB" || !history[1].ToBalance.Decimal.Equal(decimal.NewFromInt(110)) {
+			t.Fatalf("history = %+v", history)
+		}
+		if n, err := db.CountHistory(ctx, "BBBBBB", HistoryFilter{IncludeArchived: true}); err != nil || n != 2 {
+			t.Fatalf("CountHistory = %d, %v", n, err)
+		}
+	})
+}
+
+// reorderColumns rebuilds the SQLite table with its columns in reverse
+// order, keeping its rows, indexes and triggers, like a schema whose
+// columns were added in another order.
+func reorderColumns(t *testing.T, db *DB, table string) {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	rows, err := conn.QueryContext(ctx, "select name, type, \"notnull\", dflt_value, pk from pragma_table_info(?) order by cid desc", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, defs []string
+	for rows.Next() {
+		var name, typ string
+		var notNull, pk bool
+		var dflt sql.NullString
+		if err := rows.Scan(&name, &typ, &notNull, &dflt, &pk); err != nil {
+			t.Fatal(err)
+		}
+		def := name + " " + typ
+		if pk {
+			def += " primary key"
+		}
+		if notNull {
+			def += " not null"
+		}
+		if dflt.Valid {
+			def += " default " + dflt.String
+		}
+		names = append(names, name)
+		defs = append(defs, def)
+	}
+	rows.Close()
+	rows, err = conn.QueryContext(ctx, "select sql from sqlite_master where tbl_name = ? and type in ('index', 'trigger') and sql is not null", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var others []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, s)
+	}
+	rows.Close()
+
+	exec("pragma foreign_keys = off")
+	defer exec("pragma foreign_keys = on")
+	columns := strings.Join(names, ", ")
+	exec("create table " + table + "_reordered (" + strings.Join(defs, ", ") + ")")
+	exec("insert into " + table + "_reordered (" + columns + ") select " + columns + " from " + table)
+	exec("drop table " + table)
+	exec("alter table " + table + "_reordered rename to " + table)
+	for _, s := range others {
+		exec(s)
+	}
+}
+
+// TestQueriesWithReorderedColumns runs the queries against tables whose
+// columns are in another order than the migrations made them, with an
+// extra one in the middle, as during a rolling deploy of a schema change.
+func TestQueriesWithReorderedColumns(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	ctx := context.Background()
+	mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(10), testTime); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"wallets", "wallet_transactions", "wallet_transactions_archive"} {
+		if _, err := db.ExecContext(ctx, "alter table "+table+" add column memo text not null default 'x'"); err != nil {
+			t.Fatal(err)
+		}
+		reorderColumns(t, db, table)
+		var first string
+		if err := db.QueryRowContext(ctx, "select name from pragma_table_info(?) where cid = 0", table).Scan(&first); err != nil || first != "memo" {
+			t.Fatalf("first column of %s: %s, %v", table, first, err)
+		}
+	}
+	if err := db.CheckColumns(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, returning := range []bool{true, false} {
+		db.Returning = returning
+		if _, err := db.Transfer(ctx, "BBBBBB", "AAAAAA", decimal.NewFromInt(5), testTime.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(1000), testTime); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overdrawing transfer: %v", err)
+	}
+	w, err := db.GetWallet(ctx, "AAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Id != "AAAAAA" || !w.Balance.Equal(decimal.NewFromInt(100)) || !w.CreatedAt.Time.Equal(testTime) {
+		t.Fatalf("wallet = %+v", w)
+	}
+	if _, err := db.ArchiveTransactions(ctx, testTime.Add(time.Minute), 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.History(ctx, "AAAAAA", HistoryFilter{IncludeArchived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].FromId != "AAAAAA" || history[2].ToId != "BBBBBB" ||
+		!history[2].Amount.Equal(decimal.NewFromInt(10)) || !history[2].FromBalance.Decimal.Equal(decimal.NewFromInt(90)) ||
+		history[0].Status != StatusCompleted || !history[0].Date.Time.Equal(testTime.Add(time.Hour)) {
+		t.Fatalf("history = %+v", history)
+	}
+	var exported int
+	if err := db.Export(ctx, func(w Wallet) error {
+		if !w.Balance.Equal(decimal.NewFromInt(100)) {
+			t.Errorf("exported wallet %+v", w)
+		}
+		return nil
+	}, func(Transaction) error {
+		exported++
+		return nil
+	}); err != nil || exported != 3 {
+		t.Fatalf("exported %d transactions, %v", exported, err)
+	}
+}
+
+// TestCheckColumns drops a column the store reads, as a schema changed
+// by hand might: the check names the table.
+func TestCheckColumns(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	ctx := context.Background()
+	if err := db.CheckColumns(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "alter table wallet_transactions_archive drop column failure_reason"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.CheckColumns(ctx)
+	if err == nil || !strings.Contains(err.Error(), "table wallet_transactions_archive doesn't have the columns this binary reads") ||
+		!strings.Contains(err.Error(), "failure_reason") {
+		t.Fatalf("CheckColumns = %v", err)
+	}
+}
+
+// TestHistoryOrder gives transactions the same date and checks they are
+// listed newest first in the same order on every read, after a VACUUM
+// too, and that the export uses that order.
+func TestHistoryOrder(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	ctx := context.Background()
+	for _, id := range []string{"AAAAAA", "BBBBBB", "CCCCCC"} {
+		if err := db.CreateWallet(ctx, Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	transfers := []struct {
+		from, to string
+		amount   int64
+		at       time.Time
+	}{
+		{"BBBBBB", "AAAAAA", 2, at},
+		{"AAAAAA", "CCCCCC", 3, at},
+		{"AAAAAA", "BBBBBB", 5, at.Add(time.Hour)},
+		{"AAAAAA", "BBBBBB", 2, at},
+		{"AAAAAA", "BBBBBB", 1, at},
+	}
+	for _, tr := range transfers {
+		if _, err := db.Transfer(ctx, tr.from, tr.to, decimal.NewFromInt(tr.amount), tr.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "AAAAAA->BBBBBB 5, AAAAAA->BBBBBB 1, AAAAAA->BBBBBB 2, AAAAAA->CCCCCC 3, BBBBBB->AAAAAA 2"
+	list := func(transactions []Transaction) string {
+		var s []string
+		for _, tx := range transactions {
+			s = append(s, fmt.Sprintf("%s->%s %s", tx.FromId, tx.ToId, tx.Amount))
+		}
+		return strings.Join(s, ", ")
+	}
+	history := func() string {
+		t.Helper()
+		transactions, err := db.History(ctx, "AAAAAA", HistoryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list(transactions)
+	}
+
+	for i := 0; i < 5; i++ {
+		if got := history(); got != want {
+			t.Fatalf("read %d: %s\nwant %s", i, got, want)
+		}
+	}
+	if _, err := db.ExecContext(ctx, "vacuum"); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); got != want {
+		t.Fatalf("after a vacuum: %s\nwant %s", got, want)
+	}
+
+	var exported []Transaction
+	err := db.Export(ctx, func(Wallet) error { return nil }, func(tx Transaction) error {
+		exported = append(exported, tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := list(exported); got != want {
+		t.Fatalf("export: %s\nwant %s", got, want)
+	}
+}
+
+// TestEachHistory checks that EachHistory hands over the rows read before
+// an error, stops at the first error of fn and checks the wallet first.
+func TestEachHistory(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	ctx := context.Background()
+	mustCreate(t, db, "100", "AAAAAA", "BBBBBB")
+	for i := 1; i <= 5; i++ {
+		if _, err := db.Transfer(ctx, "AAAAAA", "BBBBBB", decimal.NewFromInt(int64(i)), testTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	each := func(id string, stopAt int) ([]string, error) {
+		var amounts []string
+		err := db.EachHistory(ctx, id, HistoryFilter{}, func(tx Transaction) error {
+			amounts = append(amounts, tx.Amount.String())
+			if len(amounts) == stopAt {
+				return errStop
+			}
+			return nil
+		})
+		return amounts, err
+	}
+
+	if got, err := each("AAAAAA", 0); err != nil || strings.Join(got, ",") != "5,4,3,2,1" {
+		t.Fatalf("history = %v, %v", got, err)
+	}
+	if got, err := each("AAAAAA", 2); !errors.Is(err, errStop) || strings.Join(got, ",") != "5,4" {
+		t.Fatalf("stopped at 2: %v, %v", got, err)
+	}
+	if got, err := each("ZZZZZZ", 0); !errors.Is(err, ErrNotFound) || got != nil {
+		t.Fatalf("unknown wallet: %v, %v", got, err)
+	}
+
+	// the third row can't be scanned, the two before it were handed over
+	if _, err := db.ExecContext(ctx, "update wallet_transactions set amount_cents = 'x' where amount_cents = 300"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := each("AAAAAA", 0); err == nil || strings.Join(got, ",") != "5,4" {
+		t.Fatalf("unreadable row: %v, %v", got, err)
+	}
+}
+
+// errStop is returned by the fn of TestEachHistory to stop early.
+var errStop = errors.New("stop")
+
+// TestCountHistory counts the history of wallets under every combination
+// of filters, with and without a limit, and checks the count against
+// the rows History returns and against the rows filtered one by one.
+func TestCountHistory(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	db.RecordFailures = true
+	ctx := context.Background()
+	mustCreate(t, db, "100", "AAAAAA", "BBBBBB", "CCCCCC")
+	transfers := []struct {
+		from, to string
+		amount   int64
+	}{
+		{"AAAAAA", "BBBBBB", 10},
+		{"BBBBBB", "AAAAAA", 5},
+		{"AAAAAA", "CCCCCC", 3},
+		{"AAAAAA", "AAAAAA", 1},
+		{"AAAAAA", "BBBBBB", 1000},
+		{"CCCCCC", "BBBBBB", 2},
+		{"BBBBBB", "BBBBBB", 1000},
+	}
+	for i, tr := range transfers {
+		_, err := db.Transfer(ctx, tr.from, tr.to, decimal.NewFromInt(tr.amount), testTime.Add(time.Duration(i)*time.Minute))
+		if err != nil && tr.amount != 1000 {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status)
+		values('AAAAAA', 'CCCCCC', 400, ?, ?)`, testTime.Add(time.Hour), StatusPending); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ArchiveTransactions(ctx, testTime.Add(90*time.Second), 10, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// every row, with the table it is in
+	type row struct {
+		from, to, status string
+		archived         bool
+	}
+	var all []row
+	rows, err := db.QueryContext(ctx, `select from_wallet_id, to_wallet_id, status, 0 from wallet_transactions
+		union all select from_wallet_id, to_wallet_id, status, 1 from wallet_transactions_archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.from, &r.to, &r.status, &r.archived); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	var archived int
+	for _, r := range all {
+		if r.archived {
+			archived++
+		}
+	}
+	if archived == 0 || archived == len(all) {
+		t.Fatalf("%d of %d rows archived, want some in both tables", archived, len(all))
+	}
+
+	for _, id := range []string{"AAAAAA", "BBBBBB", "CCCCCC"} {
+		for _, archived := range []bool{false, true} {
+			for _, status := range []string{"", StatusPending, StatusCompleted, StatusFailed} {
+				for _, counterparty := range []string{"", "AAAAAA", "BBBBBB", "CCCCCC", "ZZZZZZ"} {
+					var want int64
+					for _, r := range all {
+						if (r.from == id || r.to == id) && (archived || !r.archived) && (status == "" || r.status == status) &&
+							(counterparty == "" || r.from == id && r.to == counterparty || r.to == id && r.from == counterparty) {
+							want++
+						}
+					}
+					for _, limit := range []int{0, 1} {
+						filter := HistoryFilter{IncludeArchived: archived, Status: status, Counterparty: counterparty, Limit: limit}
+						count, err := db.CountHistory(ctx, id, filter)
+						if err != nil || count != want {
+							t.Errorf("%s %+v: count %d, %v, want %d", id, filter, count, err, want)
+						}
+					}
+					history, err := db.History(ctx, id, HistoryFilter{IncludeArchived: archived, Status: status, Counterparty: counterparty})
+					if err != nil || int64(len(history)) != want {
+						t.Errorf("%s archived=%t status=%q counterparty=%q: %d rows, %v, want %d", id, archived, status, counterparty, len(history), err, want)
+					}
+					// pages of one follow the same order
+					for offset, tr := range history {
+						filter := HistoryFilter{IncludeArchived: archived, Status: status, Counterparty: counterparty, Limit: 1, Offset: offset}
+						page, err := db.History(ctx, id, filter)
+						if err != nil || len(page) != 1 || page[0].FromId != tr.FromId || page[0].ToId != tr.ToId ||
+							!page[0].Amount.Equal(tr.Amount) || page[0].Date != tr.Date || page[0].Status != tr.Status {
+							t.Errorf("%s %+v: %+v, %v, want %+v", id, filter, page, err, tr)
+						}
+					}
+				}
+			}
+		}
+	}
+	if _, err := db.CountHistory(ctx, "ZZZZZZ", HistoryFilter{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unknown wallet: %v", err)
+	}
+}
+
+func TestTransactionCount(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		ctx := context.Background()
+		db.RecordFailures = true
+		mustCreate(t, db, "100", "AAAAAA", "BBBBBB", "CCCCCC")
+		transfers := []struct {
+			from, to string
+			amount   int64
+			at       time.Time
+		}{
+			{"AAAAAA", "BBBBBB", 1, testTime.Add(-48 * time.Hour)},
+			{"BBBBBB", "AAAAAA", 2, testTime},
+			{"AAAAAA", "AAAAAA", 3, testTime},
+			{"AAAAAA", "CCCCCC", 4, testTime},
+			{"AAAAAA", "BBBBBB", 1000, testTime},
+		}
+		for _, tr := range transfers {
+			_, err := db.Transfer(ctx, tr.from, tr.to, decimal.NewFromInt(tr.amount), tr.at)
+			if err != nil && tr.amount != 1000 {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.ArchiveTransactions(ctx, testTime.Add(-time.Hour), 10, nil); err != nil {
+			t.Fatal(err)
+		}
+		// the failed send isn't counted, the self transfer is once, the
+		// archived one is
+		for id, want := range map[string]int64{"AAAAAA": 4, "BBBBBB": 2, "CCCCCC": 1, "ZZZZZZ": 0} {
+			if got, err := db.TransactionCount(ctx, id); err != nil || got != want {
+				t.Errorf("TransactionCount(%s) = %d, %v, want %d", id, got, err, want)
+			}
+		}
+	})
+}
+
+func TestTransactionCountUsesIndexes(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "wallets.db"))
+	plan := queryPlan(t, db, `select (select count(*) from wallet_transactions where from_wallet_id = ? and status = ?)
+		+ (select count(*) from wallet_transactions where to_wallet_id = ? and from_wallet_id <> ? and status = ?)
+		+ (select count(*) from wallet_transactions_archive where from_wallet_id = ? and status = ?)
+		+ (select count(*) from wallet_transactions_archive where to_wallet_id = ? and from_wallet_id <> ? and status = ?)`,
+		"AAAAAA", StatusCompleted, "AAAAAA", "AAAAAA", StatusCompleted, "AAAAAA", StatusCompleted, "AAAAAA", "AAAAAA", StatusCompleted)
+	searches := 0
+	for _, detail := range plan {
+		if !strings.Contains(detail, "wallet_transactions") {
+			continue
+		}
+		if !strings.HasPrefix(detail, "SEARCH") || !strings.Contains(detail, "INDEX") {
+			t.Errorf("not an index lookup: %s\nplan: %q", detail, plan)
+		}
+		searches++
+	}
+	if searches != 4 {
+		t.Errorf("%d index lookups, want 4\nplan: %q", searches, plan)
+	}
+}
+
+// TestWalletCreatedBackfill checks that migration 16 dates the wallets
+// from before it with their first transaction, archived ones included,
+// and leaves the others without a date.
+func TestWalletCreatedBackfill(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "wallets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	steps, err := db.Plan(ctx, 15)
+	if err == nil {
+		err = db.Apply(ctx, steps)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"AAAAAA", "BBBBBB", "CCCCCC", "DDDDDD"} {
+		if _, err := db.ExecContext(ctx, "insert into wallets(id, balance_cents) values(?, 10000)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := []struct {
+		table, from, to string
+		at              time.Time
+	}{
+		{"wallet_transactions", "AAAAAA", "BBBBBB", testTime.Add(2 * time.Hour)},
+		{"wallet_transactions", "BBBBBB", "AAAAAA", testTime.Add(time.Hour)},
+		{"wallet_transactions_archive", "CCCCCC", "BBBBBB", testTime},
+		{"wallet_transactions", "CCCCCC", "AAAAAA", testTime.Add(3 * time.Hour)},
+	}
+	for _, r := range rows {
+		if _, err := db.ExecContext(ctx, "insert into "+r.table+"(from_wallet_id, to_wallet_id, amount_cents, date, status) values(?, ?, 100, ?, 'completed')",
+			r.from, r.to, r.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]time.Time{
+		"AAAAAA": testTime.Add(time.Hour),
+		"BBBBBB": testTime,
+		"CCCCCC": testTime,
+		"DDDDDD": {},
+	} {
+		w, err := db.GetWallet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.CreatedAt.Valid != !want.IsZero() || !w.CreatedAt.Time.Equal(want) {
+			t.Errorf("%s created at %v, want %v", id, w.CreatedAt, want)
+		}
+	}
+}
+
+// BenchmarkTransactionCount counts the transactions of a wallet among
+// many, which the wallet GET does on every call.
+func BenchmarkTransactionCount(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "wallets.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.Migrate(ctx); err != nil {
+		b.Fatal(err)
+	}
+	ids := []string{"AAAAAA", "BBBBBB", "CCCCCC", "DDDDDD"}
+	for _, id := range ids {
+		if err := db.CreateWallet(ctx, Wallet{Id: id, Balance: decimal.NewFromInt(100)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `with recursive n(i) as (select 0 union all select i + 1 from n where i < 199999)
+		insert into wallet_transactions(from_wallet_id, to_wallet_id, amount_cents, date, status)
+		select case i % 4 when 0 then 'AAAAAA' when 1 then 'BBBBBB' when 2 then 'CCCCCC' else 'DDDDDD' end,
+			case i % 3 when 0 then 'AAAAAA' when 1 then 'BBBBBB' else 'CCCCCC' end,
+			1, ?, 'completed' from n`, testTime); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "analyze"); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.TransactionCount(ctx, ids[i%len(ids)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
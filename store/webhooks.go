@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Webhook event types, derived from EventTransferCompleted for each side
+// of the transfer.
+const (
+	WebhookTransferReceived = "transfer.received"
+	WebhookTransferSent     = "transfer.sent"
+)
+
+// ErrWebhookNotFound is returned for webhook ids the wallet doesn't have.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is a subscription of a URL to the events of a wallet.
+type Webhook struct {
+	Id        int64
+	WalletId  string
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+	// Failures counts the failed deliveries since the last successful one,
+	// the first of which happened at FailingSince.
+	Failures     int
+	FailingSince sql.NullTime
+	// DisabledAt is set once the webhook failed for too long.
+	DisabledAt sql.NullTime
+}
+
+// Wants reports whether the webhook is enabled and subscribed to eventType.
+func (w Webhook) Wants(eventType string) bool {
+	if w.DisabledAt.Valid {
+		return false
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	Id          int64
+	WebhookId   int64
+	EventId     int64
+	EventType   string
+	AttemptedAt time.Time
+	Duration    time.Duration
+	// StatusCode is the response status, 0 when there was no response.
+	StatusCode int
+	// Error says why the delivery failed, "" when it succeeded.
+	Error string
+}
+
+const webhookColumns = "id, wallet_id, url, secret, events, created_at, failures, failing_since, disabled_at"
+
+// CreateWebhook inserts w and sets its Id. The wallet must exist.
+func (db *DB) CreateWebhook(ctx context.Context, w *Webhook) error {
+	if _, err := db.GetWallet(ctx, w.WalletId); err != nil {
+		return err
+	}
+	query := "insert into webhooks(wallet_id, url, secret, events, created_at) values(?, ?, ?, ?, ?)"
+	args := []any{w.WalletId, w.URL, w.Secret, strings.Join(w.Events, ","), w.CreatedAt}
+	if db.Driver == Postgres {
+		return db.QueryRowContext(ctx, query+" returning id", args...).Scan(&w.Id)
+	}
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	w.Id, err = res.LastInsertId()
+	return err
+}
+
+// Webhooks returns the webhooks of a wallet, oldest first. It returns
+// ErrNotFound for unknown wallets.
+func (db *DB) Webhooks(ctx context.Context, walletId string) ([]Webhook, error) {
+	if _, err := db.GetWallet(ctx, walletId); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select "+webhookColumns+" from webhooks where wallet_id = ? order by id", walletId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		var events string
+		err := rows.Scan(&w.Id, &w.WalletId, &w.URL, &w.Secret, &events, &w.CreatedAt, &w.Failures, &w.FailingSince, &w.DisabledAt)
+		if err != nil {
+			return nil, err
+		}
+		w.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// Webhook returns a webhook of a wallet, or ErrWebhookNotFound.
+func (db *DB) Webhook(ctx context.Context, walletId string, id int64) (Webhook, error) {
+	webhooks, err := db.Webhooks(ctx, walletId)
+	if err != nil {
+		return Webhook{}, err
+	}
+	for _, w := range webhooks {
+		if w.Id == id {
+			return w, nil
+		}
+	}
+	return Webhook{}, ErrWebhookNotFound
+}
+
+// DeleteWebhook deletes a webhook of a wallet with its delivery history.
+func (db *DB) DeleteWebhook(ctx context.Context, walletId string, id int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from webhook_deliveries where webhook_id in (select id from webhooks where id = ? and wallet_id = ?)", id, walletId)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "delete from webhooks where id = ? and wallet_id = ?", id, walletId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return tx.Commit()
+}
+
+// Delivered reports whether the event already reached the webhook as
+// eventType; a transfer to the same wallet reaches it as both types.
+func (db *DB) Delivered(ctx context.Context, webhookId, eventId int64, eventType string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from webhook_deliveries where webhook_id = ? and event_id = ? and event_type = ? and error is null",
+		webhookId, eventId, eventType).Scan(&n)
+	return n > 0, err
+}
+
+// RecordDelivery stores a delivery attempt and updates the failure count
+// of its webhook. A webhook failing for longer than disableAfter is
+// disabled; RecordDelivery reports whether that happened.
+func (db *DB) RecordDelivery(ctx context.Context, d WebhookDelivery, disableAfter time.Duration) (disabled bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var statusCode sql.NullInt64
+	if d.StatusCode != 0 {
+		statusCode = sql.NullInt64{Int64: int64(d.StatusCode), Valid: true}
+	}
+	var deliveryError sql.NullString
+	if d.Error != "" {
+		deliveryError = sql.NullString{String: d.Error, Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, `insert into webhook_deliveries(webhook_id, event_id, event_type, attempted_at, duration_ms, status_code, error)
+		values(?, ?, ?, ?, ?, ?, ?)`,
+		d.WebhookId, d.EventId, d.EventType, d.AttemptedAt, d.Duration.Milliseconds(), statusCode, deliveryError)
+	if err != nil {
+		return false, err
+	}
+
+	if d.Error == "" {
+		_, err = tx.ExecContext(ctx, "update webhooks set failures = 0, failing_since = null where id = ?", d.WebhookId)
+		if err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, "update webhooks set failures = failures + 1, failing_since = coalesce(failing_since, ?) where id = ?",
+		d.AttemptedAt, d.WebhookId)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, "update webhooks set disabled_at = ? where id = ? and disabled_at is null and failing_since <= ?",
+		d.AttemptedAt, d.WebhookId, d.AttemptedAt.Add(-disableAfter))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// deliveriesOfWebhook is the from clause shared by Deliveries and
+// CountDeliveries.
+const deliveriesOfWebhook = " from webhook_deliveries where webhook_id = ?"
+
+// Deliveries returns up to limit delivery attempts of a webhook, newest first.
+func (db *DB) Deliveries(ctx context.Context, webhookId int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `select id, webhook_id, event_id, event_type, attempted_at, duration_ms, status_code, error`+
+		deliveriesOfWebhook+` order by id desc limit ?`, webhookId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var durationMs int64
+		var statusCode sql.NullInt64
+		var deliveryError sql.NullString
+		err := rows.Scan(&d.Id, &d.WebhookId, &d.EventId, &d.EventType, &d.AttemptedAt, &durationMs, &statusCode, &deliveryError)
+		if err != nil {
+			return nil, err
+		}
+		d.Duration = time.Duration(durationMs) * time.Millisecond
+		d.StatusCode = int(statusCode.Int64)
+		d.Error = deliveryError.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CountDeliveries returns how many delivery attempts of the webhook are kept.
+func (db *DB) CountDeliveries(ctx context.Context, webhookId int64) (int64, error) {
+	var count int64
+	err := db.QueryRowContext(ctx, "select count(*)"+deliveriesOfWebhook, webhookId).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kordimion/secure-web-service/api"
+	"kordimion/secure-web-service/config"
+	"kordimion/secure-web-service/tracectx"
+)
+
+// TestTraceContextReachesWebhooks follows the trace of a send through the
+// outbox to the webhook it causes.
+func TestTraceContextReachesWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var hooks []http.Header
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hooks = append(hooks, r.Header.Clone())
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	cfg := testConfig(t)
+	cfg.Features = config.Features{config.FeatureWebhooks: true}
+	cfg.OutboxInterval = 10 * time.Millisecond
+	server, err := NewServer(openTestDB(t, true), api.SystemClock, cfg, discardLogger(), new(slog.LevelVar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Hub.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Jobs.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+
+	a, b := createWallet(t, ts.URL), createWallet(t, ts.URL)
+	post(t, ts.URL+"/api/v1/wallet/"+b+"/webhooks", `{"url":"`+receiver.URL+`","events":["transfer.received"]}`, nil, http.StatusCreated)
+	send := func(header http.Header) http.Header {
+		t.Helper()
+		mu.Lock()
+		hooks = nil
+		mu.Unlock()
+		post(t, ts.URL+"/api/v1/wallet/"+a+"/send", `{"to":"`+b+`","amount":"1"}`, header, http.StatusOK)
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			if len(hooks) > 0 {
+				defer mu.Unlock()
+				return hooks[0]
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("the webhook wasn't delivered")
+		return nil
+	}
+
+	incoming := http.Header{}
+	incoming.Set(tracectx.HeaderParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	incoming.Set(tracectx.HeaderState, "vendor=opaque")
+	caller, _ := tracectx.Parse(incoming.Get(tracectx.HeaderParent), "")
+	hook := send(incoming)
+	got, ok := tracectx.Parse(hook.Get(tracectx.HeaderParent), hook.Get(tracectx.HeaderState))
+	if !ok || got.TraceId != caller.TraceId || got.SpanId == caller.SpanId || got.State != "vendor=opaque" {
+		t.Fatalf("the webhook carried traceparent %q and tracestate %q", hook.Get(tracectx.HeaderParent), hook.Get(tracectx.HeaderState))
+	}
+
+	// without a trace, the webhook starts from the new root of the send
+	hook = send(nil)
+	got, ok = tracectx.Parse(hook.Get(tracectx.HeaderParent), hook.Get(tracectx.HeaderState))
+	if !ok || got.TraceId == caller.TraceId || hook.Get(tracectx.HeaderState) != "" {
+		t.Fatalf("the webhook carried traceparent %q and tracestate %q", hook.Get(tracectx.HeaderParent), hook.Get(tracectx.HeaderState))
+	}
+}
+
+// createWallet creates a wallet through the API at url and returns its id.
+func createWallet(t *testing.T, url string) string {
+	t.Helper()
+	body := post(t, url+"/api/v1/wallet", "", nil, http.StatusCreated)
+	_, rest, ok := strings.Cut(body, `"id":"`)
+	if !ok {
+		t.Fatalf("created %s", body)
+	}
+	return rest[:strings.Index(rest, `"`)]
+}
+
+// post posts a JSON body with header to url, expecting status, and
+// returns the response body.
+func post(t *testing.T, url, body string, header http.Header, status int) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if res.StatusCode != status {
+		t.Fatalf("POST %s = %d %s", url, res.StatusCode, b)
+	}
+	return string(b)
+}
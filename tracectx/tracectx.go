@@ -0,0 +1,135 @@
+// Package tracectx carries W3C Trace Context through the service: it is
+// read from incoming requests, stored with the outbox events they cause
+// and sent on with every outbound call, so a trace goes on past the
+// service even when the call is made later by the outbox.
+//
+// The service doesn't record spans itself, it only keeps the trace going:
+// every hop gets a span id of its own. See https://www.w3.org/TR/trace-context/.
+package tracectx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// The headers of W3C Trace Context. gRPC metadata and NATS headers use
+// the same names.
+const (
+	HeaderParent = "traceparent"
+	HeaderState  = "tracestate"
+)
+
+// maxStateBytes is the longest tracestate kept, as the spec allows
+// dropping longer ones.
+const maxStateBytes = 512
+
+// Trace is the position of a call in a trace.
+type Trace struct {
+	TraceId [16]byte
+	// SpanId is the span of the call the trace came from or is sent by.
+	SpanId [8]byte
+	Flags  byte
+	// State is the vendor specific tracestate, passed on as is.
+	State string
+}
+
+// Parse reads a traceparent and tracestate pair. It returns false when
+// parent isn't a valid traceparent, and then the state is ignored too.
+func Parse(parent, state string) (Trace, bool) {
+	var t Trace
+	// version-traceid-spanid-flags, later versions may add fields
+	if len(parent) < 55 || parent[2] != '-' || parent[35] != '-' || parent[52] != '-' {
+		return Trace{}, false
+	}
+	version, ok := decodeHex(parent[0:2], 1)
+	if !ok || version[0] == 0xff || version[0] == 0 && len(parent) != 55 || len(parent) > 55 && parent[55] != '-' {
+		return Trace{}, false
+	}
+	traceId, ok1 := decodeHex(parent[3:35], 16)
+	spanId, ok2 := decodeHex(parent[36:52], 8)
+	flags, ok3 := decodeHex(parent[53:55], 1)
+	if !ok1 || !ok2 || !ok3 {
+		return Trace{}, false
+	}
+	copy(t.TraceId[:], traceId)
+	copy(t.SpanId[:], spanId)
+	t.Flags = flags[0]
+	if t.TraceId == [16]byte{} || t.SpanId == [8]byte{} {
+		return Trace{}, false
+	}
+	if state = strings.TrimSpace(state); len(state) <= maxStateBytes {
+		t.State = state
+	}
+	return t, true
+}
+
+// decodeHex decodes n bytes of lower case hex.
+func decodeHex(s string, n int) ([]byte, bool) {
+	if s != strings.ToLower(s) {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil && len(b) == n
+}
+
+// New starts a trace for a call that came without one.
+func New() Trace {
+	var t Trace
+	rand.Read(t.TraceId[:])
+	rand.Read(t.SpanId[:])
+	// sampled, so that what follows is recorded and can be linked
+	t.Flags = 1
+	return t
+}
+
+// Child is the trace as passed on by the next hop: the same trace with a
+// new span id.
+func (t Trace) Child() Trace {
+	rand.Read(t.SpanId[:])
+	return t
+}
+
+// Parent returns the traceparent header of t.
+func (t Trace) Parent() string {
+	return "00-" + hex.EncodeToString(t.TraceId[:]) + "-" + hex.EncodeToString(t.SpanId[:]) + "-" + hex.EncodeToString([]byte{t.Flags})
+}
+
+// TraceIdString returns the trace id as in the traceparent header.
+func (t Trace) TraceIdString() string {
+	return hex.EncodeToString(t.TraceId[:])
+}
+
+// FromRequest returns the trace of an incoming request as this service's
+// hop of it, starting a trace when the request has none.
+func FromRequest(h http.Header) Trace {
+	t, ok := Parse(h.Get(HeaderParent), h.Get(HeaderState))
+	if !ok {
+		return New()
+	}
+	return t.Child()
+}
+
+// Inject sets the headers of an outbound request made within t: a child
+// of t, so the receiver sees the call as a hop of its own.
+func Inject(h http.Header, t Trace) {
+	h.Set(HeaderParent, t.Child().Parent())
+	if t.State != "" {
+		h.Set(HeaderState, t.State)
+	}
+}
+
+type key struct{}
+
+// NewContext returns ctx carrying t.
+func NewContext(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, key{}, t)
+}
+
+// FromContext returns the trace ctx carries.
+func FromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(key{}).(Trace)
+	return t, ok
+}
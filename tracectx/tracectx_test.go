@@ -0,0 +1,78 @@
+package tracectx
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testState  = "vendor=opaque"
+)
+
+func TestParse(t *testing.T) {
+	tr, ok := Parse(testParent, " "+testState+" ")
+	if !ok || tr.Parent() != testParent || tr.State != testState || tr.TraceIdString() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Parse = %+v, %v", tr, ok)
+	}
+	// later versions may add fields
+	if tr, ok := Parse("01"+testParent[2:]+"-later", ""); !ok || tr.Parent() != testParent {
+		t.Errorf("a later version: %+v, %v", tr, ok)
+	}
+	if tr, ok := Parse(testParent, strings.Repeat("a", maxStateBytes+1)); !ok || tr.State != "" {
+		t.Errorf("a tracestate too long was kept: %+v, %v", tr, ok)
+	}
+	for _, parent := range []string{
+		"",
+		"garbage",
+		"ff" + testParent[2:],
+		testParent + "-extra",
+		strings.ToUpper(testParent),
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if tr, ok := Parse(parent, testState); ok {
+			t.Errorf("Parse(%q) = %+v", parent, tr)
+		}
+	}
+}
+
+func TestFromRequestAndInject(t *testing.T) {
+	in := http.Header{}
+	in.Set(HeaderParent, testParent)
+	in.Set(HeaderState, testState)
+	hop := FromRequest(in)
+	parent, _ := Parse(testParent, "")
+	if hop.TraceId != parent.TraceId || hop.SpanId == parent.SpanId || hop.State != testState || hop.Flags != 1 {
+		t.Fatalf("FromRequest = %+v", hop)
+	}
+
+	out := http.Header{}
+	Inject(out, hop)
+	sent, ok := Parse(out.Get(HeaderParent), out.Get(HeaderState))
+	if !ok || sent.TraceId != hop.TraceId || sent.SpanId == hop.SpanId || sent.State != testState {
+		t.Fatalf("Inject sent %v", out)
+	}
+
+	// a request without a trace, or with an invalid one, starts one
+	for _, h := range []http.Header{{}, {"Traceparent": {"garbage"}}} {
+		root := FromRequest(h)
+		if root.TraceId == ([16]byte{}) || root.SpanId == ([8]byte{}) || root.Flags != 1 || root.TraceId == FromRequest(h).TraceId {
+			t.Errorf("FromRequest(%v) = %+v", h, root)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatal("a trace in the background context")
+	}
+	tr := New()
+	if got, ok := FromContext(NewContext(context.Background(), tr)); !ok || got != tr {
+		t.Fatalf("FromContext = %+v, %v", got, ok)
+	}
+}
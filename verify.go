@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"kordimion/secure-web-service/store"
+)
+
+// runVerify implements the verify command, which checks that the database
+// is consistent:
+//
+//	verify              report problems, exit 1 if there are any
+//	verify -fix         also rewrite mismatched balances from the ledger, after confirmation
+//	verify -fix -yes    the same without asking, for scripts
+//
+// Every wallet's balance must equal its opening balance plus its completed
+// transactions, no balance may be negative and no transaction may refer
+// to a missing wallet or lack a valid date. The balances recorded after
+// each transaction must follow from one another, see store.BalanceGaps.
+// DATABASE_URL selects the database to check.
+// It returns the process exit code.
+func runVerify(db *store.DB, args []string, in io.Reader) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "rewrite balances that don't match the ledger")
+	yes := fs.Bool("yes", false, "don't ask before fixing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	mismatches, negative, orphans, undated, gaps := 0, 0, 0, 0, 0
+
+	err := db.LedgerMismatches(ctx, store.InitialBalance, func(m store.LedgerMismatch) error {
+		mismatches++
+		fmt.Printf("wallet %s: balance %s, ledger says %s (%s)\n", m.WalletId, m.Balance, m.Expected, m.Balance.Sub(m.Expected).StringFixed(db.Scale))
+		return nil
+	})
+	if err == nil {
+		err = db.NegativeWallets(ctx, func(w store.Wallet) error {
+			negative++
+			fmt.Printf("wallet %s: negative balance %s\n", w.Id, w.Balance)
+			return nil
+		})
+	}
+	if err == nil {
+		err = db.OrphanTransactions(ctx, func(t store.Transaction) error {
+			orphans++
+			fmt.Printf("transaction %s -> %s of %s at %s: refers to a missing wallet\n",
+				t.FromId, t.ToId, t.Amount, t.Date.Time.Format(time.RFC3339))
+			return nil
+		})
+	}
+	if err == nil {
+		err = db.UndatedTransactions(ctx, func(t store.Transaction) error {
+			undated++
+			fmt.Printf("transaction %s -> %s of %s (%s): has no valid date\n", t.FromId, t.ToId, t.Amount, t.Status)
+			return nil
+		})
+	}
+	if err == nil {
+		err = db.BalanceGaps(ctx, func(g store.BalanceGap) error {
+			gaps++
+			fmt.Printf("transaction %s -> %s of %s at %s: wallet %s has a balance of %s after it, the transaction before gives %s\n",
+				g.Transaction.FromId, g.Transaction.ToId, g.Transaction.Amount, g.Transaction.Date.Time.Format(time.RFC3339),
+				g.WalletId, g.Recorded, g.Expected)
+			return nil
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("%d balances don't match the ledger, %d are negative, %d transactions refer to missing wallets, %d have no valid date, %d record a balance that doesn't follow\n",
+		mismatches, negative, orphans, undated, gaps)
+	if mismatches == 0 || !*fix {
+		if mismatches+negative+orphans+undated+gaps > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if !*yes {
+		fmt.Printf("rewrite %d balances from the ledger? type yes to continue: ", mismatches)
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fmt.Println("nothing changed")
+			return 1
+		}
+	}
+	fixed, err := db.FixBalances(ctx, store.InitialBalance)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("rewrote %d balances\n", fixed)
+	if negative+orphans+undated+gaps > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+// Package version tells which build of the service is running.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X kordimion/secure-web-service/version.Version=v1.2.0 -X kordimion/secure-web-service/version.Commit=$(git rev-parse HEAD) -X kordimion/secure-web-service/version.Date=$(date -u +%FT%TZ)"
+//
+// When they are left empty, Get falls back to what the go command
+// recorded in the binary.
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// Info describes a build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
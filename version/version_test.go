@@ -0,0 +1,28 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGetLinkedValues(t *testing.T) {
+	old := [3]string{Version, Commit, Date}
+	t.Cleanup(func() { Version, Commit, Date = old[0], old[1], old[2] })
+	Version, Commit, Date = "v1.2.0", "3f9c2e1", "2024-03-01T12:00:00Z"
+
+	want := Info{Version: "v1.2.0", Commit: "3f9c2e1", Date: "2024-03-01T12:00:00Z", GoVersion: runtime.Version()}
+	if got := Get(); got != want {
+		t.Fatalf("Get() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetWithoutLinkedValues(t *testing.T) {
+	old := [3]string{Version, Commit, Date}
+	t.Cleanup(func() { Version, Commit, Date = old[0], old[1], old[2] })
+	Version, Commit, Date = "", "", ""
+
+	// a test binary has no module version, so it is a dev build
+	if got := Get(); got.Version == "" || got.GoVersion != runtime.Version() {
+		t.Fatalf("Get() = %+v", got)
+	}
+}
@@ -0,0 +1,249 @@
+// Package walletid generates wallet ids and checks incoming ones against
+// the configured format.
+package walletid
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Wallet id strategies.
+const (
+	// StrategyShort generates short random strings over an alphabet.
+	StrategyShort = "short"
+	// StrategyUUID generates RFC 4122 version 4 UUIDs.
+	StrategyUUID = "uuid"
+)
+
+// MaxBytes is the longest wallet id accepted from clients.
+const MaxBytes = 64
+
+// DefaultAlphabet is the alphabet wallet ids have always been generated from.
+const DefaultAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
+
+// Format describes how wallet ids are generated and what
+// incoming ids must look like. Both sides use the same values so a
+// valid generated id always passes validation.
+//
+// Changing the format on an existing database makes wallets created
+// with the old format unreachable, so pick it once per deployment.
+type Format struct {
+	// Strategy is either StrategyShort or StrategyUUID.
+	// Alphabet, Length and Checksum only apply to short ids.
+	Strategy string
+	Alphabet string
+	Length   int
+	// Checksum appends a Luhn mod N check character to generated ids,
+	// so ids are Length+1 characters long and typos are caught early.
+	Checksum bool
+	// Random is where generated ids get their randomness, the system's
+	// secure source when nil. Tests set a seeded one to know the ids
+	// in advance; it must be safe for concurrent use if ids are.
+	Random io.Reader
+}
+
+// ErrChecksum is returned for ids whose check character doesn't match.
+var ErrChecksum = errors.New("invalid wallet id checksum")
+
+// Generate returns a new random id in this format.
+func (f Format) Generate() (string, error) {
+	random := f.Random
+	if random == nil {
+		random = randReader
+	}
+	if f.Strategy == StrategyUUID {
+		return generateUUID(random)
+	}
+	id, err := generateRandomStringFrom(random, f.Alphabet, f.Length)
+	if err != nil {
+		return "", err
+	}
+	if f.Checksum {
+		id += string(luhnCheckChar(f.Alphabet, id))
+	}
+	return id, nil
+}
+
+// Check validates the check character of an id that already Matches.
+// It returns ErrChecksum on mismatch and nil when checksums are off.
+func (f Format) Check(id string) error {
+	if f.Strategy == StrategyUUID || !f.Checksum {
+		return nil
+	}
+	if !luhnValid(f.Alphabet, id) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Normalize returns the form an id is stored in. UUIDs are accepted in
+// any case but stored lowercase; short ids are case sensitive.
+func (f Format) Normalize(id string) string {
+	if f.Strategy == StrategyUUID {
+		return strings.ToLower(id)
+	}
+	return id
+}
+
+// Matches reports whether id has the configured length and only uses
+// characters of the alphabet, or is a UUID in uuid mode.
+func (f Format) Matches(id string) bool {
+	if f.Strategy == StrategyUUID {
+		return isUUID(id)
+	}
+	length := f.Length
+	if f.Checksum {
+		length++
+	}
+	if len(id) != length {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(f.Alphabet, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe tells a client what a valid id looks like.
+func (f Format) Describe() string {
+	if f.Strategy == StrategyUUID {
+		return "must be a UUID"
+	}
+	length := f.Length
+	if f.Checksum {
+		length++
+	}
+	return fmt.Sprintf("must be %d characters from the wallet id alphabet", length)
+}
+
+// EntropyBits is the number of random bits in a generated id.
+func (f Format) EntropyBits() float64 {
+	if f.Strategy == StrategyUUID {
+		return 122
+	}
+	return float64(f.Length) * math.Log2(float64(len(f.Alphabet)))
+}
+
+// Validate checks the alphabet for duplicates and characters that don't
+// belong in a URL path segment, and that ids carry at least minEntropy bits.
+func (f Format) Validate(minEntropy float64) error {
+	switch f.Strategy {
+	case StrategyUUID:
+		if f.Checksum {
+			return fmt.Errorf("checksums are only supported for %q ids", StrategyShort)
+		}
+		return nil
+	case StrategyShort:
+	default:
+		return fmt.Errorf("unknown strategy %q, expected %q or %q", f.Strategy, StrategyShort, StrategyUUID)
+	}
+	if len(f.Alphabet) < 2 {
+		return fmt.Errorf("alphabet must have at least 2 characters")
+	}
+	seen := make(map[byte]bool, len(f.Alphabet))
+	for i := 0; i < len(f.Alphabet); i++ {
+		ch := f.Alphabet[i]
+		if ch <= ' ' || ch >= 0x7f || strings.IndexByte("/?#%", ch) >= 0 {
+			return fmt.Errorf("alphabet contains unsupported character %q", ch)
+		}
+		if seen[ch] {
+			return fmt.Errorf("alphabet contains %q more than once", ch)
+		}
+		seen[ch] = true
+	}
+	if f.Length < 1 || f.Length >= MaxBytes {
+		// leaves room for the check character within MaxBytes
+		return fmt.Errorf("length must be between 1 and %d", MaxBytes-1)
+	}
+	if bits := f.EntropyBits(); bits < minEntropy {
+		return fmt.Errorf("ids of length %d over %d characters only carry %.1f bits of entropy, at least %.1f are required",
+			f.Length, len(f.Alphabet), bits, minEntropy)
+	}
+	return nil
+}
+
+// generateUUID returns a random (version 4) UUID in its lowercase
+// textual form, read from random.
+func generateUUID(random io.Reader) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf), nil
+}
+
+// isUUID reports whether s is a UUID in the 8-4-4-4-12 textual form, in any case.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			c := s[i]
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// luhnCheckChar computes the Luhn mod N check character of id, where N is
+// the size of the alphabet. id must only contain alphabet characters.
+func luhnCheckChar(alphabet, id string) byte {
+	n := len(alphabet)
+	factor := 2
+	sum := 0
+	for i := len(id) - 1; i >= 0; i-- {
+		sum += luhnAddend(n, factor*strings.IndexByte(alphabet, id[i]))
+		factor = 3 - factor
+	}
+	return alphabet[(n-sum%n)%n]
+}
+
+// luhnAddend folds a weighted code point back into [0, n). For even n this is
+// the classic "sum of the base-n digits"; for odd n that folding isn't a
+// permutation of the doubled values, so plain modulo is used instead, which is.
+// Either way every single character substitution changes the checksum.
+func luhnAddend(n, addend int) int {
+	if n%2 == 0 {
+		return addend/n + addend%n
+	}
+	return addend % n
+}
+
+// luhnValid reports whether the last character of id is its Luhn mod N check character.
+func luhnValid(alphabet, id string) bool {
+	n := len(alphabet)
+	factor := 1
+	sum := 0
+	for i := len(id) - 1; i >= 0; i-- {
+		sum += luhnAddend(n, factor*strings.IndexByte(alphabet, id[i]))
+		factor = 3 - factor
+	}
+	return sum%n == 0
+}
@@ -0,0 +1,166 @@
+package walletid
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var checksumAlphabets = []struct {
+	name     string
+	alphabet string
+	sample   string
+}{
+	// 63 characters, odd
+	{"default", DefaultAlphabet, "TTTFGF"},
+	// 32 characters, even
+	{"crockford", "0123456789ABCDEFGHJKMNPQRSTVWXYZ", "7ZK3QH"},
+	{"hex", "0123456789abcdef", "0f3a9c2e"},
+	{"binary", "01", "1011001110001111011010011100101101"},
+}
+
+func TestLuhnCheckChar(t *testing.T) {
+	for _, a := range checksumAlphabets {
+		t.Run(a.name, func(t *testing.T) {
+			id := a.sample + string(luhnCheckChar(a.alphabet, a.sample))
+			if !luhnValid(a.alphabet, id) {
+				t.Fatalf("%s with its check character is not valid", id)
+			}
+			// exactly one check character completes the sample
+			valid := 0
+			for i := 0; i < len(a.alphabet); i++ {
+				if luhnValid(a.alphabet, a.sample+a.alphabet[i:i+1]) {
+					valid++
+				}
+			}
+			if valid != 1 {
+				t.Fatalf("%d check characters are valid for %s, want 1", valid, a.sample)
+			}
+		})
+	}
+}
+
+func TestLuhnEverySubstitution(t *testing.T) {
+	for _, a := range checksumAlphabets {
+		t.Run(a.name, func(t *testing.T) {
+			id := a.sample + string(luhnCheckChar(a.alphabet, a.sample))
+			f := Format{Strategy: StrategyShort, Alphabet: a.alphabet, Length: len(a.sample), Checksum: true}
+			tried := 0
+			// the check character is mistyped as easily as any other
+			for pos := 0; pos < len(id); pos++ {
+				for i := 0; i < len(a.alphabet); i++ {
+					if a.alphabet[i] == id[pos] {
+						continue
+					}
+					typo := id[:pos] + a.alphabet[i:i+1] + id[pos+1:]
+					tried++
+					if !f.Matches(typo) {
+						t.Fatalf("%s does not match the format", typo)
+					}
+					if err := f.Check(typo); !errors.Is(err, ErrChecksum) {
+						t.Fatalf("Check(%s), %s mistyped at %d: %v, want ErrChecksum", typo, id, pos, err)
+					}
+				}
+			}
+			if want := len(id) * (len(a.alphabet) - 1); tried != want {
+				t.Fatalf("tried %d substitutions, want %d", tried, want)
+			}
+		})
+	}
+}
+
+func TestChecksumGenerated(t *testing.T) {
+	for _, a := range checksumAlphabets[:3] {
+		f := Format{Strategy: StrategyShort, Alphabet: a.alphabet, Length: 8, Checksum: true}
+		for i := 0; i < 1000; i++ {
+			id, err := f.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.Matches(id) {
+				t.Fatalf("%s: generated %q does not match", a.name, id)
+			}
+			if err := f.Check(id); err != nil {
+				t.Fatalf("%s: generated %q: %v", a.name, id, err)
+			}
+		}
+	}
+}
+
+func TestCheckWithoutChecksum(t *testing.T) {
+	formats := []Format{
+		{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: 6},
+		{Strategy: StrategyUUID},
+	}
+	for _, f := range formats {
+		if err := f.Check("TTTFGF"); err != nil {
+			t.Errorf("%s: Check = %v, want nil with checksums off", f.Strategy, err)
+		}
+	}
+}
+
+func TestValidateLength(t *testing.T) {
+	for _, tt := range []struct {
+		length int
+		ok     bool
+	}{
+		{0, false},
+		{1, true},
+		{MaxBytes - 1, true},
+		{MaxBytes, false},
+	} {
+		t.Run(fmt.Sprint(tt.length), func(t *testing.T) {
+			f := Format{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: tt.length, Checksum: true}
+			err := f.Validate(0)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Validate = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if want := fmt.Sprintf("between 1 and %d", MaxBytes-1); !strings.Contains(err.Error(), want) {
+					t.Fatalf("Validate = %q, want it to say %q", err, want)
+				}
+				return
+			}
+			// the longest ids, with their check character, still fit in MaxBytes
+			id, err := f.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(id) > MaxBytes {
+				t.Fatalf("generated id of %d bytes, more than MaxBytes", len(id))
+			}
+		})
+	}
+}
+
+// TestGenerateSeeded checks that a seeded source gives the same ids in
+// the same order, in each strategy, and that they still fit the format.
+func TestGenerateSeeded(t *testing.T) {
+	for _, f := range []Format{
+		{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: 6},
+		{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: 6, Checksum: true},
+		{Strategy: StrategyUUID},
+	} {
+		generate := func() []string {
+			f.Random = rand.New(rand.NewSource(1))
+			var ids []string
+			for i := 0; i < 5; i++ {
+				id, err := f.Generate()
+				if err != nil || !f.Matches(id) {
+					t.Fatalf("%s: generated %q, %v", f.Strategy, id, err)
+				}
+				ids = append(ids, id)
+			}
+			return ids
+		}
+		first, again := generate(), generate()
+		if strings.Join(first, " ") != strings.Join(again, " ") {
+			t.Errorf("%s: %v, then %v from the same seed", f.Strategy, first, again)
+		}
+		if first[0] == first[1] {
+			t.Errorf("%s: the same id twice: %v", f.Strategy, first)
+		}
+	}
+}
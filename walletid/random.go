@@ -0,0 +1,96 @@
+package walletid
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// randReader is the source of randomness for all the helpers below.
+// It is a variable so that a failing reader can be swapped in.
+var randReader io.Reader = rand.Reader
+
+func init() {
+	assertAvailablePRNG()
+}
+
+func assertAvailablePRNG() {
+	// Assert that a cryptographically secure PRNG is available.
+	// Panic otherwise.
+	buf := make([]byte, 1)
+
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		panic(fmt.Sprintf("crypto/rand is unavailable: Read() failed with %#v", err))
+	}
+}
+
+// GenerateRandomBytes returns securely generated random bytes.
+// It will return an error if the system's secure random
+// number generator fails to function correctly, in which
+// case the caller should not continue.
+func GenerateRandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(randReader, b)
+	// Note that err == nil only if we read len(b) bytes.
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// GenerateRandomString returns a securely generated random string.
+// It will return an error if the system's secure random
+// number generator fails to function correctly, in which
+// case the caller should not continue.
+func GenerateRandomString(n int) (string, error) {
+	return generateRandomStringFrom(randReader, DefaultAlphabet, n)
+}
+
+// generateRandomStringFrom returns a random string of length n, read
+// from random, whose characters are uniformly distributed over letters.
+//
+// Random bytes are read in one go and mapped to letters by rejection:
+// bytes at or above the largest multiple of len(letters) that fits in a
+// byte are skipped, so no letter is favoured. Alphabets hold distinct
+// bytes, so len(letters) is at most 256. The buffer has some slack for
+// the skipped bytes and is only refilled when that runs out.
+func generateRandomStringFrom(random io.Reader, letters string, n int) (string, error) {
+	size := len(letters)
+	limit := 256 - 256%size
+	ret := make([]byte, 0, n)
+	buf := make([]byte, n+n/4+8)
+	for len(ret) < n {
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			ret = append(ret, letters[int(b)%size])
+			if len(ret) == n {
+				break
+			}
+		}
+	}
+
+	return string(ret), nil
+}
+
+// GenerateRandomStringURLSafe returns a URL-safe, base64 encoded
+// securely generated random string. n is the number of random bytes,
+// not the length of the result: that is 4*ceil(n/3) characters, padded
+// with '=' unless n is a multiple of 3, so 12 bytes give 16 characters.
+// It will return an error if the system's secure random
+// number generator fails to function correctly, in which
+// case the caller should not continue.
+func GenerateRandomStringURLSafe(n int) (string, error) {
+	b, err := GenerateRandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,161 @@
+package walletid
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// useReader makes r the source of randomness until the test ends.
+func useReader(t *testing.T, r io.Reader) {
+	t.Helper()
+	old := randReader
+	randReader = r
+	t.Cleanup(func() { randReader = old })
+}
+
+func TestRandomReaderFailure(t *testing.T) {
+	errBroken := errors.New("getrandom: broken")
+	generators := []struct {
+		name string
+		gen  func() (string, error)
+	}{
+		{"GenerateRandomBytes", func() (string, error) {
+			b, err := GenerateRandomBytes(16)
+			return string(b), err
+		}},
+		{"GenerateRandomString", func() (string, error) { return GenerateRandomString(6) }},
+		{"GenerateRandomStringURLSafe", func() (string, error) { return GenerateRandomStringURLSafe(12) }},
+		{"short id", Format{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: 6}.Generate},
+		{"short id with checksum", Format{Strategy: StrategyShort, Alphabet: DefaultAlphabet, Length: 6, Checksum: true}.Generate},
+		{"uuid", Format{Strategy: StrategyUUID}.Generate},
+	}
+	readers := []struct {
+		name string
+		r    func() io.Reader
+		want error
+	}{
+		{"failing", func() io.Reader { return failingReader{errBroken} }, errBroken},
+		// fewer bytes than asked for must not pass for randomness
+		{"short", func() io.Reader { return bytes.NewReader([]byte{1, 2, 3}) }, io.ErrUnexpectedEOF},
+	}
+	for _, rd := range readers {
+		for _, g := range generators {
+			t.Run(rd.name+"/"+g.name, func(t *testing.T) {
+				useReader(t, rd.r())
+				got, err := g.gen()
+				if !errors.Is(err, rd.want) {
+					t.Fatalf("err = %v, want %v", err, rd.want)
+				}
+				if got != "" {
+					t.Fatalf("got %q along with the error", got)
+				}
+			})
+		}
+	}
+}
+
+// chiSquaredLimit is the chi-squared value that df degrees of freedom
+// exceed with a probability of 0.001, by the Wilson-Hilferty
+// approximation.
+func chiSquaredLimit(df int) float64 {
+	const z = 3.09 // the 0.999 quantile of the standard normal
+	k := 2 / (9 * float64(df))
+	return float64(df) * math.Pow(1-k+z*math.Sqrt(k), 3)
+}
+
+// TestGenerateRandomStringUniform counts the letters of a large sample
+// for alphabets that don't divide 256: mapping bytes by a plain modulo
+// favours the first letters by a quarter or more, which the chi-squared
+// test catches well within the sample. The source is seeded so that the
+// test can't fail by chance.
+func TestGenerateRandomStringUniform(t *testing.T) {
+	const n = 200000
+	for _, letters := range []string{DefaultAlphabet, "0123456789", "ABCDEFGHJKLMNPQRSTUVWXYZ", "01"} {
+		s, err := generateRandomStringFrom(rand.New(rand.NewSource(1)), letters, n)
+		if err != nil || len(s) != n {
+			t.Fatalf("%s: %d letters, %v", letters, len(s), err)
+		}
+		counts := make(map[byte]int)
+		for i := 0; i < len(s); i++ {
+			counts[s[i]]++
+		}
+		if len(counts) != len(letters) {
+			t.Fatalf("%s: %d distinct letters, want %d", letters, len(counts), len(letters))
+		}
+		expected := float64(n) / float64(len(letters))
+		var chi2 float64
+		for i := 0; i < len(letters); i++ {
+			d := float64(counts[letters[i]]) - expected
+			chi2 += d * d / expected
+		}
+		if limit := chiSquaredLimit(len(letters) - 1); chi2 > limit {
+			t.Errorf("%s: chi-squared %.1f above %.1f, counts %v", letters, chi2, limit, counts)
+		}
+	}
+}
+
+// TestGenerateRandomStringRejects checks that bytes past the largest
+// multiple of the alphabet are skipped, reading again when the whole
+// buffer was skipped.
+func TestGenerateRandomStringRejects(t *testing.T) {
+	// 252 to 255 would map to 0 to 3 with DefaultAlphabet's 63 letters;
+	// 6 letters are read 15 bytes at a time, four buffers are skipped
+	random := append(bytes.Repeat([]byte{252, 253, 254, 255, 255}, 12), 0, 1, 255, 2, 64, 62, 5)
+	random = append(random, make([]byte, 8)...)
+	s, err := generateRandomStringFrom(bytes.NewReader(random), DefaultAlphabet, 6)
+	if err != nil || s != "012"+"1"+"-"+"5" {
+		t.Fatalf("got %q, %v", s, err)
+	}
+}
+
+func TestGenerateRandomStringURLSafeLength(t *testing.T) {
+	for n := 0; n <= 13; n++ {
+		s, err := GenerateRandomStringURLSafe(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := base64.URLEncoding.DecodeString(s)
+		if want := 4 * ((n + 2) / 3); len(s) != want || err != nil || len(b) != n {
+			t.Errorf("%d bytes: %q, %d characters, want %d, decoded to %d bytes, %v", n, s, len(s), want, len(b), err)
+		}
+	}
+}
+
+// BenchmarkGenerateRandomString compares the single read with the former
+// rand.Int for every letter.
+func BenchmarkGenerateRandomString(b *testing.B) {
+	b.Run("single read", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := GenerateRandomString(6); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("rand.Int per letter", func(b *testing.B) {
+		b.ReportAllocs()
+		size := big.NewInt(int64(len(DefaultAlphabet)))
+		for i := 0; i < b.N; i++ {
+			ret := make([]byte, 6)
+			for j := range ret {
+				k, err := crand.Int(crand.Reader, size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ret[j] = DefaultAlphabet[k.Int64()]
+			}
+			_ = string(ret)
+		}
+	})
+}